@@ -2,17 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"TIMKE/pkg/crypto"
 	"TIMKE/pkg/kem"
 	"TIMKE/pkg/protocol"
 )
@@ -35,13 +39,23 @@ func main() {
 		serverPubKey  = flag.String("server-key", "", "Server public key in hex format")
 		serverKeyFile = flag.String("server-key-file", "", "File containing the server public key")
 		kem1Type      = flag.String("kem1", "ML-KEM-768", "KEM1 type for server key (OW-ChCCA-KEM, ML-KEM-768, etc.)")
-		kem2Type      = flag.String("kem2", "ML-KEM-768", "KEM2 type for ephemeral key (ML-KEM-1024, X25519-ML-KEM-768, etc.)")
+		kem2Types     = flag.String("kem2", "ML-KEM-768", "Comma-separated KEM2 types for the ephemeral key in preference order; a key share is sent for the first (ML-KEM-1024, X25519-ML-KEM-768, etc.)")
+		suites        = flag.String("suites", strings.Join(crypto.DefaultCipherSuites(), ","), "Comma-separated cipher suites in preference order (empty for the defaults)")
 		zeroRTTMsg    = flag.String("0rtt", "Hello from TIMKE client! This is 0-RTT data.", "0-RTT message to send (empty to disable)")
 		interactive   = flag.Bool("i", false, "Interactive mode (send/receive messages after key exchange)")
 		verbose       = flag.Bool("v", false, "Verbose output")
+		mlock         = flag.Bool("mlock", false, "Lock session secrets in memory so they are never swapped out")
+		clientKeyFile = flag.String("client-key", "", "Client private key file for mutual authentication, in the KEM1 format of server -genkey")
+		clientID      = flag.String("client-id", "", "Client identity sent in mutual authentication mode")
+		format        = flag.String("serializer", "binary", "Message encoding, the server's: "+strings.Join(protocol.SerializerNames, ", "))
+		timeout       = flag.Duration("timeout", 30*time.Second, "Time to connect and complete the handshake (0 for none)")
+		keyPool       = flag.Int("key-pool", 0, "Number of KEM2 key pairs to generate in the background, while connecting (0 to generate on demand)")
+		keyPoolJobs   = flag.Int("key-pool-workers", 1, "Number of key pairs the pool generates at once")
 	)
 	flag.Parse()
 
+	crypto.SetMemoryLocking(*mlock)
+
 	logger := log.New(os.Stdout, "", 0)
 
 	printBanner(logger)
@@ -77,10 +91,17 @@ func main() {
 	if err != nil {
 		logger.Fatalf("%sError: KEM1 type '%s' not found: %s%s\n", colorRed, *kem1Type, err, colorReset)
 	}
-	kem2, err := kem.GetKEM(*kem2Type)
-	if err != nil {
-		logger.Fatalf("%sError: KEM2 type '%s' not found: %s%s\n", colorRed, *kem2Type, err, colorReset)
+	suiteList := splitList(*suites)
+	if len(suiteList) == 0 {
+		suiteList = crypto.DefaultCipherSuites()
+	}
+	kem2List := strings.Split(*kem2Types, ",")
+	for _, name := range kem2List {
+		if _, err := kem.GetKEM(name); err != nil {
+			logger.Fatalf("%sError: KEM2 type '%s' not found: %s%s\n", colorRed, name, err, colorReset)
+		}
 	}
+	kem2, _ := kem.GetKEM(kem2List[0])
 
 	// Parse server public key
 	serverPublicKey, err := kem1.ParsePublicKey(serverPublicKeyBytes)
@@ -95,10 +116,41 @@ func main() {
 		KEM1:                kem1,
 		KEM2:                kem2,
 		SymmetricEncryption: protocol.DefaultConfig().SymmetricEncryption,
+		CipherSuites:        suiteList,
+		KEM2Types:           kem2List,
+	}
+	if err := config.Validate(); err != nil {
+		logger.Fatalf("%sError: invalid configuration: %s%s\n", colorRed, err, colorReset)
+	}
+	limits := config.Limits()
+	serializer, err := protocol.NewSerializer(*format, limits)
+	if err != nil {
+		logger.Fatalf("%sError: %s%s\n", colorRed, err, colorReset)
 	}
 
 	// Create client options
 	options := protocol.NewSessionOptions().WithServerPublicKey(serverPublicKey)
+	if *clientKeyFile != "" {
+		clientKeyBytes, err := os.ReadFile(*clientKeyFile)
+		if err != nil {
+			logger.Fatalf("%sError reading client key file: %s%s\n", colorRed, err, colorReset)
+		}
+		clientPrivateKey, err := kem1.ParsePrivateKey(clientKeyBytes)
+		if err != nil {
+			logger.Fatalf("%sError parsing client private key: %s%s\n", colorRed, err, colorReset)
+		}
+		options.WithClientPrivateKey(clientPrivateKey).WithClientID([]byte(*clientID))
+		logger.Printf("%sMutual authentication as %q%s\n", colorGreen, *clientID, colorReset)
+	}
+
+	// The key share is generated while the connection is set up
+	var pool *protocol.KeyPool
+	if *keyPool > 0 {
+		pool = protocol.NewKeyPool(*keyPool, *keyPoolJobs, nil)
+		defer pool.Close()
+		pool.Warm(kem2)
+		options.WithKeyPool(pool)
+	}
 
 	// Create client
 	client, err := protocol.NewClient(config, options)
@@ -107,13 +159,25 @@ func main() {
 	}
 
 	// Connect to server
-	serverAddr := fmt.Sprintf("%s:%d", *host, *port)
+	serverAddr := net.JoinHostPort(*host, strconv.Itoa(*port))
 	logger.Printf("%sConnecting to %s...%s\n", colorYellow, serverAddr, colorReset)
-	conn, err := net.Dial("tcp", serverAddr)
+	// The handshake must complete before the timeout: once the context is
+	// done the KEM operations are abandoned and blocked reads and writes fail
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr)
 	if err != nil {
 		logger.Fatalf("%sError connecting to server: %s%s\n", colorRed, err, colorReset)
 	}
 	defer conn.Close()
+	stopDeadline := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
 	logger.Printf("%sConnected to %s%s\n", colorGreen, serverAddr, colorReset)
 
 	// Determine 0-RTT payload
@@ -125,7 +189,7 @@ func main() {
 	// Start protocol - generate ClientHello
 	startTime := time.Now()
 	logger.Printf("%sGenerating ClientHello...%s\n", colorCyan, colorReset)
-	clientHello, err := client.GenerateClientHello(zeroRTTData)
+	clientHello, err := client.GenerateClientHelloContext(ctx, zeroRTTData)
 	if err != nil {
 		logger.Fatalf("%sError generating ClientHello: %s%s\n", colorRed, err, colorReset)
 	}
@@ -135,6 +199,7 @@ func main() {
 		logger.Printf("%s---------- Protocol Stage 1 ----------%s\n", colorPurple, colorReset)
 		logger.Printf("KEM1 Type: %s\n", clientHello.KEM1Type)
 		logger.Printf("KEM2 Type: %s\n", clientHello.KEM2Type)
+		logger.Printf("Offered cipher suites: %s\n", strings.Join(clientHello.CipherSuites, ", "))
 		logger.Printf("Ephemeral public key length: %d bytes\n", len(clientHello.EphemeralPublicKey))
 		logger.Printf("Ciphertext1 length: %d bytes\n", len(clientHello.Ciphertext1))
 		if zeroRTTData != nil {
@@ -145,72 +210,115 @@ func main() {
 		}
 	}
 
-	// Serialize and send ClientHello
-	serializer := &protocol.DefaultSerializer{}
-	clientHelloBytes, err := serializer.MarshalClientHello(clientHello)
-	if err != nil {
-		logger.Fatalf("%sError marshalling ClientHello: %s%s\n", colorRed, err, colorReset)
-	}
+	decoder := protocol.NewDecoder(conn, limits)
 
-	// First send the length as 4 bytes, 32 bit
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(clientHelloBytes)))
-	if _, err := conn.Write(lenBuf); err != nil {
-		logger.Fatalf("%sError sending ClientHello length: %s%s\n", colorRed, err, colorReset)
-	}
+	// The server may ask once for a key share of another KEM2
+	var header *protocol.FrameHeader
+	var frame []byte
+	for {
+		// Serialize and send ClientHello
+		clientHelloBytes, err := serializer.MarshalClientHello(clientHello)
+		if err != nil {
+			logger.Fatalf("%sError marshalling ClientHello: %s%s\n", colorRed, err, colorReset)
+		}
 
-	// Then send the actual ClientHello
-	if _, err := conn.Write(clientHelloBytes); err != nil {
-		logger.Fatalf("%sError sending ClientHello: %s%s\n", colorRed, err, colorReset)
-	}
+		if _, err := conn.Write(protocol.NewFrame(protocol.MessageTypeClientHello, clientHelloBytes)); err != nil {
+			logger.Fatalf("%sError sending ClientHello: %s%s\n", colorRed, err, colorReset)
+		}
 
-	logger.Printf("%sSent ClientHello (%d bytes)%s\n", colorGreen, len(clientHelloBytes), colorReset)
-	if zeroRTTData != nil {
-		logger.Printf("%sSent 0-RTT data: \"%s\"%s\n", colorPurple, *zeroRTTMsg, colorReset)
-	}
+		logger.Printf("%sSent ClientHello (%d bytes)%s\n", colorGreen, len(clientHelloBytes), colorReset)
+		if zeroRTTData != nil {
+			logger.Printf("%sSent 0-RTT data: \"%s\"%s\n", colorPurple, *zeroRTTMsg, colorReset)
+		}
 
-	// Read server response
-	logger.Printf("%sWaiting for server response...%s\n", colorCyan, colorReset)
+		// Read server response
+		logger.Printf("%sWaiting for server response...%s\n", colorCyan, colorReset)
 
-	// Read message length
-	if _, err := io.ReadFull(conn, lenBuf); err != nil {
-		logger.Fatalf("%sError reading server response length: %s%s\n", colorRed, err, colorReset)
-	}
+		header, frame, err = decoder.ReadFrame()
+		if err != nil {
+			logger.Fatalf("%sError reading server response: %s%s\n", colorRed, err, colorReset)
+		}
+
+		if header.Type == protocol.MessageTypeAlert {
+			alert, err := serializer.UnmarshalAlert(frame[protocol.FrameHeaderSize:])
+			if err == nil {
+				err = client.ProcessAlert(alert)
+			}
+			logger.Fatalf("%sServer aborted the handshake: %s%s\n%s", colorRed, err, colorReset, alertHint(err))
+		}
+		if header.Type != protocol.MessageTypeHelloRetryRequest {
+			break
+		}
 
-	messageLen := int(binary.BigEndian.Uint32(lenBuf))
-	messageBuf := make([]byte, messageLen)
-	if _, err := io.ReadFull(conn, messageBuf); err != nil {
-		logger.Fatalf("%sError reading server response: %s%s\n", colorRed, err, colorReset)
+		hrr, err := serializer.UnmarshalHelloRetryRequest(frame[protocol.FrameHeaderSize:])
+		if err != nil {
+			abortHandshake(conn, serializer, protocol.NewAlert(err), logger, "Error unmarshalling hello retry request: %s", err)
+		}
+		if len(hrr.Cookie) > 0 {
+			logger.Printf("%sServer requested a %s key share and a retry with its cookie%s\n", colorYellow, hrr.KEM2Type, colorReset)
+		} else {
+			logger.Printf("%sServer requested a %s key share%s\n", colorYellow, hrr.KEM2Type, colorReset)
+		}
+
+		clientHello, err = client.ProcessHelloRetryRequestContext(ctx, hrr)
+		if err != nil {
+			abortHandshake(conn, serializer, client.Alert(), logger, "Error processing hello retry request: %s", err)
+		}
 	}
 
 	// Unmarshal server response
-	serverResponse, err := serializer.UnmarshalServerResponse(messageBuf)
+	if header.Type != protocol.MessageTypeServerResponse {
+		err := fmt.Errorf("%w: type %d instead of server response", protocol.ErrUnexpectedMessage, header.Type)
+		abortHandshake(conn, serializer, protocol.NewAlert(err), logger, "Error: %s", err)
+	}
+	serverResponse, err := serializer.UnmarshalServerResponse(frame[protocol.FrameHeaderSize:])
 	if err != nil {
-		logger.Fatalf("%sError unmarshalling server response: %s%s\n", colorRed, err, colorReset)
+		abortHandshake(conn, serializer, protocol.NewAlert(err), logger, "Error unmarshalling server response: %s", err)
 	}
 
-	logger.Printf("%sReceived server response (%d bytes)%s\n", colorGreen, len(messageBuf), colorReset)
+	logger.Printf("%sReceived server response (%d bytes)%s\n", colorGreen, len(frame), colorReset)
 
 	// Visualize the protocol - Stage 2
 	if *verbose {
 		logger.Printf("%s---------- Protocol Stage 2 ----------%s\n", colorPurple, colorReset)
+		logger.Printf("Cipher suite: %s\n", serverResponse.CipherSuite)
 		logger.Printf("Ciphertext2 length: %d bytes\n", len(serverResponse.Ciphertext2))
 		logger.Printf("Encrypted payload length: %d bytes\n", len(serverResponse.EncryptedPayload))
 	}
 
-	// Process server response
-	serverData, err := client.ProcessServerResponse(serverResponse)
+	// Process server response, verifying the server's Finished
+	serverData, err := client.ProcessServerResponseContext(ctx, serverResponse)
 	if err != nil {
-		logger.Fatalf("%sError processing server response: %s%s\n", colorRed, err, colorReset)
+		abortHandshake(conn, serializer, client.Alert(), logger, "Error processing server response: %s", err)
+	}
+
+	// Confirm the session keys to the server
+	clientFinished, err := client.GenerateClientFinished()
+	if err != nil {
+		logger.Fatalf("%sError generating client finished: %s%s\n", colorRed, err, colorReset)
+	}
+
+	clientFinishedBytes, err := serializer.MarshalClientFinished(clientFinished)
+	if err != nil {
+		logger.Fatalf("%sError marshalling client finished: %s%s\n", colorRed, err, colorReset)
+	}
+
+	if _, err := conn.Write(protocol.NewFrame(protocol.MessageTypeClientFinished, clientFinishedBytes)); err != nil {
+		logger.Fatalf("%sError sending client finished: %s%s\n", colorRed, err, colorReset)
 	}
 
 	elapsedTime := time.Since(startTime)
-	sessionKey := client.GetSessionKey()
+
+	// The session outlives the handshake timeout
+	if !stopDeadline() {
+		logger.Fatalf("%sError: handshake timed out%s\n", colorRed, colorReset)
+	}
 
 	// Session established!
 	logger.Printf("%sSession established! Protocol completed in %v%s\n", colorGreen, elapsedTime, colorReset)
-	if *verbose && len(sessionKey) > 0 {
-		logger.Printf("%sSession key (first 8 bytes): %x%s\n", colorPurple, sessionKey[:min(8, len(sessionKey))], colorReset)
+	if pool != nil && *verbose {
+		stats := pool.Stats()
+		logger.Printf("Key pool: %d key pairs taken, %d generated on demand\n", stats.Hits, stats.Misses)
 	}
 
 	// Display server data
@@ -218,12 +326,24 @@ func main() {
 		logger.Printf("%sServer data: %s%s\n", colorPurple, string(serverData), colorReset)
 	}
 
+	// Resend 0-RTT data the server did not process under the stage-2 keys
+	if rejected, err := client.RejectedEarlyData(); err != nil && rejected != nil {
+		logger.Printf("%s0-RTT data rejected by server, resending under the stage-2 key%s\n", colorYellow, colorReset)
+		reply, err := exchangeMessage(conn, client, rejected, logger)
+		if err != nil {
+			logger.Fatalf("%s%s%s\n", colorRed, err, colorReset)
+		}
+		logger.Printf("%sServer: %s%s\n", colorPurple, string(reply), colorReset)
+	} else if client.EarlyDataAccepted() {
+		logger.Printf("%s0-RTT data accepted by server%s\n", colorGreen, colorReset)
+	}
+
 	// Protocol complete!
 	logger.Printf("%sTIMKE protocol completed successfully!%s\n", colorBlue, colorReset)
 
 	// Interactive mode
 	if *interactive {
-		logger.Printf("\n%sEntering interactive mode. Type messages to send to server (type 'exit' to quit):%s\n",
+		logger.Printf("\n%sEntering interactive mode. Type messages to send to server (type '/rekey' to update keys, 'exit' to quit):%s\n",
 			colorYellow, colorReset)
 
 		scanner := bufio.NewScanner(os.Stdin)
@@ -238,57 +358,120 @@ func main() {
 				break
 			}
 
-			// Encrypt message
-			encryptedMessage, err := client.Encrypt([]byte(message))
-			if err != nil {
-				logger.Printf("%sError encrypting message: %s%s\n", colorRed, err, colorReset)
-				continue
+			var plaintext []byte
+			if message == "/rekey" {
+				plaintext, err = updateKeys(conn, client, logger)
+			} else {
+				plaintext, err = exchangeMessage(conn, client, []byte(message), logger)
 			}
-
-			// Send message length
-			binary.BigEndian.PutUint32(lenBuf, uint32(len(encryptedMessage)))
-			if _, err := conn.Write(lenBuf); err != nil {
-				logger.Printf("%sError sending message length: %s%s\n", colorRed, err, colorReset)
+			if err != nil {
+				logger.Printf("%s%s%s\n", colorRed, err, colorReset)
 				break
 			}
 
-			// Send encrypted message
-			if _, err := conn.Write(encryptedMessage); err != nil {
-				logger.Printf("%sError sending message: %s%s\n", colorRed, err, colorReset)
-				break
-			}
+			logger.Printf("%sServer: %s%s\n", colorPurple, string(plaintext), colorReset)
+		}
+	}
+}
 
-			logger.Printf("%sSent encrypted message (%d bytes)%s\n", colorGreen, len(encryptedMessage), colorReset)
+// splitList splits a comma-separated flag value, dropping empty entries so
+// that an empty value lists nothing
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
 
-			// Read response length
-			if _, err := io.ReadFull(conn, lenBuf); err != nil {
-				logger.Printf("%sError reading response length: %s%s\n", colorRed, err, colorReset)
-				break
-			}
+// abortHandshake tells the server why the handshake failed and exits
+func abortHandshake(conn net.Conn, serializer protocol.Serializer, alert *protocol.Alert, logger *log.Logger, format string, args ...any) {
+	if alert != nil {
+		if message, err := serializer.MarshalAlert(alert); err == nil {
+			_, _ = conn.Write(protocol.NewFrame(protocol.MessageTypeAlert, message))
+		}
+	}
+	conn.Close()
+	logger.Fatalf("%s%s%s\n", colorRed, fmt.Sprintf(format, args...), colorReset)
+}
 
-			messageLen := (int(lenBuf[0]) << 8) | int(lenBuf[1])
-			if messageLen <= 0 || messageLen > 65535 {
-				logger.Printf("%sInvalid response length: %d%s\n", colorRed, messageLen, colorReset)
-				break
-			}
+// alertHint suggests a fix for the usual reasons a server aborts
+func alertHint(err error) string {
+	switch {
+	case errors.Is(err, protocol.ErrDecryptError):
+		return "Check that -server-key-file holds the server's current public key\n"
+	case errors.Is(err, protocol.ErrPolicyViolation):
+		return "The server's security policy rejects the offered algorithms; try a stronger -kem2 or other -suites\n"
+	case errors.Is(err, protocol.ErrNoCommonKEM):
+		return "Check -kem1 against the server key and offer more -kem2 types\n"
+	case errors.Is(err, protocol.ErrClientAuthRequired), errors.Is(err, protocol.ErrClientNotAuthorized):
+		return "The server requires an authorized -client-key and -client-id\n"
+	}
+	return ""
+}
 
-			// Read response
-			responseBuf := make([]byte, messageLen)
-			if _, err := io.ReadFull(conn, responseBuf); err != nil {
-				logger.Printf("%sError reading response: %s%s\n", colorRed, err, colorReset)
-				break
-			}
+// exchangeMessage sends an encrypted message and returns the decrypted reply
+func exchangeMessage(conn net.Conn, client *protocol.Client, message []byte, logger *log.Logger) ([]byte, error) {
+	// Encrypt message
+	encryptedMessage, err := client.Encrypt(message)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
 
-			// Decrypt response
-			plaintext, err := client.Decrypt(responseBuf)
-			if err != nil {
-				logger.Printf("%sError decrypting response: %s%s\n", colorRed, err, colorReset)
-				continue
-			}
+	return exchangeRecords(conn, client, encryptedMessage, logger)
+}
 
-			logger.Printf("%sServer: %s%s\n", colorPurple, string(plaintext), colorReset)
-		}
+// updateKeys ratchets the traffic keys of both directions
+func updateKeys(conn net.Conn, client *protocol.Client, logger *log.Logger) ([]byte, error) {
+	keyUpdate, err := client.UpdateKeys()
+	if err != nil {
+		return nil, fmt.Errorf("error updating keys: %w", err)
 	}
+
+	return exchangeRecords(conn, client, keyUpdate, logger)
+}
+
+// exchangeRecords sends sealed records and returns the decrypted reply
+func exchangeRecords(conn net.Conn, client *protocol.Client, encryptedMessage []byte, logger *log.Logger) ([]byte, error) {
+	// Send message length
+	lenBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBuf, uint32(len(encryptedMessage)))
+	if _, err := conn.Write(lenBuf); err != nil {
+		return nil, fmt.Errorf("error sending message length: %w", err)
+	}
+
+	// Send encrypted message
+	if _, err := conn.Write(encryptedMessage); err != nil {
+		return nil, fmt.Errorf("error sending message: %w", err)
+	}
+
+	logger.Printf("%sSent encrypted message (%d bytes)%s\n", colorGreen, len(encryptedMessage), colorReset)
+
+	// Read response length
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, fmt.Errorf("error reading response length: %w", err)
+	}
+
+	messageLen := (int(lenBuf[0]) << 8) | int(lenBuf[1])
+	if messageLen <= 0 || messageLen > 65535 {
+		return nil, fmt.Errorf("invalid response length: %d", messageLen)
+	}
+
+	// Read response
+	responseBuf := make([]byte, messageLen)
+	if _, err := io.ReadFull(conn, responseBuf); err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	// Decrypt response
+	plaintext, err := client.Decrypt(responseBuf)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting response: %w", err)
+	}
+
+	return plaintext, nil
 }
 
 func printBanner(logger *log.Logger) {
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"TIMKE/pkg/crypto"
 	"TIMKE/pkg/kem"
 	"TIMKE/pkg/protocol"
 )
@@ -29,17 +35,34 @@ func main() {
 	var (
 		port       = flag.Int("port", 8443, "Port to listen on")
 		kem1Type   = flag.String("kem1", "ML-KEM-768", "KEM type for the first stage (OWChCCA-32, ML-KEM-768, etc.)")
-		kem2Type   = flag.String("kem2", "ML-KEM-768", "KEM type for the second stage (OWChCCA-32, ML-KEM-768, etc.)")
+		kem2Types  = flag.String("kem2", "ML-KEM-768", "Comma-separated KEM types for the second stage in preference order (OWChCCA-32, ML-KEM-768, etc.)")
+		suites     = flag.String("suites", strings.Join(crypto.DefaultCipherSuites(), ","), "Comma-separated cipher suites in preference order (empty for the defaults)")
 		keyFile    = flag.String("key", ".temp/server-key.pem", "Path to server private key file (optional)")
 		genKeyFile = flag.String("genkey", "", "Generate a new server key pair and save to file (optional)")
 		verbose    = flag.Bool("v", false, "Verbose output")
+		mlock      = flag.Bool("mlock", false, "Lock session secrets in memory so they are never swapped out")
+		maxEarly   = flag.Int("max-0rtt", protocol.DefaultMaxEarlyDataSize, "Maximum 0-RTT data size in bytes accepted from clients")
+		minLevel   = flag.Int("min-category", 0, "Minimum NIST security category accepted for both KEMs (0 for any)")
+		requirePQ  = flag.Bool("require-pq", false, "Reject KEMs that are not post-quantum")
+		maxMessage = flag.Int("max-message", protocol.DefaultMaxMessageSize, "Maximum handshake message size in bytes")
+		clients    = flag.String("clients", "", "File of authorized clients, one '<id> <public key file>' per line; requires client authentication")
+		format     = flag.String("serializer", "binary", "Message encoding: "+strings.Join(protocol.SerializerNames, ", "))
+		cookies    = flag.Bool("cookies", false, "Make clients echo a stateless retry cookie before anything is decapsulated")
+		cookieLoad = flag.Int("cookie-load", 0, "With -cookies, only require a cookie while more than this many connections are open (0 for always)")
+		timeout    = flag.Duration("handshake-timeout", 10*time.Second, "Time a client has to complete the handshake (0 for none); checked between KEM operations, as the built-in KEMs cannot be interrupted mid-operation")
 	)
 	flag.Parse()
 
+	crypto.SetMemoryLocking(*mlock)
+
 	logger := log.New(os.Stdout, "", 0)
 
 	printBanner(logger)
 
+	if _, err := protocol.NewSerializer(*format, nil); err != nil {
+		logger.Fatalf("%sError: %s%s\n", colorRed, err, colorReset)
+	}
+
 	// List available KEMs
 	logger.Printf("%sAvailable KEM algorithms:%s\n", colorYellow, colorReset)
 	for _, k := range kem.ListKEMs() {
@@ -54,10 +77,17 @@ func main() {
 	if err != nil {
 		logger.Fatalf("%sError: %s%s\n", colorRed, err, colorReset)
 	}
-	kem2, err := kem.GetKEM(*kem2Type)
-	if err != nil {
-		logger.Fatalf("%sError: %s%s\n", colorRed, err, colorReset)
+	suiteList := splitList(*suites)
+	if len(suiteList) == 0 {
+		suiteList = crypto.DefaultCipherSuites()
+	}
+	kem2List := strings.Split(*kem2Types, ",")
+	for _, name := range kem2List {
+		if _, err := kem.GetKEM(name); err != nil {
+			logger.Fatalf("%sError: %s%s\n", colorRed, err, colorReset)
+		}
 	}
+	kem2, _ := kem.GetKEM(kem2List[0])
 	// Generate a new key pair if requested
 	if *genKeyFile != "" {
 		serverPublicKey, serverPrivateKey, err = generateAndSaveKeyPair(kem1, *genKeyFile, logger)
@@ -98,8 +128,68 @@ func main() {
 		KEM1:                kem1,
 		KEM2:                kem2,
 		SymmetricEncryption: protocol.DefaultConfig().SymmetricEncryption,
+		CipherSuites:        suiteList,
+		KEM2Types:           kem2List,
+		Policy: &protocol.Policy{
+			MinSecurityCategory: *minLevel,
+			RequirePostQuantum:  *requirePQ,
+			MaxMessageSize:      *maxMessage,
+		},
+	}
+	if err := serverConfig.Validate(); err != nil {
+		logger.Fatalf("%sError: invalid configuration: %s%s\n", colorRed, err, colorReset)
+	}
+	options := protocol.NewSessionOptions().
+		WithServerPrivateKey(serverPrivateKey).
+		WithMaxEarlyDataSize(*maxEarly)
+
+	if *clients != "" {
+		authorized, err := loadAuthorizedClients(*clients)
+		if err != nil {
+			logger.Fatalf("%sError loading authorized clients: %s%s\n", colorRed, err, colorReset)
+		}
+		logger.Printf("%sClient authentication required, %d clients authorized%s\n", colorGreen, len(authorized), colorReset)
+
+		options.WithRequireClientAuth(true).
+			WithAuthorizeClient(func(ctx context.Context, identity *protocol.ClientIdentity) error {
+				if !bytes.Equal(authorized[string(identity.ID)], identity.PublicKey) {
+					return fmt.Errorf("unknown client %q", identity.ID)
+				}
+				return nil
+			})
+	}
+
+	// Connections are counted to require cookies under load only
+	var connections atomic.Int64
+	if *cookies {
+		cookieKeys, err := protocol.NewCookieKeys(protocol.DefaultCookieLifetime, nil)
+		if err != nil {
+			logger.Fatalf("%sError creating cookie keys: %s%s\n", colorRed, err, colorReset)
+		}
+		options.WithCookieKeys(cookieKeys)
+		if *cookieLoad > 0 {
+			threshold := int64(*cookieLoad)
+			options.WithRequireCookie(func(ctx context.Context, addr net.Addr) bool {
+				return connections.Load() > threshold
+			})
+			logger.Printf("%sRetry cookies required above %d open connections%s\n", colorGreen, threshold, colorReset)
+		} else {
+			logger.Printf("%sRetry cookies required%s\n", colorGreen, colorReset)
+		}
+	}
+
+	// The engine encodes and decodes the messages of every session
+	serializer, err := protocol.NewSerializer(*format, serverConfig.Limits())
+	if err != nil {
+		logger.Fatalf("%sError: %s%s\n", colorRed, err, colorReset)
+	}
+	options.WithSerializer(serializer)
+
+	// The engine is shared by every connection, each handshake gets a session
+	engine, err := protocol.NewServerEngine(serverConfig, options)
+	if err != nil {
+		logger.Fatalf("%sError creating server engine: %s%s\n", colorRed, err, colorReset)
 	}
-	options := protocol.NewSessionOptions().WithServerPrivateKey(serverPrivateKey)
 
 	// Create TCP listener
 	addr := fmt.Sprintf(":%d", *port)
@@ -121,70 +211,126 @@ func main() {
 		}
 
 		// Handle each connection in a goroutine
-		go handleConnection(conn, serverConfig, options, logger, *verbose)
+		connections.Add(1)
+		go func() {
+			defer connections.Add(-1)
+			handleConnection(conn, engine, *timeout, logger, *verbose)
+			if *verbose {
+				m := engine.Metrics()
+				logger.Printf("Handshakes: %d completed (%d resumed), %d failed, %d retries\n", m.Completed, m.Resumed, m.Failed, m.Retries)
+			}
+		}()
 	}
 }
 
-func handleConnection(conn net.Conn, config *protocol.Config, options *protocol.SessionOptions, logger *log.Logger, verbose bool) {
+func handleConnection(conn net.Conn, engine *protocol.ServerEngine, timeout time.Duration, logger *log.Logger, verbose bool) {
 	defer conn.Close()
 
+	// The handshake must complete before the timeout: once the context is
+	// done blocked reads and writes fail, and no further KEM operation
+	// starts. One under way runs to completion, since no built-in KEM
+	// implements kem.ContextKEM.
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	stopDeadline := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+
 	remoteAddr := conn.RemoteAddr().String()
 	logger.Printf("%sNew connection from %s%s\n", colorBlue, remoteAddr, colorReset)
 
-	// Create server instance
-	server, err := protocol.NewServer(config, options)
-	if err != nil {
-		logger.Printf("%sError creating server: %s%s\n", colorRed, err, colorReset)
-		return
-	}
+	server := engine.NewSession()
 	defer server.Reset()
+	server.SetClientAddress(conn.RemoteAddr())
 
-	// Read client hello message
-	logger.Printf("%s[%s] Waiting for ClientHello...%s\n", colorCyan, remoteAddr, colorReset)
-
-	// Read message length, with 32-bit length prefix
+	// Messages are bounded by the policy and the KEMs, so that a client
+	// cannot make the server allocate more than it sends. Each is framed, so
+	// the decoder reads them whatever their encoding.
+	decoder := protocol.NewDecoder(conn, engine.Limits())
+	serializer := engine.Serializer()
 	lenBuf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, lenBuf); err != nil {
-		logger.Printf("%s[%s] Error reading message length: %s%s\n", colorRed, remoteAddr, err, colorReset)
-		return
-	}
 
-	messageLen := binary.BigEndian.Uint32(lenBuf)
-	messageBuf := make([]byte, messageLen)
-	if _, err := io.ReadFull(conn, messageBuf); err != nil {
-		logger.Printf("%s[%s] Error reading client hello: %s%s\n", colorRed, remoteAddr, err, colorReset)
-		return
-	}
+	// Handshake failures are reported to the client in an alert before the
+	// connection is closed.
+	//
+	// A ClientHello with a key share we do not accept is answered with a
+	// HelloRetryRequest; the server rejects a second one itself
+	var zeroRTTData []byte
+	var processingTime time.Duration
+	for {
+		// Read client hello message
+		logger.Printf("%s[%s] Waiting for ClientHello...%s\n", colorCyan, remoteAddr, colorReset)
 
-	// Unmarshal client hello
-	serializer := &protocol.DefaultSerializer{}
-	clientHello, err := serializer.UnmarshalClientHello(messageBuf)
-	if err != nil {
-		logger.Printf("%s[%s] Error unmarshalling client hello: %s%s\n", colorRed, remoteAddr, err, colorReset)
-		return
-	}
+		header, frame, err := decoder.ReadFrame()
+		if err != nil {
+			logger.Printf("%s[%s] Error reading client hello: %s%s\n", colorRed, remoteAddr, err, colorReset)
+			return
+		}
+		if header.Type != protocol.MessageTypeClientHello {
+			err := fmt.Errorf("%w: type %d instead of client hello", protocol.ErrUnexpectedMessage, header.Type)
+			logger.Printf("%s[%s] Error: %s%s\n", colorRed, remoteAddr, err, colorReset)
+			sendAlert(conn, serializer, protocol.NewAlert(err))
+			return
+		}
 
-	logger.Printf("%s[%s] Received ClientHello%s\n", colorGreen, remoteAddr, colorReset)
-	if verbose {
-		logger.Printf("  KEM1 Type: %s\n", clientHello.KEM1Type)
-		logger.Printf("  KEM2 Type: %s\n", clientHello.KEM2Type)
-		logger.Printf("  Ephemeral public key length: %d bytes\n", len(clientHello.EphemeralPublicKey))
-		logger.Printf("  Ciphertext1 length: %d bytes\n", len(clientHello.Ciphertext1))
-		logger.Printf("  Encrypted payload length: %d bytes\n", len(clientHello.EncryptedPayload))
-	}
+		// Unmarshal client hello
+		clientHello, err := serializer.UnmarshalClientHello(frame[protocol.FrameHeaderSize:])
+		if err != nil {
+			logger.Printf("%s[%s] Error unmarshalling client hello: %s%s\n", colorRed, remoteAddr, err, colorReset)
+			sendAlert(conn, serializer, protocol.NewAlert(err))
+			return
+		}
 
-	// Process client hello (extract 0-RTT data if present)
-	startTime := time.Now()
-	zeroRTTData, err := server.ProcessClientHello(clientHello)
-	if err != nil {
-		logger.Printf("%s[%s] Error processing client hello: %s%s\n", colorRed, remoteAddr, err, colorReset)
-		return
+		logger.Printf("%s[%s] Received ClientHello%s\n", colorGreen, remoteAddr, colorReset)
+		if verbose {
+			logger.Printf("  KEM1 Type: %s\n", clientHello.KEM1Type)
+			logger.Printf("  KEM2 Type: %s\n", clientHello.KEM2Type)
+			logger.Printf("  Offered KEM2 types: %s\n", strings.Join(clientHello.SupportedKEM2Types, ", "))
+			logger.Printf("  Offered cipher suites: %s\n", strings.Join(clientHello.CipherSuites, ", "))
+			logger.Printf("  Ephemeral public key length: %d bytes\n", len(clientHello.EphemeralPublicKey))
+			logger.Printf("  Ciphertext1 length: %d bytes\n", len(clientHello.Ciphertext1))
+			logger.Printf("  Encrypted payload length: %d bytes\n", len(clientHello.EncryptedPayload))
+		}
+
+		// Process client hello (extract 0-RTT data if present)
+		startTime := time.Now()
+		zeroRTTData, err = server.ProcessClientHelloContext(ctx, clientHello)
+		processingTime = time.Since(startTime)
+		if errors.Is(err, protocol.ErrHelloRetryRequired) {
+			hrr := server.HelloRetryRequest()
+			hrrBytes, err := serializer.MarshalHelloRetryRequest(hrr)
+			if err != nil {
+				logger.Printf("%s[%s] Error marshalling hello retry request: %s%s\n", colorRed, remoteAddr, err, colorReset)
+				return
+			}
+			if _, err := conn.Write(protocol.NewFrame(protocol.MessageTypeHelloRetryRequest, hrrBytes)); err != nil {
+				logger.Printf("%s[%s] Error sending hello retry request: %s%s\n", colorRed, remoteAddr, err, colorReset)
+				return
+			}
+			if len(hrr.Cookie) > 0 {
+				logger.Printf("%s[%s] Sent HelloRetryRequest for %s with a cookie%s\n", colorYellow, remoteAddr, hrr.KEM2Type, colorReset)
+			} else {
+				logger.Printf("%s[%s] Sent HelloRetryRequest for %s%s\n", colorYellow, remoteAddr, hrr.KEM2Type, colorReset)
+			}
+			continue
+		}
+		if err != nil {
+			logger.Printf("%s[%s] Error processing client hello: %s%s\n", colorRed, remoteAddr, err, colorReset)
+			sendAlert(conn, serializer, server.Alert())
+			return
+		}
+		break
 	}
-	processingTime := time.Since(startTime)
 
 	// Log 0-RTT data if present
 	if len(zeroRTTData) > 0 {
 		logger.Printf("%s[%s] Received 0-RTT data: %s%s\n", colorPurple, remoteAddr, string(zeroRTTData), colorReset)
+	} else if err := server.EarlyDataError(); err != nil {
+		logger.Printf("%s[%s] Rejected 0-RTT data: %s%s\n", colorYellow, remoteAddr, err, colorReset)
 	} else {
 		logger.Printf("%s[%s] No 0-RTT data received%s\n", colorYellow, remoteAddr, colorReset)
 	}
@@ -192,9 +338,10 @@ func handleConnection(conn net.Conn, config *protocol.Config, options *protocol.
 	// Generate server response
 	logger.Printf("%s[%s] Generating server response...%s\n", colorCyan, remoteAddr, colorReset)
 	payload := []byte("Hello from TIMKE server! This is stage-2 protected data.")
-	serverResponse, err := server.GenerateServerResponse(payload)
+	serverResponse, err := server.GenerateServerResponseContext(ctx, payload)
 	if err != nil {
 		logger.Printf("%s[%s] Error generating server response: %s%s\n", colorRed, remoteAddr, err, colorReset)
+		sendAlert(conn, serializer, server.Alert())
 		return
 	}
 
@@ -205,28 +352,59 @@ func handleConnection(conn net.Conn, config *protocol.Config, options *protocol.
 		return
 	}
 
-	// First send the length as 4 bytes
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(responseBytes)))
-	if _, err := conn.Write(lenBuf); err != nil {
-		logger.Printf("%s[%s] Error sending response length: %s%s\n", colorRed, remoteAddr, err, colorReset)
+	if _, err := conn.Write(protocol.NewFrame(protocol.MessageTypeServerResponse, responseBytes)); err != nil {
+		logger.Printf("%s[%s] Error sending server response: %s%s\n", colorRed, remoteAddr, err, colorReset)
 		return
 	}
 
-	// Then send the actual response
-	if _, err := conn.Write(responseBytes); err != nil {
-		logger.Printf("%s[%s] Error sending server response: %s%s\n", colorRed, remoteAddr, err, colorReset)
+	logger.Printf("%s[%s] Sent server response (%d bytes)%s\n", colorGreen, remoteAddr, len(responseBytes), colorReset)
+	if verbose {
+		logger.Printf("  Cipher suite: %s\n", serverResponse.CipherSuite)
+	}
+
+	// Wait for the client to confirm the session keys, or to abort
+	header, frame, err := decoder.ReadFrame()
+	if err != nil {
+		logger.Printf("%s[%s] Error reading client finished: %s%s\n", colorRed, remoteAddr, err, colorReset)
+		return
+	}
+	if header.Type == protocol.MessageTypeAlert {
+		alert, err := serializer.UnmarshalAlert(frame[protocol.FrameHeaderSize:])
+		if err == nil {
+			err = server.ProcessAlert(alert)
+		}
+		logger.Printf("%s[%s] Client aborted the handshake: %s%s\n", colorRed, remoteAddr, err, colorReset)
+		return
+	}
+	if header.Type != protocol.MessageTypeClientFinished {
+		err := fmt.Errorf("%w: type %d instead of client finished", protocol.ErrUnexpectedMessage, header.Type)
+		logger.Printf("%s[%s] Error: %s%s\n", colorRed, remoteAddr, err, colorReset)
+		sendAlert(conn, serializer, protocol.NewAlert(err))
 		return
 	}
 
-	logger.Printf("%s[%s] Sent server response (%d bytes)%s\n", colorGreen, remoteAddr, len(responseBytes), colorReset)
+	clientFinished, err := serializer.UnmarshalClientFinished(frame[protocol.FrameHeaderSize:])
+	if err != nil {
+		logger.Printf("%s[%s] Error unmarshalling client finished: %s%s\n", colorRed, remoteAddr, err, colorReset)
+		sendAlert(conn, serializer, protocol.NewAlert(err))
+		return
+	}
+
+	if err := server.ProcessClientFinished(clientFinished); err != nil {
+		logger.Printf("%s[%s] Error verifying client finished: %s%s\n", colorRed, remoteAddr, err, colorReset)
+		sendAlert(conn, serializer, server.Alert())
+		return
+	}
+
+	// The session outlives the handshake timeout
+	if !stopDeadline() {
+		logger.Printf("%s[%s] Error: handshake timed out%s\n", colorRed, remoteAddr, colorReset)
+		return
+	}
 
 	// Session established!
-	sessionKey := server.GetSessionKey()
 	logger.Printf("%s[%s] Session established!%s\n", colorGreen, remoteAddr, colorReset)
 	logger.Printf("%s[%s] Protocol completed in %v%s\n", colorBlue, remoteAddr, processingTime, colorReset)
-	if verbose {
-		logger.Printf("%s[%s] Session key (first 8 bytes): %x%s\n", colorPurple, remoteAddr, sessionKey[:min(8, len(sessionKey))], colorReset)
-	}
 
 	// Wait for client messages
 	for {
@@ -240,9 +418,8 @@ func handleConnection(conn net.Conn, config *protocol.Config, options *protocol.
 			return
 		}
 
-		messageLen = binary.BigEndian.Uint32(lenBuf)
-		messageBuf = make([]byte, messageLen)
-		if _, err := io.ReadFull(conn, messageBuf); err != nil {
+		messageBuf, err := decoder.ReadRecords(int(binary.BigEndian.Uint32(lenBuf)))
+		if err != nil {
 			logger.Printf("%s[%s] Error reading message: %s%s\n", colorRed, remoteAddr, err, colorReset)
 			return
 		}
@@ -254,10 +431,17 @@ func handleConnection(conn net.Conn, config *protocol.Config, options *protocol.
 			return
 		}
 
-		logger.Printf("%s[%s] Received encrypted message: %s%s\n", colorPurple, remoteAddr, string(plaintext), colorReset)
+		// Records carrying only a key update have no application data
+		var response []byte
+		if plaintext == nil {
+			logger.Printf("%s[%s] Client updated its traffic keys%s\n", colorBlue, remoteAddr, colorReset)
+			response = []byte(fmt.Sprintf("Keys updated (at %s)", time.Now().Format(time.RFC3339)))
+		} else {
+			logger.Printf("%s[%s] Received encrypted message: %s%s\n", colorPurple, remoteAddr, string(plaintext), colorReset)
+			response = []byte(fmt.Sprintf("Server received: %s (at %s)", plaintext, time.Now().Format(time.RFC3339)))
+		}
 
 		// Send response
-		response := []byte(fmt.Sprintf("Server received: %s (at %s)", plaintext, time.Now().Format(time.RFC3339)))
 		encryptedResponse, err := server.Encrypt(response)
 		if err != nil {
 			logger.Printf("%s[%s] Error encrypting response: %s%s\n", colorRed, remoteAddr, err, colorReset)
@@ -282,6 +466,31 @@ func handleConnection(conn net.Conn, config *protocol.Config, options *protocol.
 	}
 }
 
+// splitList splits a comma-separated flag value, dropping empty entries so
+// that an empty value lists nothing
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// sendAlert tells the client why the handshake failed. Write errors are
+// ignored since the connection is closed right after.
+func sendAlert(conn net.Conn, serializer protocol.Serializer, alert *protocol.Alert) {
+	if alert == nil {
+		return
+	}
+	message, err := serializer.MarshalAlert(alert)
+	if err != nil {
+		return
+	}
+	_, _ = conn.Write(protocol.NewFrame(protocol.MessageTypeAlert, message))
+}
+
 func generateAndSaveKeyPair(k kem.KEM, filename string, logger *log.Logger) (kem.PublicKey, kem.PrivateKey, error) {
 	logger.Printf("%sGenerating new %s key pair...%s\n", colorYellow, k.Setup().Name, colorReset)
 
@@ -308,6 +517,39 @@ func generateAndSaveKeyPair(k kem.KEM, filename string, logger *log.Logger) (kem
 	return publicKey, privateKey, nil
 }
 
+// loadAuthorizedClients reads '<id> <public key file>' lines, relative paths
+// being resolved against the list's directory
+func loadAuthorizedClients(filename string) (map[string][]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	authorized := make(map[string][]byte)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected '<id> <public key file>'", filename, i+1)
+		}
+		keyFile := fields[1]
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(filename), keyFile)
+		}
+		publicKey, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		authorized[fields[0]] = publicKey
+	}
+
+	return authorized, nil
+}
+
 func loadPrivateKey(k kem.KEM, filename string, logger *log.Logger) (kem.PrivateKey, error) {
 	logger.Printf("%sLoading private key from %s...%s\n", colorYellow, filename, colorReset)
 
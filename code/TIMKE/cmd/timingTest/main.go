@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"TIMKE/pkg/timing"
+)
+
+func main() {
+	samples := flag.Int("samples", 2000, "Number of measurements per test")
+	kems := flag.String("kems", "", "Comma-separated list of KEMs to test (empty for all)")
+	suites := flag.String("suites", "", "Comma-separated list of cipher suites whose tag rejection to test; decryption with a valid tag is not measured (empty for all)")
+	verbose := flag.Bool("verbose", true, "Print progress information")
+	flag.Parse()
+
+	options := timing.DefaultSuiteOptions()
+	options.Samples = *samples
+	if *verbose {
+		options.Progress = func(r timing.Result) {
+			fmt.Printf("  %s: t=%.2f max|t|=%.2f (%s)\n", r.Name, r.T, r.MaxT, r.Leakage())
+		}
+	}
+
+	if *kems != "" {
+		options.KEMNames = strings.Split(*kems, ",")
+	}
+	if *suites != "" {
+		options.CipherNames = strings.Split(*suites, ",")
+	}
+
+	results, err := timing.RunAll(options)
+	if err != nil {
+		fmt.Printf("Error running timing tests: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(timing.FormatResults(results))
+
+	for _, r := range results {
+		if r.Leaky() {
+			os.Exit(2)
+		}
+	}
+}
@@ -5,6 +5,8 @@ go 1.24.0
 require (
 	github.com/MingLLuo/OW-ChCCA-KEM v0.0.0-20260214165445-6c4cddcce49e
 	github.com/cloudflare/circl v1.6.0
+	golang.org/x/crypto v0.35.0
+	golang.org/x/sys v0.30.0
 )
 
 require (
@@ -14,8 +16,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
 	github.com/tuneinsight/lattigo/v6 v6.1.0 // indirect
-	golang.org/x/crypto v0.35.0 // indirect
 	golang.org/x/exp v0.0.0-20250228200357-dead58393ab7 // indirect
-	golang.org/x/sys v0.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
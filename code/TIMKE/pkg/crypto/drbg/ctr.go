@@ -0,0 +1,125 @@
+package drbg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"TIMKE/pkg/crypto/sha3"
+)
+
+const (
+	ctrKeySize   = 32
+	ctrBlockSize = aes.BlockSize
+	ctrSeedSize  = ctrKeySize + ctrBlockSize
+)
+
+// ctrDRBG is CTR_DRBG (SP 800-90A, Section 10.2.1) with AES-256 and without
+// a derivation function. Personalization and additional inputs longer than
+// the seed length are compressed with SHAKE256 first.
+type ctrDRBG struct {
+	key [ctrKeySize]byte
+	v   [ctrBlockSize]byte
+}
+
+func newCTRDRBG() *ctrDRBG {
+	return &ctrDRBG{}
+}
+
+func (c *ctrDRBG) seedSize() int { return ctrSeedSize }
+
+// maxRequest is the 2^19-bit limit of SP 800-90A Table 3
+func (c *ctrDRBG) maxRequest() int { return 1 << 16 }
+
+func (c *ctrDRBG) incV() {
+	for i := len(c.v) - 1; i >= 0; i-- {
+		c.v[i]++
+		if c.v[i] != 0 {
+			break
+		}
+	}
+}
+
+func (c *ctrDRBG) block() cipher.Block {
+	// A 32-byte key never fails
+	block, _ := aes.NewCipher(c.key[:])
+	return block
+}
+
+func (c *ctrDRBG) update(provided *[ctrSeedSize]byte) {
+	var temp [ctrSeedSize]byte
+	block := c.block()
+	for i := 0; i < ctrSeedSize; i += ctrBlockSize {
+		c.incV()
+		block.Encrypt(temp[i:i+ctrBlockSize], c.v[:])
+	}
+
+	if provided != nil {
+		for i := range temp {
+			temp[i] ^= provided[i]
+		}
+	}
+
+	copy(c.key[:], temp[:ctrKeySize])
+	copy(c.v[:], temp[ctrKeySize:])
+	clear(temp[:])
+}
+
+func fitSeed(input []byte) *[ctrSeedSize]byte {
+	var out [ctrSeedSize]byte
+	if len(input) <= ctrSeedSize {
+		copy(out[:], input)
+		return &out
+	}
+
+	sha3.ShakeSum256(out[:], input)
+	return &out
+}
+
+func xorSeed(entropy, input []byte) *[ctrSeedSize]byte {
+	seed := fitSeed(input)
+	for i := range seed {
+		seed[i] ^= entropy[i]
+	}
+	return seed
+}
+
+// The nonce is not used without a derivation function
+func (c *ctrDRBG) instantiate(entropy, nonce, personalization []byte) {
+	clear(c.key[:])
+	clear(c.v[:])
+
+	seed := xorSeed(entropy, personalization)
+	c.update(seed)
+	clear(seed[:])
+}
+
+func (c *ctrDRBG) reseed(entropy, additional []byte) {
+	seed := xorSeed(entropy, additional)
+	c.update(seed)
+	clear(seed[:])
+}
+
+func (c *ctrDRBG) generate(out, additional []byte) {
+	var input *[ctrSeedSize]byte
+	if len(additional) > 0 {
+		input = fitSeed(additional)
+		c.update(input)
+	}
+
+	var buf [ctrBlockSize]byte
+	block := c.block()
+	for len(out) > 0 {
+		c.incV()
+		block.Encrypt(buf[:], c.v[:])
+		n := copy(out, buf[:])
+		out = out[n:]
+	}
+	clear(buf[:])
+
+	c.update(input)
+}
+
+func (c *ctrDRBG) destroy() {
+	clear(c.key[:])
+	clear(c.v[:])
+}
@@ -0,0 +1,283 @@
+// Package drbg implements deterministic random bit generators in the style of
+// NIST SP 800-90A, seeded from a health-tested entropy source.
+//
+// All randomness used by the handshake (ephemeral KEM2 keys, KEM1
+// encapsulation, AEAD nonces) is drawn from a DRBG so that there is a single
+// source to audit, and so that tests can substitute a deterministic one.
+package drbg
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mechanism selects the underlying DRBG construction
+type Mechanism int
+
+const (
+	// MechanismSHAKE256 is a sponge-based DRBG with 256-bit security
+	MechanismSHAKE256 Mechanism = iota
+	// MechanismCTRAES256 is CTR_DRBG with AES-256 and no derivation function
+	MechanismCTRAES256
+)
+
+func (m Mechanism) String() string {
+	switch m {
+	case MechanismSHAKE256:
+		return "SHAKE256-DRBG"
+	case MechanismCTRAES256:
+		return "CTR-DRBG-AES256"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	ErrHealthTestFailed = errors.New("entropy source failed health test")
+	ErrUninstantiated   = errors.New("drbg not instantiated")
+	ErrUnknownMechanism = errors.New("unknown drbg mechanism")
+)
+
+// ReseedPolicy bounds how much output may be generated from one seed. A zero
+// field disables that bound.
+type ReseedPolicy struct {
+	MaxRequests uint64
+	MaxBytes    uint64
+	Interval    time.Duration
+}
+
+func DefaultReseedPolicy() ReseedPolicy {
+	return ReseedPolicy{
+		MaxRequests: 1 << 20,
+		MaxBytes:    1 << 32,
+		Interval:    time.Hour,
+	}
+}
+
+type Options struct {
+	Mechanism Mechanism
+	// Entropy is the raw entropy source, crypto/rand.Reader if nil
+	Entropy io.Reader
+	// Personalization is mixed into the initial seed
+	Personalization []byte
+	// Nonce makes the instantiation unique, time and process id if nil.
+	// Fix it together with Entropy for reproducible output.
+	Nonce  []byte
+	Policy ReseedPolicy
+	// SkipHealthTests disables the continuous tests on Entropy. Only useful
+	// with deterministic sources in tests.
+	SkipHealthTests bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Mechanism: MechanismSHAKE256,
+		Policy:    DefaultReseedPolicy(),
+	}
+}
+
+// mechanism is the state and update functions of a concrete construction
+type mechanism interface {
+	// seedSize is the number of entropy bytes consumed per (re)seed
+	seedSize() int
+	// maxRequest is the largest output of a single generate call
+	maxRequest() int
+	instantiate(entropy, nonce, personalization []byte)
+	reseed(entropy, additional []byte)
+	generate(out, additional []byte)
+	destroy()
+}
+
+// DRBG is safe for concurrent use. It reseeds automatically according to its
+// policy and after the process id changes, so that a forked child never
+// replays its parent's output.
+type DRBG struct {
+	mu sync.Mutex
+
+	mech     mechanism
+	entropy  io.Reader
+	health   *healthTests
+	policy   ReseedPolicy
+	failed   bool
+	pid      int
+	requests uint64
+	bytes    uint64
+	seededAt time.Time
+}
+
+func New(options Options) (*DRBG, error) {
+	var mech mechanism
+	switch options.Mechanism {
+	case MechanismSHAKE256:
+		mech = newShakeDRBG()
+	case MechanismCTRAES256:
+		mech = newCTRDRBG()
+	default:
+		return nil, ErrUnknownMechanism
+	}
+
+	entropy := options.Entropy
+	if entropy == nil {
+		entropy = rand.Reader
+	}
+
+	d := &DRBG{
+		mech:    mech,
+		entropy: entropy,
+		policy:  options.Policy,
+	}
+	if !options.SkipHealthTests {
+		d.health = newHealthTests()
+	}
+
+	seed, err := d.readEntropy(mech.seedSize())
+	if err != nil {
+		return nil, err
+	}
+	defer clear(seed)
+
+	pid := os.Getpid()
+	nonce := options.Nonce
+	if nonce == nil {
+		// The nonce only has to be unique per instantiation
+		nonce = make([]byte, 16)
+		binary.BigEndian.PutUint64(nonce[:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(nonce[8:], uint64(pid))
+	}
+
+	mech.instantiate(seed, nonce, options.Personalization)
+	d.markSeeded(pid)
+
+	return d, nil
+}
+
+func (d *DRBG) readEntropy(n int) ([]byte, error) {
+	seed := make([]byte, n)
+	if _, err := io.ReadFull(d.entropy, seed); err != nil {
+		return nil, err
+	}
+
+	if d.health != nil && !d.health.check(seed) {
+		clear(seed)
+		return nil, ErrHealthTestFailed
+	}
+
+	return seed, nil
+}
+
+func (d *DRBG) markSeeded(pid int) {
+	d.pid = pid
+	d.requests = 0
+	d.bytes = 0
+	d.seededAt = time.Now()
+}
+
+func (d *DRBG) needsReseed(pid int, n int) bool {
+	if pid != d.pid {
+		return true
+	}
+
+	p := d.policy
+	return (p.MaxRequests != 0 && d.requests >= p.MaxRequests) ||
+		(p.MaxBytes != 0 && d.bytes+uint64(n) > p.MaxBytes) ||
+		(p.Interval != 0 && time.Since(d.seededAt) >= p.Interval)
+}
+
+func (d *DRBG) reseedLocked(additional []byte) error {
+	if d.failed {
+		return ErrHealthTestFailed
+	}
+
+	seed, err := d.readEntropy(d.mech.seedSize())
+	if err != nil {
+		if errors.Is(err, ErrHealthTestFailed) {
+			// SP 800-90A: a failed health test puts the DRBG into an error state
+			d.failed = true
+		}
+		return err
+	}
+	defer clear(seed)
+
+	d.mech.reseed(seed, additional)
+	d.markSeeded(os.Getpid())
+
+	return nil
+}
+
+// Reseed mixes fresh entropy and additional into the state
+func (d *DRBG) Reseed(additional []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.mech == nil {
+		return ErrUninstantiated
+	}
+
+	return d.reseedLocked(additional)
+}
+
+// Generate fills out with random bytes, mixing additional into the state
+func (d *DRBG) Generate(out, additional []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.mech == nil {
+		return ErrUninstantiated
+	}
+	if d.failed {
+		return ErrHealthTestFailed
+	}
+
+	pid := os.Getpid()
+	for len(out) > 0 {
+		n := min(len(out), d.mech.maxRequest())
+
+		if d.needsReseed(pid, n) {
+			if err := d.reseedLocked(nil); err != nil {
+				return err
+			}
+		}
+
+		d.mech.generate(out[:n], additional)
+		d.requests++
+		d.bytes += uint64(n)
+		out = out[n:]
+	}
+
+	return nil
+}
+
+// Read implements io.Reader
+func (d *DRBG) Read(p []byte) (int, error) {
+	if err := d.Generate(p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Destroy wipes the internal state. Subsequent calls fail with ErrUninstantiated.
+func (d *DRBG) Destroy() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.mech != nil {
+		d.mech.destroy()
+		d.mech = nil
+	}
+}
+
+// Reader is a process-wide DRBG seeded from crypto/rand
+var Reader io.Reader = mustNew(DefaultOptions())
+
+func mustNew(options Options) *DRBG {
+	d, err := New(options)
+	if err != nil {
+		panic("drbg: failed to instantiate default generator: " + err.Error())
+	}
+	return d
+}
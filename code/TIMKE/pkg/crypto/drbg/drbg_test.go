@@ -0,0 +1,234 @@
+package drbg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// countingReader records how many times entropy was requested
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func sequentialSeed(n int) []byte {
+	seed := make([]byte, n)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	return seed
+}
+
+// The first seed in every NIST PQC KAT file is generated by CTR_DRBG seeded
+// with the bytes 0..47
+func TestCTRDRBGKnownAnswer(t *testing.T) {
+	d, err := New(Options{
+		Mechanism:       MechanismCTRAES256,
+		Entropy:         bytes.NewReader(sequentialSeed(48)),
+		SkipHealthTests: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to instantiate DRBG: %v", err)
+	}
+
+	out := make([]byte, 48)
+	if _, err := d.Read(out); err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+
+	expected := "061550234d158c5ec95595fe04ef7a25767f2e24cc2bc479d09d86dc9abcfde7056a8c266f9ef97ed08541dbd2e1ffa1"
+	if hex.EncodeToString(out) != expected {
+		t.Errorf("Unexpected output:\n got %x\nwant %s", out, expected)
+	}
+}
+
+func TestSHAKEDRBGDeterministic(t *testing.T) {
+	generate := func(personalization string) []byte {
+		d, err := New(Options{
+			Entropy:         bytes.NewReader(sequentialSeed(64)),
+			Personalization: []byte(personalization),
+			Nonce:           []byte("nonce"),
+			SkipHealthTests: true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to instantiate DRBG: %v", err)
+		}
+
+		out := make([]byte, 100)
+		if err := d.Generate(out, nil); err != nil {
+			t.Fatalf("Failed to generate: %v", err)
+		}
+		return out
+	}
+
+	first := generate("client")
+	if !bytes.Equal(first, generate("client")) {
+		t.Error("Equal seeds produced different output")
+	}
+	if bytes.Equal(first[:50], first[50:]) {
+		t.Error("Output repeats within a request")
+	}
+	if bytes.Equal(generate("client"), generate("server")) {
+		t.Error("Different personalization strings produced equal output")
+	}
+}
+
+func TestReseedPolicy(t *testing.T) {
+	for _, mechanism := range []Mechanism{MechanismSHAKE256, MechanismCTRAES256} {
+		t.Run(mechanism.String(), func(t *testing.T) {
+			entropy := &countingReader{r: rand.Reader}
+			d, err := New(Options{
+				Mechanism: mechanism,
+				Entropy:   entropy,
+				Policy:    ReseedPolicy{MaxRequests: 3},
+			})
+			if err != nil {
+				t.Fatalf("Failed to instantiate DRBG: %v", err)
+			}
+
+			buf := make([]byte, 32)
+			for i := 0; i < 7; i++ {
+				if _, err := d.Read(buf); err != nil {
+					t.Fatalf("Failed to generate: %v", err)
+				}
+			}
+
+			// Instantiation plus reseeds before requests 4 and 7
+			if entropy.reads != 3 {
+				t.Errorf("Expected 3 entropy reads, got %d", entropy.reads)
+			}
+		})
+	}
+}
+
+func TestForkReseeds(t *testing.T) {
+	entropy := &countingReader{r: rand.Reader}
+	d, err := New(Options{Entropy: entropy})
+	if err != nil {
+		t.Fatalf("Failed to instantiate DRBG: %v", err)
+	}
+
+	// Pretend the process id changed since seeding
+	d.pid = -1
+
+	if _, err := d.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+	if entropy.reads != 2 {
+		t.Errorf("Expected a reseed after pid change, got %d entropy reads", entropy.reads)
+	}
+}
+
+func TestHealthTestFailure(t *testing.T) {
+	_, err := New(Options{Entropy: bytes.NewReader(make([]byte, 64))})
+	if !errors.Is(err, ErrHealthTestFailed) {
+		t.Fatalf("Expected health test failure for stuck source, got %v", err)
+	}
+
+	// A source that goes bad after instantiation latches the error state
+	entropy := &switchReader{good: rand.Reader}
+	d, err := New(Options{Entropy: entropy, Policy: ReseedPolicy{MaxRequests: 1}})
+	if err != nil {
+		t.Fatalf("Failed to instantiate DRBG: %v", err)
+	}
+
+	entropy.stuck = true
+	if _, err := d.Read(make([]byte, 16)); err != nil {
+		t.Fatalf("First request should not need a reseed: %v", err)
+	}
+	if _, err := d.Read(make([]byte, 16)); !errors.Is(err, ErrHealthTestFailed) {
+		t.Fatalf("Expected health test failure on reseed, got %v", err)
+	}
+
+	entropy.stuck = false
+	if _, err := d.Read(make([]byte, 16)); !errors.Is(err, ErrHealthTestFailed) {
+		t.Errorf("Expected DRBG to stay in error state, got %v", err)
+	}
+}
+
+type switchReader struct {
+	good  io.Reader
+	stuck bool
+}
+
+func (s *switchReader) Read(p []byte) (int, error) {
+	if s.stuck {
+		clear(p)
+		return len(p), nil
+	}
+	return s.good.Read(p)
+}
+
+func TestHealthTestsPassRandom(t *testing.T) {
+	h := newHealthTests()
+	buf := make([]byte, 1<<16)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatalf("Failed to read random bytes: %v", err)
+	}
+
+	if !h.check(buf) {
+		t.Error("Health tests rejected random input")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	d, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to instantiate DRBG: %v", err)
+	}
+
+	d.Destroy()
+	if _, err := d.Read(make([]byte, 16)); !errors.Is(err, ErrUninstantiated) {
+		t.Errorf("Expected ErrUninstantiated after Destroy, got %v", err)
+	}
+}
+
+func TestConcurrentRead(t *testing.T) {
+	var wg sync.WaitGroup
+	outputs := make([][]byte, 8)
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			outputs[i] = make([]byte, 32)
+			if _, err := Reader.Read(outputs[i]); err != nil {
+				t.Errorf("Failed to read: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range outputs {
+		for j := i + 1; j < len(outputs); j++ {
+			if bytes.Equal(outputs[i], outputs[j]) {
+				t.Errorf("Outputs %d and %d are equal", i, j)
+			}
+		}
+	}
+}
+
+func TestLargeRead(t *testing.T) {
+	d, err := New(Options{Mechanism: MechanismCTRAES256})
+	if err != nil {
+		t.Fatalf("Failed to instantiate DRBG: %v", err)
+	}
+
+	// Larger than a single request
+	out := make([]byte, 3<<16+5)
+	if _, err := d.Read(out); err != nil {
+		t.Fatalf("Failed to generate: %v", err)
+	}
+	if bytes.Equal(out[:16], out[1<<16:1<<16+16]) {
+		t.Error("Output repeats across requests")
+	}
+}
@@ -0,0 +1,77 @@
+package drbg
+
+// Continuous health tests from SP 800-90B, Section 4.4, applied to entropy
+// bytes. The cutoffs assume full entropy (H = 8 bits per byte) and a false
+// positive probability of 2^-40 per sample.
+const (
+	// repetitionCutoff is 1 + ceil(40 / H)
+	repetitionCutoff = 6
+
+	adaptiveWindow = 512
+	// adaptiveCutoff is the critical value of Binomial(511, 2^-8) at 2^-40,
+	// plus one for the first sample of the window
+	adaptiveCutoff = 20
+)
+
+// healthTests keeps its state across reads, since a single seed is much
+// shorter than the adaptive proportion window
+type healthTests struct {
+	started bool
+
+	// Repetition count test
+	last        byte
+	repetitions int
+
+	// Adaptive proportion test
+	windowSample byte
+	windowCount  int
+	windowSize   int
+}
+
+func newHealthTests() *healthTests {
+	return &healthTests{}
+}
+
+func (h *healthTests) push(sample byte) bool {
+	if !h.started || sample != h.last {
+		h.started = true
+		h.last = sample
+		h.repetitions = 1
+	} else {
+		h.repetitions++
+		if h.repetitions >= repetitionCutoff {
+			return false
+		}
+	}
+
+	if h.windowSize == 0 {
+		h.windowSample = sample
+		h.windowCount = 1
+		h.windowSize = 1
+		return true
+	}
+
+	if sample == h.windowSample {
+		h.windowCount++
+		if h.windowCount >= adaptiveCutoff {
+			return false
+		}
+	}
+	h.windowSize++
+	if h.windowSize == adaptiveWindow {
+		h.windowSize = 0
+	}
+
+	return true
+}
+
+// check runs the tests over samples and reports whether all of them passed
+func (h *healthTests) check(samples []byte) bool {
+	ok := true
+	for _, sample := range samples {
+		if !h.push(sample) {
+			ok = false
+		}
+	}
+	return ok
+}
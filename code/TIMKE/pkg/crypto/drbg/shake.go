@@ -0,0 +1,65 @@
+package drbg
+
+import (
+	"encoding/binary"
+
+	"TIMKE/pkg/crypto/sha3"
+)
+
+const shakeStateSize = 64
+
+// shakeDRBG keeps a 512-bit key. Every generate call squeezes a replacement
+// key before the output, so that a later state compromise does not reveal
+// earlier output.
+type shakeDRBG struct {
+	key [shakeStateSize]byte
+}
+
+func newShakeDRBG() *shakeDRBG {
+	return &shakeDRBG{}
+}
+
+func (s *shakeDRBG) seedSize() int { return shakeStateSize }
+
+func (s *shakeDRBG) maxRequest() int { return 1 << 16 }
+
+func absorb(h *sha3.State, data []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	_, _ = h.Write(length[:])
+	_, _ = h.Write(data)
+}
+
+func (s *shakeDRBG) instantiate(entropy, nonce, personalization []byte) {
+	h := sha3.NewShake256()
+	absorb(&h, []byte("TIMKE-DRBG instantiate"))
+	absorb(&h, entropy)
+	absorb(&h, nonce)
+	absorb(&h, personalization)
+	_, _ = h.Read(s.key[:])
+	h.Reset()
+}
+
+func (s *shakeDRBG) reseed(entropy, additional []byte) {
+	h := sha3.NewShake256()
+	absorb(&h, []byte("TIMKE-DRBG reseed"))
+	absorb(&h, s.key[:])
+	absorb(&h, entropy)
+	absorb(&h, additional)
+	_, _ = h.Read(s.key[:])
+	h.Reset()
+}
+
+func (s *shakeDRBG) generate(out, additional []byte) {
+	h := sha3.NewShake256()
+	absorb(&h, []byte("TIMKE-DRBG generate"))
+	absorb(&h, s.key[:])
+	absorb(&h, additional)
+	_, _ = h.Read(s.key[:])
+	_, _ = h.Read(out)
+	h.Reset()
+}
+
+func (s *shakeDRBG) destroy() {
+	clear(s.key[:])
+}
@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// AES-GCM-SIV (RFC 8452). Nonce reuse only leaks whether two messages were
+// identical, which makes it a good fit for 0-RTT data that may be retransmitted.
+
+const (
+	gcmSIVNonceSize    = 12
+	gcmSIVTagSize      = 16
+	gcmSIVMaxPlaintext = 1 << 36
+)
+
+var errGCMSIVOpen = errors.New("gcmsiv: message authentication failed")
+
+type gcmSIV struct {
+	block  cipher.Block // key-generating key
+	keyLen int
+}
+
+// NewGCMSIV returns AES-GCM-SIV with a 128 or 256 bit key-generating key
+func NewGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcmSIV{block: block, keyLen: len(key)}, nil
+}
+
+func (g *gcmSIV) NonceSize() int { return gcmSIVNonceSize }
+
+func (g *gcmSIV) Overhead() int { return gcmSIVTagSize }
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("gcmsiv: incorrect nonce length given to GCM-SIV")
+	}
+	if uint64(len(plaintext)) > gcmSIVMaxPlaintext || uint64(len(additionalData)) > gcmSIVMaxPlaintext {
+		panic("gcmsiv: message too large for GCM-SIV")
+	}
+
+	authKey, encBlock := g.deriveKeys(nonce)
+	tag := gcmSIVTag(&authKey, encBlock, nonce, plaintext, additionalData)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	gcmSIVCTR(encBlock, &tag, out[:len(plaintext)], plaintext)
+	copy(out[len(plaintext):], tag[:])
+
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("gcmsiv: incorrect nonce length given to GCM-SIV")
+	}
+	if len(ciphertext) < gcmSIVTagSize || uint64(len(ciphertext)) > gcmSIVMaxPlaintext+gcmSIVTagSize {
+		return nil, errGCMSIVOpen
+	}
+
+	var tag [gcmSIVTagSize]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSIVTagSize]
+
+	authKey, encBlock := g.deriveKeys(nonce)
+
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	gcmSIVCTR(encBlock, &tag, out, ciphertext)
+
+	expected := gcmSIVTag(&authKey, encBlock, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		clear(out)
+		return nil, errGCMSIVOpen
+	}
+
+	return ret, nil
+}
+
+// deriveKeys computes the per-nonce message-authentication and encryption keys
+func (g *gcmSIV) deriveKeys(nonce []byte) ([16]byte, cipher.Block) {
+	var authKey [16]byte
+	var in, out [16]byte
+	encKey := make([]byte, g.keyLen)
+
+	copy(in[4:], nonce)
+	for i := 0; i < 2+g.keyLen/8; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.block.Encrypt(out[:], in[:])
+		if i < 2 {
+			copy(authKey[i*8:], out[:8])
+		} else {
+			copy(encKey[(i-2)*8:], out[:8])
+		}
+	}
+
+	// encKey is 16 or 32 bytes, so NewCipher cannot fail
+	encBlock, _ := aes.NewCipher(encKey)
+	clear(encKey)
+	clear(out[:])
+
+	return authKey, encBlock
+}
+
+func gcmSIVTag(authKey *[16]byte, encBlock cipher.Block, nonce, plaintext, additionalData []byte) [16]byte {
+	p := newPolyval(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+
+	var tag [16]byte
+	encBlock.Encrypt(tag[:], s[:])
+	return tag
+}
+
+func gcmSIVCTR(encBlock cipher.Block, tag *[16]byte, dst, src []byte) {
+	counter := *tag
+	counter[15] |= 0x80
+
+	var keystream [16]byte
+	for len(src) > 0 {
+		encBlock.Encrypt(keystream[:], counter[:])
+		n := subtle.XORBytes(dst, src, keystream[:])
+		dst, src = dst[n:], src[n:]
+
+		c := binary.LittleEndian.Uint32(counter[:4])
+		binary.LittleEndian.PutUint32(counter[:4], c+1)
+	}
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the tail
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// fieldElement is an element of GF(2^128) in POLYVAL's little-endian
+// representation: bit i of lo||hi is the coefficient of x^i.
+type fieldElement struct {
+	lo, hi uint64
+}
+
+// xInv128 is x^-128 mod x^128 + x^127 + x^126 + x^121 + 1
+var xInv128 = func() fieldElement {
+	// x^-1 = x^127 + x^126 + x^125 + x^120
+	xInv := fieldElement{hi: 1<<63 | 1<<62 | 1<<61 | 1<<56}
+	r := xInv
+	for i := 1; i < 128; i++ {
+		r = gfMul(r, xInv)
+	}
+	return r
+}()
+
+// gfMulX multiplies a by x in constant time
+func gfMulX(a fieldElement) fieldElement {
+	carry := -(a.hi >> 63)
+	a.hi = a.hi<<1 | a.lo>>63
+	a.lo <<= 1
+	a.hi ^= carry & (1<<63 | 1<<62 | 1<<57)
+	a.lo ^= carry & 1
+	return a
+}
+
+// gfMul multiplies a and b modulo the POLYVAL polynomial in constant time
+func gfMul(a, b fieldElement) fieldElement {
+	var r fieldElement
+	for i := 0; i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = (b.lo >> uint(i)) & 1
+		} else {
+			bit = (b.hi >> uint(i-64)) & 1
+		}
+		mask := -bit
+		r.lo ^= a.lo & mask
+		r.hi ^= a.hi & mask
+		a = gfMulX(a)
+	}
+	return r
+}
+
+type polyval struct {
+	h fieldElement // H·x^-128, so that dot(a, H) becomes a single gfMul
+	s fieldElement
+}
+
+func newPolyval(key *[16]byte) *polyval {
+	h := fieldElement{
+		lo: binary.LittleEndian.Uint64(key[:8]),
+		hi: binary.LittleEndian.Uint64(key[8:]),
+	}
+	return &polyval{h: gfMul(h, xInv128)}
+}
+
+// update absorbs data, zero-padding the final partial block
+func (p *polyval) update(data []byte) {
+	var block [16]byte
+	for len(data) > 0 {
+		n := copy(block[:], data)
+		clear(block[n:])
+		data = data[n:]
+
+		p.s.lo ^= binary.LittleEndian.Uint64(block[:8])
+		p.s.hi ^= binary.LittleEndian.Uint64(block[8:])
+		p.s = gfMul(p.s, p.h)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var out [16]byte
+	binary.LittleEndian.PutUint64(out[:8], p.s.lo)
+	binary.LittleEndian.PutUint64(out[8:], p.s.hi)
+	return out
+}
@@ -0,0 +1,281 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestPolyval(t *testing.T) {
+	// RFC 8452, Appendix A
+	var key [16]byte
+	copy(key[:], mustHex(t, "25629347589242761d31f826ba4b757b"))
+
+	p := newPolyval(&key)
+	p.update(mustHex(t, "4f4f95668c83dfb6401762bb2d01a262"))
+	p.update(mustHex(t, "d1a24ddd2721d006bbe45f20d3c9f362"))
+
+	sum := p.sum()
+	if want := mustHex(t, "f7a3b47b846119fae5b7866cf5e5b77e"); !bytes.Equal(sum[:], want) {
+		t.Errorf("POLYVAL = %x, want %x", sum, want)
+	}
+}
+
+func TestGCMSIVVectors(t *testing.T) {
+	// RFC 8452, Appendix C
+	testCases := []struct {
+		name      string
+		key       string
+		nonce     string
+		plaintext string
+		aad       string
+		result    string
+	}{
+		{
+			name:   "AES-128 empty",
+			key:    "01000000000000000000000000000000",
+			nonce:  "030000000000000000000000",
+			result: "dc20e2d83f25705bb49e439eca56de25",
+		},
+		{
+			name:      "AES-128 8 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000",
+			result:    "b5d839330ac7b786578782fff6013b815b287c22493a364c",
+		},
+		{
+			name:   "AES-256 empty",
+			key:    "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:  "030000000000000000000000",
+			result: "07f5f4169bbf55a8400cd47ea6fd400f",
+		},
+		{
+			name:      "AES-256 8 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000",
+			result:    "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+		},
+		{
+			name:      "AES-128 32 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000000000000000000002000000000000000000000000000000",
+			result:    "84e07e62ba83a6585417245d7ec413a9fe427d6315c09b57ce45f2e3936a94451a8e45dcd4578c667cd86847bf6155ff",
+		},
+		{
+			name:      "AES-128 48 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "010000000000000000000000000000000200000000000000000000000000000003000000000000000000000000000000",
+			result:    "3fd24ce1f5a67b75bf2351f181a475c7b800a5b4d3dcf70106b1eea82fa1d64df42bf7226122fa92e17a40eeaac1201b5e6e311dbf395d35b0fe39c2714388f8",
+		},
+		{
+			name:      "AES-128 AAD 1 byte 8 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000",
+			aad:       "01",
+			result:    "1e6daba35669f4273b0a1a2560969cdf790d99759abd1508",
+		},
+		{
+			name:      "AES-128 AAD 1 byte 32 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000000000000000000003000000000000000000000000000000",
+			aad:       "01",
+			result:    "620048ef3c1e73e57e02bb8562c416a319e73e4caac8e96a1ecb2933145a1d71e6af6a7f87287da059a71684ed3498e1",
+		},
+		{
+			name:      "AES-128 AAD 1 byte 48 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000",
+			aad:       "01",
+			result:    "50c8303ea93925d64090d07bd109dfd9515a5a33431019c17d93465999a8b0053201d723120a8562b838cdff25bf9d1e6a8cc3865f76897c2e4b245cf31c51f2",
+		},
+		{
+			name:      "AES-128 AAD 12 bytes 4 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "02000000",
+			aad:       "010000000000000000000000",
+			result:    "a8fe3e8707eb1f84fb28f8cb73de8e99e2f48a14",
+		},
+		{
+			name:      "AES-128 AAD 18 bytes 20 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0300000000000000000000000000000004000000",
+			aad:       "010000000000000000000000000000000200",
+			result:    "6bb0fecf5ded9b77f902c7d5da236a4391dd029724afc9805e976f451e6d87f6fe106514",
+		},
+		{
+			name:      "AES-128 AAD 20 bytes 18 bytes",
+			key:       "01000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "030000000000000000000000000000000400",
+			aad:       "0100000000000000000000000000000002000000",
+			result:    "44d0aaf6fb2f1f34add5e8064e83e12a2adabff9b2ef00fb47920cc72a0c0f13b9fd",
+		},
+		{
+			name:      "AES-256 32 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0100000000000000000000000000000002000000000000000000000000000000",
+			result:    "4a6a9db4c8c6549201b9edb53006cba821ec9cf850948a7c86c68ac7539d027fe819e63abcd020b006a976397632eb5d",
+		},
+		{
+			name:      "AES-256 48 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "010000000000000000000000000000000200000000000000000000000000000003000000000000000000000000000000",
+			result:    "c00d121893a9fa603f48ccc1ca3c57ce7499245ea0046db16c53c7c66fe717e39cf6c748837b61f6ee3adcee17534ed5790bc96880a99ba804bd12c0e6a22cc4",
+		},
+		{
+			name:      "AES-256 AAD 1 byte 8 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000",
+			aad:       "01",
+			result:    "1de22967237a813291213f267e3b452f02d01ae33e4ec854",
+		},
+		{
+			name:      "AES-256 AAD 1 byte 32 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0200000000000000000000000000000003000000000000000000000000000000",
+			aad:       "01",
+			result:    "07dad364bfc2b9da89116d7bef6daaaf6f255510aa654f920ac81b94e8bad365aea1bad12702e1965604374aab96dbbc",
+		},
+		{
+			name:      "AES-256 AAD 1 byte 48 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000",
+			aad:       "01",
+			result:    "c67a1f0f567a5198aa1fcc8e3f21314336f7f51ca8b1af61feac35a86416fa47fbca3b5f749cdf564527f2314f42fe2503332742b228c647173616cfd44c54eb",
+		},
+		{
+			name:      "AES-256 AAD 12 bytes 4 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "02000000",
+			aad:       "010000000000000000000000",
+			result:    "22b3f4cd1835e517741dfddccfa07fa4661b74cf",
+		},
+		{
+			name:      "AES-256 AAD 18 bytes 20 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "0300000000000000000000000000000004000000",
+			aad:       "010000000000000000000000000000000200",
+			result:    "43dd0163cdb48f9fe3212bf61b201976067f342bb879ad976d8242acc188ab59cabfe307",
+		},
+		{
+			name:      "AES-256 AAD 20 bytes 18 bytes",
+			key:       "0100000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "030000000000000000000000",
+			plaintext: "030000000000000000000000000000000400",
+			aad:       "0100000000000000000000000000000002000000",
+			result:    "462401724b5ce6588d5a54aae5375513a075cfcdf5042112aa29685c912fc2056543",
+		},
+		// Appendix C.3, where the 32-bit block counter wraps around
+		{
+			name:      "AES-256 counter wrap",
+			key:       "0000000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "000000000000000000000000",
+			plaintext: "000000000000000000000000000000004db923dc793ee6497c76dcc03a98e108",
+			result:    "f3f80f2cf0cb2dd9c5984fcda908456cc537703b5ba70324a6793a7bf218d3eaffffffff000000000000000000000000",
+		},
+		{
+			name:      "AES-256 counter wrap short",
+			key:       "0000000000000000000000000000000000000000000000000000000000000000",
+			nonce:     "000000000000000000000000",
+			plaintext: "eb3640277c7ffd1303c7a542d02d3e4c0000000000000000",
+			result:    "18ce4f0b8cb4d0cac65fea8f79257b20888e53e72299e56dffffffff000000000000000000000000",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			aead, err := NewGCMSIV(mustHex(t, tc.key))
+			if err != nil {
+				t.Fatalf("NewGCMSIV failed: %v", err)
+			}
+
+			nonce := mustHex(t, tc.nonce)
+			plaintext := mustHex(t, tc.plaintext)
+			aad := mustHex(t, tc.aad)
+			want := mustHex(t, tc.result)
+
+			got := aead.Seal(nil, nonce, plaintext, aad)
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Seal = %x, want %x", got, want)
+			}
+
+			opened, err := aead.Open(nil, nonce, got, aad)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("Open = %x, want %x", opened, plaintext)
+			}
+
+			got[0] ^= 0x01
+			if _, err := aead.Open(nil, nonce, got, aad); err == nil {
+				t.Error("Expected Open to fail for modified ciphertext")
+			}
+		})
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	for _, name := range DefaultCipherSuites() {
+		t.Run(name, func(t *testing.T) {
+			suite, err := GetCipherSuite(name)
+			if err != nil {
+				t.Fatalf("GetCipherSuite failed: %v", err)
+			}
+			if suite.Name() != name {
+				t.Errorf("Expected suite name %s, got %s", name, suite.Name())
+			}
+
+			// Handshake keys are 64 bytes and get normalized by the suite
+			key := bytes.Repeat([]byte{0x42}, 64)
+			plaintext := []byte("suite round trip")
+
+			ciphertext, err := suite.Encrypt(key, plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+
+			decrypted, err := suite.Decrypt(key, ciphertext)
+			if err != nil {
+				t.Fatalf("Decrypt failed: %v", err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("Decrypted %q, want %q", decrypted, plaintext)
+			}
+
+			ciphertext[len(ciphertext)-1] ^= 0x01
+			if _, err := suite.Decrypt(key, ciphertext); err == nil {
+				t.Error("Expected decryption of forged ciphertext to fail")
+			}
+		})
+	}
+
+	if _, err := GetCipherSuite("NonExistentSuite"); err == nil {
+		t.Error("Expected error for unknown cipher suite")
+	}
+}
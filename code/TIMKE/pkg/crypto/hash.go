@@ -1,7 +1,10 @@
 package crypto
 
 import (
+	"crypto/hmac"
+	"encoding/binary"
 	"errors"
+	"hash"
 
 	"TIMKE/pkg/crypto/sha3"
 )
@@ -18,6 +21,8 @@ func NewHash() *Hash {
 
 func (h *Hash) Hash(data ...[]byte) ([]byte, error) {
 	h.h.Reset()
+	// Inputs are usually secret, do not leave them in the sponge
+	defer h.h.Reset()
 
 	for _, d := range data {
 		if _, err := h.h.Write(d); err != nil {
@@ -48,3 +53,69 @@ func H2(pkS, epkC, c1, c2, k1, k2 []byte) ([]byte, error) {
 	domain := []byte("TIMKE-H2")
 	return h.Hash(domain, pkS, epkC, c1, c2, k1, k2)
 }
+
+// H3 K_main = H3(psk, epk_C, C_2, K_2) for resumed sessions. The KEM2 inputs
+// are empty when resuming without forward secrecy.
+func H3(psk, epkC, c2, k2 []byte) ([]byte, error) {
+	// The KEM2 inputs are either all present or all absent
+	hasEpk, hasC2, hasK2 := len(epkC) > 0, len(c2) > 0, len(k2) > 0
+	if len(psk) == 0 || hasEpk != hasC2 || hasC2 != hasK2 {
+		return nil, errors.New("invalid input to H3")
+	}
+
+	return hashLengthPrefixed("TIMKE-H3", psk, epkC, c2, k2)
+}
+
+// H4 K_main' = H4(K_main, pk_C, C_3, K_3) folds the encapsulation to the
+// client's long-term key into the session key
+func H4(kMain, pkC, c3, k3 []byte) ([]byte, error) {
+	if len(kMain) == 0 || len(pkC) == 0 || len(c3) == 0 || len(k3) == 0 {
+		return nil, errors.New("invalid input to H4")
+	}
+
+	return hashLengthPrefixed("TIMKE-H4", kMain, pkC, c3, k3)
+}
+
+// hashLengthPrefixed hashes inputs that may be empty or vary in size, so
+// every input is length prefixed
+func hashLengthPrefixed(domain string, data ...[]byte) ([]byte, error) {
+	inputs := [][]byte{[]byte(domain)}
+	for _, in := range data {
+		inputs = append(inputs, binary.BigEndian.AppendUint32(nil, uint32(len(in))), in)
+	}
+	return NewHash().Hash(inputs...)
+}
+
+// ExpandLabel derives length bytes from secret for the given label and
+// context, in the style of HKDF-Expand-Label but built on SHAKE256
+func ExpandLabel(secret []byte, label string, context []byte, length int) []byte {
+	fullLabel := "TIMKE " + label
+
+	var header [4]byte
+	h := sha3.NewShake256()
+	binary.BigEndian.PutUint32(header[:], uint32(length))
+	_, _ = h.Write(header[:])
+	binary.BigEndian.PutUint32(header[:], uint32(len(fullLabel)))
+	_, _ = h.Write(header[:])
+	_, _ = h.Write([]byte(fullLabel))
+	binary.BigEndian.PutUint32(header[:], uint32(len(context)))
+	_, _ = h.Write(header[:])
+	_, _ = h.Write(context)
+	_, _ = h.Write(secret)
+
+	out := make([]byte, length)
+	_, _ = h.Read(out)
+	return out
+}
+
+// MAC computes HMAC-SHA3-512 over data under key
+func MAC(key []byte, data ...[]byte) []byte {
+	m := hmac.New(func() hash.Hash {
+		h := sha3.New512()
+		return &h
+	}, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
@@ -0,0 +1,205 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// Record content types
+const (
+	RecordTypeHandshake       byte = 22
+	RecordTypeApplicationData byte = 23
+)
+
+// RecordHeaderSize is the size of the type, sequence number and length header
+// that precedes every sealed record and is authenticated as additional data
+const RecordHeaderSize = 1 + 8 + 4
+
+// replayWindowSize is the number of sequence numbers below the highest one
+// seen that may still arrive out of order
+const replayWindowSize = 64
+
+var (
+	ErrReplayedRecord    = errors.New("replayed record")
+	ErrRecordOutOfWindow = errors.New("record outside replay window")
+	ErrKeyLimitReached   = errors.New("key usage limit reached, rekey required")
+	ErrInvalidRecord     = errors.New("invalid record")
+)
+
+// RecordCipher protects records in one direction with a traffic secret. Each
+// record nonce is the static IV XORed with a 64-bit sequence number, as in
+// TLS 1.3. The sequence number travels in the record header so that the
+// receiver can detect replayed and reordered records. A RecordCipher is safe
+// for concurrent use.
+type RecordCipher struct {
+	aead       cipher.AEAD
+	iv         []byte
+	maxRecords uint64
+
+	// mu guards the sequence number and the replay window, so that concurrent
+	// Seals never share a nonce and concurrent Opens never accept a replay
+	mu sync.Mutex
+
+	// Sending side
+	seq uint64
+
+	// Receiving side
+	received bool
+	highest  uint64
+	window   uint64 // bit i set means highest-i has been received
+}
+
+// NewRecordCipher derives the record key and IV for suite from trafficSecret
+func NewRecordCipher(suite CipherSuite, trafficSecret []byte) (*RecordCipher, error) {
+	key := ExpandLabel(trafficSecret, "key", nil, suite.KeySize())
+	defer Zeroize(key)
+
+	aead, err := suite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordCipher{
+		aead:       aead,
+		iv:         ExpandLabel(trafficSecret, "iv", nil, aead.NonceSize()),
+		maxRecords: suite.MaxRecords(),
+	}, nil
+}
+
+func (r *RecordCipher) nonce(seq uint64) []byte {
+	nonce := make([]byte, len(r.iv))
+	copy(nonce, r.iv)
+
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	for i := range seqBytes {
+		nonce[len(nonce)-8+i] ^= seqBytes[i]
+	}
+
+	return nonce
+}
+
+// Seal encrypts plaintext into a record of the given content type
+func (r *RecordCipher) Seal(contentType byte, plaintext []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seq >= r.maxRecords {
+		return nil, ErrKeyLimitReached
+	}
+
+	record := make([]byte, RecordHeaderSize, RecordHeaderSize+len(plaintext)+r.aead.Overhead())
+	record[0] = contentType
+	binary.BigEndian.PutUint64(record[1:9], r.seq)
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(plaintext)+r.aead.Overhead()))
+
+	record = r.aead.Seal(record, r.nonce(r.seq), plaintext, record[:RecordHeaderSize])
+	r.seq++
+
+	return record, nil
+}
+
+// Open authenticates and decrypts a single record, rejecting sequence numbers
+// that were already received or that fall behind the replay window
+func (r *RecordCipher) Open(record []byte) (byte, []byte, error) {
+	if len(record) < RecordHeaderSize+r.aead.Overhead() {
+		return 0, nil, ErrInvalidRecord
+	}
+
+	contentType := record[0]
+	seq := binary.BigEndian.Uint64(record[1:9])
+	length := binary.BigEndian.Uint32(record[9:13])
+	if int(length) != len(record)-RecordHeaderSize {
+		return 0, nil, ErrInvalidRecord
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.checkReplay(seq); err != nil {
+		return 0, nil, err
+	}
+
+	plaintext, err := r.aead.Open(nil, r.nonce(seq), record[RecordHeaderSize:], record[:RecordHeaderSize])
+	if err != nil {
+		return 0, nil, ErrDecryptionFailed
+	}
+
+	// Only authenticated records move the window
+	r.markReceived(seq)
+
+	return contentType, plaintext, nil
+}
+
+// Overhead is the number of bytes a sealed record adds to its plaintext
+func (r *RecordCipher) Overhead() int {
+	return RecordHeaderSize + r.aead.Overhead()
+}
+
+// Sequence returns the sequence number of the next record to be sealed
+func (r *RecordCipher) Sequence() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.seq
+}
+
+// Remaining returns the number of records that may still be sealed
+func (r *RecordCipher) Remaining() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seq >= r.maxRecords {
+		return 0
+	}
+	return r.maxRecords - r.seq
+}
+
+// Exhausted reports whether the sending key has reached its usage limit
+func (r *RecordCipher) Exhausted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.seq >= r.maxRecords
+}
+
+func (r *RecordCipher) checkReplay(seq uint64) error {
+	if !r.received || seq > r.highest {
+		return nil
+	}
+
+	diff := r.highest - seq
+	if diff >= replayWindowSize {
+		return ErrRecordOutOfWindow
+	}
+	if r.window&(1<<diff) != 0 {
+		return ErrReplayedRecord
+	}
+
+	return nil
+}
+
+func (r *RecordCipher) markReceived(seq uint64) {
+	if !r.received {
+		r.received = true
+		r.highest = seq
+		r.window = 1
+		return
+	}
+
+	if seq > r.highest {
+		shift := seq - r.highest
+		if shift >= replayWindowSize {
+			r.window = 0
+		} else {
+			r.window <<= shift
+		}
+		r.window |= 1
+		r.highest = seq
+		return
+	}
+
+	r.window |= 1 << (r.highest - seq)
+}
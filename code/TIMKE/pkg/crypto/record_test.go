@@ -0,0 +1,180 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func newRecordCipherPair(t *testing.T, suiteName string) (*RecordCipher, *RecordCipher) {
+	t.Helper()
+
+	suite, err := GetCipherSuite(suiteName)
+	if err != nil {
+		t.Fatalf("GetCipherSuite failed: %v", err)
+	}
+
+	secret := bytes.Repeat([]byte{0x17}, 64)
+	sender, err := NewRecordCipher(suite, secret)
+	if err != nil {
+		t.Fatalf("NewRecordCipher failed: %v", err)
+	}
+	receiver, err := NewRecordCipher(suite, secret)
+	if err != nil {
+		t.Fatalf("NewRecordCipher failed: %v", err)
+	}
+
+	return sender, receiver
+}
+
+func TestRecordCipherRoundTrip(t *testing.T) {
+	for _, name := range DefaultCipherSuites() {
+		t.Run(name, func(t *testing.T) {
+			sender, receiver := newRecordCipherPair(t, name)
+
+			for i := 0; i < 3; i++ {
+				plaintext := []byte("record payload")
+				record, err := sender.Seal(RecordTypeApplicationData, plaintext)
+				if err != nil {
+					t.Fatalf("Seal failed: %v", err)
+				}
+
+				contentType, opened, err := receiver.Open(record)
+				if err != nil {
+					t.Fatalf("Open failed: %v", err)
+				}
+				if contentType != RecordTypeApplicationData {
+					t.Errorf("Expected content type %d, got %d", RecordTypeApplicationData, contentType)
+				}
+				if !bytes.Equal(opened, plaintext) {
+					t.Errorf("Opened %q, want %q", opened, plaintext)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordCipherNoncesAreDistinct(t *testing.T) {
+	sender, _ := newRecordCipherPair(t, SuiteAES256GCM)
+
+	first, _ := sender.Seal(RecordTypeApplicationData, []byte("same"))
+	second, _ := sender.Seal(RecordTypeApplicationData, []byte("same"))
+	if bytes.Equal(first[RecordHeaderSize:], second[RecordHeaderSize:]) {
+		t.Error("Identical plaintexts produced identical ciphertexts")
+	}
+}
+
+func TestRecordCipherConcurrentSeal(t *testing.T) {
+	sender, receiver := newRecordCipherPair(t, SuiteChaCha20Poly1305)
+
+	const goroutines, perGoroutine = 8, 64
+	records := make([][]byte, goroutines*perGoroutine)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				record, err := sender.Seal(RecordTypeApplicationData, []byte("data"))
+				if err != nil {
+					t.Errorf("Seal failed: %v", err)
+					return
+				}
+				records[g*perGoroutine+i] = record
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for _, record := range records {
+		seq := binary.BigEndian.Uint64(record[1:9])
+		if seen[seq] {
+			t.Fatalf("Sequence number %d sealed twice", seq)
+		}
+		seen[seq] = true
+	}
+
+	// Every record opens exactly once, whichever goroutine gets to it first
+	var opened sync.Map
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, record := range records {
+				if _, _, err := receiver.Open(record); err == nil {
+					if _, dup := opened.LoadOrStore(string(record), true); dup {
+						t.Errorf("Record accepted twice")
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRecordCipherReplayWindow(t *testing.T) {
+	sender, receiver := newRecordCipherPair(t, SuiteChaCha20Poly1305)
+
+	var records [][]byte
+	for i := 0; i < replayWindowSize+2; i++ {
+		record, err := sender.Seal(RecordTypeApplicationData, []byte{byte(i)})
+		if err != nil {
+			t.Fatalf("Seal failed: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	// Reordering inside the window is accepted
+	if _, _, err := receiver.Open(records[1]); err != nil {
+		t.Fatalf("Open of record 1 failed: %v", err)
+	}
+	if _, _, err := receiver.Open(records[0]); err != nil {
+		t.Fatalf("Open of reordered record 0 failed: %v", err)
+	}
+
+	// Replays are rejected
+	if _, _, err := receiver.Open(records[1]); !errors.Is(err, ErrReplayedRecord) {
+		t.Errorf("Expected ErrReplayedRecord, got %v", err)
+	}
+
+	// Records behind the window are rejected
+	last := len(records) - 1
+	if _, _, err := receiver.Open(records[last]); err != nil {
+		t.Fatalf("Open of record %d failed: %v", last, err)
+	}
+	if _, _, err := receiver.Open(records[last-replayWindowSize]); !errors.Is(err, ErrRecordOutOfWindow) {
+		t.Errorf("Expected ErrRecordOutOfWindow, got %v", err)
+	}
+
+	// A forged record does not advance the window
+	forged := append([]byte(nil), records[2]...)
+	forged[len(forged)-1] ^= 0x01
+	if _, _, err := receiver.Open(forged); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed, got %v", err)
+	}
+	if _, _, err := receiver.Open(records[2]); err != nil {
+		t.Errorf("Open of genuine record after forgery failed: %v", err)
+	}
+}
+
+func TestRecordCipherUsageLimit(t *testing.T) {
+	sender, _ := newRecordCipherPair(t, SuiteAES256GCM)
+	sender.maxRecords = 2
+
+	for i := 0; i < 2; i++ {
+		if _, err := sender.Seal(RecordTypeApplicationData, []byte("data")); err != nil {
+			t.Fatalf("Seal %d failed: %v", i, err)
+		}
+	}
+
+	if !sender.Exhausted() {
+		t.Error("Expected sender to be exhausted")
+	}
+	if _, err := sender.Seal(RecordTypeApplicationData, []byte("data")); !errors.Is(err, ErrKeyLimitReached) {
+		t.Errorf("Expected ErrKeyLimitReached, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+)
+
+const redacted = "[REDACTED]"
+
+var memoryLocking atomic.Bool
+
+// SetMemoryLocking controls whether new Secrets are pinned in RAM with mlock
+// so they are never written to swap. Locking is best effort: it is only
+// implemented on Linux and silently skipped when RLIMIT_MEMLOCK is exhausted.
+func SetMemoryLocking(enabled bool) {
+	memoryLocking.Store(enabled)
+}
+
+// Secret holds key material that is wiped explicitly once it is no longer
+// needed and that never prints its contents through fmt or loggers
+type Secret struct {
+	b      []byte
+	locked bool
+}
+
+// NewSecret takes ownership of b. The caller must not use b afterwards
+// except through the returned Secret.
+func NewSecret(b []byte) *Secret {
+	s := &Secret{b: b}
+	if memoryLocking.Load() && len(b) > 0 {
+		s.locked = lockMemory(b) == nil
+	}
+	return s
+}
+
+// CopySecret returns a Secret holding a copy of b
+func CopySecret(b []byte) *Secret {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return NewSecret(c)
+}
+
+// Bytes returns the underlying key material, which stays valid until Destroy
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+func (s *Secret) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.b)
+}
+
+// Destroy zeroes and unlocks the key material. It is safe to call more than
+// once and on a nil Secret.
+func (s *Secret) Destroy() {
+	if s == nil || s.b == nil {
+		return
+	}
+
+	Zeroize(s.b)
+	if s.locked {
+		_ = unlockMemory(s.b)
+		s.locked = false
+	}
+	s.b = nil
+}
+
+func (s *Secret) String() string {
+	return redacted
+}
+
+func (s *Secret) GoString() string {
+	return redacted
+}
+
+// Format keeps every fmt verb, including %x and %v, from printing key material
+func (s *Secret) Format(f fmt.State, verb rune) {
+	_, _ = io.WriteString(f, redacted)
+}
+
+// Zeroize overwrites b with zeros in a way the compiler will not elide
+func Zeroize(b []byte) {
+	clear(b)
+	runtime.KeepAlive(b)
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+package crypto
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// mlock works on whole pages, and small Secrets share pages. lockedPages
+// counts the Secrets locking each page so that a page is only unlocked once
+// the last of them is destroyed.
+var (
+	lockedMu    sync.Mutex
+	lockedPages = make(map[uintptr]int)
+	pageSize    = uintptr(syscall.Getpagesize())
+)
+
+// pageRange returns the addresses of the first and last pages spanned by b
+func pageRange(b []byte) (first, last uintptr) {
+	start := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	first = start &^ (pageSize - 1)
+	last = (start + uintptr(len(b)) - 1) &^ (pageSize - 1)
+	return first, last
+}
+
+func lockMemory(b []byte) error {
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+
+	if err := syscall.Mlock(b); err != nil {
+		return err
+	}
+	first, last := pageRange(b)
+	for page := first; page <= last; page += pageSize {
+		lockedPages[page]++
+	}
+	return nil
+}
+
+func unlockMemory(b []byte) error {
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+
+	var err error
+	first, last := pageRange(b)
+	for page := first; page <= last; page += pageSize {
+		if lockedPages[page] > 1 {
+			lockedPages[page]--
+			continue
+		}
+		delete(lockedPages, page)
+		if _, _, errno := syscall.Syscall(syscall.SYS_MUNLOCK, page, pageSize, 0); errno != 0 && err == nil {
+			err = errno
+		}
+	}
+	return err
+}
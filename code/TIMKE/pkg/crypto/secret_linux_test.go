@@ -0,0 +1,38 @@
+//go:build linux
+
+package crypto
+
+import "testing"
+
+func TestSecretSharedPageStaysLocked(t *testing.T) {
+	SetMemoryLocking(true)
+	defer SetMemoryLocking(false)
+
+	buf := make([]byte, 64)
+	first := NewSecret(buf[:32])
+	second := NewSecret(buf[32:])
+	if !first.locked || !second.locked {
+		t.Skip("RLIMIT_MEMLOCK too small to lock test secrets")
+	}
+
+	page, _ := pageRange(buf)
+	count := func() int {
+		lockedMu.Lock()
+		defer lockedMu.Unlock()
+		return lockedPages[page]
+	}
+
+	if got := count(); got < 2 {
+		t.Fatalf("Expected the shared page to be locked twice, got %d", got)
+	}
+
+	first.Destroy()
+	if got := count(); got < 1 {
+		t.Errorf("Destroying one secret unlocked the page still used by another")
+	}
+
+	second.Destroy()
+	if got := count(); got != 0 {
+		t.Errorf("Expected the page to be unlocked after both secrets, got %d", got)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package crypto
+
+import "errors"
+
+var errMemoryLockingUnsupported = errors.New("memory locking not supported on this platform")
+
+func lockMemory(b []byte) error {
+	return errMemoryLockingUnsupported
+}
+
+func unlockMemory(b []byte) error {
+	return nil
+}
@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedaction(t *testing.T) {
+	secret := NewSecret([]byte{0xde, 0xad, 0xbe, 0xef})
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%x", "%X", "%q", "%d"} {
+		out := fmt.Sprintf(format, secret)
+		if out != redacted {
+			t.Errorf("Sprintf(%q) = %q, want %q", format, out, redacted)
+		}
+		if strings.Contains(strings.ToLower(out), "dead") {
+			t.Errorf("Sprintf(%q) leaked key material: %q", format, out)
+		}
+	}
+
+	wrapped := fmt.Sprintf("%v", struct{ Key *Secret }{secret})
+	if strings.Contains(wrapped, "dead") {
+		t.Errorf("Secret leaked through struct formatting: %q", wrapped)
+	}
+}
+
+func TestSecretDestroy(t *testing.T) {
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	secret := NewSecret(key)
+
+	if !bytes.Equal(secret.Bytes(), []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("Unexpected secret bytes")
+	}
+
+	secret.Destroy()
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Errorf("Expected underlying buffer to be zeroed, got %x", key)
+	}
+	if secret.Bytes() != nil || secret.Len() != 0 {
+		t.Error("Expected destroyed secret to be empty")
+	}
+
+	// Destroy is idempotent and nil-safe
+	secret.Destroy()
+	var nilSecret *Secret
+	nilSecret.Destroy()
+	if nilSecret.Len() != 0 {
+		t.Error("Expected nil secret to be empty")
+	}
+}
+
+func TestSecretMemoryLocking(t *testing.T) {
+	SetMemoryLocking(true)
+	defer SetMemoryLocking(false)
+
+	key := bytes.Repeat([]byte{0xaa}, 64)
+	secret := NewSecret(key)
+	secret.Destroy()
+
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Errorf("Expected locked buffer to be zeroed, got %x", key)
+	}
+}
@@ -0,0 +1,85 @@
+package sha3
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Serialized states start with this magic string followed by a version byte.
+const (
+	marshalMagic   = "sha3"
+	marshalVersion = 1
+	marshaledSize  = len(marshalMagic) + 1 + 7 + 25*8 + maxRate
+)
+
+var errInvalidState = errors.New("sha3: invalid serialized state")
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding captures
+// the full sponge, so a state can be checkpointed in the middle of absorbing
+// or squeezing and resumed later with UnmarshalBinary.
+func (d *State) MarshalBinary() ([]byte, error) {
+	return d.AppendBinary(make([]byte, 0, marshaledSize))
+}
+
+// AppendBinary appends the encoding of MarshalBinary to b.
+func (d *State) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, marshalMagic...)
+	b = append(b, marshalVersion)
+
+	turbo := byte(0)
+	if d.turbo {
+		turbo = 1
+	}
+	b = append(b,
+		byte(d.rate),
+		d.dsbyte,
+		byte(d.outputLen),
+		byte(d.state),
+		turbo,
+		byte(d.bufo),
+		byte(d.bufe),
+	)
+
+	for _, lane := range d.a {
+		b = binary.LittleEndian.AppendUint64(b, lane)
+	}
+
+	return append(b, d.storage.asBytes()[:]...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (d *State) UnmarshalBinary(b []byte) error {
+	if len(b) != marshaledSize || string(b[:len(marshalMagic)]) != marshalMagic {
+		return errInvalidState
+	}
+	b = b[len(marshalMagic):]
+	if b[0] != marshalVersion {
+		return errInvalidState
+	}
+	b = b[1:]
+
+	rate, dsbyte, outputLen := int(b[0]), b[1], int(b[2])
+	direction, turbo := spongeDirection(b[3]), b[4]
+	bufo, bufe := int(b[5]), int(b[6])
+	if rate == 0 || rate > maxRate || rate%8 != 0 ||
+		(direction != spongeAbsorbing && direction != spongeSqueezing) ||
+		turbo > 1 || bufo > bufe || bufe > rate {
+		return errInvalidState
+	}
+	b = b[7:]
+
+	d.rate = rate
+	d.dsbyte = dsbyte
+	d.outputLen = outputLen
+	d.state = direction
+	d.turbo = turbo == 1
+	d.bufo = bufo
+	d.bufe = bufe
+
+	for i := range d.a {
+		d.a[i] = binary.LittleEndian.Uint64(b[i*8:])
+	}
+	copy(d.storage.asBytes()[:], b[25*8:])
+
+	return nil
+}
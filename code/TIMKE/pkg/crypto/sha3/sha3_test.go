@@ -283,3 +283,60 @@ func TestTurboShake128(t *testing.T) {
 
 	// TODO all tests
 }
+
+// TestMarshalUnmarshal checks that a state restored from its encoding
+// produces the same output as the original, both while absorbing and while
+// squeezing.
+func TestMarshalUnmarshal(t *testing.T) {
+	msg := make([]byte, 500)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	for _, newState := range []func() State{New256, New512, NewShake128, NewShake256} {
+		for _, split := range []int{0, 1, 135, 136, 137, 499} {
+			original := newState()
+			_, _ = original.Write(msg[:split])
+
+			encoded, err := original.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			var restored State
+			if err := restored.UnmarshalBinary(encoded); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+
+			_, _ = original.Write(msg[split:])
+			_, _ = restored.Write(msg[split:])
+			want := make([]byte, 100)
+			got := make([]byte, 100)
+			_, _ = original.Read(want[:30])
+			_, _ = restored.Read(got[:30])
+
+			// Checkpoint again while squeezing.
+			encoded, _ = restored.MarshalBinary()
+			var squeezing State
+			if err := squeezing.UnmarshalBinary(encoded); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			_, _ = original.Read(want[30:])
+			_, _ = squeezing.Read(got[30:])
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("rate %d, split %d: restored state diverged", original.rate, split)
+			}
+		}
+	}
+
+	var s State
+	if err := s.UnmarshalBinary([]byte("sha3")); err == nil {
+		t.Error("UnmarshalBinary accepted a truncated state")
+	}
+	shake := NewShake256()
+	encoded, _ := shake.MarshalBinary()
+	encoded[len(marshalMagic)+1] = 0
+	if err := s.UnmarshalBinary(encoded); err == nil {
+		t.Error("UnmarshalBinary accepted a zero rate")
+	}
+}
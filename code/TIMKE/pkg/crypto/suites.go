@@ -0,0 +1,209 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+
+	"TIMKE/pkg/crypto/drbg"
+)
+
+// Names of the built-in cipher suites, as carried in ClientHello and ServerResponse
+const (
+	SuiteAES256GCM         = "AES-256-GCM"
+	SuiteChaCha20Poly1305  = "ChaCha20-Poly1305"
+	SuiteXChaCha20Poly1305 = "XChaCha20-Poly1305"
+	SuiteAES256GCMSIV      = "AES-256-GCM-SIV"
+)
+
+// CipherSuite is a SymmetricEncryption backed by a named AEAD that can be
+// negotiated during the handshake
+type CipherSuite interface {
+	SymmetricEncryption
+
+	Name() string
+	KeySize() int
+	NonceSize() int
+	NewAEAD(key []byte) (cipher.AEAD, error)
+
+	// MaxRecords is the number of records that may be sealed under one key
+	// before the AEAD's confidentiality or integrity bounds are at risk
+	MaxRecords() uint64
+}
+
+var cipherSuiteRegistry = &CipherSuiteRegistry{
+	suites: make(map[string]func() CipherSuite),
+}
+
+type CipherSuiteRegistry struct {
+	mu     sync.RWMutex
+	suites map[string]func() CipherSuite
+}
+
+func (r *CipherSuiteRegistry) Register(name string, constructor func() CipherSuite) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suites[name] = constructor
+}
+
+func (r *CipherSuiteRegistry) Get(name string) (CipherSuite, error) {
+	r.mu.RLock()
+	constructor, ok := r.suites[name]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("cipher suite %s not found", name)
+	}
+
+	return constructor(), nil
+}
+
+func (r *CipherSuiteRegistry) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var names []string
+	for name := range r.suites {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func RegisterCipherSuite(name string, constructor func() CipherSuite) {
+	cipherSuiteRegistry.Register(name, constructor)
+}
+
+func GetCipherSuite(name string) (CipherSuite, error) {
+	return cipherSuiteRegistry.Get(name)
+}
+
+func ListCipherSuites() []string {
+	return cipherSuiteRegistry.List()
+}
+
+func init() {
+	RegisterCipherSuite(SuiteAES256GCM, func() CipherSuite {
+		return NewAESGCM()
+	})
+	RegisterCipherSuite(SuiteChaCha20Poly1305, func() CipherSuite {
+		return newAEADSuite(SuiteChaCha20Poly1305, chacha20poly1305.KeySize, chacha20poly1305.NonceSize, 1<<62, chacha20poly1305.New)
+	})
+	RegisterCipherSuite(SuiteXChaCha20Poly1305, func() CipherSuite {
+		return newAEADSuite(SuiteXChaCha20Poly1305, chacha20poly1305.KeySize, chacha20poly1305.NonceSizeX, 1<<62, chacha20poly1305.NewX)
+	})
+	RegisterCipherSuite(SuiteAES256GCMSIV, func() CipherSuite {
+		// Per-nonce key derivation lifts the GCM bounds considerably (RFC 8452, Section 9)
+		return newAEADSuite(SuiteAES256GCMSIV, 32, gcmSIVNonceSize, 1<<48, NewGCMSIV)
+	})
+}
+
+// hasAESHardware reports whether AES-GCM is expected to be faster than
+// ChaCha20-Poly1305 on this machine, following the same heuristic as crypto/tls
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESCBC && cpu.S390X.HasAESCTR &&
+			(cpu.S390X.HasGHASH || cpu.S390X.HasAESGCM)
+	default:
+		return false
+	}
+}
+
+// DefaultCipherSuites returns the built-in suites in preference order. Machines
+// without AES acceleration prefer ChaCha20-Poly1305.
+func DefaultCipherSuites() []string {
+	if hasAESHardware() {
+		return []string{SuiteAES256GCM, SuiteChaCha20Poly1305, SuiteAES256GCMSIV, SuiteXChaCha20Poly1305}
+	}
+	return []string{SuiteChaCha20Poly1305, SuiteXChaCha20Poly1305, SuiteAES256GCM, SuiteAES256GCMSIV}
+}
+
+// aeadSuite is a generic CipherSuite that prefixes a random nonce, drawn from
+// drbg.Reader, to each ciphertext. Handshake records use RecordCipher instead.
+type aeadSuite struct {
+	name       string
+	keySize    int
+	nonceSize  int
+	maxRecords uint64
+	newAEAD    func(key []byte) (cipher.AEAD, error)
+	random     io.Reader
+}
+
+func newAEADSuite(name string, keySize, nonceSize int, maxRecords uint64, newAEAD func(key []byte) (cipher.AEAD, error)) *aeadSuite {
+	return &aeadSuite{
+		name:       name,
+		keySize:    keySize,
+		nonceSize:  nonceSize,
+		maxRecords: maxRecords,
+		newAEAD:    newAEAD,
+		random:     drbg.Reader,
+	}
+}
+
+func (a *aeadSuite) Name() string { return a.name }
+
+func (a *aeadSuite) KeySize() int { return a.keySize }
+
+func (a *aeadSuite) NonceSize() int { return a.nonceSize }
+
+func (a *aeadSuite) MaxRecords() uint64 { return a.maxRecords }
+
+func (a *aeadSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != a.keySize {
+		return nil, ErrInvalidKey
+	}
+	return a.newAEAD(key)
+}
+
+func (a *aeadSuite) normalizeKey(key []byte) []byte {
+	if len(key) == a.keySize {
+		return key
+	}
+
+	// Handshake keys are 64 bytes, compress them to the suite key size
+	h := sha256.Sum256(key)
+	return h[:a.keySize]
+}
+
+func (a *aeadSuite) Encrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := a.NewAEAD(a.normalizeKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, a.nonceSize, a.nonceSize+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(a.random, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (a *aeadSuite) Decrypt(key, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < a.nonceSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	aead, err := a.NewAEAD(a.normalizeKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:a.nonceSize], ciphertext[a.nonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return plaintext, nil
+}
@@ -3,10 +3,11 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"io"
+
+	"TIMKE/pkg/crypto/drbg"
 )
 
 var (
@@ -29,10 +30,32 @@ type AESGCM struct {
 func NewAESGCM() *AESGCM {
 	return &AESGCM{
 		nonceSize: 12,
-		random:    rand.Reader,
+		random:    drbg.Reader,
 	}
 }
 
+func (a *AESGCM) Name() string { return SuiteAES256GCM }
+
+func (a *AESGCM) KeySize() int { return 32 }
+
+func (a *AESGCM) NonceSize() int { return a.nonceSize }
+
+// MaxRecords stays below the 2^24.5 full-size records RFC 8446 allows for AES-GCM
+func (a *AESGCM) MaxRecords() uint64 { return 1 << 24 }
+
+func (a *AESGCM) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != a.KeySize() {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
 func (a *AESGCM) normalizeKey(key []byte) []byte {
 	if len(key) == 16 || len(key) == 24 || len(key) == 32 {
 		return key
@@ -100,6 +123,11 @@ func (a *AESGCM) Decrypt(key, ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// DefaultSymmetricEncryption returns the most preferred cipher suite for this machine
 func DefaultSymmetricEncryption() SymmetricEncryption {
-	return NewAESGCM()
+	suite, err := GetCipherSuite(DefaultCipherSuites()[0])
+	if err != nil {
+		return NewAESGCM()
+	}
+	return suite
 }
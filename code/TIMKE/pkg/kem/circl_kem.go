@@ -101,12 +101,19 @@ func (k *CirclKEM) Setup() Parameters {
 }
 
 func (k *CirclKEM) GenerateKeyPair(params Parameters, rand io.Reader) (PublicKey, PrivateKey, error) {
-	// circl use crypto/rand to generate random numbers internally, we ignore the rand parameter here
-	pk, sk, err := k.scheme.GenerateKeyPair()
-	if err != nil {
+	if rand == nil {
+		rand = DefaultRand
+	}
+
+	// Draw the seed ourselves so that keys come from the caller's source
+	seed := make([]byte, k.scheme.SeedSize())
+	defer clear(seed)
+	if _, err := io.ReadFull(rand, seed); err != nil {
 		return nil, nil, err
 	}
 
+	pk, sk := k.scheme.DeriveKeyPair(seed)
+
 	return &CirclPublicKey{pk: pk, scheme: k.scheme}, &CirclPrivateKey{sk: sk, scheme: k.scheme}, nil
 }
 
@@ -116,7 +123,17 @@ func (k *CirclKEM) Encapsulate(pk PublicKey, rand io.Reader) ([]byte, []byte, er
 		return nil, nil, errors.New("invalid public key type")
 	}
 
-	return k.scheme.Encapsulate(circlPK.pk)
+	if rand == nil {
+		rand = DefaultRand
+	}
+
+	seed := make([]byte, k.scheme.EncapsulationSeedSize())
+	defer clear(seed)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, nil, err
+	}
+
+	return k.scheme.EncapsulateDeterministically(circlPK.pk, seed)
 }
 
 func (k *CirclKEM) Decapsulate(sk PrivateKey, ciphertext []byte) ([]byte, error) {
@@ -124,10 +141,21 @@ func (k *CirclKEM) Decapsulate(sk PrivateKey, ciphertext []byte) ([]byte, error)
 	if !ok {
 		return nil, errors.New("invalid private key type")
 	}
+	if circlSK.sk == nil {
+		return nil, ErrInvalidPrivateKey
+	}
 
 	return k.scheme.Decapsulate(circlSK.sk, ciphertext)
 }
 
+func (k *CirclKEM) PublicKeySize() int {
+	return k.scheme.PublicKeySize()
+}
+
+func (k *CirclKEM) CiphertextSize() int {
+	return k.scheme.CiphertextSize()
+}
+
 func (k *CirclKEM) ParsePublicKey(data []byte) (PublicKey, error) {
 	pk, err := k.scheme.UnmarshalBinaryPublicKey(data)
 	if err != nil {
@@ -166,6 +194,9 @@ type CirclPrivateKey struct {
 }
 
 func (sk *CirclPrivateKey) Bytes() []byte {
+	if sk.sk == nil {
+		return nil
+	}
 	data, _ := sk.sk.MarshalBinary()
 	return data
 }
@@ -175,8 +206,18 @@ func (sk *CirclPrivateKey) Algorithm() string {
 }
 
 func (sk *CirclPrivateKey) PublicKey() PublicKey {
+	if sk.sk == nil {
+		return nil
+	}
 	return &CirclPublicKey{
 		pk:     sk.sk.Public(),
 		scheme: sk.scheme,
 	}
 }
+
+// Destroy drops the reference to the circl key. circl does not expose its
+// internal buffers, so they are reclaimed by the garbage collector rather
+// than wiped in place.
+func (sk *CirclPrivateKey) Destroy() {
+	sk.sk = nil
+}
@@ -0,0 +1,82 @@
+package kem
+
+import (
+	"context"
+	"io"
+)
+
+// ContextKEM is implemented by KEMs whose operations can be abandoned when
+// their context is done, such as those of a remote key provider. None of the
+// built-in KEMs implements it: their operations cannot be interrupted, and
+// the context is only checked before and after each of them.
+type ContextKEM interface {
+	GenerateKeyPairContext(ctx context.Context, params Parameters, rand io.Reader) (PublicKey, PrivateKey, error)
+
+	EncapsulateContext(ctx context.Context, pk PublicKey, rand io.Reader) (ciphertext []byte, sharedSecret []byte, err error)
+
+	DecapsulateContext(ctx context.Context, sk PrivateKey, ciphertext []byte) ([]byte, error)
+}
+
+// GenerateKeyPairContext generates a key pair with k unless ctx is done. A KEM
+// that does not implement ContextKEM runs to completion, and its key pair is
+// destroyed if ctx was done meanwhile.
+func GenerateKeyPairContext(ctx context.Context, k KEM, params Parameters, rand io.Reader) (PublicKey, PrivateKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if ck, ok := k.(ContextKEM); ok {
+		return ck.GenerateKeyPairContext(ctx, params, rand)
+	}
+
+	pk, sk, err := k.GenerateKeyPair(params, rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		sk.Destroy()
+		return nil, nil, err
+	}
+	return pk, sk, nil
+}
+
+// EncapsulateContext encapsulates to pk with k unless ctx is done, as
+// GenerateKeyPairContext
+func EncapsulateContext(ctx context.Context, k KEM, pk PublicKey, rand io.Reader) ([]byte, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if ck, ok := k.(ContextKEM); ok {
+		return ck.EncapsulateContext(ctx, pk, rand)
+	}
+
+	ciphertext, sharedSecret, err := k.Encapsulate(pk, rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		clear(sharedSecret)
+		return nil, nil, err
+	}
+	return ciphertext, sharedSecret, nil
+}
+
+// DecapsulateContext decapsulates ciphertext with sk and k unless ctx is
+// done, as GenerateKeyPairContext
+func DecapsulateContext(ctx context.Context, k KEM, sk PrivateKey, ciphertext []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ck, ok := k.(ContextKEM); ok {
+		return ck.DecapsulateContext(ctx, sk, ciphertext)
+	}
+
+	sharedSecret, err := k.Decapsulate(sk, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		clear(sharedSecret)
+		return nil, err
+	}
+	return sharedSecret, nil
+}
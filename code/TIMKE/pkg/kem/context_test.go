@@ -0,0 +1,85 @@
+package kem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// blockingKEM is a key provider that only answers once its context is done
+type blockingKEM struct {
+	KEM
+}
+
+func (k *blockingKEM) GenerateKeyPairContext(ctx context.Context, params Parameters, rand io.Reader) (PublicKey, PrivateKey, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func (k *blockingKEM) EncapsulateContext(ctx context.Context, pk PublicKey, rand io.Reader) ([]byte, []byte, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func (k *blockingKEM) DecapsulateContext(ctx context.Context, sk PrivateKey, ciphertext []byte) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestContextOperations(t *testing.T) {
+	k, err := GetKEM("ML-KEM-768")
+	if err != nil {
+		t.Fatalf("Failed to get KEM: %v", err)
+	}
+	ctx := context.Background()
+
+	pk, sk, err := GenerateKeyPairContext(ctx, k, k.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	ciphertext, sharedSecret, err := EncapsulateContext(ctx, k, pk, nil)
+	if err != nil {
+		t.Fatalf("Failed to encapsulate: %v", err)
+	}
+	decapsulated, err := DecapsulateContext(ctx, k, sk, ciphertext)
+	if err != nil {
+		t.Fatalf("Failed to decapsulate: %v", err)
+	}
+	if string(decapsulated) != string(sharedSecret) {
+		t.Error("Shared secrets differ")
+	}
+
+	t.Run("Canceled", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, _, err := GenerateKeyPairContext(canceled, k, k.Setup(), nil); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled from key generation, got %v", err)
+		}
+		if _, _, err := EncapsulateContext(canceled, k, pk, nil); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled from encapsulation, got %v", err)
+		}
+		if _, err := DecapsulateContext(canceled, k, sk, ciphertext); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled from decapsulation, got %v", err)
+		}
+	})
+
+	t.Run("ContextKEM", func(t *testing.T) {
+		// The provider is interrupted, not waited for
+		blocking := &blockingKEM{KEM: k}
+		deadline, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		if _, _, err := GenerateKeyPairContext(deadline, blocking, k.Setup(), nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded from key generation, got %v", err)
+		}
+		if _, _, err := EncapsulateContext(deadline, blocking, pk, nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded from encapsulation, got %v", err)
+		}
+		if _, err := DecapsulateContext(deadline, blocking, sk, ciphertext); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded from decapsulation, got %v", err)
+		}
+	})
+}
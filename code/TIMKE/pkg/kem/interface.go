@@ -1,9 +1,10 @@
 package kem
 
 import (
-	cryptoRand "crypto/rand"
 	"errors"
 	"io"
+
+	"TIMKE/pkg/crypto/drbg"
 )
 
 type Parameters struct {
@@ -20,6 +21,12 @@ type PrivateKey interface {
 	Bytes() []byte
 	Algorithm() string
 	PublicKey() PublicKey
+
+	// Destroy releases the key material. The key must not be used afterwards.
+	// Implementations wipe the material where they own its buffers; the circl
+	// and OW-ChCCA adapters can only drop their reference, leaving the memory
+	// to the garbage collector.
+	Destroy()
 }
 
 type KEM interface {
@@ -36,7 +43,30 @@ type KEM interface {
 	ParsePrivateKey(data []byte) (PrivateKey, error)
 }
 
-var DefaultRand = cryptoRand.Reader
+// Sizer is implemented by KEMs that know the sizes of their encodings, which
+// bounds what a peer may send for them
+type Sizer interface {
+	PublicKeySize() int
+	CiphertextSize() int
+}
+
+// DefaultRand is the randomness source used when none is given
+var DefaultRand io.Reader = drbg.Reader
+
+// randChecker is implemented by KEMs that cannot encapsulate with every
+// randomness source
+type randChecker interface {
+	checkRand(rand io.Reader) error
+}
+
+// CheckRand returns ErrUnsupportedRand if k cannot encapsulate with rand, so
+// that a configuration can be refused before any handshake
+func CheckRand(k KEM, rand io.Reader) error {
+	if rc, ok := k.(randChecker); ok {
+		return rc.checkRand(rand)
+	}
+	return nil
+}
 
 var (
 	ErrorKEM = errors.New("kem error")
@@ -46,4 +76,8 @@ var (
 	ErrInvalidPrivateKey = errors.New("invalid private key")
 
 	ErrUnsupportedKEM = errors.New("unsupported KEM type")
+
+	// ErrUnsupportedRand indicates a KEM that cannot draw its randomness from
+	// the given source
+	ErrUnsupportedRand = errors.New("randomness source not supported")
 )
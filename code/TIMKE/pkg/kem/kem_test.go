@@ -3,6 +3,7 @@ package kem
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"testing"
 )
 
@@ -171,6 +172,18 @@ func TestOwChCCAKEM_InvalidInputs(t *testing.T) {
 		t.Error("Expected error for encapsulation with invalid public key, got nil")
 	}
 
+	// Test encapsulation with a randomness source it cannot use
+	_, _, err = kem.Encapsulate(pk, bytes.NewReader(make([]byte, 1024)))
+	if !errors.Is(err, ErrUnsupportedRand) {
+		t.Errorf("Expected ErrUnsupportedRand for encapsulation with an injected source, got %v", err)
+	}
+	if err := CheckRand(kem, bytes.NewReader(nil)); !errors.Is(err, ErrUnsupportedRand) {
+		t.Errorf("Expected CheckRand to report ErrUnsupportedRand, got %v", err)
+	}
+	if err := CheckRand(kem, nil); err != nil {
+		t.Errorf("Expected the default source to be supported, got %v", err)
+	}
+
 	// Test decapsulation with invalid private key
 	_, err = kem.Decapsulate(invalidSk, []byte{1, 2, 3})
 	if err == nil {
@@ -230,6 +243,36 @@ func TestOwChCCAKEM_KeySerialization(t *testing.T) {
 	}
 }
 
+func TestPrivateKeyDestroy(t *testing.T) {
+	for _, name := range []string{"ML-KEM-768", "OWChCCA-16"} {
+		t.Run(name, func(t *testing.T) {
+			k, err := GetKEM(name)
+			if err != nil {
+				t.Fatalf("GetKEM failed: %v", err)
+			}
+
+			pk, sk, err := k.GenerateKeyPair(k.Setup(), rand.Reader)
+			if err != nil {
+				t.Fatalf("Key generation failed: %v", err)
+			}
+			ct, _, err := k.Encapsulate(pk, rand.Reader)
+			if err != nil {
+				t.Fatalf("Encapsulation failed: %v", err)
+			}
+
+			sk.Destroy()
+			sk.Destroy()
+
+			if len(sk.Bytes()) != 0 {
+				t.Error("Expected destroyed key to have no bytes")
+			}
+			if _, err := k.Decapsulate(sk, ct); err == nil {
+				t.Error("Expected decapsulation with destroyed key to fail")
+			}
+		})
+	}
+}
+
 type mockPublicKey struct{}
 
 func (m *mockPublicKey) Bytes() []byte {
@@ -254,6 +297,8 @@ func (m *mockPrivateKey) PublicKey() PublicKey {
 	return &mockPublicKey{}
 }
 
+func (m *mockPrivateKey) Destroy() {}
+
 func BenchmarkOwChCCAKEM(b *testing.B) {
 	kem, err := NewOwChCCAKEM(Security16Type)
 	if err != nil {
@@ -1,6 +1,8 @@
 package kem
 
 import (
+	"crypto/rand"
+	"fmt"
 	"io"
 
 	owchcca "github.com/MingLLuo/OW-ChCCA-KEM"
@@ -65,7 +67,12 @@ func (k *OwChCCAKEM) Setup() Parameters {
 }
 
 func (k *OwChCCAKEM) GenerateKeyPair(params Parameters, randSource io.Reader) (PublicKey, PrivateKey, error) {
-	owPk, owSk, err := owchcca.GenerateKeyPair(k.owParams)
+	if randSource == nil {
+		randSource = DefaultRand
+	}
+
+	ow := owchcca.NewKEM(k.owParams)
+	owPk, owSk, err := ow.GenerateKeyPair(randSource)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -82,13 +89,27 @@ func (k *OwChCCAKEM) Encapsulate(pk PublicKey, randSource io.Reader) ([]byte, []
 		return nil, nil, ErrInvalidPublicKey
 	}
 
+	if err := k.checkRand(randSource); err != nil {
+		return nil, nil, err
+	}
+
 	ct, sk, err := owchcca.Encapsulate(owPkWrapper.owPk)
 	return ct, sk, err
 }
 
+// checkRand refuses any source but the default ones: the upstream library
+// samples encapsulation randomness from crypto/rand itself, and a caller
+// injecting a source expects reproducible ciphertexts
+func (k *OwChCCAKEM) checkRand(randSource io.Reader) error {
+	if randSource != nil && randSource != DefaultRand && randSource != rand.Reader {
+		return fmt.Errorf("%w: %s encapsulates with crypto/rand only", ErrUnsupportedRand, k.owParams.Name)
+	}
+	return nil
+}
+
 func (k *OwChCCAKEM) Decapsulate(sk PrivateKey, ciphertext []byte) ([]byte, error) {
 	owSkWrapper, ok := sk.(*OwChCCAPrivateKey)
-	if !ok {
+	if !ok || owSkWrapper.owSk == nil {
 		return nil, ErrInvalidPrivateKey
 	}
 
@@ -146,14 +167,30 @@ func (pk *OwChCCAPublicKey) Algorithm() string {
 }
 
 func (sk *OwChCCAPrivateKey) Bytes() []byte {
+	if sk.owSk == nil {
+		return nil
+	}
 	bytes, _ := sk.owSk.Bytes()
 	return bytes
 }
 
 func (sk *OwChCCAPrivateKey) Algorithm() string {
+	if sk.owSk == nil {
+		return ""
+	}
 	return sk.owSk.Public().Parameters().Name
 }
 
 func (sk *OwChCCAPrivateKey) PublicKey() PublicKey {
+	if sk.owSk == nil {
+		return nil
+	}
 	return &OwChCCAPublicKey{owPk: sk.owSk.Public()}
 }
+
+// Destroy drops the reference to the OW-ChCCA key. The matrices are owned by
+// the upstream package, so they are reclaimed by the garbage collector rather
+// than wiped in place.
+func (sk *OwChCCAPrivateKey) Destroy() {
+	sk.owSk = nil
+}
@@ -60,6 +60,49 @@ func TestKEMRegistry(t *testing.T) {
 		}
 	})
 
+	t.Run("Registered KEMs should have a security level", func(t *testing.T) {
+		for _, name := range ListKEMs() {
+			k, err := GetKEM(name)
+			if err != nil {
+				t.Fatalf("GetKEM failed for %s: %v", name, err)
+			}
+			if _, ok := Security(k.Setup().Name); !ok {
+				t.Errorf("No security level for %s", name)
+			}
+		}
+
+		level, _ := Security("ML-KEM-1024")
+		if level.Category != 5 || !level.PostQuantum {
+			t.Errorf("Expected ML-KEM-1024 to be post-quantum category 5, got %+v", level)
+		}
+	})
+
+	t.Run("ML-KEM should report its encoding sizes", func(t *testing.T) {
+		for _, name := range []string{"ML-KEM-512", "ML-KEM-768", "ML-KEM-1024"} {
+			k, err := GetKEM(name)
+			if err != nil {
+				t.Fatalf("GetKEM failed for %s: %v", name, err)
+			}
+			sizer, ok := k.(Sizer)
+			if !ok {
+				t.Fatalf("%s does not report its sizes", name)
+			}
+
+			pk, _, err := k.GenerateKeyPair(k.Setup(), nil)
+			if err != nil {
+				t.Fatalf("Failed to generate %s key pair: %v", name, err)
+			}
+			ct, _, err := k.Encapsulate(pk, nil)
+			if err != nil {
+				t.Fatalf("Failed to encapsulate with %s: %v", name, err)
+			}
+			if len(pk.Bytes()) != sizer.PublicKeySize() || len(ct) != sizer.CiphertextSize() {
+				t.Errorf("%s reports %d/%d bytes, encodes %d/%d", name,
+					sizer.PublicKeySize(), sizer.CiphertextSize(), len(pk.Bytes()), len(ct))
+			}
+		}
+	})
+
 	t.Run("RegisterKEM should add new implementation", func(t *testing.T) {
 		RegisterKEM("TestKEM", func() KEM {
 			return &testKEM{}
@@ -139,3 +182,5 @@ func (sk *testPrivateKey) Algorithm() string {
 func (sk *testPrivateKey) PublicKey() PublicKey {
 	return &testPublicKey{}
 }
+
+func (sk *testPrivateKey) Destroy() {}
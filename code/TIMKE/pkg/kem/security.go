@@ -0,0 +1,45 @@
+package kem
+
+// SecurityLevel is the strength claimed for a KEM
+type SecurityLevel struct {
+	// Category is the NIST PQC security category, 1 to 5, or 0 if the KEM
+	// is not rated
+	Category int
+	// PostQuantum is set for KEMs designed to resist quantum attacks,
+	// including hybrids with a classical component
+	PostQuantum bool
+}
+
+// securityLevels is keyed by Parameters.Name
+var securityLevels = map[string]SecurityLevel{
+	"HPKE_KEM_P256_HKDF_SHA256":   {},
+	"HPKE_KEM_P384_HKDF_SHA384":   {},
+	"HPKE_KEM_P521_HKDF_SHA512":   {},
+	"HPKE_KEM_X25519_HKDF_SHA256": {},
+	"HPKE_KEM_X448_HKDF_SHA512":   {},
+
+	"Kyber512":  {Category: 1, PostQuantum: true},
+	"Kyber768":  {Category: 3, PostQuantum: true},
+	"Kyber1024": {Category: 5, PostQuantum: true},
+
+	"ML-KEM-512":  {Category: 1, PostQuantum: true},
+	"ML-KEM-768":  {Category: 3, PostQuantum: true},
+	"ML-KEM-1024": {Category: 5, PostQuantum: true},
+
+	"Kyber512-X25519": {Category: 1, PostQuantum: true},
+	"Kyber768-X25519": {Category: 3, PostQuantum: true},
+	"X25519MLKEM768":  {Category: 3, PostQuantum: true},
+	"X-Wing":          {Category: 3, PostQuantum: true},
+
+	// Lattice based, but the parameter sets are not mapped to NIST categories
+	"OWChCCA-16": {PostQuantum: true},
+	"OWChCCA-32": {PostQuantum: true},
+	"OWChCCA-64": {PostQuantum: true},
+}
+
+// Security returns the security level of the named KEM. Unknown KEMs report
+// false and the zero level.
+func Security(name string) (SecurityLevel, bool) {
+	level, ok := securityLevels[name]
+	return level, ok
+}
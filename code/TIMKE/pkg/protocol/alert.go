@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+// AlertCode identifies the reason of an Alert. Codes shared with TLS keep
+// their TLS values.
+type AlertCode uint8
+
+const (
+	AlertUnexpectedMessage    AlertCode = 10
+	AlertHandshakeFailure     AlertCode = 40
+	AlertIllegalParameter     AlertCode = 47
+	AlertAccessDenied         AlertCode = 49
+	AlertDecodeError          AlertCode = 50
+	AlertDecryptError         AlertCode = 51
+	AlertProtocolVersion      AlertCode = 70
+	AlertInternalError        AlertCode = 80
+	AlertUnsupportedExtension AlertCode = 110
+	AlertUnsupportedKEM       AlertCode = 200
+	AlertReplayDetected       AlertCode = 201
+	AlertPolicyViolation      AlertCode = 202
+	AlertTicketRejected       AlertCode = 203
+	AlertClientAuthRequired   AlertCode = 204
+)
+
+// Errors reported for alerts that have no more specific sentinel
+var (
+	// ErrHandshakeFailure indicates that the peers share no acceptable
+	// parameters
+	ErrHandshakeFailure = errors.New("handshake failure")
+	// ErrIllegalParameter indicates a well-formed message with a field the
+	// receiver does not accept
+	ErrIllegalParameter = errors.New("illegal parameter")
+	// ErrDecryptError indicates that a ciphertext or MAC did not verify,
+	// typically because the client used the wrong server public key
+	ErrDecryptError = errors.New("decrypt error")
+	// ErrReplayDetected indicates a replayed message or record
+	ErrReplayDetected = errors.New("replay detected")
+	// ErrInternalError indicates a failure unrelated to the peer's messages
+	ErrInternalError = errors.New("internal error")
+)
+
+// alertInfo is the wire name of a code and the error it unwraps to
+type alertInfo struct {
+	name string
+	err  error
+}
+
+var alertCodes = map[AlertCode]alertInfo{
+	AlertUnexpectedMessage:    {"unexpected_message", ErrUnexpectedMessage},
+	AlertHandshakeFailure:     {"handshake_failure", ErrHandshakeFailure},
+	AlertIllegalParameter:     {"illegal_parameter", ErrIllegalParameter},
+	AlertAccessDenied:         {"access_denied", ErrClientNotAuthorized},
+	AlertDecodeError:          {"decode_error", ErrInvalidMessage},
+	AlertDecryptError:         {"decrypt_error", ErrDecryptError},
+	AlertProtocolVersion:      {"protocol_version", ErrUnsupportedVersion},
+	AlertInternalError:        {"internal_error", ErrInternalError},
+	AlertUnsupportedExtension: {"unsupported_extension", ErrUnsupportedExtension},
+	AlertUnsupportedKEM:       {"unsupported_kem", ErrNoCommonKEM},
+	AlertReplayDetected:       {"replay_detected", ErrReplayDetected},
+	AlertPolicyViolation:      {"policy_violation", ErrPolicyViolation},
+	AlertTicketRejected:       {"ticket_rejected", ErrTicketRejected},
+	AlertClientAuthRequired:   {"client_auth_required", ErrClientAuthRequired},
+}
+
+func (c AlertCode) String() string {
+	if info, ok := alertCodes[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("alert(%d)", uint8(c))
+}
+
+// Alert aborts the handshake. Alerts are sent in the clear and are not
+// authenticated: they end the connection but never affect the keys.
+type Alert struct {
+	Code AlertCode
+}
+
+// AlertError is returned when the peer sent an Alert. It unwraps to the
+// sentinel of its code, such as ErrPolicyViolation or ErrDecryptError, so
+// that errors.Is matches local and remote failures alike.
+type AlertError struct {
+	Code AlertCode
+}
+
+func (e *AlertError) Error() string {
+	return "received alert: " + e.Code.String()
+}
+
+func (e *AlertError) Unwrap() error {
+	if info, ok := alertCodes[e.Code]; ok {
+		return info.err
+	}
+	// Codes from a newer peer are still fatal
+	return ErrHandshakeFailure
+}
+
+// alertClasses maps local errors to the alert telling the peer about them.
+// The first match wins, so more specific errors come first.
+var alertClasses = []struct {
+	err  error
+	code AlertCode
+}{
+	{ErrPolicyViolation, AlertPolicyViolation},
+	{ErrUnsupportedVersion, AlertProtocolVersion},
+	{ErrUnsupportedWireVersion, AlertProtocolVersion},
+	{ErrNoCommonKEM, AlertUnsupportedKEM},
+	{kem.ErrUnsupportedKEM, AlertUnsupportedKEM},
+	{ErrNoCommonCipherSuite, AlertHandshakeFailure},
+	{ErrHandshakeFailure, AlertHandshakeFailure},
+	{ErrClientAuthRequired, AlertClientAuthRequired},
+	{ErrClientNotAuthorized, AlertAccessDenied},
+	{ErrTicketRejected, AlertTicketRejected},
+	{ErrInvalidCookie, AlertIllegalParameter},
+	{ErrBinderMismatch, AlertDecryptError},
+	{ErrFinishedMismatch, AlertDecryptError},
+	{ErrDecryptError, AlertDecryptError},
+	{crypto.ErrDecryptionFailed, AlertDecryptError},
+	{crypto.ErrInvalidCiphertext, AlertDecryptError},
+	{ErrEarlyDataReplayed, AlertReplayDetected},
+	{ErrReplayDetected, AlertReplayDetected},
+	{crypto.ErrReplayedRecord, AlertReplayDetected},
+	{crypto.ErrRecordOutOfWindow, AlertReplayDetected},
+	{ErrInvalidMessage, AlertDecodeError},
+	{ErrMessageTooLarge, AlertDecodeError},
+	{ErrBufferTooShort, AlertDecodeError},
+	{crypto.ErrInvalidRecord, AlertDecodeError},
+	{ErrUnsupportedExtension, AlertUnsupportedExtension},
+	{ErrIllegalParameter, AlertIllegalParameter},
+	{kem.ErrInvalidPublicKey, AlertIllegalParameter},
+	{ErrUnexpectedMessage, AlertUnexpectedMessage},
+}
+
+// NewAlert returns the alert to send to the peer after err ended the
+// handshake or session. It returns nil for a nil error and for an alert
+// received from the peer, which must not be answered.
+func NewAlert(err error) *Alert {
+	if err == nil {
+		return nil
+	}
+	var alertErr *AlertError
+	if errors.As(err, &alertErr) {
+		return nil
+	}
+
+	for _, class := range alertClasses {
+		if errors.Is(err, class.err) {
+			return &Alert{Code: class.code}
+		}
+	}
+	return &Alert{Code: AlertInternalError}
+}
@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+func TestAlertMarshal(t *testing.T) {
+	serializer := &DefaultSerializer{}
+
+	for code, info := range alertCodes {
+		data, err := serializer.MarshalAlert(&Alert{Code: code})
+		if err != nil {
+			t.Fatalf("Failed to marshal %s: %v", info.name, err)
+		}
+		alert, err := serializer.UnmarshalAlert(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s: %v", info.name, err)
+		}
+		if alert.Code != code || code.String() != info.name {
+			t.Errorf("Expected %s, got %s", info.name, alert.Code)
+		}
+		if !errors.Is(&AlertError{Code: code}, info.err) {
+			t.Errorf("Expected %s to match %v", info.name, info.err)
+		}
+	}
+
+	legacy := &DefaultSerializer{Legacy: true, AcceptLegacy: true}
+	if _, err := legacy.UnmarshalAlert([]byte{50, 0}); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage, got %v", err)
+	}
+
+	// Codes of a newer peer are kept and still fatal
+	alert, err := legacy.UnmarshalAlert([]byte{255})
+	if err != nil {
+		t.Fatalf("Failed to unmarshal unknown alert: %v", err)
+	}
+	if alert.Code.String() != "alert(255)" || !errors.Is(&AlertError{Code: alert.Code}, ErrHandshakeFailure) {
+		t.Errorf("Unexpected handling of unknown alert %s", alert.Code)
+	}
+}
+
+func TestNewAlert(t *testing.T) {
+	testCases := []struct {
+		err  error
+		code AlertCode
+	}{
+		{&PolicyError{Subject: "KEM2", Value: "ML-KEM-512", Reason: "not allowed"}, AlertPolicyViolation},
+		{fmt.Errorf("%w: 2", ErrUnsupportedVersion), AlertProtocolVersion},
+		{fmt.Errorf("%w: KEM1", ErrNoCommonKEM), AlertUnsupportedKEM},
+		{ErrNoCommonCipherSuite, AlertHandshakeFailure},
+		{fmt.Errorf("%w: %w", ErrClientNotAuthorized, errors.New("unknown client")), AlertAccessDenied},
+		{fmt.Errorf("failed to decrypt 0-RTT data: %w", crypto.ErrDecryptionFailed), AlertDecryptError},
+		{ErrFinishedMismatch, AlertDecryptError},
+		{crypto.ErrReplayedRecord, AlertReplayDetected},
+		{ErrBufferTooShort, AlertDecodeError},
+		{kem.ErrInvalidPublicKey, AlertIllegalParameter},
+		{errors.New("out of memory"), AlertInternalError},
+	}
+
+	for _, tc := range testCases {
+		alert := NewAlert(tc.err)
+		if alert == nil || alert.Code != tc.code {
+			t.Errorf("Expected %s for %v, got %v", tc.code, tc.err, alert)
+		}
+	}
+
+	if NewAlert(nil) != nil {
+		t.Error("Expected no alert without an error")
+	}
+	if NewAlert(fmt.Errorf("aborted: %w", &AlertError{Code: AlertDecodeError})) != nil {
+		t.Error("Expected no alert in answer to an alert")
+	}
+}
+
+func TestHandshakeAlerts(t *testing.T) {
+	config := newTestConfig(t)
+	serializer := &DefaultSerializer{}
+
+	// deliver carries an alert over the wire and returns what the peer reports
+	deliver := func(t *testing.T, alert *Alert, process func(*Alert) error) error {
+		t.Helper()
+		if alert == nil {
+			t.Fatal("Expected an alert")
+		}
+		data, err := serializer.MarshalAlert(alert)
+		if err != nil {
+			t.Fatalf("Failed to marshal alert: %v", err)
+		}
+		received, err := serializer.UnmarshalAlert(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal alert: %v", err)
+		}
+		return process(received)
+	}
+
+	t.Run("PolicyViolation", func(t *testing.T) {
+		mlkem1024, _ := kem.GetKEM("ML-KEM-1024")
+		serverConfig := newTestConfig(t)
+		serverConfig.KEM2 = mlkem1024
+		serverConfig.Policy = &Policy{AllowedKEM2: []string{"ML-KEM-1024"}}
+
+		serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server key pair: %v", err)
+		}
+		client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(serverConfig, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrPolicyViolation) {
+			t.Fatalf("Expected policy violation, got %v", err)
+		}
+
+		err = deliver(t, server.Alert(), client.ProcessAlert)
+		var alertErr *AlertError
+		if !errors.As(err, &alertErr) || alertErr.Code != AlertPolicyViolation {
+			t.Fatalf("Expected policy_violation alert, got %v", err)
+		}
+		if !errors.Is(err, ErrPolicyViolation) || errors.Is(err, ErrDecryptError) {
+			t.Errorf("Expected only ErrPolicyViolation to match %v", err)
+		}
+		if client.State() != StateFailed || client.Alert() != nil {
+			t.Error("Expected client to fail without answering the alert")
+		}
+	})
+
+	t.Run("WrongServerKey", func(t *testing.T) {
+		// The client encapsulates to a stale key, so the server cannot
+		// decrypt the 0-RTT data
+		stalePubKey, _, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate key pair: %v", err)
+		}
+		_, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server key pair: %v", err)
+		}
+		client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(stalePubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		clientHello, err := client.GenerateClientHello([]byte("early"))
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, crypto.ErrDecryptionFailed) {
+			t.Fatalf("Expected decryption failure, got %v", err)
+		}
+
+		err = deliver(t, server.Alert(), client.ProcessAlert)
+		if !errors.Is(err, ErrDecryptError) || errors.Is(err, ErrPolicyViolation) {
+			t.Errorf("Expected only ErrDecryptError to match %v", err)
+		}
+	})
+
+	t.Run("UnknownClientKEM", func(t *testing.T) {
+		serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server key pair: %v", err)
+		}
+		_, clientPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client key pair: %v", err)
+		}
+		client, err := NewClient(config, NewSessionOptions().
+			WithServerPublicKey(serverPubKey).
+			WithClientPrivateKey(clientPrivKey).
+			WithClientKEM(&renamedKEM{KEM: config.KEM1, name: "Unknown-KEM"}))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(config, NewSessionOptions().
+			WithServerPrivateKey(serverPrivKey).
+			WithRequireClientAuth(true).
+			WithAuthorizeClient(func(context.Context, *ClientIdentity) error { return nil }))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, kem.ErrUnsupportedKEM) {
+			t.Fatalf("Expected ErrUnsupportedKEM, got %v", err)
+		}
+
+		err = deliver(t, server.Alert(), client.ProcessAlert)
+		var alertErr *AlertError
+		if !errors.As(err, &alertErr) || alertErr.Code != AlertUnsupportedKEM {
+			t.Errorf("Expected unsupported_kem alert, got %v", err)
+		}
+	})
+
+	t.Run("FinishedMismatch", func(t *testing.T) {
+		client, server, serverResponse := startHandshake(t, config)
+		serverResponse.Finished[0] ^= 1
+
+		if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+			t.Fatalf("Expected ErrFinishedMismatch, got %v", err)
+		}
+
+		err := deliver(t, client.Alert(), server.ProcessAlert)
+		if !errors.Is(err, ErrDecryptError) {
+			t.Errorf("Expected ErrDecryptError, got %v", err)
+		}
+		if server.State() != StateFailed {
+			t.Errorf("Expected failed state, got %v", server.State())
+		}
+	})
+}
+
+// renamedKEM reports a name no registered KEM has
+type renamedKEM struct {
+	kem.KEM
+	name string
+}
+
+func (k *renamedKEM) Setup() kem.Parameters {
+	params := k.KEM.Setup()
+	params.Name = k.name
+	return params
+}
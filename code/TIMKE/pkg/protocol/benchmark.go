@@ -174,6 +174,14 @@ func runSingleTest(tc TestCase, zeroRTTPayload []byte) (BenchmarkResult, error)
 		if err != nil {
 			return result, fmt.Errorf("failed to process server response: %v", err)
 		}
+
+		clientFinished, err := client.GenerateClientFinished()
+		if err != nil {
+			return result, fmt.Errorf("failed to generate client finished: %v", err)
+		}
+		if err := server.ProcessClientFinished(clientFinished); err != nil {
+			return result, fmt.Errorf("failed to process client finished: %v", err)
+		}
 		phase2Time := time.Since(startPhase2)
 		totalPhase2 += phase2Time
 
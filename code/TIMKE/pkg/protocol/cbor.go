@@ -0,0 +1,364 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// CBOR major types (RFC 8949, section 3.1)
+const (
+	cborUint  byte = 0
+	cborBytes byte = 2
+	cborText  byte = 3
+	cborArray byte = 4
+	cborMap   byte = 5
+	cborOther byte = 7
+)
+
+// Simple values of major type 7
+const (
+	cborFalse byte = 20
+	cborTrue  byte = 21
+)
+
+// appendCBORHead appends the initial byte and argument of a data item in its
+// shortest form, as deterministic encoding requires
+func appendCBORHead(buf []byte, major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return append(buf, major|byte(arg))
+	case arg <= 0xff:
+		return append(buf, major|24, byte(arg))
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major|27), arg)
+	}
+}
+
+// cborMessage builds the map of a message: key 0 holds the message type and
+// the fields follow in ascending key order. Zero values are left out.
+type cborMessage struct {
+	fields int
+	body   []byte
+}
+
+func (m *cborMessage) key(key uint64) {
+	m.fields++
+	m.body = appendCBORHead(m.body, cborUint, key)
+}
+
+func (m *cborMessage) bytes(key uint64, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	m.key(key)
+	m.body = appendCBORHead(m.body, cborBytes, uint64(len(value)))
+	m.body = append(m.body, value...)
+}
+
+func (m *cborMessage) text(key uint64, value string) {
+	if value == "" {
+		return
+	}
+	m.key(key)
+	m.body = appendCBORText(m.body, value)
+}
+
+func (m *cborMessage) uint(key uint64, value uint64) {
+	if value == 0 {
+		return
+	}
+	m.key(key)
+	m.body = appendCBORHead(m.body, cborUint, value)
+}
+
+func (m *cborMessage) bool(key uint64, value bool) {
+	if !value {
+		return
+	}
+	m.key(key)
+	m.body = append(m.body, cborOther<<5|cborTrue)
+}
+
+func (m *cborMessage) textList(key uint64, list []string) {
+	if len(list) == 0 {
+		return
+	}
+	m.key(key)
+	m.body = appendCBORHead(m.body, cborArray, uint64(len(list)))
+	for _, entry := range list {
+		m.body = appendCBORText(m.body, entry)
+	}
+}
+
+// extensions encodes the list as an array of [type, data] pairs, keeping
+// their order
+func (m *cborMessage) extensions(key uint64, list []Extension) {
+	if len(list) == 0 {
+		return
+	}
+	m.key(key)
+	m.body = appendCBORHead(m.body, cborArray, uint64(len(list)))
+	for _, ext := range list {
+		m.body = appendCBORHead(m.body, cborArray, 2)
+		m.body = appendCBORHead(m.body, cborUint, uint64(ext.Type))
+		m.body = appendCBORHead(m.body, cborBytes, uint64(len(ext.Data)))
+		m.body = append(m.body, ext.Data...)
+	}
+}
+
+func (m *cborMessage) encode(msgType byte) []byte {
+	result := make([]byte, 0, 9+2+len(m.body))
+	result = appendCBORHead(result, cborMap, uint64(m.fields+1))
+	result = appendCBORHead(result, cborUint, 0)
+	result = appendCBORHead(result, cborUint, uint64(msgType))
+	return append(result, m.body...)
+}
+
+func appendCBORText(buf []byte, value string) []byte {
+	buf = appendCBORHead(buf, cborText, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// cborDecoder reads the data items of one message. It only accepts definite
+// lengths in their shortest form, and never allocates more than it reads.
+type cborDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (d *cborDecoder) remaining() int {
+	return len(d.data) - d.offset
+}
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.remaining() < 1 {
+		return 0, 0, ErrBufferTooShort
+	}
+	initial := d.data[d.offset]
+	d.offset++
+	major, info := initial>>5, initial&0x1f
+
+	var arg uint64
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("%w: indefinite or reserved CBOR length", ErrInvalidMessage)
+	}
+	if d.remaining() < size {
+		return 0, 0, ErrBufferTooShort
+	}
+	for _, b := range d.data[d.offset : d.offset+size] {
+		arg = arg<<8 | uint64(b)
+	}
+	d.offset += size
+
+	// Deterministic encoding uses the shortest form
+	if (size == 1 && arg < 24) || (size > 1 && arg < 1<<(4*size)) {
+		return 0, 0, fmt.Errorf("%w: CBOR argument not in shortest form", ErrInvalidMessage)
+	}
+	return major, arg, nil
+}
+
+func (d *cborDecoder) expect(major byte) (uint64, error) {
+	got, arg, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if got != major {
+		return 0, fmt.Errorf("%w: CBOR major type %d, expected %d", ErrInvalidMessage, got, major)
+	}
+	return arg, nil
+}
+
+func (d *cborDecoder) uint(limit uint64) (uint64, error) {
+	value, err := d.expect(cborUint)
+	if err != nil {
+		return 0, err
+	}
+	if value > limit {
+		return 0, fmt.Errorf("%w: CBOR integer %d out of range", ErrInvalidMessage, value)
+	}
+	return value, nil
+}
+
+// string reads a byte or text string of at most limit bytes, or any size if
+// limit is 0
+func (d *cborDecoder) string(major byte, limit int) ([]byte, error) {
+	length, err := d.expect(major)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(d.remaining()) {
+		return nil, ErrBufferTooShort
+	}
+	if limit > 0 && length > uint64(limit) {
+		return nil, fmt.Errorf("%w: field of %d bytes exceeds the limit of %d", ErrMessageTooLarge, length, limit)
+	}
+
+	value := make([]byte, length)
+	copy(value, d.data[d.offset:])
+	d.offset += int(length)
+	return value, nil
+}
+
+func (d *cborDecoder) bytes(limit int) ([]byte, error) {
+	return d.string(cborBytes, limit)
+}
+
+func (d *cborDecoder) text(limit int) (string, error) {
+	value, err := d.string(cborText, limit)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(value) {
+		return "", fmt.Errorf("%w: CBOR text is not UTF-8", ErrInvalidMessage)
+	}
+	return string(value), nil
+}
+
+func (d *cborDecoder) bool() (bool, error) {
+	if d.remaining() < 1 {
+		return false, ErrBufferTooShort
+	}
+	initial := d.data[d.offset]
+	d.offset++
+	switch initial {
+	case cborOther<<5 | cborFalse:
+		return false, nil
+	case cborOther<<5 | cborTrue:
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: CBOR item 0x%02x is not a boolean", ErrInvalidMessage, initial)
+	}
+}
+
+// array reads the length of an array whose entries take at least minSize
+// bytes each, so that the length is bounded by the data
+func (d *cborDecoder) array(maxEntries int, minSize int) (int, error) {
+	count, err := d.expect(cborArray)
+	if err != nil {
+		return 0, err
+	}
+	if count > uint64(d.remaining()/minSize) {
+		return 0, ErrBufferTooShort
+	}
+	if maxEntries > 0 && count > uint64(maxEntries) {
+		return 0, fmt.Errorf("%w: list of %d entries exceeds the limit of %d", ErrMessageTooLarge, count, maxEntries)
+	}
+	return int(count), nil
+}
+
+func (d *cborDecoder) textList(maxEntries, maxEntrySize int) ([]string, error) {
+	count, err := d.array(maxEntries, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, count)
+	for range count {
+		entry, err := d.text(maxEntrySize)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+func (d *cborDecoder) extensions() ([]Extension, error) {
+	// Each entry is at least an array head, a type and an empty string
+	count, err := d.array(0, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Extension, 0, count)
+	for range count {
+		if n, err := d.expect(cborArray); err != nil {
+			return nil, err
+		} else if n != 2 {
+			return nil, fmt.Errorf("%w: extension of %d items", ErrInvalidMessage, n)
+		}
+		extType, err := d.uint(0xffff)
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.bytes(0)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Extension{Type: ExtensionType(extType), Data: data})
+	}
+
+	if err := checkDuplicateExtensions(list); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	return list, nil
+}
+
+// decodeCBORMessage reads the map of a message of msgType and passes each
+// field to field in ascending key order
+func decodeCBORMessage(data []byte, msgType byte, field func(d *cborDecoder, key uint64) error) error {
+	d := &cborDecoder{data: data}
+
+	// Each entry is at least a key and a value
+	fields, err := d.expect(cborMap)
+	if err != nil {
+		return err
+	}
+	if fields == 0 || fields > uint64(d.remaining()/2) {
+		return fmt.Errorf("%w: CBOR map of %d entries", ErrInvalidMessage, fields)
+	}
+
+	if _, err := d.uint(0); err != nil {
+		return fmt.Errorf("%w: message type must come first", ErrInvalidMessage)
+	}
+	got, err := d.uint(0xff)
+	if err != nil {
+		return err
+	}
+	if byte(got) != msgType {
+		return fmt.Errorf("%w: got type %d, expected %d", ErrUnexpectedMessage, got, msgType)
+	}
+
+	var previous uint64
+	for range fields - 1 {
+		key, err := d.uint(^uint64(0))
+		if err != nil {
+			return err
+		}
+		if key <= previous {
+			return fmt.Errorf("%w: CBOR map keys out of order", ErrInvalidMessage)
+		}
+		previous = key
+
+		if err := field(d, key); err != nil {
+			return err
+		}
+	}
+
+	if d.remaining() != 0 {
+		return fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
+	}
+	return nil
+}
+
+func unknownCBORField(key uint64) error {
+	return fmt.Errorf("%w: unknown field %d", ErrInvalidMessage, key)
+}
@@ -0,0 +1,359 @@
+package protocol
+
+import "errors"
+
+// CBORSerializer implements the Serializer interface with deterministic CBOR
+// (RFC 8949, section 4.2), for constrained clients that already carry a CBOR
+// codec. Each message is a map whose key 0 holds its MessageType; the other
+// keys number the fields in declaration order, and zero values are left out.
+type CBORSerializer struct {
+	// Limits bounds the fields of received messages. With nil Limits, they
+	// are only bounded by the message.
+	Limits *Limits
+}
+
+// MarshalClientHello serializes a ClientHello into a byte slice
+func (s *CBORSerializer) MarshalClientHello(ch *ClientHello) ([]byte, error) {
+	if ch == nil {
+		return nil, errors.New("cannot marshal nil ClientHello")
+	}
+	if err := checkDuplicateExtensions(ch.Extensions); err != nil {
+		return nil, err
+	}
+
+	var m cborMessage
+	m.bytes(1, ch.EphemeralPublicKey)
+	m.bytes(2, ch.Ciphertext1)
+	m.bytes(3, ch.EncryptedPayload)
+	m.text(4, ch.KEM1Type)
+	m.text(5, ch.KEM2Type)
+	m.textList(6, ch.CipherSuites)
+	m.uint(7, ch.Timestamp)
+	m.bytes(8, ch.PSKIdentity)
+	m.bytes(9, ch.PSKBinder)
+	m.bytes(10, ch.EncryptedIdentity)
+	m.textList(11, ch.SupportedKEM2Types)
+	m.uint(12, uint64(ch.Version))
+	m.extensions(13, ch.Extensions)
+	m.bytes(14, ch.Cookie)
+
+	return m.encode(MessageTypeClientHello), nil
+}
+
+// UnmarshalClientHello deserializes a byte slice into a ClientHello
+func (s *CBORSerializer) UnmarshalClientHello(data []byte) (*ClientHello, error) {
+	ch := &ClientHello{}
+	err := decodeCBORMessage(data, MessageTypeClientHello, func(d *cborDecoder, key uint64) error {
+		var err error
+		switch key {
+		case 1:
+			ch.EphemeralPublicKey, err = d.bytes(s.Limits.publicKeySize())
+		case 2:
+			ch.Ciphertext1, err = d.bytes(s.Limits.ciphertextSize())
+		case 3:
+			ch.EncryptedPayload, err = d.bytes(0)
+		case 4:
+			ch.KEM1Type, err = d.text(s.Limits.nameSize())
+		case 5:
+			ch.KEM2Type, err = d.text(s.Limits.nameSize())
+		case 6:
+			ch.CipherSuites, err = d.textList(s.Limits.listEntries(), s.Limits.nameSize())
+		case 7:
+			ch.Timestamp, err = d.uint(^uint64(0))
+		case 8:
+			ch.PSKIdentity, err = d.bytes(0)
+		case 9:
+			ch.PSKBinder, err = d.bytes(0)
+		case 10:
+			ch.EncryptedIdentity, err = d.bytes(0)
+		case 11:
+			ch.SupportedKEM2Types, err = d.textList(s.Limits.listEntries(), s.Limits.nameSize())
+		case 12:
+			var version uint64
+			version, err = d.uint(0xffff)
+			ch.Version = uint16(version)
+		case 13:
+			ch.Extensions, err = d.extensions()
+		case 14:
+			ch.Cookie, err = d.bytes(MaxCookieSize)
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkCanonical(data, func() ([]byte, error) { return s.MarshalClientHello(ch) }); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// MarshalServerResponse serializes a ServerResponse into a byte slice
+func (s *CBORSerializer) MarshalServerResponse(sr *ServerResponse) ([]byte, error) {
+	if sr == nil {
+		return nil, errors.New("cannot marshal nil ServerResponse")
+	}
+	if err := checkDuplicateExtensions(sr.Extensions); err != nil {
+		return nil, err
+	}
+
+	var m cborMessage
+	m.bytes(1, sr.Ciphertext2)
+	m.bytes(2, sr.EncryptedPayload)
+	m.text(3, sr.CipherSuite)
+	m.bytes(4, sr.Finished)
+	m.bool(5, sr.EarlyDataAccepted)
+	m.bytes(6, sr.Ciphertext3)
+	m.extensions(7, sr.Extensions)
+	m.bool(8, sr.PSKAccepted)
+
+	return m.encode(MessageTypeServerResponse), nil
+}
+
+// UnmarshalServerResponse deserializes a byte slice into a ServerResponse
+func (s *CBORSerializer) UnmarshalServerResponse(data []byte) (*ServerResponse, error) {
+	sr := &ServerResponse{}
+	err := decodeCBORMessage(data, MessageTypeServerResponse, func(d *cborDecoder, key uint64) error {
+		var err error
+		switch key {
+		case 1:
+			sr.Ciphertext2, err = d.bytes(s.Limits.ciphertextSize())
+		case 2:
+			sr.EncryptedPayload, err = d.bytes(0)
+		case 3:
+			sr.CipherSuite, err = d.text(s.Limits.nameSize())
+		case 4:
+			sr.Finished, err = d.bytes(0)
+		case 5:
+			sr.EarlyDataAccepted, err = d.bool()
+		case 6:
+			sr.Ciphertext3, err = d.bytes(s.Limits.ciphertextSize())
+		case 7:
+			sr.Extensions, err = d.extensions()
+		case 8:
+			sr.PSKAccepted, err = d.bool()
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkCanonical(data, func() ([]byte, error) { return s.MarshalServerResponse(sr) }); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// MarshalClientFinished serializes a ClientFinished into a byte slice
+func (s *CBORSerializer) MarshalClientFinished(cf *ClientFinished) ([]byte, error) {
+	if cf == nil {
+		return nil, errors.New("cannot marshal nil ClientFinished")
+	}
+
+	var m cborMessage
+	m.bytes(1, cf.Finished)
+
+	return m.encode(MessageTypeClientFinished), nil
+}
+
+// UnmarshalClientFinished deserializes a byte slice into a ClientFinished
+func (s *CBORSerializer) UnmarshalClientFinished(data []byte) (*ClientFinished, error) {
+	cf := &ClientFinished{}
+	err := decodeCBORMessage(data, MessageTypeClientFinished, func(d *cborDecoder, key uint64) error {
+		if key != 1 {
+			return unknownCBORField(key)
+		}
+		var err error
+		cf.Finished, err = d.bytes(0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// MarshalNewSessionTicket serializes a NewSessionTicket into a byte slice
+func (s *CBORSerializer) MarshalNewSessionTicket(nst *NewSessionTicket) ([]byte, error) {
+	if nst == nil {
+		return nil, errors.New("cannot marshal nil NewSessionTicket")
+	}
+
+	var m cborMessage
+	m.uint(1, uint64(nst.Lifetime))
+	m.bytes(2, nst.Nonce)
+	m.bytes(3, nst.Ticket)
+
+	return m.encode(MessageTypeNewSessionTicket), nil
+}
+
+// UnmarshalNewSessionTicket deserializes a byte slice into a NewSessionTicket
+func (s *CBORSerializer) UnmarshalNewSessionTicket(data []byte) (*NewSessionTicket, error) {
+	nst := &NewSessionTicket{}
+	err := decodeCBORMessage(data, MessageTypeNewSessionTicket, func(d *cborDecoder, key uint64) error {
+		var err error
+		switch key {
+		case 1:
+			var lifetime uint64
+			lifetime, err = d.uint(0xffffffff)
+			nst.Lifetime = uint32(lifetime)
+		case 2:
+			nst.Nonce, err = d.bytes(0)
+		case 3:
+			nst.Ticket, err = d.bytes(0)
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nst, nil
+}
+
+// MarshalClientIdentity serializes a ClientIdentity into a byte slice. It is
+// not a message of its own and uses type 0.
+func (s *CBORSerializer) MarshalClientIdentity(id *ClientIdentity) ([]byte, error) {
+	if id == nil {
+		return nil, errors.New("cannot marshal nil ClientIdentity")
+	}
+
+	var m cborMessage
+	m.bytes(1, id.ID)
+	m.text(2, id.KEMType)
+	m.bytes(3, id.PublicKey)
+
+	return m.encode(0), nil
+}
+
+// UnmarshalClientIdentity deserializes a byte slice into a ClientIdentity
+func (s *CBORSerializer) UnmarshalClientIdentity(data []byte) (*ClientIdentity, error) {
+	id := &ClientIdentity{}
+	err := decodeCBORMessage(data, 0, func(d *cborDecoder, key uint64) error {
+		var err error
+		switch key {
+		case 1:
+			id.ID, err = d.bytes(0)
+		case 2:
+			id.KEMType, err = d.text(s.Limits.nameSize())
+		case 3:
+			id.PublicKey, err = d.bytes(0)
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// MarshalKeyUpdate serializes a KeyUpdate into a byte slice
+func (s *CBORSerializer) MarshalKeyUpdate(ku *KeyUpdate) ([]byte, error) {
+	if ku == nil {
+		return nil, errors.New("cannot marshal nil KeyUpdate")
+	}
+
+	var m cborMessage
+	m.bool(1, ku.UpdateRequested)
+
+	return m.encode(MessageTypeKeyUpdate), nil
+}
+
+// UnmarshalKeyUpdate deserializes a byte slice into a KeyUpdate
+func (s *CBORSerializer) UnmarshalKeyUpdate(data []byte) (*KeyUpdate, error) {
+	ku := &KeyUpdate{}
+	err := decodeCBORMessage(data, MessageTypeKeyUpdate, func(d *cborDecoder, key uint64) error {
+		if key != 1 {
+			return unknownCBORField(key)
+		}
+		var err error
+		ku.UpdateRequested, err = d.bool()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ku, nil
+}
+
+// MarshalHelloRetryRequest serializes a HelloRetryRequest into a byte slice
+func (s *CBORSerializer) MarshalHelloRetryRequest(hrr *HelloRetryRequest) ([]byte, error) {
+	if hrr == nil {
+		return nil, errors.New("cannot marshal nil HelloRetryRequest")
+	}
+
+	var m cborMessage
+	m.text(1, hrr.KEM2Type)
+	m.bytes(2, hrr.Cookie)
+
+	return m.encode(MessageTypeHelloRetryRequest), nil
+}
+
+// UnmarshalHelloRetryRequest deserializes a byte slice into a HelloRetryRequest
+func (s *CBORSerializer) UnmarshalHelloRetryRequest(data []byte) (*HelloRetryRequest, error) {
+	hrr := &HelloRetryRequest{}
+	err := decodeCBORMessage(data, MessageTypeHelloRetryRequest, func(d *cborDecoder, key uint64) error {
+		var err error
+		switch key {
+		case 1:
+			hrr.KEM2Type, err = d.text(s.Limits.nameSize())
+		case 2:
+			hrr.Cookie, err = d.bytes(MaxCookieSize)
+		default:
+			err = unknownCBORField(key)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkCanonical(data, func() ([]byte, error) { return s.MarshalHelloRetryRequest(hrr) }); err != nil {
+		return nil, err
+	}
+	return hrr, nil
+}
+
+// MarshalAlert serializes an Alert into a byte slice
+func (s *CBORSerializer) MarshalAlert(a *Alert) ([]byte, error) {
+	if a == nil {
+		return nil, errors.New("cannot marshal nil Alert")
+	}
+
+	var m cborMessage
+	m.uint(1, uint64(a.Code))
+
+	return m.encode(MessageTypeAlert), nil
+}
+
+// UnmarshalAlert deserializes a byte slice into an Alert. Unknown codes are
+// kept, since every alert is fatal.
+func (s *CBORSerializer) UnmarshalAlert(data []byte) (*Alert, error) {
+	a := &Alert{}
+	err := decodeCBORMessage(data, MessageTypeAlert, func(d *cborDecoder, key uint64) error {
+		if key != 1 {
+			return unknownCBORField(key)
+		}
+		code, err := d.uint(0xff)
+		a.Code = AlertCode(code)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
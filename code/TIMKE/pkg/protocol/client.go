@@ -1,9 +1,12 @@
 package protocol
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"time"
 
 	"TIMKE/pkg/crypto"
 	"TIMKE/pkg/kem"
@@ -14,21 +17,54 @@ type Client struct {
 	state   SessionState
 	options *SessionOptions
 	rand    io.Reader
+	now     func() time.Time
 
 	ephemeralPublicKey  kem.PublicKey
 	ephemeralPrivateKey kem.PrivateKey
 	ciphertext1         []byte
-	sharedSecret1       []byte // K_1
-	tempKey             []byte // K_tmp
+	sharedSecret1       *crypto.Secret // K_1
+	tempKey             *crypto.Secret // K_tmp
 	ciphertext2         []byte
-	sharedSecret2       []byte // K_2
-	sessionKey          []byte // K_main
+	sharedSecret2       *crypto.Secret // K_2
+	sessionKey          *crypto.Secret // K_main
+
+	kem2          kem.KEM // KEM of the ephemeral key share
+	offeredKEM2s  []string
+	offeredSuites []string
+	offer         *negotiation
+	cipherSuite   crypto.CipherSuite
+	records       *recordLayer
+	retried       bool   // a HelloRetryRequest was answered
+	cookie        []byte // echoed from the HelloRetryRequest
+	alert         *Alert // why the handshake failed
+
+	transcript     *Transcript
+	transcriptHash []byte // through ClientFinished
+	clientFinished []byte
+
+	earlyData         []byte // kept until the server reports whether it was processed
+	earlyDataAccepted bool
+
+	serverExtensions []Extension
+
+	resumed          bool
+	ticket           []byte         // ticket being resumed
+	psk              *crypto.Secret // PSK of the ticket being resumed
+	earlyExporter    *crypto.Secret // stage-1 exporter master
+	exporter         *crypto.Secret // stage-2 exporter master
+	resumptionSecret *crypto.Secret // base of the tickets the server issues
 }
 
 func NewClient(config *Config, options *SessionOptions) (*Client, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.KEM2 == nil {
+		return nil, errors.New("invalid config: KEM2 is required")
+	}
 
 	if options == nil || options.ServerPublicKey == nil {
 		return nil, errors.New("server public key is required")
@@ -38,127 +74,523 @@ func NewClient(config *Config, options *SessionOptions) (*Client, error) {
 		config:  config,
 		state:   StateInitial,
 		options: options,
-		rand:    kem.DefaultRand,
+		rand:    config.random(),
+		now:     time.Now,
 	}, nil
 }
 
 func (c *Client) GenerateClientHello(zeroRTTData []byte) (*ClientHello, error) {
+	return c.GenerateClientHelloContext(context.Background(), zeroRTTData)
+}
+
+// GenerateClientHelloContext is GenerateClientHello under ctx, which bounds
+// the session cache lookup and the KEM operations. The handshake fails if ctx
+// is done before they are.
+func (c *Client) GenerateClientHelloContext(ctx context.Context, zeroRTTData []byte) (*ClientHello, error) {
 	if c.state != StateInitial {
 		return nil, errors.New("client not in initial state")
 	}
 
-	// 1. Generate (epk, esk)
-	params := c.config.KEM2.Setup()
-	epk, esk, err := c.config.KEM2.GenerateKeyPair(params, c.rand)
+	// Resume if a ticket for this server is cached
+	session := c.takeSession(ctx)
+	if session != nil {
+		c.psk = crypto.NewSecret(session.PSK)
+		c.ticket = session.Ticket
+		c.resumed = true
+	}
+
+	c.kem2 = c.config.KEM2
+	c.offeredKEM2s = c.config.kem2Types()
+	c.offeredSuites = c.config.cipherSuites()
+	if zeroRTTData != nil {
+		c.earlyData = slices.Clone(zeroRTTData)
+	}
+
+	c.transcript = NewTranscript()
+	return c.sendClientHello(ctx)
+}
+
+// ProcessHelloRetryRequest answers the server's request for a key share of
+// another KEM2, or for its cookie, with a new ClientHello. The 0-RTT data, if
+// any, is sent again.
+func (c *Client) ProcessHelloRetryRequest(hrr *HelloRetryRequest) (*ClientHello, error) {
+	return c.ProcessHelloRetryRequestContext(context.Background(), hrr)
+}
+
+// ProcessHelloRetryRequestContext is ProcessHelloRetryRequest under ctx
+func (c *Client) ProcessHelloRetryRequestContext(ctx context.Context, hrr *HelloRetryRequest) (*ClientHello, error) {
+	if c.state != StateAwaitingServerResponse {
+		return nil, errors.New("client not waiting for server response")
+	}
+
+	if hrr == nil {
+		return nil, c.fail(errors.New("nil hello retry request"))
+	}
+	if c.retried {
+		return nil, c.fail(fmt.Errorf("%w: second hello retry request", ErrUnexpectedMessage))
+	}
+	// Only a request for a cookie may ask for the KEM2 already sent
+	if !slices.Contains(c.offeredKEM2s, hrr.KEM2Type) || (hrr.KEM2Type == c.kem2.Setup().Name && len(hrr.Cookie) == 0) {
+		return nil, c.fail(fmt.Errorf("%w: server requested KEM2 %q that was not offered or already sent", ErrIllegalParameter, hrr.KEM2Type))
+	}
+
+	k, err := SelectKEM(hrr.KEM2Type)
 	if err != nil {
-		c.state = StateFailed
-		return nil, fmt.Errorf("failed to generate ephemeral key pair: %w", err)
+		return nil, c.fail(err)
+	}
+
+	// The key shares of the first ClientHello are discarded
+	if c.ephemeralPrivateKey != nil {
+		c.ephemeralPrivateKey.Destroy()
 	}
-	c.ephemeralPublicKey = epk
-	c.ephemeralPrivateKey = esk
+	c.ephemeralPublicKey = nil
+	c.ephemeralPrivateKey = nil
+	c.sharedSecret1.Destroy()
+	c.sharedSecret1 = nil
+	c.ciphertext1 = nil
+	c.earlyExporter.Destroy()
+	c.earlyExporter = nil
 
-	// 2. Use server's long-term public key to encapsulate KEM1
-	c.ciphertext1, c.sharedSecret1, err = c.config.KEM1.Encapsulate(c.options.ServerPublicKey, c.rand)
+	hrrBytes, err := encodeHelloRetryRequest(hrr)
 	if err != nil {
-		c.state = StateFailed
-		return nil, fmt.Errorf("failed to encapsulate KEM1: %w", err)
+		return nil, c.fail(err)
+	}
+	c.transcript.Write(MessageTypeHelloRetryRequest, hrrBytes)
+
+	c.kem2 = k
+	c.cookie = hrr.Cookie
+	c.retried = true
+	return c.sendClientHello(ctx)
+}
+
+// generateKeyShare returns an ephemeral key pair of the KEM2, from the key
+// pool if one is ready
+func (c *Client) generateKeyShare(ctx context.Context) (kem.PublicKey, kem.PrivateKey, error) {
+	if c.options.KeyPool != nil {
+		if epk, esk, ok := c.options.KeyPool.Take(c.kem2); ok {
+			return epk, esk, nil
+		}
+	}
+	return kem.GenerateKeyPairContext(ctx, c.kem2, c.kem2.Setup(), c.rand)
+}
+
+// fail aborts the handshake and records the alert telling the server why
+func (c *Client) fail(err error) error {
+	c.state = StateFailed
+	c.alert = NewAlert(err)
+	return err
+}
+
+// Alert returns the alert to send to the server after the handshake failed,
+// nil if it did not or the server sent an alert itself
+func (c *Client) Alert() *Alert {
+	return c.alert
+}
+
+// ProcessAlert aborts the handshake on an alert from the server and returns
+// it as an *AlertError, so that errors.Is tells a policy rejection from a
+// wrong server key
+func (c *Client) ProcessAlert(alert *Alert) error {
+	if alert == nil {
+		return c.fail(errors.New("nil alert"))
 	}
+	return c.fail(&AlertError{Code: alert.Code})
+}
 
-	// 3. K_tmp = H1(server_pk, C₁, K_1)
-	c.tempKey, err = crypto.H1(
-		c.options.ServerPublicKey.Bytes(),
-		c.ciphertext1,
-		c.sharedSecret1,
-	)
+// sendClientHello generates fresh key shares and builds the ClientHello for
+// the negotiated parameters
+func (c *Client) sendClientHello(ctx context.Context) (*ClientHello, error) {
+	// 1. Generate (epk, esk), unless resuming without forward secrecy
+	if !c.resumed || !c.options.PSKOnlyResumption {
+		epk, esk, err := c.generateKeyShare(ctx)
+		if err != nil {
+			return nil, c.fail(fmt.Errorf("failed to generate ephemeral key pair: %w", err))
+		}
+		c.ephemeralPublicKey = epk
+		c.ephemeralPrivateKey = esk
+	}
+
+	if c.resumed {
+		// 2-3. The ticket's PSK replaces KEM1. A KEM1 key share is sent as
+		// well, so that the server can fall back to the full handshake if it
+		// rejects the ticket. The identity is hidden under the ticket's
+		// K_tmp, so mutual authentication cannot fall back.
+		if c.ephemeralPrivateKey != nil && c.options.ClientPrivateKey == nil {
+			if err := c.encapsulateKEM1(ctx); err != nil {
+				return nil, err
+			}
+		}
+		c.tempKey = resumptionEarlySecret(c.psk)
+	} else {
+		// 2. Use server's long-term public key to encapsulate KEM1
+		if err := c.encapsulateKEM1(ctx); err != nil {
+			return nil, err
+		}
+
+		// 3. K_tmp = H1(server_pk, C₁, K_1)
+		tempKey, err := crypto.H1(
+			c.options.ServerPublicKey.Bytes(),
+			c.ciphertext1,
+			c.sharedSecret1.Bytes(),
+		)
+		if err != nil {
+			return nil, c.fail(fmt.Errorf("failed to derive temp key: %w", err))
+		}
+		c.tempKey = crypto.NewSecret(tempKey)
+	}
+	// A ClientHello modified in transit yields another K_tmp, so its 0-RTT
+	// data does not decrypt
+	c.offer = &negotiation{
+		version:   ProtocolVersion,
+		kem1Type:  c.config.KEM1.Setup().Name,
+		kem2Type:  c.kem2.Setup().Name,
+		kem2Types: c.offeredKEM2s,
+		suites:    c.offeredSuites,
+		timestamp: uint64(c.now().UnixMilli()),
+	}
+	c.tempKey = c.offer.bindEarly(c.tempKey)
+	// K_tmp only protects the 0-RTT data and keys the stage-1 exporter
+	defer c.tempKey.Destroy()
+
+	// 4. Encrypt the identity and 0-RTT data by K_tmp, using the most
+	// preferred suite
+	earlySuite, err := SelectCipherSuite(c.offeredSuites[0])
 	if err != nil {
-		c.state = StateFailed
-		return nil, fmt.Errorf("failed to derive temp key: %w", err)
+		return nil, c.fail(fmt.Errorf("failed to select 0-RTT cipher suite: %w", err))
 	}
 
-	// 4. Encrypt 0-RTT data by K_tmp
-	var encryptedPayload []byte
-	if zeroRTTData != nil {
-		encryptedPayload, err = c.config.SymmetricEncryption.Encrypt(c.tempKey, zeroRTTData)
+	// In mutual authentication mode the identity is hidden under K_tmp too
+	var encryptedIdentity []byte
+	if c.options.ClientPrivateKey != nil {
+		encryptedIdentity, err = c.encryptIdentity(earlySuite)
 		if err != nil {
-			c.state = StateFailed
-			return nil, fmt.Errorf("failed to encrypt 0-RTT data: %w", err)
+			return nil, c.fail(fmt.Errorf("failed to encrypt client identity: %w", err))
 		}
 	}
 
 	// 5. Construct ClientHello message
 	clientHello := &ClientHello{
-		EphemeralPublicKey: c.ephemeralPublicKey.Bytes(),
+		EphemeralPublicKey: c.ephemeralPublicKeyBytes(),
 		Ciphertext1:        c.ciphertext1,
-		EncryptedPayload:   encryptedPayload,
 
-		KEM1Type: c.config.KEM1.Setup().Name,
-		KEM2Type: c.config.KEM2.Setup().Name,
+		KEM1Type:     c.offer.kem1Type,
+		KEM2Type:     c.offer.kem2Type,
+		CipherSuites: c.offer.suites,
+		Timestamp:    c.offer.timestamp,
+
+		EncryptedIdentity:  encryptedIdentity,
+		SupportedKEM2Types: c.offer.kem2Types,
+		Version:            c.offer.version,
+		Extensions:         c.options.ClientExtensions,
+		Cookie:             c.cookie,
+	}
+	if c.resumed {
+		clientHello.PSKIdentity = c.ticket
+	}
+
+	// The 0-RTT keys depend on the rest of the ClientHello
+	if c.earlyData != nil {
+		earlyContext, err := earlyTrafficContext(clientHello)
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		earlyCipher, err := newRecordCipher(earlySuite, c.tempKey.Bytes(), labelEarlyTraffic, earlyContext)
+		if err != nil {
+			return nil, c.fail(err)
+		}
+
+		clientHello.EncryptedPayload, err = earlyCipher.Seal(crypto.RecordTypeApplicationData, c.earlyData)
+		if err != nil {
+			return nil, c.fail(fmt.Errorf("failed to encrypt 0-RTT data: %w", err))
+		}
 	}
 
+	if c.resumed {
+		binder, err := pskBinder(c.tempKey, clientHello)
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		clientHello.PSKBinder = binder
+	}
+
+	helloBytes, err := encodeClientHello(clientHello)
+	if err != nil {
+		return nil, c.fail(err)
+	}
+	c.transcript.Write(MessageTypeClientHello, helloBytes)
+	c.earlyExporter = exporterMaster(c.tempKey, labelEarlyExporter, c.transcript.Sum())
+
 	c.state = StateAwaitingServerResponse
 	return clientHello, nil
 }
 
+// encapsulateKEM1 encapsulates to the server's long-term key, giving C₁
+// and K_1
+func (c *Client) encapsulateKEM1(ctx context.Context) error {
+	ciphertext1, sharedSecret1, err := kem.EncapsulateContext(ctx, c.config.KEM1, c.options.ServerPublicKey, c.rand)
+	if err != nil {
+		return c.fail(fmt.Errorf("failed to encapsulate KEM1: %w", err))
+	}
+	c.ciphertext1 = ciphertext1
+	c.sharedSecret1 = crypto.NewSecret(sharedSecret1)
+	return nil
+}
+
 func (c *Client) ProcessServerResponse(response *ServerResponse) ([]byte, error) {
+	return c.ProcessServerResponseContext(context.Background(), response)
+}
+
+// ProcessServerResponseContext is ProcessServerResponse under ctx, which
+// bounds the decapsulations
+func (c *Client) ProcessServerResponseContext(ctx context.Context, response *ServerResponse) ([]byte, error) {
 	if c.state != StateAwaitingServerResponse {
 		return nil, errors.New("client not waiting for server response")
 	}
 
 	if response == nil {
-		c.state = StateFailed
-		return nil, errors.New("nil server response")
+		return nil, c.fail(errors.New("nil server response"))
 	}
 
-	c.ciphertext2 = response.Ciphertext2
-	sharedSecret2, err := c.config.KEM2.Decapsulate(c.ephemeralPrivateKey, c.ciphertext2)
+	responseBytes, err := encodeServerResponse(response)
 	if err != nil {
-		c.state = StateFailed
-		return nil, fmt.Errorf("failed to decapsulate KEM2: %w", err)
-	}
-	c.sharedSecret2 = sharedSecret2
-
-	c.sessionKey, err = crypto.H2(
-		c.options.ServerPublicKey.Bytes(),
-		c.ephemeralPublicKey.Bytes(),
-		c.ciphertext1,
-		c.ciphertext2,
-		c.sharedSecret1,
-		c.sharedSecret2,
-	)
+		return nil, c.fail(err)
+	}
+	if err := c.config.Policy.checkMessageSize("ServerResponse", len(responseBytes)); err != nil {
+		return nil, c.fail(err)
+	}
+
+	if !slices.Contains(c.offeredSuites, response.CipherSuite) {
+		return nil, c.fail(fmt.Errorf("%w: server selected cipher suite %q that was not offered", ErrIllegalParameter, response.CipherSuite))
+	}
+	suite, err := SelectCipherSuite(response.CipherSuite)
 	if err != nil {
-		c.state = StateFailed
-		return nil, fmt.Errorf("failed to derive session key: %w", err)
+		return nil, c.fail(err)
 	}
+	c.cipherSuite = suite
 
-	if len(response.EncryptedPayload) == 0 {
-		c.state = StateEstablished
-		return nil, nil
+	if err := checkExtensionsOffered(c.options.ClientExtensions, response.Extensions); err != nil {
+		return nil, c.fail(err)
+	}
+	if err := checkExtensions(response.Extensions); err != nil {
+		return nil, c.fail(err)
+	}
+
+	if response.EarlyDataAccepted && c.earlyData == nil {
+		return nil, c.fail(fmt.Errorf("%w: server accepted 0-RTT data that was not sent", ErrIllegalParameter))
+	}
+
+	if response.PSKAccepted && !c.resumed {
+		return nil, c.fail(fmt.Errorf("%w: server accepted a session ticket that was not sent", ErrIllegalParameter))
+	}
+	if c.resumed && !response.PSKAccepted {
+		if len(c.ciphertext1) == 0 {
+			return nil, c.fail(fmt.Errorf("%w: server fell back to a full handshake without a KEM1 key share", ErrIllegalParameter))
+		}
+		// The server rejected the ticket and ran the full handshake on the
+		// key shares sent along with it
+		c.resumed = false
+		c.psk.Destroy()
+		c.psk = nil
+		c.earlyExporter.Destroy()
+		c.earlyExporter = nil
 	}
 
-	plaintext, err := c.config.SymmetricEncryption.Decrypt(c.sessionKey, response.EncryptedPayload)
+	c.ciphertext2 = response.Ciphertext2
+	if c.ephemeralPrivateKey != nil {
+		sharedSecret2, err := kem.DecapsulateContext(ctx, c.kem2, c.ephemeralPrivateKey, c.ciphertext2)
+		// The ephemeral key is single use
+		c.ephemeralPrivateKey.Destroy()
+		if err != nil {
+			return nil, c.fail(fmt.Errorf("failed to decapsulate KEM2: %w", err))
+		}
+		c.sharedSecret2 = crypto.NewSecret(sharedSecret2)
+	} else if len(c.ciphertext2) > 0 {
+		return nil, c.fail(fmt.Errorf("%w: unexpected KEM2 ciphertext", ErrIllegalParameter))
+	}
+
+	var sessionKey []byte
+	if c.resumed {
+		sessionKey, err = crypto.H3(c.psk.Bytes(), c.ephemeralPublicKeyBytes(), c.ciphertext2, c.sharedSecret2.Bytes())
+		c.psk.Destroy()
+	} else {
+		sessionKey, err = crypto.H2(
+			c.options.ServerPublicKey.Bytes(),
+			c.ephemeralPublicKey.Bytes(),
+			c.ciphertext1,
+			c.ciphertext2,
+			c.sharedSecret1.Bytes(),
+			c.sharedSecret2.Bytes(),
+		)
+	}
+	c.sharedSecret1.Destroy()
+	c.sharedSecret2.Destroy()
 	if err != nil {
-		c.state = StateFailed
-		return nil, fmt.Errorf("failed to decrypt server payload: %w", err)
+		return nil, c.fail(fmt.Errorf("failed to derive session key: %w", err))
 	}
+	sessionKey = c.offer.bindMain(sessionKey, response.CipherSuite)
 
-	c.state = StateEstablished
+	if c.options.ClientPrivateKey != nil {
+		authenticated, err := c.authenticateToServer(ctx, sessionKey, response.Ciphertext3)
+		crypto.Zeroize(sessionKey)
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		sessionKey = authenticated
+	} else if len(response.Ciphertext3) > 0 {
+		return nil, c.fail(fmt.Errorf("%w: unexpected client KEM ciphertext", ErrIllegalParameter))
+	}
+	c.sessionKey = crypto.NewSecret(sessionKey)
+
+	if err := c.transcript.AddServerResponse(response); err != nil {
+		return nil, c.fail(err)
+	}
+	keyShareHash := c.transcript.Sum()
+
+	// The server must prove it derived the same K_main over the same messages
+	if err := verifyFinished(c.sessionKey, labelServerFinished, keyShareHash, response.Finished); err != nil {
+		return nil, c.fail(err)
+	}
+	c.transcript.AddFinished(response.Finished)
+
+	c.records, err = newRecordLayer(c.cipherSuite, c.sessionKey.Bytes(), labelClientTraffic, labelServerTraffic, keyShareHash, c.options.keyUpdateLimits())
+	if err != nil {
+		return nil, c.fail(err)
+	}
+
+	var plaintext []byte
+	if len(response.EncryptedPayload) > 0 {
+		plaintext, err = openApplicationData(c.records.read.cipher, response.EncryptedPayload)
+		if err != nil {
+			return nil, c.fail(fmt.Errorf("failed to decrypt server payload: %w", err))
+		}
+	}
+
+	c.serverExtensions = response.Extensions
+	c.earlyDataAccepted = response.EarlyDataAccepted
+	if c.earlyDataAccepted {
+		crypto.Zeroize(c.earlyData)
+		c.earlyData = nil
+	}
+
+	c.clientFinished = finishedMAC(c.sessionKey, labelClientFinished, c.transcript.Sum())
+	c.transcript.AddFinished(c.clientFinished)
+	c.transcriptHash = c.transcript.Sum()
+	c.resumptionSecret = resumptionMaster(c.sessionKey, c.transcriptHash)
+	c.exporter = exporterMaster(c.sessionKey, labelExporter, c.transcriptHash)
+
+	c.state = StateAwaitingFinished
 	return plaintext, nil
 }
 
+// GenerateClientFinished returns the client's key confirmation, which must be
+// sent to the server before any application data
+func (c *Client) GenerateClientFinished() (*ClientFinished, error) {
+	if c.state != StateAwaitingFinished {
+		return nil, errors.New("server response not processed")
+	}
+
+	c.state = StateEstablished
+	return &ClientFinished{Finished: c.clientFinished}, nil
+}
+
 func (c *Client) Encrypt(plaintext []byte) ([]byte, error) {
 	if c.state != StateEstablished {
 		return nil, errors.New("session not established")
 	}
 
-	return c.config.SymmetricEncryption.Encrypt(c.sessionKey, plaintext)
+	return c.records.seal(plaintext)
+}
+
+// UpdateKeys ratchets the client's sending keys and asks the server to do the
+// same. The returned KeyUpdate record must be sent before any later record.
+func (c *Client) UpdateKeys() ([]byte, error) {
+	if c.state != StateEstablished {
+		return nil, errors.New("session not established")
+	}
+
+	return c.records.keyUpdate(true)
 }
 
+// Decrypt opens the records in ciphertext and returns their application
+// data. Post-handshake messages, such as key updates and session tickets,
+// are handled here; records carrying only those yield nil.
 func (c *Client) Decrypt(ciphertext []byte) ([]byte, error) {
 	if c.state != StateEstablished {
 		return nil, errors.New("session not established")
 	}
 
-	return c.config.SymmetricEncryption.Decrypt(c.sessionKey, ciphertext)
+	return c.records.open(ciphertext, c.processPostHandshake)
+}
+
+func (c *Client) processPostHandshake(msgType byte, msg []byte) error {
+	switch msgType {
+	case MessageTypeNewSessionTicket:
+		ticket, err := (&DefaultSerializer{}).UnmarshalNewSessionTicket(msg)
+		if err != nil {
+			return fmt.Errorf("failed to parse session ticket: %w", err)
+		}
+		return c.storeTicket(ticket)
+	default:
+		return fmt.Errorf("%w: type %d", ErrUnexpectedMessage, msgType)
+	}
+}
+
+// storeTicket caches a ticket for resuming with this server. Tickets are
+// dropped if there is no SessionStore.
+func (c *Client) storeTicket(ticket *NewSessionTicket) error {
+	if c.options.SessionStore == nil || ticket.Lifetime == 0 {
+		return nil
+	}
+
+	state := &ResumptionState{
+		CipherSuite: c.cipherSuite.Name(),
+		KEM1Type:    c.config.KEM1.Setup().Name,
+		KEM2Type:    c.kem2.Setup().Name,
+		IssuedAt:    c.now(),
+		Lifetime:    time.Duration(ticket.Lifetime) * time.Second,
+		PSK:         ticketPSK(c.resumptionSecret, ticket.Nonce),
+		Ticket:      ticket.Ticket,
+	}
+	defer crypto.Zeroize(state.PSK)
+
+	key := sessionCacheKey(c.options.ServerPublicKey)
+	if err := c.options.SessionStore.Put(context.Background(), key, state); err != nil {
+		return fmt.Errorf("failed to store session ticket: %w", err)
+	}
+	return nil
+}
+
+// takeSession removes a usable ticket for this server from the cache, since
+// tickets are single use. Cache errors fall back to a full handshake.
+func (c *Client) takeSession(ctx context.Context) *ResumptionState {
+	if c.options.SessionStore == nil {
+		return nil
+	}
+
+	key := sessionCacheKey(c.options.ServerPublicKey)
+	session, err := c.options.SessionStore.Take(ctx, key)
+	if err != nil || session == nil {
+		return nil
+	}
+
+	if session.Expired(c.now()) || session.KEM1Type != c.config.KEM1.Setup().Name ||
+		!slices.Contains(c.config.cipherSuites(), session.CipherSuite) || len(session.Ticket) == 0 {
+		crypto.Zeroize(session.PSK)
+		return nil
+	}
+	return session
+}
+
+func (c *Client) ephemeralPublicKeyBytes() []byte {
+	if c.ephemeralPublicKey == nil {
+		return nil
+	}
+	return c.ephemeralPublicKey.Bytes()
+}
+
+// Resumed reports whether the handshake resumed a session from a ticket
+func (c *Client) Resumed() bool {
+	return c.resumed
 }
 
 func (c *Client) GetSessionKey() []byte {
@@ -166,16 +598,96 @@ func (c *Client) GetSessionKey() []byte {
 		return nil
 	}
 
-	key := make([]byte, len(c.sessionKey))
-	copy(key, c.sessionKey)
+	key := make([]byte, c.sessionKey.Len())
+	copy(key, c.sessionKey.Bytes())
 	return key
 }
 
+// ServerExtensions returns the extensions of the verified ServerResponse
+func (c *Client) ServerExtensions() []Extension {
+	if c.state != StateAwaitingFinished && c.state != StateEstablished {
+		return nil
+	}
+	return c.serverExtensions
+}
+
+// EarlyDataAccepted reports whether the server processed the 0-RTT data
+func (c *Client) EarlyDataAccepted() bool {
+	return c.earlyDataAccepted
+}
+
+// RejectedEarlyData returns the 0-RTT data the server did not process, along
+// with ErrEarlyDataRejected, so that the application can send it again with
+// Encrypt. It returns nil, nil if no early data was sent or it was accepted.
+func (c *Client) RejectedEarlyData() ([]byte, error) {
+	if c.state != StateAwaitingFinished && c.state != StateEstablished {
+		return nil, errors.New("server response not processed")
+	}
+	if c.earlyData == nil {
+		return nil, nil
+	}
+	return slices.Clone(c.earlyData), ErrEarlyDataRejected
+}
+
+// ExportKeyingMaterial derives length bytes for label and context, keeping
+// application keys separate from the traffic keys. It uses the stage-2 key
+// once the server response is verified and the stage-1 key after the
+// ClientHello, and reports which one it used.
+func (c *Client) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, KeyStage, error) {
+	if c.state == StateFailed {
+		return nil, 0, errors.New("handshake failed")
+	}
+	return exportFromBestStage(c.earlyExporter, c.exporter, label, context, length)
+}
+
+// ExportEarlyKeyingMaterial is ExportKeyingMaterial restricted to the stage-1
+// key, so that it matches what the server exported when processing the
+// ClientHello
+func (c *Client) ExportEarlyKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if c.state == StateFailed {
+		return nil, errors.New("handshake failed")
+	}
+	return exportKeyingMaterial(c.earlyExporter, label, context, length)
+}
+
+// TranscriptHash returns the hash of the handshake messages that the session
+// keys are bound to
+func (c *Client) TranscriptHash() []byte {
+	if c.state != StateEstablished {
+		return nil
+	}
+	return slices.Clone(c.transcriptHash)
+}
+
+// ChannelBinding returns a value unique to this session for binding
+// upper-layer authentication to it
+func (c *Client) ChannelBinding() []byte {
+	if c.state != StateEstablished {
+		return nil
+	}
+	return channelBinding(c.sessionKey, c.transcriptHash)
+}
+
 func (c *Client) State() SessionState {
 	return c.state
 }
 
+// Reset wipes all handshake and session secrets and returns the client to
+// its initial state
 func (c *Client) Reset() {
+	if c.ephemeralPrivateKey != nil {
+		c.ephemeralPrivateKey.Destroy()
+	}
+	c.sharedSecret1.Destroy()
+	c.tempKey.Destroy()
+	c.sharedSecret2.Destroy()
+	c.sessionKey.Destroy()
+	c.psk.Destroy()
+	c.resumptionSecret.Destroy()
+	c.earlyExporter.Destroy()
+	c.exporter.Destroy()
+	c.records.destroy()
+
 	c.state = StateInitial
 	c.ephemeralPublicKey = nil
 	c.ephemeralPrivateKey = nil
@@ -185,4 +697,26 @@ func (c *Client) Reset() {
 	c.ciphertext2 = nil
 	c.sharedSecret2 = nil
 	c.sessionKey = nil
+	c.kem2 = nil
+	c.offeredKEM2s = nil
+	c.offeredSuites = nil
+	c.offer = nil
+	c.cipherSuite = nil
+	c.records = nil
+	c.retried = false
+	c.cookie = nil
+	c.alert = nil
+	c.transcript = nil
+	c.transcriptHash = nil
+	c.clientFinished = nil
+	crypto.Zeroize(c.earlyData)
+	c.earlyData = nil
+	c.earlyDataAccepted = false
+	c.serverExtensions = nil
+	c.resumed = false
+	c.ticket = nil
+	c.psk = nil
+	c.resumptionSecret = nil
+	c.earlyExporter = nil
+	c.exporter = nil
 }
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+// labelClientIdentity keys the encryption of the client identity under the
+// stage-1 secret
+const labelClientIdentity = "c identity"
+
+var (
+	ErrClientAuthRequired  = errors.New("client authentication required")
+	ErrClientNotAuthorized = errors.New("client not authorized")
+)
+
+// clientKEM returns the KEM of the client's long-term key
+func (c *Client) clientKEM() kem.KEM {
+	if c.options.ClientKEM != nil {
+		return c.options.ClientKEM
+	}
+	return c.config.KEM1
+}
+
+// encryptIdentity seals the client identity under the stage-1 key
+func (c *Client) encryptIdentity(suite crypto.CipherSuite) ([]byte, error) {
+	identity := &ClientIdentity{
+		ID:        c.options.ClientID,
+		KEMType:   c.clientKEM().Setup().Name,
+		PublicKey: c.options.ClientPrivateKey.PublicKey().Bytes(),
+	}
+	data, err := (&DefaultSerializer{}).MarshalClientIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := newRecordCipher(suite, c.tempKey.Bytes(), labelClientIdentity, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rc.Seal(crypto.RecordTypeHandshake, data)
+}
+
+// authenticateToServer decapsulates C_3 with the client's long-term key and
+// folds K_3 into K_main
+func (c *Client) authenticateToServer(ctx context.Context, sessionKey, ciphertext3 []byte) ([]byte, error) {
+	if len(ciphertext3) == 0 {
+		return nil, errors.New("server did not encapsulate to the client key")
+	}
+
+	sharedSecret3, err := kem.DecapsulateContext(ctx, c.clientKEM(), c.options.ClientPrivateKey, ciphertext3)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decapsulate client KEM: %w", err)
+	}
+	defer crypto.Zeroize(sharedSecret3)
+
+	return crypto.H4(sessionKey, c.options.ClientPrivateKey.PublicKey().Bytes(), ciphertext3, sharedSecret3)
+}
+
+// processIdentity decrypts and authorizes the client identity. The client is
+// only authenticated once its Finished proves it decapsulated C_3.
+func (s *Server) processIdentity(ctx context.Context, clientHello *ClientHello) error {
+	if len(clientHello.EncryptedIdentity) == 0 {
+		if s.options.RequireClientAuth {
+			return ErrClientAuthRequired
+		}
+		return nil
+	}
+	if s.options.AuthorizeClient == nil {
+		return fmt.Errorf("%w: client authentication not configured", ErrClientNotAuthorized)
+	}
+
+	suite, err := s.earlySuite(clientHello)
+	if err != nil {
+		return err
+	}
+	rc, err := newRecordCipher(suite, s.tempKey.Bytes(), labelClientIdentity, nil)
+	if err != nil {
+		return err
+	}
+	contentType, data, err := rc.Open(clientHello.EncryptedIdentity)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt client identity: %w", err)
+	}
+	if contentType != crypto.RecordTypeHandshake {
+		return fmt.Errorf("unexpected record type %d", contentType)
+	}
+
+	identity, err := (&DefaultSerializer{}).UnmarshalClientIdentity(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse client identity: %w", err)
+	}
+	clientKEM, err := SelectKEM(identity.KEMType)
+	if err != nil {
+		return err
+	}
+	if err := s.config.Policy.checkClientKEM(identity.KEMType); err != nil {
+		return err
+	}
+	clientPublicKey, err := clientKEM.ParsePublicKey(identity.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse client public key: %w", err)
+	}
+
+	if err := s.options.AuthorizeClient(ctx, identity); err != nil {
+		return fmt.Errorf("%w: %w", ErrClientNotAuthorized, err)
+	}
+
+	s.clientIdentity = identity
+	s.clientKEM = clientKEM
+	s.clientPublicKey = clientPublicKey
+	return nil
+}
+
+// authenticateClient encapsulates to the client's long-term key and folds
+// K_3 into K_main
+func (s *Server) authenticateClient(ctx context.Context, sessionKey []byte) ([]byte, []byte, error) {
+	ciphertext3, sharedSecret3, err := kem.EncapsulateContext(ctx, s.clientKEM, s.clientPublicKey, s.rand)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encapsulate to client key: %w", err)
+	}
+	defer crypto.Zeroize(sharedSecret3)
+
+	authenticated, err := crypto.H4(sessionKey, s.clientPublicKey.Bytes(), ciphertext3, sharedSecret3)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ciphertext3, authenticated, nil
+}
+
+// ClientIdentity returns the identity of a client that authenticated with its
+// long-term key, or nil. It is only set once the handshake is complete.
+func (s *Server) ClientIdentity() *ClientIdentity {
+	if s.state != StateEstablished {
+		return nil
+	}
+	return s.clientIdentity
+}
@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"TIMKE/pkg/kem"
+)
+
+// blockingKEM stands for a key provider that does not answer until its
+// context is done
+type blockingKEM struct {
+	kem.KEM
+}
+
+func (k *blockingKEM) GenerateKeyPairContext(ctx context.Context, params kem.Parameters, rand io.Reader) (kem.PublicKey, kem.PrivateKey, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func (k *blockingKEM) EncapsulateContext(ctx context.Context, pk kem.PublicKey, rand io.Reader) ([]byte, []byte, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func (k *blockingKEM) DecapsulateContext(ctx context.Context, sk kem.PrivateKey, ciphertext []byte) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestHandshakeContext(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	newPeers := func(t *testing.T, clientConfig *Config, serverOptions *SessionOptions, serverConfig ...*Config) (*Client, *Server) {
+		client, err := NewClient(clientConfig, NewSessionOptions().WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		if len(serverConfig) == 0 {
+			serverConfig = []*Config{config}
+		}
+		server, err := NewServer(serverConfig[0], serverOptions.WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return client, server
+	}
+	expectFailed := func(t *testing.T, err, want error, state SessionState) {
+		t.Helper()
+
+		if !errors.Is(err, want) {
+			t.Fatalf("Expected %v, got %v", want, err)
+		}
+		if state != StateFailed {
+			t.Errorf("Expected failed state, got %v", state)
+		}
+	}
+
+	t.Run("ClientHelloDeadline", func(t *testing.T) {
+		// The encapsulation to a slow server key is abandoned
+		clientConfig := *config
+		clientConfig.KEM1 = &blockingKEM{KEM: config.KEM1}
+		client, _ := newPeers(t, &clientConfig, NewSessionOptions())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := client.GenerateClientHelloContext(ctx, nil)
+		expectFailed(t, err, context.DeadlineExceeded, client.State())
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the deadline to interrupt the handshake, took %v", elapsed)
+		}
+	})
+
+	t.Run("ClientHelloCanceled", func(t *testing.T) {
+		client, _ := newPeers(t, config, NewSessionOptions())
+
+		_, err := client.GenerateClientHelloContext(canceled, nil)
+		expectFailed(t, err, context.Canceled, client.State())
+	})
+
+	t.Run("ServerCallback", func(t *testing.T) {
+		// Callbacks see the deadline of the ClientHello
+		options := NewSessionOptions().WithNegotiateExtensions(func(ctx context.Context, offered []Extension) ([]Extension, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		client, server := newPeers(t, config, options)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = server.ProcessClientHelloContext(ctx, clientHello)
+		expectFailed(t, err, context.DeadlineExceeded, server.State())
+	})
+
+	t.Run("ServerKEM1Deadline", func(t *testing.T) {
+		// The server decapsulates with the configured provider, not the
+		// registered KEM of the same name
+		serverConfig := *config
+		serverConfig.KEM1 = &blockingKEM{KEM: config.KEM1}
+		client, server := newPeers(t, config, NewSessionOptions(), &serverConfig)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = server.ProcessClientHelloContext(ctx, clientHello)
+		expectFailed(t, err, context.DeadlineExceeded, server.State())
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the deadline to interrupt the handshake, took %v", elapsed)
+		}
+	})
+
+	t.Run("ServerKEM2Deadline", func(t *testing.T) {
+		serverConfig := *config
+		serverConfig.KEM2 = &blockingKEM{KEM: config.KEM2}
+		client, server := newPeers(t, config, NewSessionOptions(), &serverConfig)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = server.GenerateServerResponseContext(ctx, nil)
+		expectFailed(t, err, context.DeadlineExceeded, server.State())
+	})
+
+	t.Run("ClientHelloProcessingCanceled", func(t *testing.T) {
+		client, server := newPeers(t, config, NewSessionOptions())
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+
+		_, err = server.ProcessClientHelloContext(canceled, clientHello)
+		expectFailed(t, err, context.Canceled, server.State())
+	})
+
+	t.Run("ServerResponseCanceled", func(t *testing.T) {
+		client, server := newPeers(t, config, NewSessionOptions())
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+
+		_, err = server.GenerateServerResponseContext(canceled, nil)
+		expectFailed(t, err, context.Canceled, server.State())
+	})
+
+	t.Run("ServerResponseProcessingCanceled", func(t *testing.T) {
+		client, server := newPeers(t, config, NewSessionOptions())
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+
+		_, err = client.ProcessServerResponseContext(canceled, serverResponse)
+		expectFailed(t, err, context.Canceled, client.State())
+	})
+}
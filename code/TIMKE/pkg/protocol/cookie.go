@@ -0,0 +1,246 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+// DefaultCookieLifetime bounds how long a retry cookie is accepted
+const DefaultCookieLifetime = 30 * time.Second
+
+// MaxCookieSize bounds the cookies of received messages
+const MaxCookieSize = 1024
+
+// ExtensionCookie carries ClientHello.Cookie in the extension block of
+// DefaultSerializer, the type TLS uses for its cookie
+const ExtensionCookie ExtensionType = 44
+
+const (
+	cookieDomain         = "TIMKE-cookie"
+	cookieVersion   byte = 1
+	cookieKeySize        = 32
+	cookieKeyIDSize      = 8
+	cookieMACSize        = 64 // HMAC-SHA3-512
+)
+
+// ErrInvalidCookie indicates a cookie that the server did not issue to this
+// client, that expired, or that it did not ask for
+var ErrInvalidCookie = errors.New("invalid retry cookie")
+
+// CookieKeys authenticates the stateless cookies of HelloRetryRequests. A
+// cookie carries the transcript of the ClientHello it answers, so that the
+// server keeps no state until the client echoes it, and is bound to the
+// client's address. The key is replaced every lifetime and the previous one
+// still verifies for one more period. Servers behind one address must share
+// a CookieKeys.
+type CookieKeys struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	rand     io.Reader
+	now      func() time.Time
+
+	current  *cookieKey
+	previous *cookieKey
+}
+
+type cookieKey struct {
+	id      []byte
+	key     []byte
+	created time.Time
+}
+
+// NewCookieKeys returns keys for cookies valid for lifetime,
+// DefaultCookieLifetime if zero. rand defaults to kem.DefaultRand.
+func NewCookieKeys(lifetime time.Duration, rand io.Reader) (*CookieKeys, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultCookieLifetime
+	}
+	if rand == nil {
+		rand = kem.DefaultRand
+	}
+
+	k := &CookieKeys{
+		lifetime: lifetime,
+		rand:     rand,
+		now:      time.Now,
+	}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate replaces the current key, keeping it to verify cookies it issued
+func (k *CookieKeys) Rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.rotate()
+}
+
+func (k *CookieKeys) rotate() error {
+	key := make([]byte, cookieKeySize+cookieKeyIDSize)
+	if _, err := io.ReadFull(k.rand, key); err != nil {
+		return fmt.Errorf("failed to generate cookie key: %w", err)
+	}
+
+	if k.previous != nil {
+		crypto.Zeroize(k.previous.key)
+	}
+	k.previous = k.current
+	k.current = &cookieKey{
+		id:      key[cookieKeySize:],
+		key:     key[:cookieKeySize],
+		created: k.now(),
+	}
+	return nil
+}
+
+// rotateIfDue rotates lazily, dropping keys older than two periods
+func (k *CookieKeys) rotateIfDue() error {
+	now := k.now()
+	if now.Before(k.current.created.Add(k.lifetime)) {
+		return nil
+	}
+
+	expired := !now.Before(k.current.created.Add(2 * k.lifetime))
+	if err := k.rotate(); err != nil {
+		return err
+	}
+	if expired && k.previous != nil {
+		crypto.Zeroize(k.previous.key)
+		k.previous = nil
+	}
+	return nil
+}
+
+// issue returns a cookie for the retry of the ClientHello that ends
+// transcript, as version || key ID || issue time || transcript state ||
+// KEM2 type || MAC. The address is only covered by the MAC.
+func (k *CookieKeys) issue(addr []byte, transcript *Transcript, kem2Type string) ([]byte, error) {
+	state, err := transcript.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkpoint transcript: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.rotateIfDue(); err != nil {
+		return nil, err
+	}
+
+	key := k.current
+	cookie := make([]byte, 0, 1+cookieKeyIDSize+8+4+len(state)+4+len(kem2Type)+cookieMACSize)
+	cookie = append(cookie, cookieVersion)
+	cookie = append(cookie, key.id...)
+	cookie = binary.BigEndian.AppendUint64(cookie, uint64(k.now().UnixMilli()))
+	cookie = writeLengthPrefixedBytes(cookie, state)
+	cookie = writeLengthPrefixedBytes(cookie, []byte(kem2Type))
+
+	return append(cookie, cookieMAC(key.key, cookie, addr)...), nil
+}
+
+// open verifies a cookie echoed from addr and returns the transcript and
+// KEM2 type it carries
+func (k *CookieKeys) open(addr []byte, cookie []byte) (*Transcript, string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.rotateIfDue(); err != nil {
+		return nil, "", err
+	}
+
+	if len(cookie) < 1+cookieKeyIDSize+8+cookieMACSize || cookie[0] != cookieVersion {
+		return nil, "", fmt.Errorf("%w: malformed", ErrInvalidCookie)
+	}
+	body, mac := cookie[:len(cookie)-cookieMACSize], cookie[len(cookie)-cookieMACSize:]
+	id := body[1 : 1+cookieKeyIDSize]
+
+	var key *cookieKey
+	for _, candidate := range []*cookieKey{k.current, k.previous} {
+		if candidate != nil && hmac.Equal(candidate.id, id) {
+			key = candidate
+		}
+	}
+	if key == nil {
+		return nil, "", fmt.Errorf("%w: unknown key", ErrInvalidCookie)
+	}
+	if !hmac.Equal(mac, cookieMAC(key.key, body, addr)) {
+		return nil, "", fmt.Errorf("%w: MAC mismatch", ErrInvalidCookie)
+	}
+
+	// The MAC only proves the server issued it, the fields are checked as
+	// for any message
+	offset := 1 + cookieKeyIDSize
+	issued := time.UnixMilli(int64(binary.BigEndian.Uint64(body[offset : offset+8])))
+	offset += 8
+	if age := k.now().Sub(issued); age < 0 || age > k.lifetime {
+		return nil, "", fmt.Errorf("%w: expired", ErrInvalidCookie)
+	}
+
+	state, offset, err := readLengthPrefixedBytes(body, offset)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrInvalidCookie, err)
+	}
+	kem2Type, offset, err := readLengthPrefixedBytes(body, offset)
+	if err != nil || offset != len(body) {
+		return nil, "", fmt.Errorf("%w: malformed", ErrInvalidCookie)
+	}
+
+	transcript := NewTranscript()
+	if err := transcript.UnmarshalBinary(state); err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrInvalidCookie, err)
+	}
+	return transcript, string(kem2Type), nil
+}
+
+func cookieMAC(key, body, addr []byte) []byte {
+	return crypto.MAC(key, []byte(cookieDomain), body, writeLengthPrefixedBytes(nil, addr))
+}
+
+// cookieAddress is the part of a client address that cookies are bound to:
+// the IP of network addresses, since a client retrying over a new
+// connection comes from another port
+func cookieAddress(addr net.Addr) []byte {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP.To16()
+	case *net.UDPAddr:
+		return a.IP.To16()
+	default:
+		return []byte(addr.String())
+	}
+}
+
+// splitCookie takes the ExtensionCookie out of a received extension list
+func splitCookie(list []Extension) ([]Extension, []byte, error) {
+	ext, ok := FindExtension(list, ExtensionCookie)
+	if !ok {
+		return list, nil, nil
+	}
+	if len(ext.Data) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty cookie", ErrInvalidMessage)
+	}
+	if len(ext.Data) > MaxCookieSize {
+		return nil, nil, fmt.Errorf("%w: cookie of %d bytes exceeds the limit of %d", ErrMessageTooLarge, len(ext.Data), MaxCookieSize)
+	}
+
+	rest := slices.DeleteFunc(slices.Clone(list), func(e Extension) bool { return e.Type == ExtensionCookie })
+	if len(rest) == 0 {
+		rest = nil
+	}
+	return rest, ext.Data, nil
+}
@@ -0,0 +1,291 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"TIMKE/pkg/kem"
+)
+
+func TestCookieKeys(t *testing.T) {
+	keys, err := NewCookieKeys(time.Minute, nil)
+	if err != nil {
+		t.Fatalf("Failed to create cookie keys: %v", err)
+	}
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	transcript := NewTranscript()
+	transcript.Write(MessageTypeClientHello, []byte("client hello"))
+	addr := []byte{192, 0, 2, 1}
+
+	cookie, err := keys.issue(addr, transcript, "ML-KEM-512")
+	if err != nil {
+		t.Fatalf("Failed to issue cookie: %v", err)
+	}
+	restored, kem2Type, err := keys.open(addr, cookie)
+	if err != nil {
+		t.Fatalf("Failed to open cookie: %v", err)
+	}
+	if kem2Type != "ML-KEM-512" {
+		t.Errorf("Expected ML-KEM-512, got %q", kem2Type)
+	}
+	if !bytes.Equal(restored.Sum(), transcript.Sum()) {
+		t.Error("Restored transcript differs")
+	}
+
+	if _, _, err := keys.open([]byte{192, 0, 2, 2}, cookie); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("Expected a cookie from another address to be rejected, got %v", err)
+	}
+	tampered := bytes.Clone(cookie)
+	tampered[len(tampered)/2] ^= 1
+	if _, _, err := keys.open(addr, tampered); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("Expected a tampered cookie to be rejected, got %v", err)
+	}
+	if _, _, err := keys.open(addr, cookie[:10]); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("Expected a truncated cookie to be rejected, got %v", err)
+	}
+
+	// A rotation keeps the key, but not the cookie, valid
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("Failed to rotate cookie keys: %v", err)
+	}
+	if _, _, err := keys.open(addr, cookie); err != nil {
+		t.Errorf("Failed to open cookie after a rotation: %v", err)
+	}
+	now = now.Add(time.Minute + time.Millisecond)
+	if _, _, err := keys.open(addr, cookie); !errors.Is(err, ErrInvalidCookie) {
+		t.Errorf("Expected an expired cookie to be rejected, got %v", err)
+	}
+}
+
+func TestCookieAddress(t *testing.T) {
+	// A client retrying over a new connection keeps its cookie
+	first := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	second := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40001}
+	if !bytes.Equal(cookieAddress(first), cookieAddress(second)) {
+		t.Error("Expected the port to be ignored")
+	}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}
+	if bytes.Equal(cookieAddress(first), cookieAddress(other)) {
+		t.Error("Expected addresses to differ")
+	}
+}
+
+func TestHelloRetryCookie(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	keys, err := NewCookieKeys(0, nil)
+	if err != nil {
+		t.Fatalf("Failed to create cookie keys: %v", err)
+	}
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+
+	newClient := func(t *testing.T, config *Config) *Client {
+		client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		return client
+	}
+	newServer := func(t *testing.T, config *Config, options *SessionOptions, addr net.Addr) *Server {
+		server, err := NewServer(config, options.WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		server.SetClientAddress(addr)
+		return server
+	}
+	// askCookie sends the first ClientHello, which must be answered with a
+	// cookie
+	askCookie := func(t *testing.T, client *Client, server *Server) *HelloRetryRequest {
+		t.Helper()
+
+		clientHello, err := client.GenerateClientHello([]byte("early"))
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected ErrHelloRetryRequired, got %v", err)
+		}
+		hrr := server.HelloRetryRequest()
+		if hrr == nil || len(hrr.Cookie) == 0 {
+			t.Fatalf("Expected a cookie, got %+v", hrr)
+		}
+		return hrr
+	}
+	expectRejected := func(t *testing.T, server *Server, clientHello *ClientHello) {
+		t.Helper()
+
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrInvalidCookie) {
+			t.Fatalf("Expected ErrInvalidCookie, got %v", err)
+		}
+		if alert := server.Alert(); alert == nil || alert.Code != AlertIllegalParameter {
+			t.Errorf("Expected illegal_parameter alert, got %v", alert)
+		}
+	}
+
+	t.Run("Stateless", func(t *testing.T) {
+		client := newClient(t, config)
+		hrr := askCookie(t, client, newServer(t, config, NewSessionOptions().WithCookieKeys(keys), clientAddr))
+		if hrr.KEM2Type != config.KEM2.Setup().Name {
+			t.Errorf("Expected the key share to be kept, got a request for %s", hrr.KEM2Type)
+		}
+
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+		if !bytes.Equal(retryHello.Cookie, hrr.Cookie) {
+			t.Fatal("Expected the cookie to be echoed")
+		}
+
+		// Another server, from another port, finishes the handshake
+		server := newServer(t, config, NewSessionOptions().WithCookieKeys(keys),
+			&net.TCPAddr{IP: clientAddr.IP, Port: clientAddr.Port + 1})
+		earlyData, err := server.ProcessClientHello(retryHello)
+		if err != nil {
+			t.Fatalf("Failed to process retried client hello: %v", err)
+		}
+		if string(earlyData) != "early" {
+			t.Errorf("Expected 0-RTT data to be resent, got %q", earlyData)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+		completeHandshake(t, client, server)
+
+		if !bytes.Equal(client.TranscriptHash(), server.TranscriptHash()) {
+			t.Error("Transcript hashes differ after retry")
+		}
+	})
+
+	t.Run("NoDecapsulation", func(t *testing.T) {
+		// A ClientHello that does not decapsulate is answered all the same
+		client := newClient(t, config)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		clientHello.Ciphertext1 = bytes.Repeat([]byte{0xff}, len(clientHello.Ciphertext1))
+
+		server := newServer(t, config, NewSessionOptions().WithCookieKeys(keys), clientAddr)
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected ErrHelloRetryRequired, got %v", err)
+		}
+	})
+
+	t.Run("KEM2Retry", func(t *testing.T) {
+		// The request for another key share carries the cookie
+		mlkem512, _ := kem.GetKEM("ML-KEM-512")
+		clientConfig := &Config{KEM1: config.KEM1, KEM2: config.KEM2, KEM2Types: []string{"ML-KEM-768", "ML-KEM-512"}}
+		serverConfig := &Config{KEM1: config.KEM1, KEM2: mlkem512}
+
+		client := newClient(t, clientConfig)
+		hrr := askCookie(t, client, newServer(t, serverConfig, NewSessionOptions().WithCookieKeys(keys), clientAddr))
+		if hrr.KEM2Type != "ML-KEM-512" {
+			t.Errorf("Expected a request for ML-KEM-512, got %s", hrr.KEM2Type)
+		}
+
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+		server := newServer(t, serverConfig, NewSessionOptions().WithCookieKeys(keys), clientAddr)
+		if _, err := server.ProcessClientHello(retryHello); err != nil {
+			t.Fatalf("Failed to process retried client hello: %v", err)
+		}
+	})
+
+	t.Run("NotRequired", func(t *testing.T) {
+		var seen net.Addr
+		options := NewSessionOptions().
+			WithCookieKeys(keys).
+			WithRequireCookie(func(ctx context.Context, addr net.Addr) bool {
+				seen = addr
+				return false
+			})
+		server := newServer(t, config, options, clientAddr)
+
+		clientHello, err := newClient(t, config).GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		if seen != clientAddr {
+			t.Errorf("Expected RequireCookie to see %v, got %v", clientAddr, seen)
+		}
+	})
+
+	t.Run("MissingCookie", func(t *testing.T) {
+		client := newClient(t, config)
+		server := newServer(t, config, NewSessionOptions().WithCookieKeys(keys), clientAddr)
+		hrr := askCookie(t, client, server)
+
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+		retryHello.Cookie = nil
+		expectRejected(t, server, retryHello)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		testCases := map[string]struct {
+			options *SessionOptions
+			addr    net.Addr
+			tamper  bool
+		}{
+			"tampered":      {options: NewSessionOptions().WithCookieKeys(keys), addr: clientAddr, tamper: true},
+			"other address": {options: NewSessionOptions().WithCookieKeys(keys), addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2")}},
+			"disabled":      {options: NewSessionOptions(), addr: clientAddr},
+		}
+		for name, tc := range testCases {
+			t.Run(name, func(t *testing.T) {
+				client := newClient(t, config)
+				hrr := askCookie(t, client, newServer(t, config, NewSessionOptions().WithCookieKeys(keys), clientAddr))
+
+				retryHello, err := client.ProcessHelloRetryRequest(hrr)
+				if err != nil {
+					t.Fatalf("Failed to process hello retry request: %v", err)
+				}
+				if tc.tamper {
+					retryHello.Cookie[len(retryHello.Cookie)-1] ^= 1
+				}
+				expectRejected(t, newServer(t, config, tc.options, tc.addr), retryHello)
+			})
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		keys, err := NewCookieKeys(time.Minute, nil)
+		if err != nil {
+			t.Fatalf("Failed to create cookie keys: %v", err)
+		}
+		now := time.Now()
+		keys.now = func() time.Time { return now }
+
+		client := newClient(t, config)
+		hrr := askCookie(t, client, newServer(t, config, NewSessionOptions().WithCookieKeys(keys), clientAddr))
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+
+		now = now.Add(2 * time.Minute)
+		expectRejected(t, newServer(t, config, NewSessionOptions().WithCookieKeys(keys), clientAddr), retryHello)
+	})
+}
@@ -0,0 +1,248 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"TIMKE/pkg/kem"
+)
+
+// MaxMessageSize bounds every frame a Decoder reads, whatever its Limits
+const MaxMessageSize = 16 << 20
+
+// Default bounds of the fields that do not depend on the KEMs
+const (
+	DefaultMaxNameSize    = 64
+	DefaultMaxListEntries = 32
+)
+
+// ErrMessageTooLarge indicates a message or field over its limit
+var ErrMessageTooLarge = errors.New("message too large")
+
+// Limits bounds what a peer can make a Decoder or DefaultSerializer
+// allocate. Zero fields leave a field bounded by the message alone.
+type Limits struct {
+	// MaxMessageSize bounds a whole frame, header included. It is capped at
+	// MaxMessageSize.
+	MaxMessageSize int
+	// MaxPublicKeySize bounds EphemeralPublicKey
+	MaxPublicKeySize int
+	// MaxCiphertextSize bounds Ciphertext1, Ciphertext2 and Ciphertext3
+	MaxCiphertextSize int
+	// MaxNameSize bounds KEM and cipher suite names
+	MaxNameSize int
+	// MaxListEntries bounds the cipher suites and KEM2 types a ClientHello
+	// offers
+	MaxListEntries int
+}
+
+// NewLimits bounds key shares and ciphertexts by the largest encodings of
+// kems, and messages by DefaultMaxMessageSize. If one of kems does not
+// implement kem.Sizer, key shares and ciphertexts are only bounded by the
+// message size.
+func NewLimits(kems ...kem.KEM) *Limits {
+	l := &Limits{
+		MaxMessageSize: DefaultMaxMessageSize,
+		MaxNameSize:    DefaultMaxNameSize,
+		MaxListEntries: DefaultMaxListEntries,
+	}
+
+	for _, k := range kems {
+		sizer, ok := k.(kem.Sizer)
+		if !ok {
+			l.MaxPublicKeySize = 0
+			l.MaxCiphertextSize = 0
+			return l
+		}
+		l.MaxPublicKeySize = max(l.MaxPublicKeySize, sizer.PublicKeySize())
+		l.MaxCiphertextSize = max(l.MaxCiphertextSize, sizer.CiphertextSize())
+	}
+	return l
+}
+
+// Limits bounds received ciphertexts by the sizes of KEM1, KEM2, KEM2Types
+// and every registered KEM the policy allows for client authentication, and
+// messages by the policy's MaxMessageSize. Key shares are bounded by every
+// registered KEM, since a client may send one for any KEM2 and be asked for
+// another in a HelloRetryRequest.
+func (c *Config) Limits() *Limits {
+	var kems []kem.KEM
+	if c.KEM1 != nil {
+		kems = append(kems, c.KEM1)
+	}
+	if c.KEM2 != nil {
+		kems = append(kems, c.KEM2)
+	}
+	for _, name := range c.kem2Types() {
+		if k, err := kem.GetKEM(name); err == nil {
+			kems = append(kems, k)
+		}
+	}
+
+	l := NewLimits(kems...)
+	for _, name := range kem.ListKEMs() {
+		k, err := kem.GetKEM(name)
+		if err != nil {
+			continue
+		}
+		clientKEM := c.Policy.checkClientKEM(name) == nil
+		sizer, ok := k.(kem.Sizer)
+		if !ok {
+			l.MaxPublicKeySize = 0
+			if clientKEM {
+				l.MaxCiphertextSize = 0
+			}
+			continue
+		}
+		// Zero leaves a field unbounded, and stays so
+		if l.MaxPublicKeySize > 0 {
+			l.MaxPublicKeySize = max(l.MaxPublicKeySize, sizer.PublicKeySize())
+		}
+		if l.MaxCiphertextSize > 0 && clientKEM {
+			l.MaxCiphertextSize = max(l.MaxCiphertextSize, sizer.CiphertextSize())
+		}
+	}
+	if c.Policy != nil && c.Policy.MaxMessageSize > 0 {
+		l.MaxMessageSize = c.Policy.MaxMessageSize
+	}
+	return l
+}
+
+func (l *Limits) messageSize() int {
+	if l == nil || l.MaxMessageSize <= 0 {
+		return MaxMessageSize
+	}
+	return min(l.MaxMessageSize, MaxMessageSize)
+}
+
+func (l *Limits) publicKeySize() int {
+	if l == nil {
+		return 0
+	}
+	return l.MaxPublicKeySize
+}
+
+func (l *Limits) ciphertextSize() int {
+	if l == nil {
+		return 0
+	}
+	return l.MaxCiphertextSize
+}
+
+func (l *Limits) nameSize() int {
+	if l == nil {
+		return 0
+	}
+	return l.MaxNameSize
+}
+
+func (l *Limits) listEntries() int {
+	if l == nil {
+		return 0
+	}
+	return l.MaxListEntries
+}
+
+// Decoder reads framed messages from a stream without trusting the lengths
+// the peer announces: frames over the limit are rejected before their body is
+// read, and buffers only grow as data arrives.
+type Decoder struct {
+	r          io.Reader
+	limits     *Limits
+	serializer *DefaultSerializer
+}
+
+// NewDecoder reads from r under limits, NewLimits() if nil
+func NewDecoder(r io.Reader, limits *Limits) *Decoder {
+	if limits == nil {
+		limits = NewLimits()
+	}
+	return &Decoder{
+		r:          r,
+		limits:     limits,
+		serializer: &DefaultSerializer{Limits: limits},
+	}
+}
+
+// Serializer decodes messages under the decoder's field limits
+func (d *Decoder) Serializer() *DefaultSerializer {
+	return d.serializer
+}
+
+// ReadFrame reads the next message and returns its header and the whole
+// frame, header included
+func (d *Decoder) ReadFrame() (*FrameHeader, []byte, error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	h, err := ParseFrameHeader(header[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit := d.limits.messageSize(); int64(h.Length) > int64(limit) {
+		return nil, nil, fmt.Errorf("%w: frame of %d bytes exceeds the limit of %d", ErrMessageTooLarge, h.Length, limit)
+	}
+
+	frame, err := readIncrementally(d.r, header[:], int(h.Length)-FrameHeaderSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, frame, nil
+}
+
+// ReadMessage reads the next message and decodes it according to its type,
+// into a *ClientHello, *ServerResponse, *ClientFinished, *NewSessionTicket,
+// *KeyUpdate, *HelloRetryRequest or *Alert
+func (d *Decoder) ReadMessage() (any, error) {
+	h, frame, err := d.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	switch h.Type {
+	case MessageTypeClientHello:
+		return d.serializer.UnmarshalClientHello(frame)
+	case MessageTypeServerResponse:
+		return d.serializer.UnmarshalServerResponse(frame)
+	case MessageTypeClientFinished:
+		return d.serializer.UnmarshalClientFinished(frame)
+	case MessageTypeNewSessionTicket:
+		return d.serializer.UnmarshalNewSessionTicket(frame)
+	case MessageTypeKeyUpdate:
+		return d.serializer.UnmarshalKeyUpdate(frame)
+	case MessageTypeHelloRetryRequest:
+		return d.serializer.UnmarshalHelloRetryRequest(frame)
+	case MessageTypeAlert:
+		return d.serializer.UnmarshalAlert(frame)
+	default:
+		return nil, fmt.Errorf("%w: type %d", ErrUnexpectedMessage, h.Type)
+	}
+}
+
+// ReadRecords reads n bytes of sealed records, which are bounded by the
+// message size too
+func (d *Decoder) ReadRecords(n int) ([]byte, error) {
+	if limit := d.limits.messageSize(); n < 0 || n > limit {
+		return nil, fmt.Errorf("%w: %d bytes of records exceed the limit of %d", ErrMessageTooLarge, n, limit)
+	}
+	return readIncrementally(d.r, nil, n)
+}
+
+// readIncrementally appends n bytes from r to prefix. The buffer grows with
+// the data received rather than with n, so a peer announcing a large message
+// has to send it.
+func readIncrementally(r io.Reader, prefix []byte, n int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(prefix)+min(n, bytes.MinRead)))
+	buf.Write(prefix)
+	if _, err := io.CopyN(buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
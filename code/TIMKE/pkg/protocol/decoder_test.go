@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"TIMKE/pkg/kem"
+)
+
+// allocatedBytes returns how much f allocates on the heap
+func allocatedBytes(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// frameHeader returns a header announcing a frame of length bytes
+func frameHeader(msgType byte, length uint32) []byte {
+	return appendFrameHeader(nil, msgType, length)
+}
+
+func TestDecoder(t *testing.T) {
+	serializer := &DefaultSerializer{}
+
+	t.Run("Stream", func(t *testing.T) {
+		var stream bytes.Buffer
+		for _, msg := range goldenMessages() {
+			if msg.name == "client_identity" {
+				continue
+			}
+			data, err := msg.marshal(serializer)
+			if err != nil {
+				t.Fatalf("Failed to marshal %s: %v", msg.name, err)
+			}
+			stream.Write(data)
+		}
+
+		decoder := NewDecoder(&stream, nil)
+		var types []string
+		for {
+			msg, err := decoder.ReadMessage()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read message %d: %v", len(types), err)
+			}
+			switch msg.(type) {
+			case *ClientHello:
+				types = append(types, "client_hello")
+			case *ServerResponse:
+				types = append(types, "server_response")
+			case *ClientFinished:
+				types = append(types, "client_finished")
+			case *NewSessionTicket:
+				types = append(types, "new_session_ticket")
+			case *KeyUpdate:
+				types = append(types, "key_update")
+			case *HelloRetryRequest:
+				types = append(types, "hello_retry_request")
+			case *Alert:
+				types = append(types, "alert")
+			}
+		}
+		if len(types) != 10 {
+			t.Errorf("Expected 10 messages, got %v", types)
+		}
+	})
+
+	t.Run("OversizedFrame", func(t *testing.T) {
+		stream := bytes.NewReader(append(frameHeader(MessageTypeClientHello, 0xffffffff), make([]byte, 1024)...))
+		if _, _, err := NewDecoder(stream, nil).ReadFrame(); !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("Expected ErrMessageTooLarge, got %v", err)
+		}
+		if stream.Len() != 1024 {
+			t.Errorf("Expected the body to be left unread, %d bytes remain", stream.Len())
+		}
+
+		limits := &Limits{MaxMessageSize: 100}
+		header := frameHeader(MessageTypeClientFinished, 101)
+		if _, _, err := NewDecoder(bytes.NewReader(header), limits).ReadFrame(); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+		}
+		if _, err := NewDecoder(bytes.NewReader(nil), limits).ReadRecords(101); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Expected ErrMessageTooLarge for records, got %v", err)
+		}
+	})
+
+	t.Run("TruncatedFrame", func(t *testing.T) {
+		// The peer announces the largest frame allowed but sends a few bytes
+		stream := append(frameHeader(MessageTypeClientHello, MaxMessageSize), make([]byte, 16)...)
+		decoder := NewDecoder(bytes.NewReader(stream), &Limits{MaxMessageSize: MaxMessageSize})
+
+		var err error
+		allocated := allocatedBytes(func() {
+			_, _, err = decoder.ReadFrame()
+		})
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+		}
+		if allocated > 64<<10 {
+			t.Errorf("Allocated %d bytes for a 26-byte stream", allocated)
+		}
+	})
+
+	t.Run("FieldLimits", func(t *testing.T) {
+		mlkem768, _ := kem.GetKEM("ML-KEM-768")
+		mlkem1024, _ := kem.GetKEM("ML-KEM-1024")
+		config := newTestConfig(t)
+		config.Policy = &Policy{MinSecurityCategory: 5}
+		limits := config.Limits()
+		// Ciphertext3 may be for any KEM a client is allowed to authenticate with
+		if limits.MaxCiphertextSize != mlkem1024.(kem.Sizer).CiphertextSize() {
+			t.Errorf("Expected ML-KEM-1024 ciphertexts, got %+v", limits)
+		}
+		// A key share for a KEM2 the server does not accept gets a retry
+		if limits.MaxPublicKeySize < mlkem1024.(kem.Sizer).PublicKeySize() {
+			t.Errorf("Expected key shares of any registered KEM, got %+v", limits)
+		}
+
+		limits = newTestConfig(t).Limits()
+		for _, name := range kem.ListKEMs() {
+			k, _ := kem.GetKEM(name)
+			if sizer, ok := k.(kem.Sizer); ok && limits.MaxCiphertextSize < sizer.CiphertextSize() {
+				t.Errorf("Expected ciphertexts of any registered KEM without a policy, %s exceeds %+v", name, limits)
+			}
+		}
+
+		limits = NewLimits(mlkem768)
+		decoder := NewDecoder(nil, limits)
+
+		ch := testClientHello()
+		ch.EphemeralPublicKey = make([]byte, limits.MaxPublicKeySize+1)
+		data, err := serializer.MarshalClientHello(ch)
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+		if _, err := decoder.Serializer().UnmarshalClientHello(data); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Expected ErrMessageTooLarge for the key share, got %v", err)
+		}
+
+		ch = testClientHello()
+		ch.CipherSuites = make([]string, limits.MaxListEntries+1)
+		data, err = serializer.MarshalClientHello(ch)
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+		_, err = decoder.Serializer().UnmarshalClientHello(data)
+		if !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Expected ErrMessageTooLarge for the cipher suites, got %v", err)
+		}
+		if alert := NewAlert(err); alert.Code != AlertDecodeError {
+			t.Errorf("Expected decode_error alert, got %s", alert.Code)
+		}
+
+		sr := &ServerResponse{CipherSuite: string(make([]byte, limits.MaxNameSize+1))}
+		data, err = serializer.MarshalServerResponse(sr)
+		if err != nil {
+			t.Fatalf("Failed to marshal server response: %v", err)
+		}
+		if _, err := decoder.Serializer().UnmarshalServerResponse(data); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Expected ErrMessageTooLarge for the cipher suite, got %v", err)
+		}
+	})
+}
+
+// FuzzDecoder checks that what the decoder allocates is bounded by the bytes
+// it is sent, not by the lengths those announce
+func FuzzDecoder(f *testing.F) {
+	paths, _ := filepath.Glob(filepath.Join("testdata", "wire", "v1", "*.golden"))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatalf("Failed to read %s: %v", path, err)
+		}
+		f.Add(data)
+	}
+	f.Add(frameHeader(MessageTypeClientHello, MaxMessageSize))
+	f.Add(append(frameHeader(MessageTypeClientHello, 22), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0))
+
+	limits := &Limits{MaxMessageSize: 1 << 20, MaxPublicKeySize: 2048, MaxCiphertextSize: 2048, MaxNameSize: 64, MaxListEntries: 16}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoder := NewDecoder(bytes.NewReader(data), limits)
+		allocated := allocatedBytes(func() {
+			for {
+				if _, err := decoder.ReadMessage(); err != nil {
+					return
+				}
+			}
+		})
+
+		// Every field is copied once and buffers at most double
+		if bound := uint64(8*len(data) + 16<<10); allocated > bound {
+			t.Errorf("Allocated %d bytes for %d bytes of input", allocated, len(data))
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// ServerEngine holds what the handshakes of a server share: the long-term
+// key, the configuration and policy, the replay cache, ticket and cookie keys,
+// and metrics. It is validated once and safe for concurrent use; each
+// connection gets its own ServerSession.
+type ServerEngine struct {
+	config     *Config
+	options    *SessionOptions
+	limits     *Limits
+	serializer Serializer
+	metrics    engineMetrics
+}
+
+// EngineMetrics counts the handshakes of a ServerEngine since it was created
+type EngineMetrics struct {
+	Sessions  uint64 // sessions created
+	Retries   uint64 // HelloRetryRequests sent
+	Completed uint64 // handshakes completed
+	Resumed   uint64 // completed handshakes that resumed a ticket
+	Failed    uint64 // handshakes aborted by either side
+}
+
+type engineMetrics struct {
+	sessions  atomic.Uint64
+	retries   atomic.Uint64
+	completed atomic.Uint64
+	resumed   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewServerEngine validates config and options for the sessions it creates.
+// The options are copied, so later changes to them have no effect; the
+// replay cache they name, DefaultReplayCache() if none, is shared by every
+// session. Messages are encoded by their serializer, a DefaultSerializer
+// bounded by config.Limits() if none.
+func NewServerEngine(config *Config, options *SessionOptions) (*ServerEngine, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if options == nil || options.ServerPrivateKey == nil {
+		return nil, errors.New("server private key is required")
+	}
+
+	limits := config.Limits()
+	shared := *options
+	shared.ReplayCache = options.replayCache()
+	shared.ClientExtensions = append([]Extension(nil), options.ClientExtensions...)
+	if shared.Serializer == nil {
+		shared.Serializer = &DefaultSerializer{Limits: limits}
+	}
+
+	return &ServerEngine{
+		config:     config,
+		options:    &shared,
+		limits:     limits,
+		serializer: shared.Serializer,
+	}, nil
+}
+
+// Limits returns the bounds of the messages the sessions accept, for
+// decoding them from a stream
+func (e *ServerEngine) Limits() *Limits {
+	return e.limits
+}
+
+// Serializer returns the encoding of the messages the sessions send and
+// receive
+func (e *ServerEngine) Serializer() Serializer {
+	return e.serializer
+}
+
+// NewSession returns a server for one handshake and the session it
+// establishes
+func (e *ServerEngine) NewSession() *ServerSession {
+	e.metrics.sessions.Add(1)
+
+	server := newServer(e.config, e.options)
+	server.metrics = &e.metrics
+	return &ServerSession{Server: server, engine: e}
+}
+
+// Metrics returns the counters of the engine
+func (e *ServerEngine) Metrics() EngineMetrics {
+	return EngineMetrics{
+		Sessions:  e.metrics.sessions.Load(),
+		Retries:   e.metrics.retries.Load(),
+		Completed: e.metrics.completed.Load(),
+		Resumed:   e.metrics.resumed.Load(),
+		Failed:    e.metrics.failed.Load(),
+	}
+}
+
+// HandleClientHello answers a ClientHello encoded by the serializer of the
+// engine in a new session. The response
+// is what to send back in every case: a ServerResponse, a HelloRetryRequest
+// along with ErrHelloRetryRequired, or an alert along with any other error.
+//
+// The session is returned to finish the handshake, or after a
+// HelloRetryRequest to take the retried ClientHello unless the server uses
+// stateless cookies. Cookies are bound to the address set with
+// ContextWithClientAddress.
+func (e *ServerEngine) HandleClientHello(ctx context.Context, data []byte) ([]byte, *ServerSession, error) {
+	session := e.NewSession()
+	session.SetClientAddress(clientAddressFromContext(ctx))
+
+	response, err := session.HandleClientHello(ctx, data)
+	return response, session, err
+}
+
+// ServerSession is one handshake of a ServerEngine, and the session it
+// establishes. It is not safe for concurrent use.
+type ServerSession struct {
+	*Server
+	engine    *ServerEngine
+	earlyData []byte
+}
+
+// HandleClientHello answers a serialized ClientHello, the first one or the
+// one retried after a HelloRetryRequest, as ServerEngine.HandleClientHello.
+// The ServerResponse carries no payload.
+func (s *ServerSession) HandleClientHello(ctx context.Context, data []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	clientHello, err := s.engine.serializer.UnmarshalClientHello(data)
+	if err != nil {
+		err = s.fail(err)
+		return s.alertResponse(), err
+	}
+
+	s.earlyData, err = s.ProcessClientHelloContext(ctx, clientHello)
+	if errors.Is(err, ErrHelloRetryRequired) {
+		hrr, merr := s.engine.serializer.MarshalHelloRetryRequest(s.HelloRetryRequest())
+		if merr != nil {
+			return nil, s.fail(merr)
+		}
+		return hrr, err
+	}
+	if err != nil {
+		return s.alertResponse(), err
+	}
+
+	serverResponse, err := s.GenerateServerResponseContext(ctx, nil)
+	if err != nil {
+		return s.alertResponse(), err
+	}
+	response, err := s.engine.serializer.MarshalServerResponse(serverResponse)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	return response, nil
+}
+
+// HandleClientFinished completes the handshake with a serialized
+// ClientFinished. On error it returns the alert to send.
+func (s *ServerSession) HandleClientFinished(data []byte) ([]byte, error) {
+	if s.state != StateAwaitingFinished {
+		return nil, errors.New("server not waiting for client finished")
+	}
+
+	clientFinished, err := s.engine.serializer.UnmarshalClientFinished(data)
+	if err != nil {
+		err = s.fail(err)
+		return s.alertResponse(), err
+	}
+	if err := s.ProcessClientFinished(clientFinished); err != nil {
+		return s.alertResponse(), err
+	}
+	return nil, nil
+}
+
+// EarlyData returns the 0-RTT data of the ClientHello, nil if none was
+// accepted
+func (s *ServerSession) EarlyData() []byte {
+	return s.earlyData
+}
+
+// alertResponse serializes the alert of a failed handshake
+func (s *ServerSession) alertResponse() []byte {
+	alert := s.Alert()
+	if alert == nil {
+		return nil
+	}
+	data, err := s.engine.serializer.MarshalAlert(alert)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+type clientAddressKey struct{}
+
+// ContextWithClientAddress returns a context telling
+// ServerEngine.HandleClientHello the address of the client
+func ContextWithClientAddress(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddressKey{}, addr)
+}
+
+func clientAddressFromContext(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(clientAddressKey{}).(net.Addr)
+	return addr
+}
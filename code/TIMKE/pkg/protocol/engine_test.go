@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newTestEngine returns an engine for config and the public key clients need
+func newTestEngine(t *testing.T, config *Config, options *SessionOptions) (*ServerEngine, *SessionOptions) {
+	t.Helper()
+
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	engine, err := NewServerEngine(config, options.WithServerPrivateKey(serverPrivKey))
+	if err != nil {
+		t.Fatalf("Failed to create server engine: %v", err)
+	}
+	return engine, NewSessionOptions().WithServerPublicKey(serverPubKey)
+}
+
+// engineHandshake runs a handshake against engine through its serialized
+// messages
+func engineHandshake(ctx context.Context, engine *ServerEngine, clientConfig *Config, clientOptions *SessionOptions) (*Client, *ServerSession, error) {
+	serializer := &DefaultSerializer{}
+
+	client, err := NewClient(clientConfig, clientOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientHello, err := client.GenerateClientHello([]byte("early"))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := serializer.MarshalClientHello(clientHello)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, session, err := engine.HandleClientHello(ctx, data)
+	if errors.Is(err, ErrHelloRetryRequired) {
+		hrr, err := serializer.UnmarshalHelloRetryRequest(response)
+		if err != nil {
+			return nil, nil, err
+		}
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = serializer.MarshalClientHello(retryHello); err != nil {
+			return nil, nil, err
+		}
+		response, err = session.HandleClientHello(ctx, data)
+	}
+	if err != nil {
+		return nil, session, err
+	}
+
+	serverResponse, err := serializer.UnmarshalServerResponse(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+		return nil, nil, err
+	}
+	clientFinished, err := client.GenerateClientFinished()
+	if err != nil {
+		return nil, nil, err
+	}
+	if data, err = serializer.MarshalClientFinished(clientFinished); err != nil {
+		return nil, nil, err
+	}
+	if _, err := session.HandleClientFinished(data); err != nil {
+		return nil, nil, err
+	}
+	return client, session, nil
+}
+
+func TestServerEngine(t *testing.T) {
+	config := newTestConfig(t)
+
+	t.Run("Concurrent", func(t *testing.T) {
+		engine, clientOptions := newTestEngine(t, config, NewSessionOptions().WithReplayCache(NewMemoryReplayCache(0)))
+
+		const handshakes = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, handshakes)
+		for range handshakes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client, session, err := engineHandshake(context.Background(), engine, config, clientOptions)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(client.GetSessionKey(), session.GetSessionKey()) {
+					errs <- errors.New("session keys differ")
+				}
+				if string(session.EarlyData()) != "early" {
+					errs <- errors.New("0-RTT data lost")
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("Failed handshake: %v", err)
+		}
+
+		metrics := engine.Metrics()
+		if metrics.Sessions != handshakes || metrics.Completed != handshakes || metrics.Failed != 0 {
+			t.Errorf("Unexpected metrics %+v", metrics)
+		}
+	})
+
+	t.Run("StatelessCookie", func(t *testing.T) {
+		keys, err := NewCookieKeys(0, nil)
+		if err != nil {
+			t.Fatalf("Failed to create cookie keys: %v", err)
+		}
+		engine, clientOptions := newTestEngine(t, config, NewSessionOptions().WithCookieKeys(keys))
+		ctx := ContextWithClientAddress(context.Background(), &net.TCPAddr{IP: net.ParseIP("192.0.2.1")})
+		serializer := &DefaultSerializer{}
+
+		client, err := NewClient(config, clientOptions)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		data, err := serializer.MarshalClientHello(clientHello)
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+		response, _, err := engine.HandleClientHello(ctx, data)
+		if !errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected ErrHelloRetryRequired, got %v", err)
+		}
+		hrr, err := serializer.UnmarshalHelloRetryRequest(response)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal hello retry request: %v", err)
+		}
+
+		// The first session is dropped, a new one takes the retry
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+		if data, err = serializer.MarshalClientHello(retryHello); err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+		response, _, err = engine.HandleClientHello(ctx, data)
+		if err != nil {
+			t.Fatalf("Failed to handle retried client hello: %v", err)
+		}
+		if _, err := serializer.UnmarshalServerResponse(response); err != nil {
+			t.Fatalf("Failed to unmarshal server response: %v", err)
+		}
+
+		if metrics := engine.Metrics(); metrics.Sessions != 2 || metrics.Retries != 1 {
+			t.Errorf("Unexpected metrics %+v", metrics)
+		}
+	})
+
+	t.Run("Alert", func(t *testing.T) {
+		engine, _ := newTestEngine(t, config, NewSessionOptions())
+
+		response, session, err := engine.HandleClientHello(context.Background(), []byte("garbage"))
+		if err == nil {
+			t.Fatal("Expected a malformed client hello to be rejected")
+		}
+		alert, uerr := (&DefaultSerializer{}).UnmarshalAlert(response)
+		if uerr != nil {
+			t.Fatalf("Failed to unmarshal alert: %v", uerr)
+		}
+		if want := NewAlert(err).Code; alert.Code != want {
+			t.Errorf("Expected alert %v, got %v", want, alert.Code)
+		}
+		if session.State() != StateFailed {
+			t.Errorf("Expected failed state, got %v", session.State())
+		}
+		if metrics := engine.Metrics(); metrics.Failed != 1 {
+			t.Errorf("Expected one failure, got %+v", metrics)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		engine, clientOptions := newTestEngine(t, config, NewSessionOptions())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, _, err := engineHandshake(ctx, engine, config, clientOptions); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+
+	t.Run("OptionsCopied", func(t *testing.T) {
+		options := NewSessionOptions()
+		engine, clientOptions := newTestEngine(t, config, options)
+
+		// Options changed after the engine was created do not apply
+		options.WithRequireClientAuth(true)
+		if _, _, err := engineHandshake(context.Background(), engine, config, clientOptions); err != nil {
+			t.Fatalf("Failed handshake: %v", err)
+		}
+	})
+}
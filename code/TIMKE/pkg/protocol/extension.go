@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ExtensionType identifies an extension of a ClientHello or ServerResponse
+type ExtensionType uint16
+
+// Extension is one entry of the ordered extension list that ends a
+// ClientHello or ServerResponse. Data is encoded by the codec registered for
+// Type.
+type Extension struct {
+	Type ExtensionType
+	Data []byte
+}
+
+var (
+	// ErrDuplicateExtension indicates an extension list with a type twice
+	ErrDuplicateExtension = errors.New("duplicate extension")
+	// ErrUnsupportedExtension indicates an extension in a ServerResponse
+	// that the client did not offer, or one without a registered codec
+	ErrUnsupportedExtension = errors.New("unsupported extension")
+)
+
+// ExtensionCodec encodes and decodes the data of one extension type
+type ExtensionCodec interface {
+	Type() ExtensionType
+	// Name is used in errors and logs
+	Name() string
+	Marshal(value any) ([]byte, error)
+	// Unmarshal must reject malformed data, which aborts the handshake
+	Unmarshal(data []byte) (any, error)
+}
+
+var extensionRegistry = &ExtensionRegistry{
+	codecs: make(map[ExtensionType]ExtensionCodec),
+}
+
+type ExtensionRegistry struct {
+	mu     sync.RWMutex
+	codecs map[ExtensionType]ExtensionCodec
+}
+
+func (r *ExtensionRegistry) Register(codec ExtensionCodec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[codec.Type()] = codec
+}
+
+func (r *ExtensionRegistry) Get(extType ExtensionType) (ExtensionCodec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	codec, ok := r.codecs[extType]
+	return codec, ok
+}
+
+// RegisterExtension makes an extension type known to every client and
+// server. Unknown extensions are carried in the transcript but otherwise
+// ignored by the server.
+func RegisterExtension(codec ExtensionCodec) {
+	extensionRegistry.Register(codec)
+}
+
+func GetExtensionCodec(extType ExtensionType) (ExtensionCodec, bool) {
+	return extensionRegistry.Get(extType)
+}
+
+// NewExtension encodes value with the codec registered for extType
+func NewExtension(extType ExtensionType, value any) (Extension, error) {
+	codec, ok := GetExtensionCodec(extType)
+	if !ok {
+		return Extension{}, fmt.Errorf("%w: type %d", ErrUnsupportedExtension, extType)
+	}
+
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return Extension{}, fmt.Errorf("failed to marshal %s extension: %w", codec.Name(), err)
+	}
+	return Extension{Type: extType, Data: data}, nil
+}
+
+// Value decodes the extension with its registered codec
+func (e Extension) Value() (any, error) {
+	codec, ok := GetExtensionCodec(e.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: type %d", ErrUnsupportedExtension, e.Type)
+	}
+
+	value, err := codec.Unmarshal(e.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s extension: %v", ErrInvalidMessage, codec.Name(), err)
+	}
+	return value, nil
+}
+
+// FindExtension returns the extension of the given type from list
+func FindExtension(list []Extension, extType ExtensionType) (Extension, bool) {
+	i := slices.IndexFunc(list, func(e Extension) bool { return e.Type == extType })
+	if i < 0 {
+		return Extension{}, false
+	}
+	return list[i], true
+}
+
+// checkExtensions decodes the registered extensions of a received list, so
+// that malformed ones abort the handshake, and skips the others
+func checkExtensions(list []Extension) error {
+	for _, ext := range list {
+		if _, ok := GetExtensionCodec(ext.Type); !ok {
+			continue
+		}
+		if _, err := ext.Value(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExtensionsOffered rejects extensions in a ServerResponse whose type
+// was not in the ClientHello
+func checkExtensionsOffered(offered, response []Extension) error {
+	for _, ext := range response {
+		if _, ok := FindExtension(offered, ext.Type); !ok {
+			return fmt.Errorf("%w: type %d was not offered", ErrUnsupportedExtension, ext.Type)
+		}
+	}
+	return nil
+}
+
+// checkDuplicateExtensions rejects a list with a type twice
+func checkDuplicateExtensions(list []Extension) error {
+	seen := make(map[ExtensionType]bool, len(list))
+	for _, ext := range list {
+		if seen[ext.Type] {
+			return fmt.Errorf("%w: type %d", ErrDuplicateExtension, ext.Type)
+		}
+		seen[ext.Type] = true
+	}
+	return nil
+}
+
+// writeExtensions appends the extension block: its length, then type,
+// length and data of each extension. An empty list is left out, keeping
+// messages without extensions readable by older peers.
+func writeExtensions(result []byte, list []Extension) []byte {
+	if len(list) == 0 {
+		return result
+	}
+
+	result = binary.BigEndian.AppendUint32(result, uint32(extensionsSize(list)-4))
+	for _, ext := range list {
+		result = binary.BigEndian.AppendUint16(result, uint16(ext.Type))
+		result = writeLengthPrefixedBytes(result, ext.Data)
+	}
+
+	return result
+}
+
+// readExtensions reads the extension block at offset, which ends the
+// message. Messages of older peers end before it.
+func readExtensions(data []byte, offset int) ([]Extension, int, error) {
+	if offset == len(data) {
+		return nil, offset, nil
+	}
+
+	block, offset, err := readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, offset, err
+	}
+	if len(block) == 0 {
+		return nil, offset, fmt.Errorf("%w: empty extension block", ErrInvalidMessage)
+	}
+
+	var list []Extension
+	for pos := 0; pos < len(block); {
+		if pos+2 > len(block) {
+			return nil, offset, ErrBufferTooShort
+		}
+		ext := Extension{Type: ExtensionType(binary.BigEndian.Uint16(block[pos : pos+2]))}
+		ext.Data, pos, err = readLengthPrefixedBytes(block, pos+2)
+		if err != nil {
+			return nil, offset, err
+		}
+		list = append(list, ext)
+	}
+
+	if err := checkDuplicateExtensions(list); err != nil {
+		return nil, offset, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	return list, offset, nil
+}
+
+func extensionsSize(list []Extension) int {
+	if len(list) == 0 {
+		return 0
+	}
+
+	size := 4
+	for _, ext := range list {
+		size += 2 + 4 + len(ext.Data)
+	}
+	return size
+}
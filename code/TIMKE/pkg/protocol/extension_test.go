@@ -0,0 +1,266 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+const (
+	testExtensionName    ExtensionType = 0xff00
+	testExtensionUnknown ExtensionType = 0xff01
+)
+
+// nameCodec encodes a non-empty string
+type nameCodec struct{}
+
+func (nameCodec) Type() ExtensionType { return testExtensionName }
+func (nameCodec) Name() string        { return "test name" }
+
+func (nameCodec) Marshal(value any) ([]byte, error) {
+	name, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected string, got %T", value)
+	}
+	return []byte(name), nil
+}
+
+func (nameCodec) Unmarshal(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty name")
+	}
+	return string(data), nil
+}
+
+func init() {
+	RegisterExtension(nameCodec{})
+}
+
+func TestExtensionMarshal(t *testing.T) {
+	serializer := &DefaultSerializer{}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		name, err := NewExtension(testExtensionName, "server.example")
+		if err != nil {
+			t.Fatalf("Failed to create extension: %v", err)
+		}
+		ch := testClientHello()
+		ch.Extensions = []Extension{
+			{Type: testExtensionUnknown, Data: []byte{1, 2, 3}},
+			name,
+			{Type: 7},
+		}
+
+		data, err := serializer.MarshalClientHello(ch)
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+		decoded, err := serializer.UnmarshalClientHello(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal client hello: %v", err)
+		}
+		if len(decoded.Extensions) != 3 {
+			t.Fatalf("Expected 3 extensions, got %d", len(decoded.Extensions))
+		}
+		for i, ext := range ch.Extensions {
+			if decoded.Extensions[i].Type != ext.Type || !bytes.Equal(decoded.Extensions[i].Data, ext.Data) {
+				t.Errorf("Extension %d changed: %+v", i, decoded.Extensions[i])
+			}
+		}
+
+		value, err := decoded.Extensions[1].Value()
+		if err != nil || value != "server.example" {
+			t.Errorf("Expected decoded name, got %v, %v", value, err)
+		}
+		if _, err := decoded.Extensions[0].Value(); !errors.Is(err, ErrUnsupportedExtension) {
+			t.Errorf("Expected ErrUnsupportedExtension, got %v", err)
+		}
+
+		sr := &ServerResponse{CipherSuite: "AES-256-GCM", Extensions: []Extension{name}}
+		data, err = serializer.MarshalServerResponse(sr)
+		if err != nil {
+			t.Fatalf("Failed to marshal server response: %v", err)
+		}
+		decodedSR, err := serializer.UnmarshalServerResponse(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal server response: %v", err)
+		}
+		if len(decodedSR.Extensions) != 1 || decodedSR.Extensions[0].Type != testExtensionName {
+			t.Errorf("Unexpected server extensions %+v", decodedSR.Extensions)
+		}
+	})
+
+	t.Run("WithoutExtensions", func(t *testing.T) {
+		ch := testClientHello()
+		ch.Version = ProtocolVersion
+		data, err := serializer.MarshalClientHello(ch)
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+
+		// Messages without extensions end with the version, as before
+		if !bytes.Equal(data[len(data)-2:], binary.BigEndian.AppendUint16(nil, ProtocolVersion)) {
+			t.Errorf("Expected the message to end with the version, got %x", data[len(data)-6:])
+		}
+		decoded, err := serializer.UnmarshalClientHello(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal client hello: %v", err)
+		}
+		if decoded.Extensions != nil {
+			t.Errorf("Expected no extensions, got %+v", decoded.Extensions)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		// Blocks are appended to the unframed message, so that the frame
+		// length does not mask them
+		serializer := &DefaultSerializer{Legacy: true, AcceptLegacy: true}
+		ch := testClientHello()
+		ch.Extensions = []Extension{{Type: 1}, {Type: 1}}
+		if _, err := serializer.MarshalClientHello(ch); !errors.Is(err, ErrDuplicateExtension) {
+			t.Errorf("Expected ErrDuplicateExtension, got %v", err)
+		}
+
+		ch.Extensions = nil
+		base, err := serializer.MarshalClientHello(ch)
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+
+		testCases := map[string][]byte{
+			"duplicate": {0, 0, 0, 12, 0, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0},
+			"empty":     {0, 0, 0, 0},
+			"truncated": {0, 0, 0, 7, 0, 1, 0, 0, 0, 2, 9},
+			"dangling":  {0, 0, 0, 1, 0},
+		}
+		for name, block := range testCases {
+			if _, err := serializer.UnmarshalClientHello(append(slices.Clone(base), block...)); err == nil {
+				t.Errorf("Expected %s extension block to be rejected", name)
+			} else if !errors.Is(err, ErrInvalidMessage) && !errors.Is(err, ErrBufferTooShort) {
+				t.Errorf("Expected a decoding error for %s extension block, got %v", name, err)
+			}
+		}
+	})
+}
+
+func TestExtensionNegotiation(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	name, err := NewExtension(testExtensionName, "server.example")
+	if err != nil {
+		t.Fatalf("Failed to create extension: %v", err)
+	}
+	unknown := Extension{Type: testExtensionUnknown, Data: []byte("opaque")}
+
+	newPeers := func(t *testing.T, offered []Extension, negotiate func(context.Context, []Extension) ([]Extension, error)) (*Client, *Server) {
+		t.Helper()
+		client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey).WithClientExtensions(offered))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey).WithNegotiateExtensions(negotiate))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return client, server
+	}
+
+	// echoName answers the name extension and ignores the unknown one
+	echoName := func(ctx context.Context, offered []Extension) ([]Extension, error) {
+		ext, ok := FindExtension(offered, testExtensionName)
+		if !ok {
+			return nil, nil
+		}
+		return []Extension{ext}, nil
+	}
+
+	t.Run("Negotiated", func(t *testing.T) {
+		client, server := newPeers(t, []Extension{unknown, name}, echoName)
+		runHandshake(t, client, server, nil)
+
+		if offered := server.ClientExtensions(); len(offered) != 2 || offered[0].Type != testExtensionUnknown {
+			t.Errorf("Expected the server to see both extensions in order, got %+v", offered)
+		}
+		answered := client.ServerExtensions()
+		if len(answered) != 1 {
+			t.Fatalf("Expected one server extension, got %+v", answered)
+		}
+		if value, err := answered[0].Value(); err != nil || value != "server.example" {
+			t.Errorf("Expected echoed name, got %v, %v", value, err)
+		}
+	})
+
+	t.Run("TamperedResponse", func(t *testing.T) {
+		client, server := newPeers(t, []Extension{name}, echoName)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+
+		// Extensions are bound into the transcript the Finished MAC covers
+		serverResponse.Extensions = []Extension{{Type: testExtensionName, Data: []byte("attacker.example")}}
+		if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+			t.Errorf("Expected ErrFinishedMismatch, got %v", err)
+		}
+	})
+
+	t.Run("NotOffered", func(t *testing.T) {
+		client, server := newPeers(t, nil, nil)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+
+		serverResponse.Extensions = []Extension{name}
+		if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrUnsupportedExtension) {
+			t.Fatalf("Expected ErrUnsupportedExtension, got %v", err)
+		}
+		if alert := client.Alert(); alert == nil || alert.Code != AlertUnsupportedExtension {
+			t.Errorf("Expected unsupported_extension alert, got %v", alert)
+		}
+
+		// The server may not answer with types the client did not offer
+		_, server = newPeers(t, nil, func(ctx context.Context, offered []Extension) ([]Extension, error) {
+			return []Extension{name}, nil
+		})
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrUnsupportedExtension) {
+			t.Errorf("Expected ErrUnsupportedExtension, got %v", err)
+		}
+	})
+
+	t.Run("MalformedKnownExtension", func(t *testing.T) {
+		client, server := newPeers(t, []Extension{{Type: testExtensionName}}, nil)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("Expected ErrInvalidMessage, got %v", err)
+		}
+		if alert := server.Alert(); alert == nil || alert.Code != AlertDecodeError {
+			t.Errorf("Expected decode_error alert, got %v", alert)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire format versions of DefaultSerializer
+const (
+	// WireVersionLegacy is the unframed encoding of earlier releases: the
+	// message fields alone, without magic, version or type
+	WireVersionLegacy uint8 = 0
+	// WireVersion1 prefixes the legacy encoding with a FrameHeader
+	WireVersion1 uint8 = 1
+	// WireVersion is the version DefaultSerializer writes
+	WireVersion = WireVersion1
+)
+
+// FrameHeaderSize is the size of the magic, version, type and length that
+// start a framed message
+const FrameHeaderSize = 4 + 1 + 1 + 4
+
+// frameMagic starts every framed message. As a legacy length prefix it would
+// announce a field of over a gigabyte, so the formats cannot be confused.
+var frameMagic = [4]byte{'T', 'M', 'K', 'E'}
+
+// ErrUnsupportedWireVersion indicates a framed message of an unknown version
+var ErrUnsupportedWireVersion = errors.New("unsupported wire format version")
+
+// FrameHeader starts every message of WireVersion1 and later
+type FrameHeader struct {
+	Version uint8
+	// Type is one of the MessageType constants
+	Type byte
+	// Length is the size of the whole frame, header included
+	Length uint32
+}
+
+// ParseFrameHeader reads the header at the start of data, which may hold
+// only the header
+func ParseFrameHeader(data []byte) (*FrameHeader, error) {
+	if len(data) < FrameHeaderSize {
+		return nil, ErrBufferTooShort
+	}
+	if !bytes.Equal(data[:4], frameMagic[:]) {
+		return nil, fmt.Errorf("%w: bad frame magic", ErrInvalidMessage)
+	}
+
+	h := &FrameHeader{
+		Version: data[4],
+		Type:    data[5],
+		Length:  binary.BigEndian.Uint32(data[6:FrameHeaderSize]),
+	}
+	if h.Version != WireVersion1 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedWireVersion, h.Version)
+	}
+	if h.Length < FrameHeaderSize {
+		return nil, fmt.Errorf("%w: frame length %d", ErrInvalidMessage, h.Length)
+	}
+	return h, nil
+}
+
+// isFramed reports whether data starts like a framed message
+func isFramed(data []byte) bool {
+	return bytes.HasPrefix(data, frameMagic[:])
+}
+
+// encoderFor returns a serializer that writes messages in the wire version
+// of data
+func (s *DefaultSerializer) encoderFor(data []byte) *DefaultSerializer {
+	enc := *s
+	enc.Legacy = !isFramed(data)
+	return &enc
+}
+
+// beginFrame returns a buffer for a message of the given type, starting with
+// a header whose length endFrame fills in
+func (s *DefaultSerializer) beginFrame(msgType byte, bodySize int) []byte {
+	if s.Legacy {
+		return make([]byte, 0, bodySize)
+	}
+
+	return appendFrameHeader(make([]byte, 0, FrameHeaderSize+bodySize), msgType, 0)
+}
+
+func appendFrameHeader(buf []byte, msgType byte, length uint32) []byte {
+	buf = append(buf, frameMagic[:]...)
+	buf = append(buf, WireVersion, msgType)
+	return binary.BigEndian.AppendUint32(buf, length)
+}
+
+// NewFrame frames the body of a message of the given type, so that messages
+// of serializers other than DefaultSerializer can be read with a Decoder
+func NewFrame(msgType byte, body []byte) []byte {
+	frame := appendFrameHeader(make([]byte, 0, FrameHeaderSize+len(body)), msgType, uint32(FrameHeaderSize+len(body)))
+	return append(frame, body...)
+}
+
+func (s *DefaultSerializer) endFrame(result []byte) []byte {
+	if !s.Legacy {
+		binary.BigEndian.PutUint32(result[6:FrameHeaderSize], uint32(len(result)))
+	}
+	return result
+}
+
+// openFrame checks the header of a message of the given type and returns the
+// body. Unframed messages are only read with AcceptLegacy.
+func (s *DefaultSerializer) openFrame(msgType byte, data []byte) ([]byte, error) {
+	if !isFramed(data) {
+		if s.AcceptLegacy {
+			return data, nil
+		}
+		return nil, fmt.Errorf("%w: missing frame header", ErrInvalidMessage)
+	}
+
+	h, err := ParseFrameHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if h.Type != msgType {
+		return nil, fmt.Errorf("%w: got type %d, expected %d", ErrUnexpectedMessage, h.Type, msgType)
+	}
+	if int64(h.Length) != int64(len(data)) {
+		return nil, fmt.Errorf("%w: frame length %d, got %d bytes", ErrInvalidMessage, h.Length, len(data))
+	}
+
+	// WireVersion1 frames the legacy body unchanged
+	return data[FrameHeaderSize:], nil
+}
@@ -0,0 +1,247 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/wire")
+
+// goldenMessage is one message of every type, with fixed contents
+type goldenMessage struct {
+	name      string
+	marshal   func(s Serializer) ([]byte, error)
+	unmarshal func(s Serializer, data []byte) (any, error)
+}
+
+func goldenMessages() []goldenMessage {
+	ch := &ClientHello{
+		EphemeralPublicKey: []byte{0x01, 0x02, 0x03, 0x04},
+		Ciphertext1:        []byte{0x05, 0x06, 0x07},
+		EncryptedPayload:   []byte("early data"),
+		KEM1Type:           "ML-KEM-768",
+		KEM2Type:           "ML-KEM-512",
+		CipherSuites:       []string{"AES-256-GCM", "ChaCha20-Poly1305"},
+		Timestamp:          1700000000000,
+		PSKIdentity:        []byte("ticket"),
+		PSKBinder:          []byte{0xb1, 0xb2},
+		EncryptedIdentity:  []byte{0xe1},
+		SupportedKEM2Types: []string{"ML-KEM-512", "ML-KEM-768"},
+		Version:            ProtocolVersion,
+		Extensions:         []Extension{{Type: 0x0010, Data: []byte("h2")}},
+	}
+	chCookie := &ClientHello{
+		EphemeralPublicKey: []byte{0x01, 0x02, 0x03, 0x04},
+		Ciphertext1:        []byte{0x05, 0x06, 0x07},
+		KEM1Type:           "ML-KEM-768",
+		KEM2Type:           "ML-KEM-768",
+		CipherSuites:       []string{"AES-256-GCM"},
+		Timestamp:          1700000000000,
+		Version:            ProtocolVersion,
+		Extensions:         []Extension{{Type: 0x0010, Data: []byte("h2")}},
+		Cookie:             []byte("cookie"),
+	}
+	sr := &ServerResponse{
+		Ciphertext2:       []byte{0x21, 0x22},
+		EncryptedPayload:  []byte("response"),
+		CipherSuite:       "AES-256-GCM",
+		Finished:          bytes.Repeat([]byte{0xf0}, 8),
+		EarlyDataAccepted: true,
+		Ciphertext3:       []byte{0x31},
+		Extensions:        []Extension{{Type: 0x0010, Data: []byte("h2")}},
+	}
+
+	return []goldenMessage{
+		{
+			name:      "client_hello",
+			marshal:   func(s Serializer) ([]byte, error) { return s.MarshalClientHello(ch) },
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalClientHello(data) },
+		},
+		{
+			name: "hello_retry_request_cookie",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalHelloRetryRequest(&HelloRetryRequest{KEM2Type: "ML-KEM-768", Cookie: []byte("cookie")})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalHelloRetryRequest(data) },
+		},
+		{
+			name:      "server_response",
+			marshal:   func(s Serializer) ([]byte, error) { return s.MarshalServerResponse(sr) },
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalServerResponse(data) },
+		},
+		{
+			name: "client_finished",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalClientFinished(&ClientFinished{Finished: bytes.Repeat([]byte{0xcf}, 8)})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalClientFinished(data) },
+		},
+		{
+			name: "new_session_ticket",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalNewSessionTicket(&NewSessionTicket{Lifetime: 3600, Nonce: []byte{0x0a}, Ticket: []byte("opaque ticket")})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalNewSessionTicket(data) },
+		},
+		{
+			name: "client_identity",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalClientIdentity(&ClientIdentity{ID: []byte("device-1"), KEMType: "ML-KEM-768", PublicKey: []byte{0x41, 0x42}})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalClientIdentity(data) },
+		},
+		{
+			name: "key_update",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalKeyUpdate(&KeyUpdate{UpdateRequested: true})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalKeyUpdate(data) },
+		},
+		{
+			name:      "client_hello_cookie",
+			marshal:   func(s Serializer) ([]byte, error) { return s.MarshalClientHello(chCookie) },
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalClientHello(data) },
+		},
+		{
+			name: "hello_retry_request",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalHelloRetryRequest(&HelloRetryRequest{KEM2Type: "ML-KEM-1024"})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalHelloRetryRequest(data) },
+		},
+		{
+			name: "alert",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalAlert(&Alert{Code: AlertDecryptError})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalAlert(data) },
+		},
+		{
+			name: "server_response_resumed",
+			marshal: func(s Serializer) ([]byte, error) {
+				return s.MarshalServerResponse(&ServerResponse{CipherSuite: "AES-256-GCM", Finished: bytes.Repeat([]byte{0xf0}, 8), PSKAccepted: true})
+			},
+			unmarshal: func(s Serializer, data []byte) (any, error) { return s.UnmarshalServerResponse(data) },
+		},
+	}
+}
+
+// TestWireFormatGolden freezes the bytes of every wire version and of the
+// other serializers. Run with -update after an intended change of the current
+// version only.
+func TestWireFormatGolden(t *testing.T) {
+	versions := []struct {
+		dir        string
+		serializer Serializer
+	}{
+		{"v0", &DefaultSerializer{Legacy: true, AcceptLegacy: true}},
+		{"v1", &DefaultSerializer{}},
+		{"cbor", &CBORSerializer{}},
+		{"json", &JSONSerializer{Indent: true}},
+	}
+
+	for _, version := range versions {
+		for _, msg := range goldenMessages() {
+			t.Run(version.dir+"/"+msg.name, func(t *testing.T) {
+				path := filepath.Join("testdata", "wire", version.dir, msg.name+".golden")
+
+				data, err := msg.marshal(version.serializer)
+				if err != nil {
+					t.Fatalf("Failed to marshal: %v", err)
+				}
+				if *updateGolden {
+					if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+						t.Fatalf("Failed to create golden directory: %v", err)
+					}
+					if err := os.WriteFile(path, data, 0644); err != nil {
+						t.Fatalf("Failed to write golden file: %v", err)
+					}
+				}
+
+				golden, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("Failed to read golden file: %v", err)
+				}
+				if !bytes.Equal(data, golden) {
+					t.Errorf("Encoding changed:\ngot  %x\nwant %x", data, golden)
+				}
+				if _, err := msg.unmarshal(version.serializer, golden); err != nil {
+					t.Errorf("Failed to unmarshal golden file: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestFrameHeader(t *testing.T) {
+	serializer := &DefaultSerializer{}
+	hrr := &HelloRetryRequest{KEM2Type: "ML-KEM-1024"}
+	framed, err := serializer.MarshalHelloRetryRequest(hrr)
+	if err != nil {
+		t.Fatalf("Failed to marshal hello retry request: %v", err)
+	}
+	legacy, err := (&DefaultSerializer{Legacy: true}).MarshalHelloRetryRequest(hrr)
+	if err != nil {
+		t.Fatalf("Failed to marshal legacy hello retry request: %v", err)
+	}
+
+	header, err := ParseFrameHeader(framed)
+	if err != nil {
+		t.Fatalf("Failed to parse frame header: %v", err)
+	}
+	if header.Version != WireVersion || header.Type != MessageTypeHelloRetryRequest || int(header.Length) != len(framed) {
+		t.Errorf("Unexpected frame header %+v", header)
+	}
+	if !bytes.Equal(framed[FrameHeaderSize:], legacy) {
+		t.Error("Expected version 1 to frame the legacy body")
+	}
+
+	t.Run("WrongType", func(t *testing.T) {
+		if _, err := serializer.UnmarshalClientFinished(framed); !errors.Is(err, ErrUnexpectedMessage) {
+			t.Errorf("Expected ErrUnexpectedMessage, got %v", err)
+		}
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		if _, err := serializer.UnmarshalHelloRetryRequest(legacy); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("Expected unframed message to be rejected, got %v", err)
+		}
+
+		accepting := &DefaultSerializer{AcceptLegacy: true}
+		for _, data := range [][]byte{legacy, framed} {
+			decoded, err := accepting.UnmarshalHelloRetryRequest(data)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal: %v", err)
+			}
+			if decoded.KEM2Type != hrr.KEM2Type {
+				t.Errorf("Expected %s, got %s", hrr.KEM2Type, decoded.KEM2Type)
+			}
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		unknownVersion := bytes.Clone(framed)
+		unknownVersion[4] = 2
+		if _, err := serializer.UnmarshalHelloRetryRequest(unknownVersion); !errors.Is(err, ErrUnsupportedWireVersion) {
+			t.Errorf("Expected ErrUnsupportedWireVersion, got %v", err)
+		}
+		if alert := NewAlert(ErrUnsupportedWireVersion); alert.Code != AlertProtocolVersion {
+			t.Errorf("Expected protocol_version alert, got %s", alert.Code)
+		}
+
+		testCases := map[string][]byte{
+			"truncated header": framed[:FrameHeaderSize-1],
+			"truncated body":   framed[:len(framed)-1],
+			"trailing data":    append(bytes.Clone(framed), 0),
+		}
+		for name, data := range testCases {
+			if _, err := serializer.UnmarshalHelloRetryRequest(data); !errors.Is(err, ErrInvalidMessage) && !errors.Is(err, ErrBufferTooShort) {
+				t.Errorf("Expected a decoding error for %s, got %v", name, err)
+			}
+		}
+	})
+}
@@ -2,8 +2,17 @@ package protocol
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/crypto/drbg"
 	"TIMKE/pkg/kem"
 )
 
@@ -143,17 +152,41 @@ func testProtocolWithKEMs(t *testing.T, kem1Name, kem2Name string) {
 
 	t.Logf("Client received server data: %q", serverData)
 
-	// 9. 验证客户端和服务器的会话密钥一致
+	// 9. 客户端发送 Finished 消息, 服务器验证后会话建立
+	clientFinished, err := client.GenerateClientFinished()
+	if err != nil {
+		t.Fatalf("Failed to generate client finished: %v", err)
+	}
+
+	clientFinishedBytes, err := serializer.MarshalClientFinished(clientFinished)
+	if err != nil {
+		t.Fatalf("Failed to marshal client finished: %v", err)
+	}
+
+	parsedClientFinished, err := serializer.UnmarshalClientFinished(clientFinishedBytes)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal client finished: %v", err)
+	}
+
+	if err := server.ProcessClientFinished(parsedClientFinished); err != nil {
+		t.Fatalf("Failed to process client finished: %v", err)
+	}
+
+	if client.State() != StateEstablished || server.State() != StateEstablished {
+		t.Fatalf("Session not established: client %v, server %v", client.State(), server.State())
+	}
+
+	// 10. 验证客户端和服务器的会话密钥一致
 	clientSessionKey := client.GetSessionKey()
 	serverSessionKey := server.GetSessionKey()
 
 	if !bytes.Equal(clientSessionKey, serverSessionKey) {
 		t.Error("Client and server session keys do not match")
 	} else {
-		t.Logf("Session key match: %x", clientSessionKey[:8])
+		t.Log("Session keys match")
 	}
 
-	// 10. 测试加密通信
+	// 11. 测试加密通信
 	testMessage := []byte("Encrypted message for testing")
 	encrypted, err := client.Encrypt(testMessage)
 	if err != nil {
@@ -171,3 +204,1701 @@ func testProtocolWithKEMs(t *testing.T, kem1Name, kem2Name string) {
 
 	t.Logf("Successfully tested encrypted communication")
 }
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+	kem1, _ := kem.GetKEM("ML-KEM-768")
+	kem2, _ := kem.GetKEM("ML-KEM-768")
+
+	serverPubKey, serverPrivKey, err := kem1.GenerateKeyPair(kem1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		clientSuites  []string
+		serverSuites  []string
+		expectedSuite string
+	}{
+		{
+			name:          "server preference wins",
+			clientSuites:  []string{crypto.SuiteXChaCha20Poly1305, crypto.SuiteAES256GCMSIV},
+			serverSuites:  []string{crypto.SuiteAES256GCMSIV, crypto.SuiteXChaCha20Poly1305},
+			expectedSuite: crypto.SuiteAES256GCMSIV,
+		},
+		{
+			name:          "ChaCha20 only",
+			clientSuites:  []string{crypto.SuiteChaCha20Poly1305},
+			serverSuites:  []string{crypto.SuiteAES256GCM, crypto.SuiteChaCha20Poly1305},
+			expectedSuite: crypto.SuiteChaCha20Poly1305,
+		},
+		{
+			name:         "no common suite",
+			clientSuites: []string{crypto.SuiteChaCha20Poly1305},
+			serverSuites: []string{crypto.SuiteAES256GCM},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientConfig := &Config{KEM1: kem1, KEM2: kem2, CipherSuites: tc.clientSuites}
+			serverConfig := &Config{KEM1: kem1, KEM2: kem2, CipherSuites: tc.serverSuites}
+
+			client, err := NewClient(clientConfig, NewSessionOptions().WithServerPublicKey(serverPubKey))
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			server, err := NewServer(serverConfig, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+
+			clientHello, err := client.GenerateClientHello(nil)
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+
+			_, err = server.ProcessClientHello(clientHello)
+			if tc.expectedSuite == "" {
+				if err == nil {
+					t.Fatal("Expected negotiation failure, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to process client hello: %v", err)
+			}
+
+			serverResponse, err := server.GenerateServerResponse([]byte("stage-2"))
+			if err != nil {
+				t.Fatalf("Failed to generate server response: %v", err)
+			}
+			if serverResponse.CipherSuite != tc.expectedSuite {
+				t.Errorf("Expected suite %s, got %s", tc.expectedSuite, serverResponse.CipherSuite)
+			}
+
+			if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+				t.Fatalf("Failed to process server response: %v", err)
+			}
+			completeHandshake(t, client, server)
+
+			encrypted, err := server.Encrypt([]byte("ping"))
+			if err != nil {
+				t.Fatalf("Server encryption failed: %v", err)
+			}
+			if _, err := client.Decrypt(encrypted); err != nil {
+				t.Fatalf("Client decryption failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestHelloRetryRequest(t *testing.T) {
+	kem1, _ := kem.GetKEM("ML-KEM-768")
+	mlkem512, _ := kem.GetKEM("ML-KEM-512")
+
+	serverPubKey, serverPrivKey, err := kem1.GenerateKeyPair(kem1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	// The client prefers ML-KEM-768 but also accepts ML-KEM-512, which is
+	// all the server accepts
+	clientConfig := &Config{KEM1: kem1, KEM2: kem1, KEM2Types: []string{"ML-KEM-768", "ML-KEM-512"}}
+	serverConfig := &Config{KEM1: kem1, KEM2: mlkem512}
+
+	newPeers := func(t *testing.T) (*Client, *Server) {
+		client, err := NewClient(clientConfig, NewSessionOptions().WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(serverConfig, NewSessionOptions().
+			WithServerPrivateKey(serverPrivKey).
+			WithReplayCache(NewMemoryReplayCache(0)))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return client, server
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		client, server := newPeers(t)
+
+		clientHello, err := client.GenerateClientHello([]byte("early"))
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if !slices.Equal(clientHello.SupportedKEM2Types, clientConfig.KEM2Types) {
+			t.Fatalf("Expected KEM2 types %v offered, got %v", clientConfig.KEM2Types, clientHello.SupportedKEM2Types)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected ErrHelloRetryRequired, got %v", err)
+		}
+		hrr := server.HelloRetryRequest()
+		if hrr == nil || hrr.KEM2Type != "ML-KEM-512" {
+			t.Fatalf("Expected retry for ML-KEM-512, got %+v", hrr)
+		}
+
+		retryHello, err := client.ProcessHelloRetryRequest(hrr)
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+		if retryHello.KEM2Type != "ML-KEM-512" {
+			t.Fatalf("Expected ML-KEM-512 key share, got %s", retryHello.KEM2Type)
+		}
+		earlyData, err := server.ProcessClientHello(retryHello)
+		if err != nil {
+			t.Fatalf("Failed to process retried client hello: %v", err)
+		}
+		if string(earlyData) != "early" {
+			t.Errorf("Expected 0-RTT data to be resent, got %q", earlyData)
+		}
+
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+		completeHandshake(t, client, server)
+
+		if !bytes.Equal(client.TranscriptHash(), server.TranscriptHash()) {
+			t.Error("Transcript hashes differ after retry")
+		}
+		if _, err := client.ProcessHelloRetryRequest(hrr); err == nil {
+			t.Error("Expected hello retry request to be rejected after the handshake")
+		}
+	})
+
+	t.Run("NoCommonKEM", func(t *testing.T) {
+		client, _ := newPeers(t)
+		server, err := NewServer(&Config{KEM1: kem1, KEM2Types: []string{"ML-KEM-1024"}},
+			NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrNoCommonKEM) {
+			t.Fatalf("Expected ErrNoCommonKEM, got %v", err)
+		}
+		if server.HelloRetryRequest() != nil {
+			t.Error("Expected no hello retry request")
+		}
+	})
+
+	t.Run("UnknownKEM1", func(t *testing.T) {
+		client, server := newPeers(t)
+
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		clientHello.KEM1Type = "ML-KEM-1024"
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrNoCommonKEM) {
+			t.Fatalf("Expected ErrNoCommonKEM, got %v", err)
+		}
+	})
+
+	t.Run("IgnoredRetry", func(t *testing.T) {
+		client, server := newPeers(t)
+
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected ErrHelloRetryRequired, got %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err == nil || errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected a second retry to fail the handshake, got %v", err)
+		}
+		if server.State() != StateFailed {
+			t.Errorf("Expected failed state, got %v", server.State())
+		}
+	})
+
+	t.Run("InjectedRetry", func(t *testing.T) {
+		// An attacker asks a client for a weaker key share than the server
+		// wants; the server never saw the first ClientHello
+		client, _ := newPeers(t)
+		server, err := NewServer(clientConfig, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		if _, err := client.GenerateClientHello(nil); err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		retryHello, err := client.ProcessHelloRetryRequest(&HelloRetryRequest{KEM2Type: "ML-KEM-512"})
+		if err != nil {
+			t.Fatalf("Failed to process hello retry request: %v", err)
+		}
+		if _, err := server.ProcessClientHello(retryHello); !errors.Is(err, ErrHelloRetryRequired) {
+			t.Fatalf("Expected the server to ask for its preferred KEM2, got %v", err)
+		}
+		if _, err := client.ProcessHelloRetryRequest(server.HelloRetryRequest()); err == nil {
+			t.Fatal("Expected a second hello retry request to be rejected")
+		}
+	})
+}
+
+// newTestConfig returns a fast ML-KEM-768 configuration for handshake tests
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+
+	kem1, err := kem.GetKEM("ML-KEM-768")
+	if err != nil {
+		t.Fatalf("Failed to get KEM: %v", err)
+	}
+	kem2, err := kem.GetKEM("ML-KEM-768")
+	if err != nil {
+		t.Fatalf("Failed to get KEM: %v", err)
+	}
+
+	return &Config{KEM1: kem1, KEM2: kem2, CipherSuites: crypto.DefaultCipherSuites()}
+}
+
+// establishSession runs a complete handshake between a new client and server
+func establishSession(t *testing.T, config *Config) (*Client, *Server) {
+	t.Helper()
+
+	client, server, serverResponse := startHandshake(t, config)
+	if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+		t.Fatalf("Failed to process server response: %v", err)
+	}
+	completeHandshake(t, client, server)
+
+	return client, server
+}
+
+// startHandshake runs the handshake up to the server response
+func startHandshake(t *testing.T, config *Config) (*Client, *Server, *ServerResponse) {
+	t.Helper()
+
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	server, err := NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	clientHello, err := client.GenerateClientHello(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+	if _, err := server.ProcessClientHello(clientHello); err != nil {
+		t.Fatalf("Failed to process client hello: %v", err)
+	}
+	serverResponse, err := server.GenerateServerResponse(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server response: %v", err)
+	}
+
+	return client, server, serverResponse
+}
+
+// completeHandshake delivers the client Finished to the server
+func completeHandshake(t *testing.T, client *Client, server *Server) {
+	t.Helper()
+
+	clientFinished, err := client.GenerateClientFinished()
+	if err != nil {
+		t.Fatalf("Failed to generate client finished: %v", err)
+	}
+	if err := server.ProcessClientFinished(clientFinished); err != nil {
+		t.Fatalf("Failed to process client finished: %v", err)
+	}
+}
+
+func TestRecordReplayRejected(t *testing.T) {
+	client, server := establishSession(t, newTestConfig(t))
+
+	first, err := client.Encrypt([]byte("first"))
+	if err != nil {
+		t.Fatalf("Client encryption failed: %v", err)
+	}
+	second, err := client.Encrypt([]byte("second"))
+	if err != nil {
+		t.Fatalf("Client encryption failed: %v", err)
+	}
+
+	if _, err := server.Decrypt(second); err != nil {
+		t.Fatalf("Server decryption failed: %v", err)
+	}
+	if _, err := server.Decrypt(first); err != nil {
+		t.Fatalf("Server decryption of reordered record failed: %v", err)
+	}
+	if _, err := server.Decrypt(second); !errors.Is(err, crypto.ErrReplayedRecord) {
+		t.Errorf("Expected ErrReplayedRecord, got %v", err)
+	}
+
+	// Each direction has its own keys
+	if _, err := client.Decrypt(first); err == nil {
+		t.Error("Expected client to reject its own record")
+	}
+}
+
+func TestResetWipesSecrets(t *testing.T) {
+	client, server := establishSession(t, newTestConfig(t))
+
+	clientKey := client.sessionKey.Bytes()
+	serverKey := server.sessionKey.Bytes()
+	if len(clientKey) == 0 || len(serverKey) == 0 {
+		t.Fatal("Expected established session keys")
+	}
+
+	// Handshake secrets are wiped as soon as K_main is derived
+	if client.sharedSecret1.Len() != 0 || client.sharedSecret2.Len() != 0 || client.tempKey.Len() != 0 {
+		t.Error("Client kept handshake secrets after deriving the session key")
+	}
+	if server.sharedSecret1.Len() != 0 || server.sharedSecret2.Len() != 0 || server.tempKey.Len() != 0 {
+		t.Error("Server kept handshake secrets after deriving the session key")
+	}
+
+	client.Reset()
+	server.Reset()
+
+	if !bytes.Equal(clientKey, make([]byte, len(clientKey))) {
+		t.Error("Client session key was not zeroed on Reset")
+	}
+	if !bytes.Equal(serverKey, make([]byte, len(serverKey))) {
+		t.Error("Server session key was not zeroed on Reset")
+	}
+}
+
+func TestInjectedRandomness(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, _, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	generateHello := func() *ClientHello {
+		seeded := *config
+		seeded.Rand, err = drbg.New(drbg.Options{
+			Entropy:         bytes.NewReader(make([]byte, 64)),
+			Nonce:           []byte("test"),
+			SkipHealthTests: true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create DRBG: %v", err)
+		}
+
+		client, err := NewClient(&seeded, NewSessionOptions().WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		return clientHello
+	}
+
+	first := generateHello()
+	second := generateHello()
+	if !bytes.Equal(first.EphemeralPublicKey, second.EphemeralPublicKey) {
+		t.Error("Ephemeral keys differ with the same randomness source")
+	}
+	if !bytes.Equal(first.Ciphertext1, second.Ciphertext1) {
+		t.Error("KEM1 ciphertexts differ with the same randomness source")
+	}
+
+	// OW-ChCCA cannot use the injected source, which is refused up front
+	owchcca := *config
+	owchcca.KEM1, err = kem.GetKEM("OWChCCA-16")
+	if err != nil {
+		t.Fatalf("Failed to get KEM: %v", err)
+	}
+	owchcca.Rand = bytes.NewReader(make([]byte, 1<<20))
+	if err := owchcca.Validate(); !errors.Is(err, kem.ErrUnsupportedRand) {
+		t.Errorf("Expected kem.ErrUnsupportedRand, got %v", err)
+	}
+
+	owchcca = *config
+	owchcca.KEM2Types = []string{"OWChCCA-16"}
+	owchcca.Rand = bytes.NewReader(make([]byte, 1<<20))
+	if err := owchcca.Validate(); !errors.Is(err, kem.ErrUnsupportedRand) {
+		t.Errorf("Expected kem.ErrUnsupportedRand for a KEM2 type, got %v", err)
+	}
+
+	owchcca.Rand = nil
+	if err := owchcca.Validate(); err != nil {
+		t.Errorf("Failed to validate OW-ChCCA with the default source: %v", err)
+	}
+}
+
+func TestTranscriptBinding(t *testing.T) {
+	config := newTestConfig(t)
+	client, server := establishSession(t, config)
+
+	if !bytes.Equal(client.TranscriptHash(), server.TranscriptHash()) {
+		t.Fatal("Transcript hashes do not match")
+	}
+	if !bytes.Equal(client.ChannelBinding(), server.ChannelBinding()) {
+		t.Fatal("Channel bindings do not match")
+	}
+
+	// Tamper with a field the KEMs do not cover
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	client, err = NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	server, err = NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	clientHello, err := client.GenerateClientHello(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+	tampered := *clientHello
+	tampered.CipherSuites = append(slices.Clone(clientHello.CipherSuites), "NULL")
+	if _, err := server.ProcessClientHello(&tampered); err != nil {
+		t.Fatalf("Failed to process client hello: %v", err)
+	}
+	serverResponse, err := server.GenerateServerResponse(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server response: %v", err)
+	}
+	if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+		t.Errorf("Expected ErrFinishedMismatch after tampering with the client hello, got %v", err)
+	}
+	if client.State() != StateFailed {
+		t.Errorf("Expected client to fail, got state %v", client.State())
+	}
+}
+
+func TestNegotiationBinding(t *testing.T) {
+	kem1, _ := kem.GetKEM("ML-KEM-768")
+	config := &Config{
+		KEM1:         kem1,
+		KEM2:         kem1,
+		KEM2Types:    []string{"ML-KEM-768", "ML-KEM-512"},
+		CipherSuites: crypto.DefaultCipherSuites(),
+	}
+	serverPubKey, serverPrivKey, err := kem1.GenerateKeyPair(kem1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	// The name extension is offered and echoed, so that both Extensions
+	// fields carry something to tamper with
+	name, err := NewExtension(testExtensionName, "server.example")
+	if err != nil {
+		t.Fatalf("Failed to create extension: %v", err)
+	}
+	echo := func(ctx context.Context, offered []Extension) ([]Extension, error) {
+		return offered, nil
+	}
+
+	newPeers := func(t *testing.T) (*Client, *Server) {
+		client, err := NewClient(config, NewSessionOptions().
+			WithServerPublicKey(serverPubKey).
+			WithClientExtensions([]Extension{name}))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(config, NewSessionOptions().
+			WithServerPrivateKey(serverPrivKey).
+			WithReplayCache(NewMemoryReplayCache(0)).
+			WithNegotiateExtensions(echo))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return client, server
+	}
+
+	// Every wire field of the ClientHello. The 0-RTT data and the PSK binder
+	// are computed from the others, and the binder of a full handshake is
+	// refused outright.
+	helloFields := []struct {
+		name   string
+		tamper func(ch *ClientHello)
+	}{
+		{"Version", func(ch *ClientHello) { ch.Version++ }},
+		{"KEM1Type", func(ch *ClientHello) { ch.KEM1Type = "ML-KEM-1024" }},
+		{"KEM2Type", func(ch *ClientHello) { ch.KEM2Type = "ML-KEM-512" }},
+		{"SupportedKEM2Types", func(ch *ClientHello) { ch.SupportedKEM2Types = ch.SupportedKEM2Types[:1] }},
+		{"CipherSuites", func(ch *ClientHello) {
+			// The first entry picks the 0-RTT suite, so reorder behind it
+			suites := slices.Clone(ch.CipherSuites)
+			suites[1], suites[2] = suites[2], suites[1]
+			ch.CipherSuites = suites
+		}},
+		{"Timestamp", func(ch *ClientHello) { ch.Timestamp++ }},
+		{"Extensions", func(ch *ClientHello) {
+			ch.Extensions = []Extension{{Type: testExtensionName, Data: []byte("attacker.example")}}
+		}},
+		{"EphemeralPublicKey", func(ch *ClientHello) { ch.EphemeralPublicKey = flipped(ch.EphemeralPublicKey) }},
+		{"Ciphertext1", func(ch *ClientHello) { ch.Ciphertext1 = flipped(ch.Ciphertext1) }},
+		{"EncryptedPayload", func(ch *ClientHello) { ch.EncryptedPayload = append(ch.EncryptedPayload, 0) }},
+		{"EncryptedIdentity", func(ch *ClientHello) { ch.EncryptedIdentity = []byte("identity") }},
+		{"PSKIdentity", func(ch *ClientHello) { ch.PSKIdentity = []byte("ticket") }},
+		{"PSKBinder", func(ch *ClientHello) { ch.PSKBinder = []byte("binder") }},
+		{"Cookie", func(ch *ClientHello) { ch.Cookie = []byte("cookie") }},
+	}
+
+	for _, field := range helloFields {
+		t.Run("ClientHello."+field.name, func(t *testing.T) {
+			// 0-RTT data under a modified ClientHello must not be accepted
+			client, server := newPeers(t)
+			clientHello, err := client.GenerateClientHello([]byte("early"))
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+			tampered := *clientHello
+			field.tamper(&tampered)
+			// A forged ticket is dropped for the full handshake, which only
+			// refuses the 0-RTT data
+			if data, err := server.ProcessClientHello(&tampered); data != nil || (err == nil && server.EarlyDataError() == nil) {
+				t.Fatalf("Expected tampered client hello to be rejected, got %q, %v", data, err)
+			}
+
+			// Without 0-RTT data the peers must not agree on a session key
+			client, server = newPeers(t)
+			clientHello, err = client.GenerateClientHello(nil)
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+			tampered = *clientHello
+			field.tamper(&tampered)
+			if _, err := server.ProcessClientHello(&tampered); err != nil {
+				return
+			}
+			serverResponse, err := server.GenerateServerResponse(nil)
+			if err != nil {
+				t.Fatalf("Failed to generate server response: %v", err)
+			}
+			if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+				t.Errorf("Expected ErrFinishedMismatch, got %v", err)
+			}
+		})
+	}
+
+	// Ciphertext3 is only sent in mutual authentication mode, where
+	// TestMutualAuthentication covers it
+	responseFields := []struct {
+		name   string
+		tamper func(ch *ClientHello, sr *ServerResponse)
+		want   error
+	}{
+		{"CipherSuite", func(ch *ClientHello, sr *ServerResponse) {
+			// Another suite the client offered
+			sr.CipherSuite = ch.CipherSuites[len(ch.CipherSuites)-1]
+		}, ErrFinishedMismatch},
+		{"Ciphertext2", func(ch *ClientHello, sr *ServerResponse) { sr.Ciphertext2 = flipped(sr.Ciphertext2) }, ErrFinishedMismatch},
+		// The payload is the one field checked by its AEAD rather than by
+		// the Finished MAC
+		{"EncryptedPayload", func(ch *ClientHello, sr *ServerResponse) { sr.EncryptedPayload = flipped(sr.EncryptedPayload) }, crypto.ErrDecryptionFailed},
+		{"Finished", func(ch *ClientHello, sr *ServerResponse) { sr.Finished = flipped(sr.Finished) }, ErrFinishedMismatch},
+		{"EarlyDataAccepted", func(ch *ClientHello, sr *ServerResponse) { sr.EarlyDataAccepted = !sr.EarlyDataAccepted }, ErrFinishedMismatch},
+		{"Extensions", func(ch *ClientHello, sr *ServerResponse) {
+			sr.Extensions = []Extension{{Type: testExtensionName, Data: []byte("attacker.example")}}
+		}, ErrFinishedMismatch},
+	}
+
+	for _, field := range responseFields {
+		t.Run("ServerResponse."+field.name, func(t *testing.T) {
+			client, server := newPeers(t)
+			clientHello, err := client.GenerateClientHello([]byte("early"))
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+			if _, err := server.ProcessClientHello(clientHello); err != nil {
+				t.Fatalf("Failed to process client hello: %v", err)
+			}
+			serverResponse, err := server.GenerateServerResponse([]byte("payload"))
+			if err != nil {
+				t.Fatalf("Failed to generate server response: %v", err)
+			}
+
+			field.tamper(clientHello, serverResponse)
+			if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, field.want) {
+				t.Errorf("Expected %v, got %v", field.want, err)
+			}
+		})
+	}
+
+	t.Run("SessionKeys", func(t *testing.T) {
+		// The negotiated parameters feed into K_main, not only the transcript
+		client, server := newPeers(t)
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+
+		kMain, err := crypto.H2(serverPubKey.Bytes(), clientHello.EphemeralPublicKey, clientHello.Ciphertext1,
+			serverResponse.Ciphertext2, client.sharedSecret1.Bytes(), mustDecapsulate(t, client, serverResponse))
+		if err != nil {
+			t.Fatalf("Failed to derive K_main: %v", err)
+		}
+		if bytes.Equal(kMain, server.sessionKey.Bytes()) {
+			t.Error("Session key does not depend on the negotiated parameters")
+		}
+	})
+}
+
+// mustDecapsulate recovers K_2 with the client's ephemeral key without
+// advancing the client
+func mustDecapsulate(t *testing.T, client *Client, serverResponse *ServerResponse) []byte {
+	t.Helper()
+
+	k2, err := client.kem2.Decapsulate(client.ephemeralPrivateKey, serverResponse.Ciphertext2)
+	if err != nil {
+		t.Fatalf("Failed to decapsulate KEM2: %v", err)
+	}
+	return k2
+}
+
+func TestFinishedRequired(t *testing.T) {
+	config := newTestConfig(t)
+
+	client, server, serverResponse := startHandshake(t, config)
+
+	// The server is not established until the client has confirmed its keys
+	if server.State() != StateAwaitingFinished {
+		t.Errorf("Expected server to await finished, got state %v", server.State())
+	}
+	if _, err := server.Decrypt([]byte("record")); err == nil {
+		t.Error("Server accepted application data before client finished")
+	}
+
+	// A forged server Finished is rejected
+	serverResponse.Finished[0] ^= 1
+	if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+		t.Errorf("Expected ErrFinishedMismatch for forged server finished, got %v", err)
+	}
+
+	// A forged client Finished is rejected
+	client, server, serverResponse = startHandshake(t, config)
+	if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+		t.Fatalf("Failed to process server response: %v", err)
+	}
+	clientFinished, err := client.GenerateClientFinished()
+	if err != nil {
+		t.Fatalf("Failed to generate client finished: %v", err)
+	}
+
+	clientFinished.Finished[0] ^= 1
+	if err := server.ProcessClientFinished(clientFinished); !errors.Is(err, ErrFinishedMismatch) {
+		t.Errorf("Expected ErrFinishedMismatch for forged client finished, got %v", err)
+	}
+	if server.State() != StateFailed {
+		t.Errorf("Expected server to fail, got state %v", server.State())
+	}
+}
+
+func TestEarlyDataReplay(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	serverOptions := NewSessionOptions().
+		WithServerPrivateKey(serverPrivKey).
+		WithReplayCache(NewMemoryReplayCache(0))
+
+	client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	clientHello, err := client.GenerateClientHello([]byte("transfer 100"))
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+
+	// An attacker delivers a copy first
+	first, err := NewServer(config, serverOptions)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if data, err := first.ProcessClientHello(clientHello); err != nil || data == nil {
+		t.Fatalf("Expected first delivery to be accepted, got %q, %v", data, err)
+	}
+
+	// The second delivery loses its early data but still completes
+	server, err := NewServer(config, serverOptions)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	data, err := server.ProcessClientHello(clientHello)
+	if err != nil {
+		t.Fatalf("Failed to process replayed client hello: %v", err)
+	}
+	if data != nil {
+		t.Errorf("Replayed 0-RTT data was returned: %q", data)
+	}
+	if server.EarlyDataAccepted() || !errors.Is(server.EarlyDataError(), ErrEarlyDataReplayed) {
+		t.Errorf("Expected ErrEarlyDataReplayed, got %v", server.EarlyDataError())
+	}
+
+	serverResponse, err := server.GenerateServerResponse(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server response: %v", err)
+	}
+	if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+		t.Fatalf("Failed to process server response: %v", err)
+	}
+	completeHandshake(t, client, server)
+
+	if _, err := client.RejectedEarlyData(); !errors.Is(err, ErrEarlyDataRejected) {
+		t.Errorf("Expected client to learn of the rejection, got %v", err)
+	}
+}
+
+func TestEarlyDataWindow(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	client.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	clientHello, err := client.GenerateClientHello([]byte("stale"))
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+
+	server, err := NewServer(config, NewSessionOptions().
+		WithServerPrivateKey(serverPrivKey).
+		WithReplayCache(NewMemoryReplayCache(0)).
+		WithEarlyDataWindow(5*time.Second))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	data, err := server.ProcessClientHello(clientHello)
+	if err != nil {
+		t.Fatalf("Failed to process client hello: %v", err)
+	}
+	if data != nil || !errors.Is(server.EarlyDataError(), ErrEarlyDataOutOfTime) {
+		t.Errorf("Expected stale 0-RTT data to be rejected, got %q, %v", data, server.EarlyDataError())
+	}
+}
+
+func TestEarlyDataTimestampRewritten(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	// A ClientHello captured long enough ago for its entry to have left the
+	// replay cache
+	client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	client.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	clientHello, err := client.GenerateClientHello([]byte("transfer 100"))
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+
+	// The attacker moves the timestamp into the acceptance window
+	clientHello.Timestamp = uint64(time.Now().UnixMilli())
+	server, err := NewServer(config, NewSessionOptions().
+		WithServerPrivateKey(serverPrivKey).
+		WithReplayCache(NewMemoryReplayCache(0)))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	data, err := server.ProcessClientHello(clientHello)
+	if err == nil || data != nil {
+		t.Fatalf("Expected the rewritten client hello to be rejected, got %q, %v", data, err)
+	}
+	if server.State() != StateFailed {
+		t.Errorf("Expected failed state, got %v", server.State())
+	}
+}
+
+func TestEarlyDataPolicy(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	// Only idempotent requests may be replayed safely
+	var offered EarlyDataInfo
+	serverOptions := NewSessionOptions().
+		WithServerPrivateKey(serverPrivKey).
+		WithReplayCache(NewMemoryReplayCache(0)).
+		WithMaxEarlyDataSize(64).
+		WithAcceptEarlyData(func(ctx context.Context, info EarlyDataInfo) bool {
+			offered = info
+			return bytes.HasPrefix(info.Data, []byte("GET "))
+		})
+
+	handshake := func(earlyData []byte) (*Client, *Server, *ServerResponse) {
+		client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(config, serverOptions)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		clientHello, err := client.GenerateClientHello(earlyData)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		return client, server, serverResponse
+	}
+
+	t.Run("Accepted", func(t *testing.T) {
+		client, server, serverResponse := handshake([]byte("GET /"))
+		if !serverResponse.EarlyDataAccepted || !server.EarlyDataAccepted() {
+			t.Fatalf("Expected early data to be accepted: %v", server.EarlyDataError())
+		}
+		if offered.CipherSuite != config.CipherSuites[0] || offered.KEM1Type != "ML-KEM-768" {
+			t.Errorf("Unexpected early data info: %+v", offered)
+		}
+
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+		if data, err := client.RejectedEarlyData(); data != nil || err != nil {
+			t.Errorf("Expected no rejected early data, got %q, %v", data, err)
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		client, server, serverResponse := handshake([]byte("POST /transfer"))
+		if serverResponse.EarlyDataAccepted || !errors.Is(server.EarlyDataError(), ErrEarlyDataRefused) {
+			t.Fatalf("Expected early data to be refused, got %v", server.EarlyDataError())
+		}
+
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+		completeHandshake(t, client, server)
+
+		// The application resends under the stage-2 keys
+		data, err := client.RejectedEarlyData()
+		if !errors.Is(err, ErrEarlyDataRejected) {
+			t.Fatalf("Expected ErrEarlyDataRejected, got %v", err)
+		}
+		encrypted, err := client.Encrypt(data)
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		decrypted, err := server.Decrypt(encrypted)
+		if err != nil || string(decrypted) != "POST /transfer" {
+			t.Errorf("Failed to resend early data: %q, %v", decrypted, err)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		_, server, serverResponse := handshake(bytes.Repeat([]byte("GET "), 20))
+		if serverResponse.EarlyDataAccepted || !errors.Is(server.EarlyDataError(), ErrEarlyDataTooLarge) {
+			t.Errorf("Expected ErrEarlyDataTooLarge, got %v", server.EarlyDataError())
+		}
+	})
+
+	t.Run("ForgedFlag", func(t *testing.T) {
+		client, _, serverResponse := handshake([]byte("POST /transfer"))
+		serverResponse.EarlyDataAccepted = true
+		if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+			t.Errorf("Expected ErrFinishedMismatch for a forged accept flag, got %v", err)
+		}
+	})
+}
+
+// resumptionPeers returns a server key pair and option factories for
+// clients sharing one ticket cache and servers sharing one ticket setup
+func resumptionPeers(t *testing.T, config *Config, serverOptions func(kem.PrivateKey) *SessionOptions) (func() *Client, func() *Server) {
+	t.Helper()
+
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	clientOptions := NewSessionOptions().
+		WithServerPublicKey(serverPubKey).
+		WithSessionStore(NewMemorySessionStore(0))
+	serverOpts := serverOptions(serverPrivKey).WithReplayCache(NewMemoryReplayCache(0))
+
+	newClient := func() *Client {
+		client, err := NewClient(config, clientOptions)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		return client
+	}
+	newServer := func() *Server {
+		server, err := NewServer(config, serverOpts)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		return server
+	}
+	return newClient, newServer
+}
+
+// runHandshake completes a handshake between client and server and returns
+// the 0-RTT data the server accepted
+func runHandshake(t *testing.T, client *Client, server *Server, earlyData []byte) (*ClientHello, *ServerResponse, []byte) {
+	t.Helper()
+
+	clientHello, err := client.GenerateClientHello(earlyData)
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+	accepted, err := server.ProcessClientHello(clientHello)
+	if err != nil {
+		t.Fatalf("Failed to process client hello: %v", err)
+	}
+	serverResponse, err := server.GenerateServerResponse(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server response: %v", err)
+	}
+	if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+		t.Fatalf("Failed to process server response: %v", err)
+	}
+	completeHandshake(t, client, server)
+
+	return clientHello, serverResponse, accepted
+}
+
+// issueTicket delivers a session ticket from server to client
+func issueTicket(t *testing.T, client *Client, server *Server) {
+	t.Helper()
+
+	record, err := server.NewSessionTicket()
+	if err != nil {
+		t.Fatalf("Failed to issue session ticket: %v", err)
+	}
+	if data, err := client.Decrypt(record); err != nil || data != nil {
+		t.Fatalf("Expected ticket to be consumed, got %q, %v", data, err)
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	config := newTestConfig(t)
+	ticketKeys, err := NewTicketKeys(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("Failed to create ticket keys: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		serverOptions func(kem.PrivateKey) *SessionOptions
+		pskOnly       bool
+	}{
+		{
+			name: "Stateless",
+			serverOptions: func(sk kem.PrivateKey) *SessionOptions {
+				return NewSessionOptions().WithServerPrivateKey(sk).WithTicketKeys(ticketKeys)
+			},
+		},
+		{
+			name: "Stateful",
+			serverOptions: func(sk kem.PrivateKey) *SessionOptions {
+				return NewSessionOptions().WithServerPrivateKey(sk).WithSessionStore(NewMemorySessionStore(0))
+			},
+		},
+		{
+			name: "PSKOnly",
+			serverOptions: func(sk kem.PrivateKey) *SessionOptions {
+				return NewSessionOptions().WithServerPrivateKey(sk).WithTicketKeys(ticketKeys)
+			},
+			pskOnly: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			newClient, newServer := resumptionPeers(t, config, tc.serverOptions)
+
+			// 1. 完整握手并下发票据
+			client, server := newClient(), newServer()
+			runHandshake(t, client, server, nil)
+			if client.Resumed() || server.Resumed() {
+				t.Fatal("Full handshake reported as resumed")
+			}
+			issueTicket(t, client, server)
+
+			// 2. 使用票据恢复会话，携带0-RTT数据
+			resumedClient, resumedServer := newClient(), newServer()
+			resumedClient.options.PSKOnlyResumption = tc.pskOnly
+			clientHello, serverResponse, accepted := runHandshake(t, resumedClient, resumedServer, []byte("GET /"))
+			resumedClient.options.PSKOnlyResumption = false
+
+			if !resumedClient.Resumed() || !resumedServer.Resumed() {
+				t.Fatal("Expected the session to be resumed")
+			}
+			if len(clientHello.PSKIdentity) == 0 || !serverResponse.PSKAccepted {
+				t.Error("Resumed client hello should carry an accepted ticket")
+			}
+			// A KEM1 key share to fall back on goes with the KEM2 one
+			if tc.pskOnly != (len(clientHello.Ciphertext1) == 0) {
+				t.Errorf("KEM1 key share sent = %v, want %v", len(clientHello.Ciphertext1) > 0, !tc.pskOnly)
+			}
+			if tc.pskOnly != (len(clientHello.EphemeralPublicKey) == 0 && len(serverResponse.Ciphertext2) == 0) {
+				t.Errorf("KEM2 ran = %v, want %v", len(serverResponse.Ciphertext2) > 0, !tc.pskOnly)
+			}
+			if string(accepted) != "GET /" {
+				t.Errorf("Expected resumed 0-RTT data to be accepted, got %q: %v", accepted, resumedServer.EarlyDataError())
+			}
+
+			// 3. 验证会话密钥一致且与原会话不同
+			if !bytes.Equal(resumedClient.GetSessionKey(), resumedServer.GetSessionKey()) {
+				t.Fatal("Resumed session keys do not match")
+			}
+			if bytes.Equal(resumedClient.GetSessionKey(), client.GetSessionKey()) {
+				t.Error("Resumed session reused the original session key")
+			}
+			encrypted, err := resumedClient.Encrypt([]byte("hello"))
+			if err != nil {
+				t.Fatalf("Failed to encrypt: %v", err)
+			}
+			if decrypted, err := resumedServer.Decrypt(encrypted); err != nil || string(decrypted) != "hello" {
+				t.Errorf("Failed to exchange data over resumed session: %q, %v", decrypted, err)
+			}
+
+			// 4. 票据只能使用一次，客户端回退到完整握手
+			fallbackClient := newClient()
+			clientHello, err = fallbackClient.GenerateClientHello(nil)
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+			if len(clientHello.PSKIdentity) != 0 {
+				t.Error("Client reused a ticket")
+			}
+		})
+	}
+}
+
+func TestResumptionRejected(t *testing.T) {
+	config := newTestConfig(t)
+	ticketKeys, err := NewTicketKeys(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("Failed to create ticket keys: %v", err)
+	}
+	serverOptions := func(sk kem.PrivateKey) *SessionOptions {
+		return NewSessionOptions().WithServerPrivateKey(sk).WithTicketKeys(ticketKeys)
+	}
+
+	// resumptionHello returns a client and its ClientHello presenting a
+	// fresh ticket along with 0-RTT data
+	resumptionHello := func(newClient func() *Client, newServer func() *Server) (*Client, *ClientHello) {
+		client, server := newClient(), newServer()
+		runHandshake(t, client, server, nil)
+		issueTicket(t, client, server)
+
+		client = newClient()
+		clientHello, err := client.GenerateClientHello([]byte("GET /"))
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		return client, clientHello
+	}
+
+	// fallBack checks that server drops the ticket of clientHello and
+	// completes a full handshake with client instead
+	fallBack := func(t *testing.T, client *Client, server *Server, clientHello *ClientHello) {
+		t.Helper()
+
+		accepted, err := server.ProcessClientHello(clientHello)
+		if err != nil {
+			t.Fatalf("Expected a fallback to the full handshake, got %v", err)
+		}
+		if accepted != nil || !errors.Is(server.EarlyDataError(), ErrTicketRejected) {
+			t.Errorf("Expected 0-RTT data to be rejected with the ticket, got %q, %v", accepted, server.EarlyDataError())
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		if serverResponse.PSKAccepted {
+			t.Error("Server response accepts the rejected ticket")
+		}
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+		completeHandshake(t, client, server)
+
+		if client.Resumed() || server.Resumed() {
+			t.Error("Fallback handshake reported as resumed")
+		}
+		if !bytes.Equal(client.GetSessionKey(), server.GetSessionKey()) {
+			t.Error("Session keys do not match after the fallback")
+		}
+		if _, err := client.ExportEarlyKeyingMaterial("test", nil, 32); !errors.Is(err, ErrExporterUnavailable) {
+			t.Errorf("Expected no early exporter after the fallback, got %v", err)
+		}
+	}
+
+	t.Run("Binder", func(t *testing.T) {
+		newClient, newServer := resumptionPeers(t, config, serverOptions)
+		_, clientHello := resumptionHello(newClient, newServer)
+
+		// Swapping in another KEM2 key breaks the binder
+		clientHello.EphemeralPublicKey = slices.Clone(clientHello.EphemeralPublicKey)
+		clientHello.EphemeralPublicKey[0] ^= 1
+		server := newServer()
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrBinderMismatch) {
+			t.Errorf("Expected ErrBinderMismatch, got %v", err)
+		}
+		if server.State() != StateFailed {
+			t.Errorf("Expected failed state, got %v", server.State())
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		newClient, newServer := resumptionPeers(t, config, serverOptions)
+		client, clientHello := resumptionHello(newClient, newServer)
+
+		server := newServer()
+		server.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		fallBack(t, client, server, clientHello)
+	})
+
+	t.Run("CipherSuite", func(t *testing.T) {
+		newClient, newServer := resumptionPeers(t, config, serverOptions)
+		client, clientHello := resumptionHello(newClient, newServer)
+
+		// The server now prefers another suite the client also offers
+		serverConfig := *config
+		serverConfig.CipherSuites = []string{clientHello.CipherSuites[1]}
+		server := newServer()
+		server.config = &serverConfig
+		fallBack(t, client, server, clientHello)
+	})
+
+	t.Run("NoKeyShares", func(t *testing.T) {
+		newClient, newServer := resumptionPeers(t, config, serverOptions)
+		client, server := newClient(), newServer()
+		runHandshake(t, client, server, nil)
+		issueTicket(t, client, server)
+
+		// Without forward secrecy there is nothing to fall back on
+		client = newClient()
+		client.options.PSKOnlyResumption = true
+		clientHello, err := client.GenerateClientHello(nil)
+		client.options.PSKOnlyResumption = false
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		server = newServer()
+		server.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		if _, err := server.ProcessClientHello(clientHello); !errors.Is(err, ErrTicketRejected) {
+			t.Errorf("Expected ErrTicketRejected, got %v", err)
+		}
+	})
+
+	t.Run("ConcurrentRedeem", func(t *testing.T) {
+		newClient, newServer := resumptionPeers(t, config, func(sk kem.PrivateKey) *SessionOptions {
+			return NewSessionOptions().WithServerPrivateKey(sk).WithSessionStore(NewMemorySessionStore(0))
+		})
+		_, clientHello := resumptionHello(newClient, newServer)
+
+		// Replays of one ClientHello race to redeem its stateful ticket
+		const servers = 8
+		var (
+			wg      sync.WaitGroup
+			resumed atomic.Int32
+		)
+		for i := 0; i < servers; i++ {
+			server := newServer()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := server.ProcessClientHello(clientHello); err != nil {
+					t.Errorf("Failed to process client hello: %v", err)
+					return
+				}
+				if server.Resumed() {
+					resumed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := resumed.Load(); n != 1 {
+			t.Errorf("Expected the ticket to be redeemed once, got %d", n)
+		}
+	})
+
+	t.Run("ForeignKeys", func(t *testing.T) {
+		newClient, newServer := resumptionPeers(t, config, serverOptions)
+		client, clientHello := resumptionHello(newClient, newServer)
+
+		otherKeys, err := NewTicketKeys(time.Hour, nil)
+		if err != nil {
+			t.Fatalf("Failed to create ticket keys: %v", err)
+		}
+		server := newServer()
+		server.options = NewSessionOptions().WithServerPrivateKey(server.options.ServerPrivateKey).WithTicketKeys(otherKeys)
+		fallBack(t, client, server, clientHello)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		_, server := establishSession(t, config)
+		if _, err := server.NewSessionTicket(); !errors.Is(err, ErrTicketsDisabled) {
+			t.Errorf("Expected ErrTicketsDisabled, got %v", err)
+		}
+	})
+}
+
+func TestKeyUpdate(t *testing.T) {
+	config := newTestConfig(t)
+
+	// exchange sends message from one side to the other and checks it arrives
+	exchange := func(encrypt func([]byte) ([]byte, error), decrypt func([]byte) ([]byte, error), message string) {
+		t.Helper()
+		record, err := encrypt([]byte(message))
+		if err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		decrypted, err := decrypt(record)
+		if err != nil || string(decrypted) != message {
+			t.Fatalf("Expected %q, got %q: %v", message, decrypted, err)
+		}
+	}
+
+	t.Run("Requested", func(t *testing.T) {
+		client, server := establishSession(t, config)
+
+		record, err := client.UpdateKeys()
+		if err != nil {
+			t.Fatalf("Failed to update keys: %v", err)
+		}
+		if data, err := server.Decrypt(record); err != nil || data != nil {
+			t.Fatalf("Expected key update to be consumed, got %q, %v", data, err)
+		}
+
+		// The server answers with its own update in front of the next record
+		exchange(server.Encrypt, client.Decrypt, "pong")
+		exchange(client.Encrypt, server.Decrypt, "ping")
+
+		for name, keys := range map[string]*trafficKeys{
+			"client write": client.records.write, "client read": client.records.read,
+			"server write": server.records.write, "server read": server.records.read,
+		} {
+			if keys.generation != 1 {
+				t.Errorf("Expected %s keys in generation 1, got %d", name, keys.generation)
+			}
+		}
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		client, server := establishSession(t, config)
+		client.records.limits = KeyUpdateLimits{MaxRecords: 3, MaxBytes: 100}
+
+		for i := 0; i < 10; i++ {
+			exchange(client.Encrypt, server.Decrypt, "short")
+		}
+		if client.records.write.generation != 3 || server.records.read.generation != 3 {
+			t.Errorf("Expected 3 updates by record count, got %d/%d",
+				client.records.write.generation, server.records.read.generation)
+		}
+
+		long := string(bytes.Repeat([]byte("x"), 60))
+		for i := 0; i < 4; i++ {
+			exchange(client.Encrypt, server.Decrypt, long)
+		}
+		// Only one 60-byte message fits under the byte limit
+		if client.records.write.generation != 6 {
+			t.Errorf("Expected 3 updates by byte count, got generation %d", client.records.write.generation)
+		}
+		// The other direction is unaffected
+		if server.records.write.generation != 0 {
+			t.Errorf("Server keys updated without a request: generation %d", server.records.write.generation)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		client, server := establishSession(t, config)
+
+		const goroutines, perGoroutine = 8, 32
+		records := make(chan []byte, goroutines*perGoroutine)
+
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perGoroutine; i++ {
+					record, err := client.Encrypt([]byte("data"))
+					if err != nil {
+						t.Errorf("Failed to encrypt: %v", err)
+						return
+					}
+					records <- record
+				}
+			}()
+		}
+		// The other direction runs at the same time
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				record, err := server.Encrypt([]byte("pong"))
+				if err != nil {
+					t.Errorf("Failed to encrypt: %v", err)
+					return
+				}
+				if data, err := client.Decrypt(record); err != nil || string(data) != "pong" {
+					t.Errorf("Expected %q, got %q: %v", "pong", data, err)
+					return
+				}
+			}
+		}()
+		wg.Wait()
+		close(records)
+
+		bySeq := make(map[uint64][]byte)
+		for record := range records {
+			seq := binary.BigEndian.Uint64(record[1:9])
+			if _, dup := bySeq[seq]; dup {
+				t.Fatalf("Sequence number %d sealed twice", seq)
+			}
+			bySeq[seq] = record
+		}
+		for seq := uint64(0); seq < goroutines*perGoroutine; seq++ {
+			if data, err := server.Decrypt(bySeq[seq]); err != nil || string(data) != "data" {
+				t.Fatalf("Failed to decrypt record %d: %q, %v", seq, data, err)
+			}
+		}
+	})
+
+	t.Run("OldKeysRejected", func(t *testing.T) {
+		client, server := establishSession(t, config)
+
+		stale, err := client.records.write.cipher.Seal(crypto.RecordTypeApplicationData, []byte("stale"))
+		if err != nil {
+			t.Fatalf("Failed to seal: %v", err)
+		}
+		record, err := client.UpdateKeys()
+		if err != nil {
+			t.Fatalf("Failed to update keys: %v", err)
+		}
+		if _, err := server.Decrypt(record); err != nil {
+			t.Fatalf("Failed to process key update: %v", err)
+		}
+		if _, err := server.Decrypt(stale); err == nil {
+			t.Error("Expected record under the previous keys to be rejected")
+		}
+	})
+
+	t.Run("UnexpectedMessage", func(t *testing.T) {
+		client, server := establishSession(t, config)
+
+		msg, err := (&DefaultSerializer{}).MarshalNewSessionTicket(&NewSessionTicket{})
+		if err != nil {
+			t.Fatalf("Failed to marshal session ticket: %v", err)
+		}
+		record, err := client.records.write.cipher.Seal(crypto.RecordTypeHandshake, msg)
+		if err != nil {
+			t.Fatalf("Failed to seal: %v", err)
+		}
+		if _, err := server.Decrypt(record); !errors.Is(err, ErrUnexpectedMessage) {
+			t.Errorf("Expected ErrUnexpectedMessage, got %v", err)
+		}
+	})
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	server, err := NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	export := func(exporter func(string, []byte, int) ([]byte, KeyStage, error), want KeyStage) []byte {
+		t.Helper()
+		out, stage, err := exporter("db key", []byte("tenant-1"), 32)
+		if err != nil {
+			t.Fatalf("Failed to export keying material: %v", err)
+		}
+		if stage != want {
+			t.Fatalf("Expected %v, got %v", want, stage)
+		}
+		return out
+	}
+
+	if _, _, err := client.ExportKeyingMaterial("db key", nil, 32); !errors.Is(err, ErrExporterUnavailable) {
+		t.Errorf("Expected ErrExporterUnavailable before the handshake, got %v", err)
+	}
+
+	// 1. ClientHello之后可导出第一阶段密钥材料
+	clientHello, err := client.GenerateClientHello(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate client hello: %v", err)
+	}
+	if _, err := server.ProcessClientHello(clientHello); err != nil {
+		t.Fatalf("Failed to process client hello: %v", err)
+	}
+	clientStage1 := export(client.ExportKeyingMaterial, KeyStage1)
+	serverStage1 := export(server.ExportKeyingMaterial, KeyStage1)
+	if !bytes.Equal(clientStage1, serverStage1) {
+		t.Fatal("Stage-1 exports differ")
+	}
+
+	// 2. 服务器在收到ClientFinished之前仍使用第一阶段
+	serverResponse, err := server.GenerateServerResponse(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server response: %v", err)
+	}
+	if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+		t.Fatalf("Failed to process server response: %v", err)
+	}
+	export(server.ExportKeyingMaterial, KeyStage1)
+	clientStage2 := export(client.ExportKeyingMaterial, KeyStage2)
+
+	// 3. 握手完成后两端的第二阶段导出一致
+	completeHandshake(t, client, server)
+	serverStage2 := export(server.ExportKeyingMaterial, KeyStage2)
+	if !bytes.Equal(clientStage2, serverStage2) {
+		t.Fatal("Stage-2 exports differ")
+	}
+	if bytes.Equal(clientStage1, clientStage2) {
+		t.Error("Stage-1 and stage-2 exports are equal")
+	}
+
+	// 4. 第一阶段导出在握手后仍然可用且不变
+	early, err := client.ExportEarlyKeyingMaterial("db key", []byte("tenant-1"), 32)
+	if err != nil || !bytes.Equal(early, clientStage1) {
+		t.Errorf("Stage-1 export changed after the handshake: %v", err)
+	}
+
+	// 5. 标签、上下文和长度都影响输出
+	for _, tc := range []struct {
+		label   string
+		context []byte
+		length  int
+	}{
+		{"other key", []byte("tenant-1"), 32},
+		{"db key", []byte("tenant-2"), 32},
+		{"db key", []byte("tenant-1"), 64},
+	} {
+		out, _, err := client.ExportKeyingMaterial(tc.label, tc.context, tc.length)
+		if err != nil {
+			t.Fatalf("Failed to export keying material: %v", err)
+		}
+		if bytes.Equal(out[:32], clientStage2) {
+			t.Errorf("Export for %q/%q/%d collides", tc.label, tc.context, tc.length)
+		}
+	}
+	if bytes.Equal(clientStage2, client.GetSessionKey()[:32]) {
+		t.Error("Export leaks the session key")
+	}
+
+	if _, _, err := client.ExportKeyingMaterial("db key", nil, 0); err == nil {
+		t.Error("Expected zero length to be rejected")
+	}
+}
+
+// impostorKey claims another client's public key while holding its own
+// private key
+type impostorKey struct {
+	kem.PrivateKey
+	claimed kem.PublicKey
+}
+
+func (k *impostorKey) PublicKey() kem.PublicKey { return k.claimed }
+
+// impostorKEM decapsulates with the impostor's real key
+type impostorKEM struct {
+	kem.KEM
+	own kem.PrivateKey
+}
+
+func (k *impostorKEM) Decapsulate(_ kem.PrivateKey, ciphertext []byte) ([]byte, error) {
+	return k.KEM.Decapsulate(k.own, ciphertext)
+}
+
+func TestMutualAuthentication(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+	devicePubKey, devicePrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate device key pair: %v", err)
+	}
+
+	// The server knows the key of every device
+	registered := map[string][]byte{"device-1": devicePubKey.Bytes()}
+	serverOptions := NewSessionOptions().
+		WithServerPrivateKey(serverPrivKey).
+		WithRequireClientAuth(true).
+		WithAuthorizeClient(func(ctx context.Context, identity *ClientIdentity) error {
+			if !bytes.Equal(registered[string(identity.ID)], identity.PublicKey) {
+				return errors.New("unknown device")
+			}
+			return nil
+		})
+
+	start := func(clientOptions *SessionOptions) (*Client, *Server, *ClientHello, error) {
+		client, err := NewClient(config, clientOptions.WithServerPublicKey(serverPubKey))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		server, err := NewServer(config, serverOptions)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		_, err = server.ProcessClientHello(clientHello)
+		return client, server, clientHello, err
+	}
+
+	t.Run("Authenticated", func(t *testing.T) {
+		client, server, clientHello, err := start(NewSessionOptions().
+			WithClientPrivateKey(devicePrivKey).
+			WithClientID([]byte("device-1")))
+		if err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		if bytes.Contains(clientHello.EncryptedIdentity, []byte("device-1")) {
+			t.Error("Client identity sent in the clear")
+		}
+
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		if len(serverResponse.Ciphertext3) == 0 {
+			t.Fatal("Server did not encapsulate to the client key")
+		}
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+
+		// Not authenticated until the client Finished arrives
+		if server.ClientIdentity() != nil {
+			t.Error("Client identity reported before the client Finished")
+		}
+		completeHandshake(t, client, server)
+
+		identity := server.ClientIdentity()
+		if identity == nil || string(identity.ID) != "device-1" {
+			t.Fatalf("Expected device-1 to be authenticated, got %+v", identity)
+		}
+		if !bytes.Equal(client.GetSessionKey(), server.GetSessionKey()) {
+			t.Error("Session keys do not match")
+		}
+	})
+
+	t.Run("Unregistered", func(t *testing.T) {
+		_, otherPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate key pair: %v", err)
+		}
+		_, _, _, err = start(NewSessionOptions().
+			WithClientPrivateKey(otherPrivKey).
+			WithClientID([]byte("device-1")))
+		if !errors.Is(err, ErrClientNotAuthorized) {
+			t.Errorf("Expected ErrClientNotAuthorized, got %v", err)
+		}
+	})
+
+	t.Run("Impostor", func(t *testing.T) {
+		_, ownPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate key pair: %v", err)
+		}
+		client, server, _, err := start(NewSessionOptions().
+			WithClientPrivateKey(&impostorKey{PrivateKey: ownPrivKey, claimed: devicePubKey}).
+			WithClientKEM(&impostorKEM{KEM: config.KEM1, own: ownPrivKey}).
+			WithClientID([]byte("device-1")))
+		if err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+
+		// Claiming device-1's key is not enough without its private key
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		if _, err := client.ProcessServerResponse(serverResponse); !errors.Is(err, ErrFinishedMismatch) {
+			t.Errorf("Expected ErrFinishedMismatch, got %v", err)
+		}
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		_, server, _, err := start(NewSessionOptions())
+		if !errors.Is(err, ErrClientAuthRequired) {
+			t.Errorf("Expected ErrClientAuthRequired, got %v", err)
+		}
+		if server.State() != StateFailed {
+			t.Errorf("Expected failed state, got %v", server.State())
+		}
+	})
+
+	t.Run("StrippedCiphertext", func(t *testing.T) {
+		client, server, _, err := start(NewSessionOptions().
+			WithClientPrivateKey(devicePrivKey).
+			WithClientID([]byte("device-1")))
+		if err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		serverResponse.Ciphertext3 = nil
+		if _, err := client.ProcessServerResponse(serverResponse); err == nil {
+			t.Error("Expected a response without the client encapsulation to fail")
+		}
+	})
+}
+
+// flipped returns a copy of data with the bits of its first byte flipped
+func flipped(data []byte) []byte {
+	data = bytes.Clone(data)
+	data[0] ^= 0xff
+	return data
+}
@@ -0,0 +1,265 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// jsonTypeNames names the message types in the JSON envelope
+var jsonTypeNames = map[byte]string{
+	MessageTypeClientHello:       "client_hello",
+	MessageTypeServerResponse:    "server_response",
+	MessageTypeClientFinished:    "client_finished",
+	MessageTypeNewSessionTicket:  "new_session_ticket",
+	MessageTypeKeyUpdate:         "key_update",
+	MessageTypeHelloRetryRequest: "hello_retry_request",
+	MessageTypeAlert:             "alert",
+}
+
+// jsonClientIdentity names the ClientIdentity, which has no message type
+const jsonClientIdentity = "client_identity"
+
+// jsonEnvelope wraps every message with its type, so that one kind of message
+// cannot be read as another
+type jsonEnvelope struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+// JSONSerializer implements the Serializer interface with JSON, for debugging
+// and test fixtures. Messages keep their Go field names and byte fields are
+// base64 encoded. It is not meant for the wire: messages are only bounded by
+// their size.
+type JSONSerializer struct {
+	// Indent pretty-prints messages
+	Indent bool
+}
+
+func (s *JSONSerializer) marshal(typeName string, msg any) ([]byte, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", typeName, err)
+	}
+
+	envelope := jsonEnvelope{Type: typeName, Message: body}
+	if s.Indent {
+		return json.MarshalIndent(envelope, "", "  ")
+	}
+	return json.Marshal(envelope)
+}
+
+// unmarshal decodes a message of typeName into msg, rejecting unknown fields
+// and trailing data
+func (s *JSONSerializer) unmarshal(data []byte, typeName string, msg any) error {
+	var envelope jsonEnvelope
+	if err := decodeStrictJSON(data, &envelope); err != nil {
+		return err
+	}
+	if envelope.Type != typeName {
+		return fmt.Errorf("%w: got %q, expected %q", ErrUnexpectedMessage, envelope.Type, typeName)
+	}
+	if envelope.Message == nil {
+		return fmt.Errorf("%w: missing message", ErrInvalidMessage)
+	}
+
+	return decodeStrictJSON(envelope.Message, msg)
+}
+
+func decodeStrictJSON(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
+	}
+	return nil
+}
+
+// checkCanonicalJSON checks data against the encoding marshal gives the
+// message decoded from it, ignoring the whitespace Indent adds
+func checkCanonicalJSON(data []byte, marshal func(enc *JSONSerializer) ([]byte, error)) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return checkCanonical(compact.Bytes(), func() ([]byte, error) { return marshal(&JSONSerializer{}) })
+}
+
+// MarshalClientHello serializes a ClientHello into a byte slice
+func (s *JSONSerializer) MarshalClientHello(ch *ClientHello) ([]byte, error) {
+	if ch == nil {
+		return nil, errors.New("cannot marshal nil ClientHello")
+	}
+	if err := checkDuplicateExtensions(ch.Extensions); err != nil {
+		return nil, err
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeClientHello], ch)
+}
+
+// UnmarshalClientHello deserializes a byte slice into a ClientHello
+func (s *JSONSerializer) UnmarshalClientHello(data []byte) (*ClientHello, error) {
+	ch := &ClientHello{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeClientHello], ch); err != nil {
+		return nil, err
+	}
+	if err := checkDuplicateExtensions(ch.Extensions); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	if err := checkCanonicalJSON(data, func(enc *JSONSerializer) ([]byte, error) { return enc.MarshalClientHello(ch) }); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// MarshalServerResponse serializes a ServerResponse into a byte slice
+func (s *JSONSerializer) MarshalServerResponse(sr *ServerResponse) ([]byte, error) {
+	if sr == nil {
+		return nil, errors.New("cannot marshal nil ServerResponse")
+	}
+	if err := checkDuplicateExtensions(sr.Extensions); err != nil {
+		return nil, err
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeServerResponse], sr)
+}
+
+// UnmarshalServerResponse deserializes a byte slice into a ServerResponse
+func (s *JSONSerializer) UnmarshalServerResponse(data []byte) (*ServerResponse, error) {
+	sr := &ServerResponse{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeServerResponse], sr); err != nil {
+		return nil, err
+	}
+	if err := checkDuplicateExtensions(sr.Extensions); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+
+	if err := checkCanonicalJSON(data, func(enc *JSONSerializer) ([]byte, error) { return enc.MarshalServerResponse(sr) }); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// MarshalClientFinished serializes a ClientFinished into a byte slice
+func (s *JSONSerializer) MarshalClientFinished(cf *ClientFinished) ([]byte, error) {
+	if cf == nil {
+		return nil, errors.New("cannot marshal nil ClientFinished")
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeClientFinished], cf)
+}
+
+// UnmarshalClientFinished deserializes a byte slice into a ClientFinished
+func (s *JSONSerializer) UnmarshalClientFinished(data []byte) (*ClientFinished, error) {
+	cf := &ClientFinished{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeClientFinished], cf); err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// MarshalNewSessionTicket serializes a NewSessionTicket into a byte slice
+func (s *JSONSerializer) MarshalNewSessionTicket(nst *NewSessionTicket) ([]byte, error) {
+	if nst == nil {
+		return nil, errors.New("cannot marshal nil NewSessionTicket")
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeNewSessionTicket], nst)
+}
+
+// UnmarshalNewSessionTicket deserializes a byte slice into a NewSessionTicket
+func (s *JSONSerializer) UnmarshalNewSessionTicket(data []byte) (*NewSessionTicket, error) {
+	nst := &NewSessionTicket{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeNewSessionTicket], nst); err != nil {
+		return nil, err
+	}
+
+	return nst, nil
+}
+
+// MarshalClientIdentity serializes a ClientIdentity into a byte slice
+func (s *JSONSerializer) MarshalClientIdentity(id *ClientIdentity) ([]byte, error) {
+	if id == nil {
+		return nil, errors.New("cannot marshal nil ClientIdentity")
+	}
+
+	return s.marshal(jsonClientIdentity, id)
+}
+
+// UnmarshalClientIdentity deserializes a byte slice into a ClientIdentity
+func (s *JSONSerializer) UnmarshalClientIdentity(data []byte) (*ClientIdentity, error) {
+	id := &ClientIdentity{}
+	if err := s.unmarshal(data, jsonClientIdentity, id); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// MarshalKeyUpdate serializes a KeyUpdate into a byte slice
+func (s *JSONSerializer) MarshalKeyUpdate(ku *KeyUpdate) ([]byte, error) {
+	if ku == nil {
+		return nil, errors.New("cannot marshal nil KeyUpdate")
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeKeyUpdate], ku)
+}
+
+// UnmarshalKeyUpdate deserializes a byte slice into a KeyUpdate
+func (s *JSONSerializer) UnmarshalKeyUpdate(data []byte) (*KeyUpdate, error) {
+	ku := &KeyUpdate{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeKeyUpdate], ku); err != nil {
+		return nil, err
+	}
+
+	return ku, nil
+}
+
+// MarshalHelloRetryRequest serializes a HelloRetryRequest into a byte slice
+func (s *JSONSerializer) MarshalHelloRetryRequest(hrr *HelloRetryRequest) ([]byte, error) {
+	if hrr == nil {
+		return nil, errors.New("cannot marshal nil HelloRetryRequest")
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeHelloRetryRequest], hrr)
+}
+
+// UnmarshalHelloRetryRequest deserializes a byte slice into a HelloRetryRequest
+func (s *JSONSerializer) UnmarshalHelloRetryRequest(data []byte) (*HelloRetryRequest, error) {
+	hrr := &HelloRetryRequest{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeHelloRetryRequest], hrr); err != nil {
+		return nil, err
+	}
+
+	if err := checkCanonicalJSON(data, func(enc *JSONSerializer) ([]byte, error) { return enc.MarshalHelloRetryRequest(hrr) }); err != nil {
+		return nil, err
+	}
+	return hrr, nil
+}
+
+// MarshalAlert serializes an Alert into a byte slice
+func (s *JSONSerializer) MarshalAlert(a *Alert) ([]byte, error) {
+	if a == nil {
+		return nil, errors.New("cannot marshal nil Alert")
+	}
+
+	return s.marshal(jsonTypeNames[MessageTypeAlert], a)
+}
+
+// UnmarshalAlert deserializes a byte slice into an Alert. Unknown codes are
+// kept, since every alert is fatal.
+func (s *JSONSerializer) UnmarshalAlert(data []byte) (*Alert, error) {
+	a := &Alert{}
+	if err := s.unmarshal(data, jsonTypeNames[MessageTypeAlert], a); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
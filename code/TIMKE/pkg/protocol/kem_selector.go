@@ -1,24 +1,59 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 
 	"TIMKE/pkg/kem"
 )
 
+var (
+	ErrNoCommonKEM = errors.New("no common KEM")
+	// ErrHelloRetryRequired is returned by Server.ProcessClientHello when the
+	// client has to resend its ClientHello, see Server.HelloRetryRequest
+	ErrHelloRetryRequired = errors.New("hello retry required")
+)
+
 func SelectKEM(kemType string) (kem.KEM, error) {
 	if kemType == "" {
-		return nil, fmt.Errorf("KEM type not specified")
+		return nil, fmt.Errorf("%w: KEM type not specified", kem.ErrUnsupportedKEM)
 	}
 
 	k, err := kem.GetKEM(kemType)
 	if err != nil {
-		return nil, fmt.Errorf("unknown KEM type: %s", kemType)
+		return nil, fmt.Errorf("%w: %s", kem.ErrUnsupportedKEM, kemType)
 	}
 
 	return k, nil
 }
 
+// selectConfiguredKEM returns configured if it is the KEM named, so that a
+// KEM backed by a key provider, such as a kem.ContextKEM, is not replaced by
+// the registered implementation
+func selectConfiguredKEM(configured kem.KEM, kemType string) (kem.KEM, error) {
+	if configured != nil && configured.Setup().Name == kemType {
+		return configured, nil
+	}
+	return SelectKEM(kemType)
+}
+
+// NegotiateKEM picks the first KEM in preferred that the peer offered
+func NegotiateKEM(preferred, offered []string) (kem.KEM, error) {
+	for _, name := range preferred {
+		if !slices.Contains(offered, name) {
+			continue
+		}
+
+		k, err := SelectKEM(name)
+		if err == nil {
+			return k, nil
+		}
+	}
+
+	return nil, ErrNoCommonKEM
+}
+
 func DefaultKEM1() kem.KEM {
 	k, err := kem.GetKEM("ML-KEM-768")
 	if err == nil {
@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"TIMKE/pkg/kem"
+)
+
+// DefaultKeyPoolSize is the number of key pairs a KeyPool keeps per KEM
+const DefaultKeyPoolSize = 4
+
+// KeyPool keeps KEM2 key pairs generated in the background, so that a client
+// takes one instead of generating it while connecting. Each key pair is handed
+// out once and destroyed by the client that used it; those left when the pool
+// is closed are destroyed with it, which for circl and OW-ChCCA keys releases
+// rather than wipes them, see kem.PrivateKey. It is safe for concurrent use
+// and may be shared by clients.
+type KeyPool struct {
+	size  int
+	rand  io.Reader
+	slots chan struct{} // bounds the generations in progress
+
+	ctx    context.Context // done once the pool is closed
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	queues map[string]*keyQueue
+	closed bool
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// KeyPoolStats counts the key pairs of a KeyPool
+type KeyPoolStats struct {
+	Hits      uint64 // taken from the pool
+	Misses    uint64 // asked for while none was ready
+	Available int    // ready to be taken
+}
+
+type keyQueue struct {
+	kem     kem.KEM
+	keys    []keyPair
+	pending int // generations in progress
+}
+
+type keyPair struct {
+	pk kem.PublicKey
+	sk kem.PrivateKey
+}
+
+// NewKeyPool returns a pool keeping size key pairs per KEM, DefaultKeyPoolSize
+// if zero, with at most concurrency of them generated at once, one if zero.
+// rand defaults to kem.DefaultRand; reads from any other source are serialized,
+// so it need not be safe for concurrent use. Nothing is generated until Warm
+// or Take names a KEM.
+func NewKeyPool(size, concurrency int, rand io.Reader) *KeyPool {
+	if size <= 0 {
+		size = DefaultKeyPoolSize
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if rand == nil {
+		rand = kem.DefaultRand
+	} else if rand != kem.DefaultRand {
+		rand = &lockedReader{r: rand}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KeyPool{
+		size:   size,
+		rand:   rand,
+		slots:  make(chan struct{}, concurrency),
+		ctx:    ctx,
+		cancel: cancel,
+		queues: make(map[string]*keyQueue),
+	}
+}
+
+// Warm starts filling the pool with key pairs of each KEM, typically those a
+// client will offer
+func (p *KeyPool) Warm(kems ...kem.KEM) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, k := range kems {
+		p.refill(p.queue(k))
+	}
+}
+
+// Take hands out a key pair of k generated in advance, and refills the pool.
+// It reports false if none is ready, and the caller generates one itself.
+func (p *KeyPool) Take(k kem.KEM) (kem.PublicKey, kem.PrivateKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		p.misses.Add(1)
+		return nil, nil, false
+	}
+
+	q := p.queue(k)
+	defer p.refill(q)
+	if len(q.keys) == 0 {
+		p.misses.Add(1)
+		return nil, nil, false
+	}
+
+	// The oldest key pair goes first
+	pair := q.keys[0]
+	q.keys[0] = keyPair{}
+	q.keys = q.keys[1:]
+	p.hits.Add(1)
+	return pair.pk, pair.sk, true
+}
+
+// Stats returns the counters of the pool
+func (p *KeyPool) Stats() KeyPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := KeyPoolStats{Hits: p.hits.Load(), Misses: p.misses.Load()}
+	for _, q := range p.queues {
+		stats.Available += len(q.keys)
+	}
+	return stats
+}
+
+// Close stops the refills and destroys the key pairs not taken. Take reports
+// false afterwards.
+func (p *KeyPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.cancel()
+	p.mu.Unlock()
+
+	// Key pairs still being generated are destroyed as they complete
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, q := range p.queues {
+		for _, pair := range q.keys {
+			pair.sk.Destroy()
+		}
+		q.keys = nil
+	}
+}
+
+// queue returns the key pairs of k, p.mu held
+func (p *KeyPool) queue(k kem.KEM) *keyQueue {
+	name := k.Setup().Name
+	q, ok := p.queues[name]
+	if !ok {
+		q = &keyQueue{kem: k}
+		p.queues[name] = q
+	}
+	return q
+}
+
+// refill starts generating the key pairs missing from q, p.mu held
+func (p *KeyPool) refill(q *keyQueue) {
+	if p.closed {
+		return
+	}
+	for len(q.keys)+q.pending < p.size {
+		q.pending++
+		p.wg.Add(1)
+		go p.generate(q)
+	}
+}
+
+// generate adds a key pair to q once a slot is free. A failed generation is
+// retried on the next Take.
+func (p *KeyPool) generate(q *keyQueue) {
+	defer p.wg.Done()
+
+	var pk kem.PublicKey
+	var sk kem.PrivateKey
+	var err error
+	select {
+	case p.slots <- struct{}{}:
+		pk, sk, err = kem.GenerateKeyPairContext(p.ctx, q.kem, q.kem.Setup(), p.rand)
+		<-p.slots
+	case <-p.ctx.Done():
+		err = p.ctx.Err()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q.pending--
+	if err != nil {
+		return
+	}
+	if p.closed {
+		sk.Destroy()
+		return
+	}
+	q.keys = append(q.keys, keyPair{pk: pk, sk: sk})
+}
+
+// lockedReader serializes the reads of the generations running at once
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"TIMKE/pkg/kem"
+)
+
+// trackingKEM records how many key pairs are generated at once and which
+// private keys are destroyed
+type trackingKEM struct {
+	kem.KEM
+
+	mu        sync.Mutex
+	running   int
+	peak      int
+	destroyed atomic.Int32
+}
+
+type trackedKey struct {
+	kem.PrivateKey
+	kem *trackingKEM
+}
+
+func (k *trackingKEM) GenerateKeyPair(params kem.Parameters, rand io.Reader) (kem.PublicKey, kem.PrivateKey, error) {
+	k.mu.Lock()
+	k.running++
+	k.peak = max(k.peak, k.running)
+	k.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+	pk, sk, err := k.KEM.GenerateKeyPair(params, rand)
+
+	k.mu.Lock()
+	k.running--
+	k.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pk, &trackedKey{PrivateKey: sk, kem: k}, nil
+}
+
+func (sk *trackedKey) Destroy() {
+	sk.kem.destroyed.Add(1)
+	sk.PrivateKey.Destroy()
+}
+
+// overlapReader records whether it is read from two goroutines at once
+type overlapReader struct {
+	r          io.Reader
+	reading    atomic.Bool
+	overlapped atomic.Bool
+}
+
+func (o *overlapReader) Read(p []byte) (int, error) {
+	if !o.reading.CompareAndSwap(false, true) {
+		o.overlapped.Store(true)
+		return o.r.Read(p)
+	}
+	defer o.reading.Store(false)
+	time.Sleep(100 * time.Microsecond)
+	return o.r.Read(p)
+}
+
+// waitAvailable waits for the pool to hold n key pairs
+func waitAvailable(t *testing.T, pool *KeyPool, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Stats().Available != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d key pairs in the pool, got %+v", n, pool.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeyPool(t *testing.T) {
+	mlkem768, err := kem.GetKEM("ML-KEM-768")
+	if err != nil {
+		t.Fatalf("Failed to get KEM: %v", err)
+	}
+
+	t.Run("Refill", func(t *testing.T) {
+		tracking := &trackingKEM{KEM: mlkem768}
+		pool := NewKeyPool(6, 2, nil)
+		defer pool.Close()
+
+		pool.Warm(tracking)
+		waitAvailable(t, pool, 6)
+		if tracking.peak > 2 {
+			t.Errorf("Expected at most 2 key pairs generated at once, got %d", tracking.peak)
+		}
+
+		// Every key pair is handed out once
+		seen := make(map[string]bool)
+		for range 6 {
+			pk, _, ok := pool.Take(tracking)
+			if !ok {
+				t.Fatal("Expected a key pair from the pool")
+			}
+			if seen[string(pk.Bytes())] {
+				t.Fatal("Key pair handed out twice")
+			}
+			seen[string(pk.Bytes())] = true
+		}
+		waitAvailable(t, pool, 6)
+
+		if stats := pool.Stats(); stats.Hits != 6 || stats.Misses != 0 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("Miss", func(t *testing.T) {
+		pool := NewKeyPool(1, 1, nil)
+		defer pool.Close()
+
+		// The first request for a KEM starts filling the pool
+		if _, _, ok := pool.Take(mlkem768); ok {
+			t.Fatal("Expected no key pair from a cold pool")
+		}
+		waitAvailable(t, pool, 1)
+		if _, _, ok := pool.Take(mlkem768); !ok {
+			t.Error("Expected a key pair once the pool is warm")
+		}
+		if stats := pool.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		tracking := &trackingKEM{KEM: mlkem768}
+		pool := NewKeyPool(3, 3, nil)
+		pool.Warm(tracking)
+		waitAvailable(t, pool, 3)
+
+		pool.Close()
+		if got := tracking.destroyed.Load(); got != 3 {
+			t.Errorf("Expected the 3 key pairs left to be destroyed, got %d", got)
+		}
+		if _, _, ok := pool.Take(tracking); ok {
+			t.Error("Expected no key pair from a closed pool")
+		}
+		if stats := pool.Stats(); stats.Available != 0 {
+			t.Errorf("Expected an empty pool, got %+v", stats)
+		}
+		pool.Close()
+	})
+
+	t.Run("InjectedRand", func(t *testing.T) {
+		rand := &overlapReader{r: kem.DefaultRand}
+		pool := NewKeyPool(4, 4, rand)
+		defer pool.Close()
+
+		pool.Warm(&trackingKEM{KEM: mlkem768})
+		waitAvailable(t, pool, 4)
+		if rand.overlapped.Load() {
+			t.Error("Injected rand read by two generations at once")
+		}
+	})
+
+	t.Run("Handshake", func(t *testing.T) {
+		config := newTestConfig(t)
+		pool := NewKeyPool(2, 1, nil)
+		defer pool.Close()
+		pool.Warm(config.KEM2)
+		waitAvailable(t, pool, 2)
+
+		serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server key pair: %v", err)
+		}
+		server, err := NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey).WithKeyPool(pool))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		clientHello, err := client.GenerateClientHello(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate client hello: %v", err)
+		}
+		if _, err := server.ProcessClientHello(clientHello); err != nil {
+			t.Fatalf("Failed to process client hello: %v", err)
+		}
+		serverResponse, err := server.GenerateServerResponse(nil)
+		if err != nil {
+			t.Fatalf("Failed to generate server response: %v", err)
+		}
+		if _, err := client.ProcessServerResponse(serverResponse); err != nil {
+			t.Fatalf("Failed to process server response: %v", err)
+		}
+		completeHandshake(t, client, server)
+
+		if !bytes.Equal(client.GetSessionKey(), server.GetSessionKey()) {
+			t.Error("Session keys differ")
+		}
+		if stats := pool.Stats(); stats.Hits != 1 {
+			t.Errorf("Expected the key share to come from the pool, got %+v", stats)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+
+	"TIMKE/pkg/crypto"
+)
+
+// Labels for the traffic secrets derived from K_tmp and K_main
+const (
+	labelEarlyTraffic   = "c e traffic"
+	labelClientTraffic  = "c ap traffic"
+	labelServerTraffic  = "s ap traffic"
+	labelServerFinished = "s finished"
+	labelClientFinished = "c finished"
+	labelChannelBinding = "channel binding"
+	labelEarlyExporter  = "e exp master"
+	labelExporter       = "exp master"
+	labelExport         = "exporter"
+)
+
+const (
+	trafficSecretSize  = 64
+	channelBindingSize = 32
+)
+
+// newRecordCipher derives the traffic secret for label from secret and the
+// transcript hash, and returns the matching record protection for suite.
+// 0-RTT keys precede the transcript and pass a nil hash.
+func newRecordCipher(suite crypto.CipherSuite, secret []byte, label string, transcriptHash []byte) (*crypto.RecordCipher, error) {
+	trafficSecret := crypto.ExpandLabel(secret, label, transcriptHash, trafficSecretSize)
+	defer crypto.Zeroize(trafficSecret)
+
+	rc, err := crypto.NewRecordCipher(suite, trafficSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive %s keys: %w", label, err)
+	}
+
+	return rc, nil
+}
+
+// earlyTrafficContext hashes a ClientHello without the 0-RTT data and PSK
+// binder computed from it, so that the 0-RTT keys depend on every other field
+func earlyTrafficContext(ch *ClientHello) ([]byte, error) {
+	partial := *ch
+	partial.EncryptedPayload = nil
+	partial.PSKBinder = nil
+	return hashPartialClientHello(partial)
+}
+
+// ErrFinishedMismatch indicates that the peer's Finished MAC did not verify,
+// so the two sides did not derive the same keys or saw different messages
+var ErrFinishedMismatch = errors.New("finished verification failed")
+
+// finishedMAC computes the Finished value for label over the transcript hash
+func finishedMAC(sessionKey *crypto.Secret, label string, transcriptHash []byte) []byte {
+	finishedKey := crypto.ExpandLabel(sessionKey.Bytes(), label, nil, trafficSecretSize)
+	defer crypto.Zeroize(finishedKey)
+
+	return crypto.MAC(finishedKey, transcriptHash)
+}
+
+// verifyFinished checks a peer's Finished value in constant time
+func verifyFinished(sessionKey *crypto.Secret, label string, transcriptHash, verifyData []byte) error {
+	if !hmac.Equal(finishedMAC(sessionKey, label, transcriptHash), verifyData) {
+		return ErrFinishedMismatch
+	}
+	return nil
+}
+
+// channelBinding derives a value that identifies the session to upper layers
+func channelBinding(sessionKey *crypto.Secret, transcriptHash []byte) []byte {
+	return crypto.ExpandLabel(sessionKey.Bytes(), labelChannelBinding, transcriptHash, channelBindingSize)
+}
+
+// KeyStage identifies the key that exported keying material derives from
+type KeyStage int
+
+const (
+	// KeyStage1 material derives from K_tmp (or the resumption PSK) and the
+	// ClientHello. It is available once the ClientHello is processed, but it
+	// is not forward secret, the client is not authenticated and a replayed
+	// ClientHello yields the same value.
+	KeyStage1 KeyStage = 1
+	// KeyStage2 material derives from K_main and the full handshake
+	KeyStage2 KeyStage = 2
+)
+
+func (s KeyStage) String() string {
+	switch s {
+	case KeyStage1:
+		return "stage-1"
+	case KeyStage2:
+		return "stage-2"
+	default:
+		return fmt.Sprintf("KeyStage(%d)", int(s))
+	}
+}
+
+// maxExportLength bounds a single ExportKeyingMaterial call
+const maxExportLength = 1 << 16
+
+var ErrExporterUnavailable = errors.New("keying material exporter not available yet")
+
+// exporterMaster derives the exporter secret of a stage from its key
+func exporterMaster(secret *crypto.Secret, label string, transcriptHash []byte) *crypto.Secret {
+	return crypto.NewSecret(crypto.ExpandLabel(secret.Bytes(), label, transcriptHash, trafficSecretSize))
+}
+
+// exportKeyingMaterial follows the TLS 1.3 exporter: a secret per label, then
+// expanded over the context
+func exportKeyingMaterial(master *crypto.Secret, label string, context []byte, length int) ([]byte, error) {
+	if master.Len() == 0 {
+		return nil, ErrExporterUnavailable
+	}
+	if length <= 0 || length > maxExportLength {
+		return nil, fmt.Errorf("invalid export length %d", length)
+	}
+
+	labelSecret := crypto.ExpandLabel(master.Bytes(), label, nil, trafficSecretSize)
+	defer crypto.Zeroize(labelSecret)
+
+	return crypto.ExpandLabel(labelSecret, labelExport, context, length), nil
+}
+
+// exportFromBestStage exports from the stage-2 master when it exists and
+// falls back to stage 1
+func exportFromBestStage(early, main *crypto.Secret, label string, context []byte, length int) ([]byte, KeyStage, error) {
+	stage, master := KeyStage2, main
+	if main.Len() == 0 {
+		stage, master = KeyStage1, early
+	}
+
+	out, err := exportKeyingMaterial(master, label, context, length)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, stage, nil
+}
+
+// openApplicationData opens a record and checks that it carries application data
+func openApplicationData(rc *crypto.RecordCipher, record []byte) ([]byte, error) {
+	contentType, plaintext, err := rc.Open(record)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != crypto.RecordTypeApplicationData {
+		return nil, fmt.Errorf("unexpected record type %d", contentType)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,256 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"TIMKE/pkg/crypto"
+)
+
+// labelTrafficUpdate ratchets a traffic secret to the next generation
+const labelTrafficUpdate = "traffic upd"
+
+// KeyUpdateLimits bounds how much traffic one generation of sending keys
+// protects before it is ratcheted automatically
+type KeyUpdateLimits struct {
+	// MaxRecords is the number of records sealed under one key
+	MaxRecords uint64
+	// MaxBytes is the number of plaintext bytes sealed under one key
+	MaxBytes uint64
+}
+
+// DefaultKeyUpdateLimits keeps every key well below the AEAD usage limits
+var DefaultKeyUpdateLimits = KeyUpdateLimits{
+	MaxRecords: 1 << 20,
+	MaxBytes:   1 << 34,
+}
+
+// ErrUnexpectedMessage indicates a post-handshake message the receiver does
+// not accept
+var ErrUnexpectedMessage = errors.New("unexpected post-handshake message")
+
+// KeyUpdate tells the peer that the sender's following records use the next
+// generation of its traffic keys
+type KeyUpdate struct {
+	// UpdateRequested asks the peer to update its sending keys as well
+	UpdateRequested bool
+}
+
+// trafficKeys protects one direction of an established session and keeps
+// the traffic secret so that it can be ratcheted
+type trafficKeys struct {
+	suite      crypto.CipherSuite
+	secret     *crypto.Secret
+	cipher     *crypto.RecordCipher
+	bytes      uint64 // plaintext sealed under the current generation
+	generation uint64
+}
+
+// newTrafficKeys derives the first generation of traffic keys for label
+func newTrafficKeys(suite crypto.CipherSuite, sessionKey []byte, label string, transcriptHash []byte) (*trafficKeys, error) {
+	secret := crypto.NewSecret(crypto.ExpandLabel(sessionKey, label, transcriptHash, trafficSecretSize))
+
+	rc, err := crypto.NewRecordCipher(suite, secret.Bytes())
+	if err != nil {
+		secret.Destroy()
+		return nil, fmt.Errorf("failed to derive %s keys: %w", label, err)
+	}
+
+	return &trafficKeys{suite: suite, secret: secret, cipher: rc}, nil
+}
+
+// update replaces the keys with the next generation and wipes the old secret,
+// so that a later compromise does not expose earlier records
+func (k *trafficKeys) update() error {
+	next := crypto.NewSecret(crypto.ExpandLabel(k.secret.Bytes(), labelTrafficUpdate, nil, trafficSecretSize))
+
+	rc, err := crypto.NewRecordCipher(k.suite, next.Bytes())
+	if err != nil {
+		next.Destroy()
+		return fmt.Errorf("failed to update traffic keys: %w", err)
+	}
+
+	k.secret.Destroy()
+	k.secret = next
+	k.cipher = rc
+	k.bytes = 0
+	k.generation++
+	return nil
+}
+
+// due reports whether the limits call for an update before sealing n more
+// bytes. One record is kept in reserve for the KeyUpdate itself.
+func (k *trafficKeys) due(limits KeyUpdateLimits, n int) bool {
+	return k.cipher.Sequence() >= limits.MaxRecords ||
+		k.bytes+uint64(n) > limits.MaxBytes ||
+		k.cipher.Remaining() <= 1
+}
+
+func (k *trafficKeys) destroy() {
+	if k != nil {
+		k.secret.Destroy()
+	}
+}
+
+// recordLayer carries the records of an established session. It answers and
+// sends KeyUpdates and passes other post-handshake messages to its owner.
+// Sealing and opening may run concurrently with each other and themselves.
+type recordLayer struct {
+	writeMu sync.Mutex // guards write, including its ratchet
+	write   *trafficKeys
+	readMu  sync.Mutex // guards read and keeps records in order
+	read    *trafficKeys
+	limits  KeyUpdateLimits
+
+	// updatePending is set when the peer asked us to update our sending keys
+	updatePending atomic.Bool
+}
+
+func newRecordLayer(suite crypto.CipherSuite, sessionKey []byte, writeLabel, readLabel string, transcriptHash []byte, limits KeyUpdateLimits) (*recordLayer, error) {
+	write, err := newTrafficKeys(suite, sessionKey, writeLabel, transcriptHash)
+	if err != nil {
+		return nil, err
+	}
+	read, err := newTrafficKeys(suite, sessionKey, readLabel, transcriptHash)
+	if err != nil {
+		write.destroy()
+		return nil, err
+	}
+
+	return &recordLayer{write: write, read: read, limits: limits}, nil
+}
+
+// seal protects application data. A KeyUpdate record is put in front when
+// the peer asked for one or the sending keys reached their limits.
+func (l *recordLayer) seal(plaintext []byte) ([]byte, error) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	var out []byte
+	if l.updatePending.Load() || l.write.due(l.limits, len(plaintext)) {
+		var err error
+		out, err = l.keyUpdateLocked(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	record, err := l.write.cipher.Seal(crypto.RecordTypeApplicationData, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	l.write.bytes += uint64(len(plaintext))
+
+	return append(out, record...), nil
+}
+
+// sealHandshake protects a post-handshake message under the sending keys
+func (l *recordLayer) sealHandshake(msg []byte) ([]byte, error) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	return l.write.cipher.Seal(crypto.RecordTypeHandshake, msg)
+}
+
+// keyUpdate seals a KeyUpdate under the current sending keys and then moves
+// to the next generation
+func (l *recordLayer) keyUpdate(requestPeer bool) ([]byte, error) {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	return l.keyUpdateLocked(requestPeer)
+}
+
+func (l *recordLayer) keyUpdateLocked(requestPeer bool) ([]byte, error) {
+	msg, err := (&DefaultSerializer{}).MarshalKeyUpdate(&KeyUpdate{UpdateRequested: requestPeer})
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := l.write.cipher.Seal(crypto.RecordTypeHandshake, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.write.update(); err != nil {
+		return nil, err
+	}
+
+	l.updatePending.Store(false)
+	return record, nil
+}
+
+// open processes every record in data and returns the concatenated
+// application data, nil if the records only carried post-handshake messages.
+// Messages other than KeyUpdate go to handle, which may be nil.
+func (l *recordLayer) open(data []byte, handle func(msgType byte, msg []byte) error) ([]byte, error) {
+	l.readMu.Lock()
+	defer l.readMu.Unlock()
+
+	var plaintext []byte
+	for len(data) > 0 {
+		if len(data) < crypto.RecordHeaderSize {
+			return nil, crypto.ErrInvalidRecord
+		}
+		n := crypto.RecordHeaderSize + int(binary.BigEndian.Uint32(data[9:crypto.RecordHeaderSize]))
+		if n > len(data) {
+			return nil, crypto.ErrInvalidRecord
+		}
+
+		contentType, payload, err := l.read.cipher.Open(data[:n])
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+
+		switch contentType {
+		case crypto.RecordTypeApplicationData:
+			plaintext = append(plaintext, payload...)
+		case crypto.RecordTypeHandshake:
+			if err := l.processHandshake(payload, handle); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected record type %d", contentType)
+		}
+	}
+
+	return plaintext, nil
+}
+
+// processHandshake handles a framed message of a handshake record
+func (l *recordLayer) processHandshake(msg []byte, handle func(msgType byte, msg []byte) error) error {
+	header, err := ParseFrameHeader(msg)
+	if err != nil {
+		return err
+	}
+
+	if header.Type != MessageTypeKeyUpdate {
+		if handle == nil {
+			return fmt.Errorf("%w: type %d", ErrUnexpectedMessage, header.Type)
+		}
+		return handle(header.Type, msg)
+	}
+
+	ku, err := (&DefaultSerializer{}).UnmarshalKeyUpdate(msg)
+	if err != nil {
+		return err
+	}
+	// The peer's following records use its next generation of keys
+	if err := l.read.update(); err != nil {
+		return err
+	}
+	if ku.UpdateRequested {
+		l.updatePending.Store(true)
+	}
+	return nil
+}
+
+func (l *recordLayer) destroy() {
+	if l != nil {
+		l.write.destroy()
+		l.read.destroy()
+	}
+}
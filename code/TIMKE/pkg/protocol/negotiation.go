@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"TIMKE/pkg/crypto"
+)
+
+// ProtocolVersion is the handshake version sent in ClientHello.Version
+const ProtocolVersion uint16 = 1
+
+// ErrUnsupportedVersion indicates a ClientHello of another protocol version
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Labels binding the negotiated parameters into K_tmp and K_main
+const (
+	labelEarlyBinding = "e negotiation"
+	labelMainBinding  = "negotiation"
+)
+
+const negotiationDomain = "TIMKE-negotiation"
+
+// negotiation is what the client offered and, once known, the suite the
+// server selected. It is folded into the keys, so that a peer that saw
+// different algorithms or lists derives different keys. The timestamp is
+// bound too, since the server trusts it to bound replays of 0-RTT data.
+type negotiation struct {
+	version   uint16
+	kem1Type  string
+	kem2Type  string
+	kem2Types []string
+	suites    []string
+	timestamp uint64
+	suite     string
+}
+
+// offeredNegotiation returns the parameters offered in a ClientHello
+func offeredNegotiation(ch *ClientHello) *negotiation {
+	return &negotiation{
+		version:   ch.Version,
+		kem1Type:  ch.KEM1Type,
+		kem2Type:  ch.KEM2Type,
+		kem2Types: ch.SupportedKEM2Types,
+		suites:    ch.CipherSuites,
+		timestamp: ch.Timestamp,
+	}
+}
+
+// hash encodes the parameters unambiguously and hashes them
+func (n *negotiation) hash() []byte {
+	data := binary.BigEndian.AppendUint16([]byte(negotiationDomain), n.version)
+	data = writeLengthPrefixedBytes(data, []byte(n.kem1Type))
+	data = writeLengthPrefixedBytes(data, []byte(n.kem2Type))
+	data = writeStringList(data, n.kem2Types)
+	data = writeStringList(data, n.suites)
+	data = binary.BigEndian.AppendUint64(data, n.timestamp)
+	data = writeLengthPrefixedBytes(data, []byte(n.suite))
+
+	sum, _ := crypto.NewHash().Hash(data)
+	return sum
+}
+
+// bindEarly derives the K_tmp that protects 0-RTT data from the one computed
+// by H1 or from the ticket, and destroys the latter
+func (n *negotiation) bindEarly(tempKey *crypto.Secret) *crypto.Secret {
+	defer tempKey.Destroy()
+	return crypto.NewSecret(crypto.ExpandLabel(tempKey.Bytes(), labelEarlyBinding, n.hash(), tempKey.Len()))
+}
+
+// bindMain derives K_main from the output of H2 or H3 and the selected suite,
+// and wipes the input
+func (n *negotiation) bindMain(sessionKey []byte, suite string) []byte {
+	defer crypto.Zeroize(sessionKey)
+
+	selected := *n
+	selected.suite = suite
+	return crypto.ExpandLabel(sessionKey, labelMainBinding, selected.hash(), len(sessionKey))
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+// DefaultMaxMessageSize bounds serialized handshake messages under
+// DefaultPolicy. It leaves room for ML-KEM-1024 key shares and 0-RTT data.
+const DefaultMaxMessageSize = 1 << 20
+
+// ErrPolicyViolation is matched by every PolicyError
+var ErrPolicyViolation = errors.New("policy violation")
+
+// PolicyError reports a configuration or handshake parameter that the Policy
+// forbids. Use errors.Is(err, ErrPolicyViolation) to detect it.
+type PolicyError struct {
+	// Subject is what was checked, such as "KEM1" or "cipher suite"
+	Subject string
+	// Value is the offending algorithm name, if any
+	Value  string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%v: %s: %s", ErrPolicyViolation, e.Subject, e.Reason)
+	}
+	return fmt.Sprintf("%v: %s %q: %s", ErrPolicyViolation, e.Subject, e.Value, e.Reason)
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrPolicyViolation
+}
+
+// Policy restricts the algorithms and message sizes a peer accepts. Empty
+// lists and zero values impose no restriction.
+type Policy struct {
+	// AllowedKEM1 lists the KEMs accepted for the long-term key
+	AllowedKEM1 []string
+	// AllowedKEM2 lists the KEMs accepted for the ephemeral key
+	AllowedKEM2 []string
+	// MinSecurityCategory is the lowest NIST category accepted for any KEM,
+	// including the one a client authenticates with. KEMs without a category
+	// are rejected if it is set.
+	MinSecurityCategory int
+	// RequirePostQuantum rejects KEMs that are not post-quantum or hybrid
+	RequirePostQuantum bool
+	// AllowedCipherSuites lists the suites that may protect records,
+	// including 0-RTT data
+	AllowedCipherSuites []string
+	// MaxMessageSize bounds each serialized handshake message
+	MaxMessageSize int
+}
+
+// DefaultPolicy requires post-quantum KEMs of at least NIST category 3
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinSecurityCategory: 3,
+		RequirePostQuantum:  true,
+		MaxMessageSize:      DefaultMaxMessageSize,
+	}
+}
+
+func (p *Policy) checkKEM1(name string) error {
+	if p == nil {
+		return nil
+	}
+	return p.checkKEM("KEM1", p.AllowedKEM1, name)
+}
+
+func (p *Policy) checkKEM2(name string) error {
+	if p == nil {
+		return nil
+	}
+	return p.checkKEM("KEM2", p.AllowedKEM2, name)
+}
+
+// checkClientKEM checks the KEM of a client's long-term key in mutual
+// authentication mode
+func (p *Policy) checkClientKEM(name string) error {
+	if p == nil {
+		return nil
+	}
+	return p.checkKEM("client KEM", nil, name)
+}
+
+func (p *Policy) checkKEM(subject string, allowed []string, name string) error {
+	if len(allowed) > 0 && !slices.Contains(allowed, name) {
+		return &PolicyError{Subject: subject, Value: name, Reason: "not allowed"}
+	}
+
+	if p.MinSecurityCategory == 0 && !p.RequirePostQuantum {
+		return nil
+	}
+	level, ok := kem.Security(name)
+	if !ok {
+		return &PolicyError{Subject: subject, Value: name, Reason: "unknown security level"}
+	}
+	if level.Category < p.MinSecurityCategory {
+		return &PolicyError{
+			Subject: subject,
+			Value:   name,
+			Reason:  fmt.Sprintf("security category %d below the minimum of %d", level.Category, p.MinSecurityCategory),
+		}
+	}
+	if p.RequirePostQuantum && !level.PostQuantum {
+		return &PolicyError{Subject: subject, Value: name, Reason: "not post-quantum"}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkCipherSuite(name string) error {
+	if p == nil || len(p.AllowedCipherSuites) == 0 || slices.Contains(p.AllowedCipherSuites, name) {
+		return nil
+	}
+	return &PolicyError{Subject: "cipher suite", Value: name, Reason: "not allowed"}
+}
+
+func (p *Policy) checkMessageSize(message string, size int) error {
+	if p == nil || p.MaxMessageSize <= 0 || size <= p.MaxMessageSize {
+		return nil
+	}
+	return &PolicyError{
+		Subject: message,
+		Reason:  fmt.Sprintf("%d bytes exceeds the limit of %d", size, p.MaxMessageSize),
+	}
+}
+
+// Validate checks that the configuration names known algorithms and complies
+// with its Policy. Call it at startup; NewClient and NewServer call it too.
+func (c *Config) Validate() error {
+	if c.KEM1 == nil {
+		return errors.New("KEM1 is required")
+	}
+	if err := c.Policy.checkKEM1(c.KEM1.Setup().Name); err != nil {
+		return err
+	}
+	if err := kem.CheckRand(c.KEM1, c.Rand); err != nil {
+		return err
+	}
+
+	kem2Types := c.kem2Types()
+	if len(kem2Types) == 0 {
+		return errors.New("KEM2 or KEM2Types is required")
+	}
+	for _, name := range kem2Types {
+		k, err := SelectKEM(name)
+		if err != nil {
+			return err
+		}
+		if err := kem.CheckRand(k, c.Rand); err != nil {
+			return err
+		}
+		if err := c.Policy.checkKEM2(name); err != nil {
+			return err
+		}
+	}
+
+	// Only a named suite can be negotiated, any other would be ignored
+	if _, ok := c.SymmetricEncryption.(crypto.CipherSuite); c.SymmetricEncryption != nil && !ok {
+		return fmt.Errorf("SymmetricEncryption %T is not a crypto.CipherSuite", c.SymmetricEncryption)
+	}
+	for _, name := range c.cipherSuites() {
+		if _, err := SelectCipherSuite(name); err != nil {
+			return err
+		}
+		if err := c.Policy.checkCipherSuite(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
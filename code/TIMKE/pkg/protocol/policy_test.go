@@ -0,0 +1,196 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+// nullEncryption is a SymmetricEncryption that is not a negotiable suite
+type nullEncryption struct{}
+
+func (nullEncryption) Encrypt(key, plaintext []byte) ([]byte, error)  { return plaintext, nil }
+func (nullEncryption) Decrypt(key, ciphertext []byte) ([]byte, error) { return ciphertext, nil }
+
+func TestConfigValidate(t *testing.T) {
+	mlkem512, _ := kem.GetKEM("ML-KEM-512")
+	mlkem768, _ := kem.GetKEM("ML-KEM-768")
+	owchcca, _ := kem.GetKEM("OWChCCA-16")
+
+	testCases := []struct {
+		name    string
+		config  *Config
+		subject string // of the expected PolicyError, empty for other errors
+		valid   bool
+	}{
+		{name: "default", config: DefaultConfig(), valid: true},
+		{name: "no policy", config: &Config{KEM1: owchcca, KEM2: mlkem512}, valid: true},
+		{name: "missing KEM1", config: &Config{KEM2: mlkem768}},
+		{name: "unknown suite", config: &Config{KEM1: mlkem768, KEM2: mlkem768, CipherSuites: []string{"NULL"}}},
+		{name: "unnamed encryption", config: &Config{KEM1: mlkem768, KEM2: mlkem768, SymmetricEncryption: nullEncryption{}}},
+		{name: "unknown KEM2", config: &Config{KEM1: mlkem768, KEM2: mlkem768, KEM2Types: []string{"ML-KEM-768", "X-Wing"}}},
+		{
+			name:    "KEM2 below category",
+			config:  &Config{KEM1: mlkem768, KEM2: mlkem512, Policy: DefaultPolicy()},
+			subject: "KEM2",
+		},
+		{
+			name:    "unrated KEM1",
+			config:  &Config{KEM1: owchcca, KEM2: mlkem768, Policy: &Policy{MinSecurityCategory: 1}},
+			subject: "KEM1",
+		},
+		{
+			name:   "unrated KEM1 without minimum",
+			config: &Config{KEM1: owchcca, KEM2: mlkem768, Policy: &Policy{RequirePostQuantum: true}},
+			valid:  true,
+		},
+		{
+			name:    "KEM1 not allowed",
+			config:  &Config{KEM1: mlkem768, KEM2: mlkem768, Policy: &Policy{AllowedKEM1: []string{"ML-KEM-1024"}}},
+			subject: "KEM1",
+		},
+		{
+			name: "suite not allowed",
+			config: &Config{KEM1: mlkem768, KEM2: mlkem768, CipherSuites: crypto.DefaultCipherSuites(),
+				Policy: &Policy{AllowedCipherSuites: []string{crypto.SuiteAES256GCM}}},
+			subject: "cipher suite",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if tc.valid {
+				if err != nil {
+					t.Fatalf("Expected valid config, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Expected invalid config")
+			}
+
+			var policyErr *PolicyError
+			if tc.subject == "" {
+				if errors.Is(err, ErrPolicyViolation) {
+					t.Errorf("Expected a configuration error, got policy violation %v", err)
+				}
+			} else if !errors.As(err, &policyErr) || !errors.Is(err, ErrPolicyViolation) || policyErr.Subject != tc.subject {
+				t.Errorf("Expected %s policy violation, got %v", tc.subject, err)
+			}
+		})
+	}
+
+	if _, err := NewServer(&Config{KEM1: mlkem768, KEM2: mlkem512, Policy: DefaultPolicy()},
+		NewSessionOptions().WithServerPrivateKey(nil)); !errors.Is(err, ErrPolicyViolation) {
+		t.Errorf("Expected NewServer to reject the config, got %v", err)
+	}
+}
+
+func TestPolicyHandshake(t *testing.T) {
+	mlkem512, _ := kem.GetKEM("ML-KEM-512")
+	mlkem768, _ := kem.GetKEM("ML-KEM-768")
+	mlkem1024, _ := kem.GetKEM("ML-KEM-1024")
+
+	serverPubKey, serverPrivKey, err := mlkem768.GenerateKeyPair(mlkem768.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	// The server only accepts category 5 ephemeral keys, AES-256-GCM and
+	// small ClientHellos
+	serverConfig := &Config{
+		KEM1:         mlkem768,
+		KEM2:         mlkem1024,
+		CipherSuites: []string{crypto.SuiteAES256GCM},
+		Policy: &Policy{
+			AllowedKEM2:         []string{"ML-KEM-1024"},
+			MinSecurityCategory: 3,
+			RequirePostQuantum:  true,
+			AllowedCipherSuites: []string{crypto.SuiteAES256GCM},
+			MaxMessageSize:      8 << 10,
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		config    *Config
+		earlyData []byte
+		clientKEM kem.KEM // authenticates the client if set
+		subject   string
+	}{
+		{
+			name:   "compliant",
+			config: &Config{KEM1: mlkem768, KEM2: mlkem1024, CipherSuites: []string{crypto.SuiteAES256GCM}},
+		},
+		{
+			name:    "KEM2",
+			config:  &Config{KEM1: mlkem768, KEM2: mlkem768, CipherSuites: []string{crypto.SuiteAES256GCM}},
+			subject: "KEM2",
+		},
+		{
+			name:    "cipher suite",
+			config:  &Config{KEM1: mlkem768, KEM2: mlkem1024, CipherSuites: []string{crypto.SuiteChaCha20Poly1305}},
+			subject: "cipher suite",
+		},
+		{
+			name:      "client KEM",
+			config:    &Config{KEM1: mlkem768, KEM2: mlkem1024, CipherSuites: []string{crypto.SuiteAES256GCM}},
+			clientKEM: mlkem512,
+			subject:   "client KEM",
+		},
+		{
+			name:      "message size",
+			config:    &Config{KEM1: mlkem768, KEM2: mlkem1024, CipherSuites: []string{crypto.SuiteAES256GCM}},
+			earlyData: bytes.Repeat([]byte("x"), 8<<10),
+			subject:   "ClientHello",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientOptions := NewSessionOptions().WithServerPublicKey(serverPubKey)
+			if tc.clientKEM != nil {
+				_, clientPrivKey, err := tc.clientKEM.GenerateKeyPair(tc.clientKEM.Setup(), nil)
+				if err != nil {
+					t.Fatalf("Failed to generate client key pair: %v", err)
+				}
+				clientOptions.WithClientPrivateKey(clientPrivKey).WithClientKEM(tc.clientKEM)
+			}
+			client, err := NewClient(tc.config, clientOptions)
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			server, err := NewServer(serverConfig, NewSessionOptions().
+				WithServerPrivateKey(serverPrivKey).
+				WithAuthorizeClient(func(ctx context.Context, identity *ClientIdentity) error { return nil }))
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+
+			clientHello, err := client.GenerateClientHello(tc.earlyData)
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+			_, err = server.ProcessClientHello(clientHello)
+			if tc.subject == "" {
+				if err != nil {
+					t.Fatalf("Failed to process client hello: %v", err)
+				}
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) || !errors.Is(err, ErrPolicyViolation) || policyErr.Subject != tc.subject {
+				t.Fatalf("Expected %s policy violation, got %v", tc.subject, err)
+			}
+			if server.State() != StateFailed {
+				t.Errorf("Expected failed state, got %v", server.State())
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"TIMKE/pkg/crypto/sha3"
+)
+
+// DefaultEarlyDataWindow is how far a ClientHello timestamp may deviate from
+// the server clock before its 0-RTT data is rejected
+const DefaultEarlyDataWindow = 10 * time.Second
+
+// DefaultReplayCacheSize bounds the number of ClientHellos remembered by the
+// default in-memory replay cache
+const DefaultReplayCacheSize = 1 << 20
+
+// DefaultMaxEarlyDataSize bounds the 0-RTT plaintext a server accepts
+const DefaultMaxEarlyDataSize = 16 << 10
+
+var (
+	ErrEarlyDataReplayed  = errors.New("0-RTT data replayed")
+	ErrEarlyDataOutOfTime = errors.New("0-RTT timestamp outside acceptance window")
+	ErrEarlyDataTooLarge  = errors.New("0-RTT data exceeds maximum size")
+	ErrEarlyDataRefused   = errors.New("0-RTT data refused by application")
+	ErrReplayCacheFull    = errors.New("replay cache full")
+
+	// ErrEarlyDataRejected is reported to the client when the server did not
+	// process its 0-RTT data
+	ErrEarlyDataRejected = errors.New("0-RTT data rejected by server")
+)
+
+// ReplayCache remembers ClientHellos that carried 0-RTT data. Servers that
+// share a long-term key must share a cache, otherwise a ClientHello can be
+// replayed once against each of them.
+type ReplayCache interface {
+	// CheckAndStore records key until expiry and reports whether it was
+	// already present. Implementations must fail closed: if the key cannot
+	// be recorded, return an error rather than false.
+	CheckAndStore(ctx context.Context, key []byte, expiry time.Time) (seen bool, err error)
+}
+
+// replayKey identifies a ClientHello by its KEM1 ciphertext, which is fresh
+// for every encapsulation, or by its PSK binder when resuming without KEM1
+func replayKey(ch *ClientHello) []byte {
+	h := sha3.New256()
+	_, _ = h.Write([]byte("TIMKE-replay"))
+	_, _ = h.Write(ch.Ciphertext1)
+	_, _ = h.Write(ch.PSKBinder)
+	return h.Sum(nil)
+}
+
+const replayShards = 64
+
+// MemoryReplayCache is a bounded in-process ReplayCache, sharded to keep lock
+// contention low under many concurrent handshakes
+type MemoryReplayCache struct {
+	shards      [replayShards]replayShard
+	maxPerShard int
+}
+
+type replayShard struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func NewMemoryReplayCache(maxEntries int) *MemoryReplayCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultReplayCacheSize
+	}
+
+	c := &MemoryReplayCache{
+		maxPerShard: max(1, maxEntries/replayShards),
+	}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]time.Time)
+	}
+	return c
+}
+
+func (c *MemoryReplayCache) CheckAndStore(ctx context.Context, key []byte, expiry time.Time) (bool, error) {
+	if len(key) == 0 {
+		return false, errors.New("empty replay key")
+	}
+
+	// Keys are hashes, the first byte is uniformly distributed
+	shard := &c.shards[int(key[0])%replayShards]
+	now := time.Now()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if existing, ok := shard.entries[string(key)]; ok && existing.After(now) {
+		return true, nil
+	}
+
+	if len(shard.entries) >= c.maxPerShard {
+		for k, e := range shard.entries {
+			if !e.After(now) {
+				delete(shard.entries, k)
+			}
+		}
+		// Evicting live entries would let their ClientHellos be replayed
+		if len(shard.entries) >= c.maxPerShard {
+			return false, ErrReplayCacheFull
+		}
+	}
+
+	shard.entries[string(key)] = expiry
+	return false, nil
+}
+
+// Len returns the number of remembered entries, including expired ones not
+// yet purged
+func (c *MemoryReplayCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		c.shards[i].mu.Lock()
+		n += len(c.shards[i].entries)
+		c.shards[i].mu.Unlock()
+	}
+	return n
+}
+
+var (
+	defaultReplayCacheOnce sync.Once
+	defaultReplayCache     *MemoryReplayCache
+)
+
+// DefaultReplayCache returns the process-wide cache used by servers whose
+// SessionOptions do not set one
+func DefaultReplayCache() ReplayCache {
+	defaultReplayCacheOnce.Do(func() {
+		defaultReplayCache = NewMemoryReplayCache(DefaultReplayCacheSize)
+	})
+	return defaultReplayCache
+}
+
+// checkEarlyDataFreshness enforces the acceptance window and the replay
+// cache for a ClientHello carrying 0-RTT data
+func checkEarlyDataFreshness(ctx context.Context, ch *ClientHello, cache ReplayCache, window time.Duration, now time.Time) error {
+	sent := time.UnixMilli(int64(ch.Timestamp))
+	if sent.Before(now.Add(-window)) || sent.After(now.Add(window)) {
+		return ErrEarlyDataOutOfTime
+	}
+
+	// The timestamp is bound into K_tmp, so a replay carries the same one and
+	// is rejected by the check above once the server clock passes
+	// sent+window, at the latest now+2*window. The expiry is kept on the
+	// server clock rather than trusted from the ClientHello.
+	seen, err := cache.CheckAndStore(ctx, replayKey(ch), now.Add(2*window))
+	if err != nil {
+		return err
+	}
+	if seen {
+		return ErrEarlyDataReplayed
+	}
+
+	return nil
+}
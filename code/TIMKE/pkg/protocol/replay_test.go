@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	cache := NewMemoryReplayCache(replayShards)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	key := replayKey(&ClientHello{Ciphertext1: []byte("c1")})
+	seen, err := cache.CheckAndStore(ctx, key, expiry)
+	if err != nil || seen {
+		t.Fatalf("Expected first use to be unseen, got seen=%v err=%v", seen, err)
+	}
+
+	seen, err = cache.CheckAndStore(ctx, key, expiry)
+	if err != nil || !seen {
+		t.Fatalf("Expected second use to be seen, got seen=%v err=%v", seen, err)
+	}
+
+	// One entry per shard: a second live key in the same shard does not fit
+	other := append([]byte{key[0]}, []byte("other")...)
+	if _, err := cache.CheckAndStore(ctx, other, expiry); !errors.Is(err, ErrReplayCacheFull) {
+		t.Errorf("Expected ErrReplayCacheFull, got %v", err)
+	}
+}
+
+func TestMemoryReplayCacheExpiry(t *testing.T) {
+	cache := NewMemoryReplayCache(replayShards)
+	ctx := context.Background()
+
+	key := []byte{1, 2, 3}
+	if _, err := cache.CheckAndStore(ctx, key, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Failed to store key: %v", err)
+	}
+
+	// Expired entries are neither reported nor allowed to block new ones
+	seen, err := cache.CheckAndStore(ctx, key, time.Now().Add(time.Minute))
+	if err != nil || seen {
+		t.Fatalf("Expected expired key to be unseen, got seen=%v err=%v", seen, err)
+	}
+
+	other := []byte{1, 4, 5}
+	cache.shards[1].entries[string(key)] = time.Now().Add(-time.Second)
+	if _, err := cache.CheckAndStore(ctx, other, time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("Expected expired entry to be purged, got %v", err)
+	}
+	if cache.Len() != 1 {
+		t.Errorf("Expected 1 entry after purge, got %d", cache.Len())
+	}
+}
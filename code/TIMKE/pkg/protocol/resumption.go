@@ -0,0 +1,450 @@
+package protocol
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/crypto/sha3"
+	"TIMKE/pkg/kem"
+)
+
+// DefaultTicketLifetime bounds how long an issued session ticket can be used
+const DefaultTicketLifetime = 24 * time.Hour
+
+// DefaultSessionStoreSize bounds the number of sessions kept by
+// NewMemorySessionStore when no size is given
+const DefaultSessionStoreSize = 1 << 16
+
+// Labels of the resumption key schedule
+const (
+	labelResumptionMaster = "res master"
+	labelResumption       = "resumption"
+	labelResumptionEarly  = "res early"
+	labelResumptionBinder = "res binder"
+)
+
+const (
+	resumptionSecretSize = 64
+	ticketNonceSize      = 16
+	ticketKeySize        = 32
+	ticketKeyIDSize      = 16
+	statefulTicketSize   = 32
+
+	resumptionStateVersion byte = 1
+)
+
+var (
+	// ErrTicketRejected means the server could not resume from the offered
+	// ticket. The client should drop it and run a full handshake.
+	ErrTicketRejected = errors.New("session ticket rejected")
+	// ErrBinderMismatch means the ClientHello was not bound to the ticket's PSK
+	ErrBinderMismatch = errors.New("PSK binder verification failed")
+	// ErrTicketsDisabled is returned when issuing a ticket without a
+	// SessionStore or TicketKeys
+	ErrTicketsDisabled = errors.New("session tickets not configured")
+)
+
+// ResumptionState is the PSK of a resumable session along with the
+// algorithms it was negotiated with
+type ResumptionState struct {
+	CipherSuite string
+	KEM1Type    string
+	KEM2Type    string
+	IssuedAt    time.Time
+	Lifetime    time.Duration
+	PSK         []byte
+	// Ticket is the identity the client presents to the server, it is only
+	// set in client caches
+	Ticket []byte
+}
+
+// Expired reports whether the ticket can no longer be used at now
+func (r *ResumptionState) Expired(now time.Time) bool {
+	return !now.Before(r.IssuedAt.Add(r.Lifetime))
+}
+
+func (r *ResumptionState) clone() *ResumptionState {
+	c := *r
+	c.PSK = slices.Clone(r.PSK)
+	c.Ticket = slices.Clone(r.Ticket)
+	return &c
+}
+
+// MarshalBinary encodes the state for tickets and external session stores
+func (r *ResumptionState) MarshalBinary() ([]byte, error) {
+	result := make([]byte, 0, 1+8+8+4*5+len(r.CipherSuite)+len(r.KEM1Type)+len(r.KEM2Type)+len(r.PSK)+len(r.Ticket))
+	result = append(result, resumptionStateVersion)
+	result = binary.BigEndian.AppendUint64(result, uint64(r.IssuedAt.UnixMilli()))
+	result = binary.BigEndian.AppendUint64(result, uint64(r.Lifetime.Milliseconds()))
+	result = writeLengthPrefixedBytes(result, []byte(r.CipherSuite))
+	result = writeLengthPrefixedBytes(result, []byte(r.KEM1Type))
+	result = writeLengthPrefixedBytes(result, []byte(r.KEM2Type))
+	result = writeLengthPrefixedBytes(result, r.PSK)
+	result = writeLengthPrefixedBytes(result, r.Ticket)
+
+	return result, nil
+}
+
+// UnmarshalBinary decodes a state encoded by MarshalBinary
+func (r *ResumptionState) UnmarshalBinary(data []byte) error {
+	if len(data) < 1+8+8 {
+		return ErrBufferTooShort
+	}
+	if data[0] != resumptionStateVersion {
+		return fmt.Errorf("unsupported resumption state version %d", data[0])
+	}
+
+	state := ResumptionState{
+		IssuedAt: time.UnixMilli(int64(binary.BigEndian.Uint64(data[1:9]))),
+		Lifetime: time.Duration(binary.BigEndian.Uint64(data[9:17])) * time.Millisecond,
+	}
+	offset := 17
+
+	var fields [3][]byte
+	var err error
+	for i := range fields {
+		fields[i], offset, err = readLengthPrefixedBytes(data, offset)
+		if err != nil {
+			return err
+		}
+	}
+	state.CipherSuite = string(fields[0])
+	state.KEM1Type = string(fields[1])
+	state.KEM2Type = string(fields[2])
+
+	state.PSK, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return err
+	}
+	state.Ticket, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return err
+	}
+
+	if offset != len(data) {
+		return errors.New("extra data after resumption state")
+	}
+
+	*r = state
+	return nil
+}
+
+// SessionStore keeps resumption state. Clients use it as their ticket cache,
+// keyed by server. Servers that set one issue stateful tickets, which are
+// random keys into the store and can be used only once. Implementations must
+// copy the states they are given and return copies.
+type SessionStore interface {
+	// Get returns the state stored under key, or nil if there is none
+	Get(ctx context.Context, key string) (*ResumptionState, error)
+	// Take removes and returns the state stored under key, or nil if there
+	// is none. It must be atomic: of concurrent Takes of one key, only one
+	// may return the state, or a ticket could be redeemed twice.
+	Take(ctx context.Context, key string) (*ResumptionState, error)
+	Put(ctx context.Context, key string, state *ResumptionState) error
+	Delete(ctx context.Context, key string) error
+}
+
+// MemorySessionStore is a bounded in-process SessionStore. When full, expired
+// sessions are purged first and then the oldest one is evicted.
+type MemorySessionStore struct {
+	mu         sync.Mutex
+	entries    map[string]*ResumptionState
+	maxEntries int
+}
+
+func NewMemorySessionStore(maxEntries int) *MemorySessionStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultSessionStoreSize
+	}
+
+	return &MemorySessionStore{
+		entries:    make(map[string]*ResumptionState),
+		maxEntries: maxEntries,
+	}
+}
+
+func (m *MemorySessionStore) Get(ctx context.Context, key string) (*ResumptionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if state.Expired(time.Now()) {
+		m.remove(key)
+		return nil, nil
+	}
+	return state.clone(), nil
+}
+
+func (m *MemorySessionStore) Take(ctx context.Context, key string) (*ResumptionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	// The stored copy is wiped on removal, so the caller gets its own
+	var taken *ResumptionState
+	if !state.Expired(time.Now()) {
+		taken = state.clone()
+	}
+	m.remove(key)
+	return taken, nil
+}
+
+func (m *MemorySessionStore) Put(ctx context.Context, key string, state *ResumptionState) error {
+	if state == nil {
+		return errors.New("nil resumption state")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+	if len(m.entries) >= m.maxEntries {
+		now := time.Now()
+		for k, e := range m.entries {
+			if e.Expired(now) {
+				m.remove(k)
+			}
+		}
+	}
+	if len(m.entries) >= m.maxEntries {
+		var oldest string
+		for k, e := range m.entries {
+			if oldest == "" || e.IssuedAt.Before(m.entries[oldest].IssuedAt) {
+				oldest = k
+			}
+		}
+		m.remove(oldest)
+	}
+
+	m.entries[key] = state.clone()
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.remove(key)
+	return nil
+}
+
+// Len returns the number of stored sessions, including expired ones not yet
+// purged
+func (m *MemorySessionStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
+
+func (m *MemorySessionStore) remove(key string) {
+	if state, ok := m.entries[key]; ok {
+		crypto.Zeroize(state.PSK)
+		delete(m.entries, key)
+	}
+}
+
+// TicketKeys encrypts stateless session tickets. The current key is replaced
+// every rotation period and the previous one still decrypts for one more
+// period, so a rotation does not invalidate recently issued tickets. Servers
+// sharing tickets must share a TicketKeys.
+type TicketKeys struct {
+	mu       sync.Mutex
+	rotation time.Duration
+	rand     io.Reader
+	now      func() time.Time
+
+	current  *ticketKey
+	previous *ticketKey
+}
+
+type ticketKey struct {
+	id      []byte
+	aead    cipher.AEAD
+	created time.Time
+}
+
+// NewTicketKeys returns a key ring that rotates every rotation period,
+// DefaultTicketLifetime if zero. rand defaults to kem.DefaultRand.
+func NewTicketKeys(rotation time.Duration, rand io.Reader) (*TicketKeys, error) {
+	if rotation <= 0 {
+		rotation = DefaultTicketLifetime
+	}
+	if rand == nil {
+		rand = kem.DefaultRand
+	}
+
+	k := &TicketKeys{
+		rotation: rotation,
+		rand:     rand,
+		now:      time.Now,
+	}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate replaces the current key, keeping it to decrypt older tickets
+func (k *TicketKeys) Rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.rotate()
+}
+
+func (k *TicketKeys) rotate() error {
+	key := make([]byte, ticketKeySize+ticketKeyIDSize)
+	defer crypto.Zeroize(key)
+	if _, err := io.ReadFull(k.rand, key); err != nil {
+		return fmt.Errorf("failed to generate ticket key: %w", err)
+	}
+
+	aead, err := crypto.NewAESGCM().NewAEAD(key[:ticketKeySize])
+	if err != nil {
+		return err
+	}
+
+	k.previous = k.current
+	k.current = &ticketKey{
+		id:      slices.Clone(key[ticketKeySize:]),
+		aead:    aead,
+		created: k.now(),
+	}
+	return nil
+}
+
+// rotateIfDue rotates lazily, dropping keys older than two periods
+func (k *TicketKeys) rotateIfDue() error {
+	now := k.now()
+	if now.Before(k.current.created.Add(k.rotation)) {
+		return nil
+	}
+
+	expired := !now.Before(k.current.created.Add(2 * k.rotation))
+	if err := k.rotate(); err != nil {
+		return err
+	}
+	if expired {
+		k.previous = nil
+	}
+	return nil
+}
+
+// seal encrypts a ticket as key ID || nonce || AEAD(state)
+func (k *TicketKeys) seal(plaintext []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.rotateIfDue(); err != nil {
+		return nil, err
+	}
+
+	key := k.current
+	ticket := make([]byte, 0, len(key.id)+key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+	ticket = append(ticket, key.id...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(k.rand, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket nonce: %w", err)
+	}
+	ticket = append(ticket, nonce...)
+
+	return key.aead.Seal(ticket, nonce, plaintext, key.id), nil
+}
+
+// open decrypts a ticket sealed under the current or previous key
+func (k *TicketKeys) open(ticket []byte) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.rotateIfDue(); err != nil {
+		return nil, err
+	}
+
+	if len(ticket) < ticketKeyIDSize {
+		return nil, ErrInvalidMessage
+	}
+	id := ticket[:ticketKeyIDSize]
+
+	for _, key := range []*ticketKey{k.current, k.previous} {
+		if key == nil || !hmac.Equal(key.id, id) {
+			continue
+		}
+
+		nonceSize := key.aead.NonceSize()
+		if len(ticket) < ticketKeyIDSize+nonceSize {
+			return nil, ErrInvalidMessage
+		}
+		nonce := ticket[ticketKeyIDSize : ticketKeyIDSize+nonceSize]
+		return key.aead.Open(nil, nonce, ticket[ticketKeyIDSize+nonceSize:], id)
+	}
+
+	return nil, errors.New("unknown ticket key")
+}
+
+// sessionCacheKey is the client cache key for tickets issued by a server
+func sessionCacheKey(serverPublicKey kem.PublicKey) string {
+	h := sha3.New256()
+	_, _ = h.Write([]byte("TIMKE-session"))
+	_, _ = h.Write(serverPublicKey.Bytes())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// resumptionMaster derives the secret that tickets of a session are based on
+func resumptionMaster(sessionKey *crypto.Secret, transcriptHash []byte) *crypto.Secret {
+	return crypto.NewSecret(crypto.ExpandLabel(sessionKey.Bytes(), labelResumptionMaster, transcriptHash, resumptionSecretSize))
+}
+
+// ticketPSK derives the PSK of one ticket from the resumption secret
+func ticketPSK(resumptionSecret *crypto.Secret, nonce []byte) []byte {
+	return crypto.ExpandLabel(resumptionSecret.Bytes(), labelResumption, nonce, resumptionSecretSize)
+}
+
+// resumptionEarlySecret takes the place of K_tmp when resuming
+func resumptionEarlySecret(psk *crypto.Secret) *crypto.Secret {
+	return crypto.NewSecret(crypto.ExpandLabel(psk.Bytes(), labelResumptionEarly, nil, resumptionSecretSize))
+}
+
+// pskBinder computes the MAC over the ClientHello, minus the binder itself,
+// that proves the client holds the ticket's PSK
+func pskBinder(earlySecret *crypto.Secret, ch *ClientHello) ([]byte, error) {
+	partial := *ch
+	partial.PSKBinder = nil
+	partialHash, err := hashPartialClientHello(partial)
+	if err != nil {
+		return nil, err
+	}
+
+	binderKey := crypto.ExpandLabel(earlySecret.Bytes(), labelResumptionBinder, nil, trafficSecretSize)
+	defer crypto.Zeroize(binderKey)
+
+	return crypto.MAC(binderKey, partialHash), nil
+}
+
+// verifyBinder checks the PSK binder of a ClientHello in constant time
+func verifyBinder(earlySecret *crypto.Secret, ch *ClientHello) error {
+	binder, err := pskBinder(earlySecret, ch)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(binder, ch.PSKBinder) {
+		return ErrBinderMismatch
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResumptionStateMarshal(t *testing.T) {
+	state := &ResumptionState{
+		CipherSuite: "AES-256-GCM",
+		KEM1Type:    "ML-KEM-768",
+		KEM2Type:    "ML-KEM-1024",
+		IssuedAt:    time.UnixMilli(1700000000123),
+		Lifetime:    90 * time.Minute,
+		PSK:         bytes.Repeat([]byte{7}, resumptionSecretSize),
+		Ticket:      []byte("ticket"),
+	}
+
+	data, err := state.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal state: %v", err)
+	}
+
+	var decoded ResumptionState
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Failed to unmarshal state: %v", err)
+	}
+	if decoded.CipherSuite != state.CipherSuite || decoded.KEM1Type != state.KEM1Type ||
+		decoded.KEM2Type != state.KEM2Type || !decoded.IssuedAt.Equal(state.IssuedAt) ||
+		decoded.Lifetime != state.Lifetime || !bytes.Equal(decoded.PSK, state.PSK) ||
+		!bytes.Equal(decoded.Ticket, state.Ticket) {
+		t.Errorf("Decoded state differs: %+v", decoded)
+	}
+
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Expected truncated state to be rejected")
+	}
+}
+
+func TestTicketKeysRotation(t *testing.T) {
+	keys, err := NewTicketKeys(time.Hour, nil)
+	if err != nil {
+		t.Fatalf("Failed to create ticket keys: %v", err)
+	}
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+
+	ticket, err := keys.seal([]byte("state"))
+	if err != nil {
+		t.Fatalf("Failed to seal ticket: %v", err)
+	}
+
+	// One rotation later the previous key still opens the ticket
+	now = now.Add(time.Hour)
+	if plaintext, err := keys.open(ticket); err != nil || string(plaintext) != "state" {
+		t.Fatalf("Failed to open ticket after one rotation: %q, %v", plaintext, err)
+	}
+
+	// After the next rotation the key is retired
+	now = now.Add(time.Hour)
+	if _, err := keys.open(ticket); err == nil {
+		t.Error("Expected ticket under a retired key to be rejected")
+	}
+
+	fresh, err := keys.seal([]byte("state"))
+	if err != nil {
+		t.Fatalf("Failed to seal ticket: %v", err)
+	}
+	fresh[len(fresh)-1] ^= 1
+	if _, err := keys.open(fresh); err == nil {
+		t.Error("Expected tampered ticket to be rejected")
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore(2)
+	ctx := context.Background()
+
+	put := func(key string, issued time.Time) {
+		state := &ResumptionState{IssuedAt: issued, Lifetime: time.Hour, PSK: []byte(key)}
+		if err := store.Put(ctx, key, state); err != nil {
+			t.Fatalf("Failed to store session: %v", err)
+		}
+	}
+
+	now := time.Now()
+	put("old", now.Add(-time.Minute))
+	put("new", now)
+
+	// The store keeps its own copy
+	state, err := store.Get(ctx, "new")
+	if err != nil || state == nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	state.PSK[0] = 'x'
+	if again, _ := store.Get(ctx, "new"); string(again.PSK) != "new" {
+		t.Error("Store returned a shared copy")
+	}
+
+	// When full, the oldest session is evicted
+	put("newest", now.Add(time.Minute))
+	if state, _ := store.Get(ctx, "old"); state != nil {
+		t.Error("Expected oldest session to be evicted")
+	}
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 sessions, got %d", store.Len())
+	}
+
+	if err := store.Delete(ctx, "new"); err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	if state, _ := store.Get(ctx, "new"); state != nil {
+		t.Error("Expected deleted session to be gone")
+	}
+
+	put("expired", now.Add(-2*time.Hour))
+	if state, _ := store.Get(ctx, "expired"); state != nil {
+		t.Error("Expected expired session to be hidden")
+	}
+
+	// Take hands out a session once
+	put("taken", now)
+	if state, err := store.Take(ctx, "taken"); err != nil || state == nil || string(state.PSK) != "taken" {
+		t.Fatalf("Failed to take session: %v, %v", state, err)
+	}
+	if state, _ := store.Take(ctx, "taken"); state != nil {
+		t.Error("Expected taken session to be gone")
+	}
+}
+
+func TestMemorySessionStoreConcurrentTake(t *testing.T) {
+	store := NewMemorySessionStore(0)
+	ctx := context.Background()
+
+	state := &ResumptionState{IssuedAt: time.Now(), Lifetime: time.Hour, PSK: []byte("psk")}
+	if err := store.Put(ctx, "ticket", state); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		taken atomic.Int32
+	)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if state, err := store.Take(ctx, "ticket"); err == nil && state != nil {
+				taken.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := taken.Load(); n != 1 {
+		t.Errorf("Expected one Take to get the session, got %d", n)
+	}
+}
@@ -1,8 +1,12 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 )
 
 var (
@@ -12,31 +16,179 @@ var (
 	ErrBufferTooShort = errors.New("buffer too short")
 )
 
+// Handshake message types, as absorbed into the transcript
+const (
+	MessageTypeClientHello    byte = 1
+	MessageTypeServerResponse byte = 2
+	MessageTypeClientFinished byte = 3
+	// MessageTypeNewSessionTicket is sent after the handshake, in a
+	// handshake record
+	MessageTypeNewSessionTicket byte = 4
+	// MessageTypeKeyUpdate ratchets the sender's traffic keys
+	MessageTypeKeyUpdate byte = 5
+	// MessageTypeHelloRetryRequest asks the client for a new ClientHello
+	MessageTypeHelloRetryRequest byte = 6
+	// MessageTypeAlert tells the peer why the sender aborted the handshake.
+	// Alerts are not absorbed into the transcript.
+	MessageTypeAlert byte = 7
+)
+
 // ClientHello represents a client's first message in the protocol
 type ClientHello struct {
 	EphemeralPublicKey []byte
 	Ciphertext1        []byte
 	EncryptedPayload   []byte
 	KEM1Type           string
-	KEM2Type           string
+	// KEM2Type is the KEM of EphemeralPublicKey
+	KEM2Type     string
+	CipherSuites []string
+	// Timestamp is the client clock in Unix milliseconds, bounding how long
+	// the 0-RTT data can be replayed. It is bound into K_tmp and K_main.
+	Timestamp uint64
+	// PSKIdentity is the session ticket of a resumption attempt. Resuming
+	// clients leave Ciphertext1 empty, and EphemeralPublicKey too when they
+	// skip KEM2.
+	PSKIdentity []byte
+	// PSKBinder is a MAC over the ClientHello under the resumption PSK
+	PSKBinder []byte
+	// EncryptedIdentity is the client's ClientIdentity under the stage-1
+	// key, present in mutual authentication mode
+	EncryptedIdentity []byte
+	// SupportedKEM2Types lists the KEM2 types the client accepts, in
+	// preference order. KEM2Type alone is offered if it is empty.
+	SupportedKEM2Types []string
+	// Version is the client's ProtocolVersion
+	Version uint16
+	// Extensions are offered to the server in this order
+	Extensions []Extension
+	// Cookie echoes the cookie of a HelloRetryRequest. DefaultSerializer
+	// sends it as the last extension, of type ExtensionCookie.
+	Cookie []byte
+}
+
+// HelloRetryRequest answers a ClientHello whose key share the server does not
+// accept, or that has to prove it can receive the server's messages. The
+// client sends a new ClientHello with a key share for KEM2Type, echoing
+// Cookie.
+type HelloRetryRequest struct {
+	KEM2Type string
+	// Cookie lets a server that kept no state resume the handshake
+	Cookie []byte
 }
 
 // ServerResponse represents a server's response in the protocol
 type ServerResponse struct {
 	Ciphertext2      []byte
 	EncryptedPayload []byte
+	CipherSuite      string
+	// Finished is the server's MAC over the transcript
+	Finished []byte
+	// EarlyDataAccepted tells the client whether its 0-RTT data was
+	// processed or has to be sent again under the stage-2 keys
+	EarlyDataAccepted bool
+	// PSKAccepted tells a client that sent a session ticket whether the
+	// server resumed from it or fell back to the full handshake
+	PSKAccepted bool
+	// Ciphertext3 encapsulates to the client's long-term key in mutual
+	// authentication mode
+	Ciphertext3 []byte
+	// Extensions answer those of the ClientHello; each type must have been
+	// offered
+	Extensions []Extension
 }
 
-// Serializer defines methods for serializing and deserializing protocol messages
+// ClientFinished is the client's third message, confirming that it derived
+// the same session keys as the server
+type ClientFinished struct {
+	Finished []byte
+}
+
+// ClientIdentity names the client and its long-term KEM public key in mutual
+// authentication mode
+type ClientIdentity struct {
+	// ID is chosen by the application, for example a device serial number
+	ID        []byte
+	KEMType   string
+	PublicKey []byte
+}
+
+// NewSessionTicket carries a ticket the client can use to resume the session
+type NewSessionTicket struct {
+	// Lifetime is the ticket validity in seconds
+	Lifetime uint32
+	// Nonce derives the ticket's PSK from the resumption secret
+	Nonce  []byte
+	Ticket []byte
+}
+
+// Serializer defines methods for serializing and deserializing protocol messages.
+// Decoders must be canonical: they accept a ClientHello, ServerResponse or
+// HelloRetryRequest only in the exact encoding its Marshal would produce, up
+// to the whitespace of JSON, as the transcript hashes the decoded message
+// rather than the bytes received.
 type Serializer interface {
 	MarshalClientHello(ch *ClientHello) ([]byte, error)
 	UnmarshalClientHello(data []byte) (*ClientHello, error)
 	MarshalServerResponse(sr *ServerResponse) ([]byte, error)
 	UnmarshalServerResponse(data []byte) (*ServerResponse, error)
+	MarshalClientFinished(cf *ClientFinished) ([]byte, error)
+	UnmarshalClientFinished(data []byte) (*ClientFinished, error)
+	MarshalNewSessionTicket(nst *NewSessionTicket) ([]byte, error)
+	UnmarshalNewSessionTicket(data []byte) (*NewSessionTicket, error)
+	MarshalClientIdentity(id *ClientIdentity) ([]byte, error)
+	UnmarshalClientIdentity(data []byte) (*ClientIdentity, error)
+	MarshalKeyUpdate(ku *KeyUpdate) ([]byte, error)
+	UnmarshalKeyUpdate(data []byte) (*KeyUpdate, error)
+	MarshalHelloRetryRequest(hrr *HelloRetryRequest) ([]byte, error)
+	UnmarshalHelloRetryRequest(data []byte) (*HelloRetryRequest, error)
+	MarshalAlert(a *Alert) ([]byte, error)
+	UnmarshalAlert(data []byte) (*Alert, error)
+}
+
+// checkCanonical rejects data that does not equal the encoding marshal gives
+// the message decoded from it
+func checkCanonical(data []byte, marshal func() ([]byte, error)) error {
+	encoded, err := marshal()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if !bytes.Equal(encoded, data) {
+		return fmt.Errorf("%w: not canonically encoded", ErrInvalidMessage)
+	}
+	return nil
 }
 
-// DefaultSerializer implements the Serializer interface
-type DefaultSerializer struct{}
+// DefaultSerializer implements the Serializer interface. Each message starts
+// with a FrameHeader, except ClientIdentity, which is only ever carried
+// encrypted inside a ClientHello.
+type DefaultSerializer struct {
+	// Legacy writes messages in WireVersionLegacy, without a frame header
+	Legacy bool
+	// AcceptLegacy reads unframed messages as well as framed ones
+	AcceptLegacy bool
+	// Limits bounds the fields of received messages. With nil Limits, they
+	// are only bounded by the message.
+	Limits *Limits
+}
+
+// SerializerNames lists the formats NewSerializer knows
+var SerializerNames = []string{"binary", "cbor", "json"}
+
+// NewSerializer returns the serializer of the named format, which encodes
+// message bodies alone: send them in a NewFrame, and pass received frames to
+// it without their header. Binary messages are thus in WireVersionLegacy.
+func NewSerializer(name string, limits *Limits) (Serializer, error) {
+	switch name {
+	case "binary":
+		return &DefaultSerializer{Legacy: true, AcceptLegacy: true, Limits: limits}, nil
+	case "cbor":
+		return &CBORSerializer{Limits: limits}, nil
+	case "json":
+		return &JSONSerializer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown serializer %q (expected one of %s)", name, strings.Join(SerializerNames, ", "))
+	}
+}
 
 // readLengthPrefixedBytes reads a length-prefixed byte array from data starting at offset
 // returns the bytes and the new offset
@@ -63,6 +215,18 @@ func readLengthPrefixedBytes(data []byte, offset int) ([]byte, int, error) {
 	return result, offset, nil
 }
 
+// readBoundedBytes reads a length-prefixed field of at most limit bytes, or
+// of any size if limit is 0
+func readBoundedBytes(data []byte, offset int, limit int) ([]byte, int, error) {
+	if limit > 0 && offset+4 <= len(data) {
+		if length := binary.BigEndian.Uint32(data[offset : offset+4]); uint64(length) > uint64(limit) {
+			return nil, offset, fmt.Errorf("%w: field of %d bytes exceeds the limit of %d", ErrMessageTooLarge, length, limit)
+		}
+	}
+
+	return readLengthPrefixedBytes(data, offset)
+}
+
 // writeLengthPrefixedBytes appends a length-prefixed byte array to the result
 func writeLengthPrefixedBytes(result []byte, data []byte) []byte {
 	// Reserve 4 bytes in-place for length to avoid a tiny temporary allocation.
@@ -74,47 +238,131 @@ func writeLengthPrefixedBytes(result []byte, data []byte) []byte {
 	return result
 }
 
+// readStringList reads a count-prefixed list of length-prefixed strings, of
+// at most maxEntries entries of maxEntrySize bytes if those are not 0
+func readStringList(data []byte, offset int, maxEntries, maxEntrySize int) ([]string, int, error) {
+	if offset+4 > len(data) {
+		return nil, offset, ErrBufferTooShort
+	}
+
+	count := binary.BigEndian.Uint32(data[offset : offset+4])
+	if maxEntries > 0 && uint64(count) > uint64(maxEntries) {
+		return nil, offset, fmt.Errorf("%w: list of %d entries exceeds the limit of %d", ErrMessageTooLarge, count, maxEntries)
+	}
+	offset += 4
+
+	// Every entry needs at least its 4-byte length prefix
+	if uint64(count)*4 > uint64(len(data)-offset) {
+		return nil, offset, ErrBufferTooShort
+	}
+
+	list := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var entry []byte
+		var err error
+		entry, offset, err = readBoundedBytes(data, offset, maxEntrySize)
+		if err != nil {
+			return nil, offset, err
+		}
+		list = append(list, string(entry))
+	}
+
+	return list, offset, nil
+}
+
+// writeStringList appends a count-prefixed list of length-prefixed strings
+func writeStringList(result []byte, list []string) []byte {
+	countOffset := len(result)
+	result = append(result, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(result[countOffset:countOffset+4], uint32(len(list)))
+	for _, entry := range list {
+		result = writeLengthPrefixedBytes(result, []byte(entry))
+	}
+
+	return result
+}
+
+func stringListSize(list []string) int {
+	size := 4
+	for _, entry := range list {
+		size += 4 + len(entry)
+	}
+	return size
+}
+
 // MarshalClientHello serializes a ClientHello into a byte slice
 func (s *DefaultSerializer) MarshalClientHello(ch *ClientHello) ([]byte, error) {
 	if ch == nil {
 		return nil, errors.New("cannot marshal nil ClientHello")
 	}
+	if err := checkDuplicateExtensions(ch.Extensions); err != nil {
+		return nil, err
+	}
+
+	extensions := ch.Extensions
+	if len(ch.Cookie) > 0 {
+		extensions = append(slices.Clip(extensions), Extension{Type: ExtensionCookie, Data: ch.Cookie})
+		if err := checkDuplicateExtensions(extensions); err != nil {
+			return nil, err
+		}
+	}
 
 	// Pre-allocate a reasonable buffer to reduce allocations
 	estimatedSize := 4 + len(ch.EphemeralPublicKey) +
 		4 + len(ch.Ciphertext1) +
 		4 + len(ch.EncryptedPayload) +
 		4 + len(ch.KEM1Type) +
-		4 + len(ch.KEM2Type)
-
-	result := make([]byte, 0, estimatedSize)
+		4 + len(ch.KEM2Type) +
+		stringListSize(ch.CipherSuites) +
+		8 +
+		4 + len(ch.PSKIdentity) +
+		4 + len(ch.PSKBinder) +
+		4 + len(ch.EncryptedIdentity) +
+		stringListSize(ch.SupportedKEM2Types) +
+		2 +
+		extensionsSize(extensions)
+
+	result := s.beginFrame(MessageTypeClientHello, estimatedSize)
 
 	result = writeLengthPrefixedBytes(result, ch.EphemeralPublicKey)
 	result = writeLengthPrefixedBytes(result, ch.Ciphertext1)
 	result = writeLengthPrefixedBytes(result, ch.EncryptedPayload)
 	result = writeLengthPrefixedBytes(result, []byte(ch.KEM1Type))
 	result = writeLengthPrefixedBytes(result, []byte(ch.KEM2Type))
-
-	return result, nil
+	result = writeStringList(result, ch.CipherSuites)
+	result = binary.BigEndian.AppendUint64(result, ch.Timestamp)
+	result = writeLengthPrefixedBytes(result, ch.PSKIdentity)
+	result = writeLengthPrefixedBytes(result, ch.PSKBinder)
+	result = writeLengthPrefixedBytes(result, ch.EncryptedIdentity)
+	result = writeStringList(result, ch.SupportedKEM2Types)
+	result = binary.BigEndian.AppendUint16(result, ch.Version)
+	result = writeExtensions(result, extensions)
+
+	return s.endFrame(result), nil
 }
 
 // UnmarshalClientHello deserializes a byte slice into a ClientHello
 func (s *DefaultSerializer) UnmarshalClientHello(data []byte) (*ClientHello, error) {
+	raw := data
+	data, err := s.openFrame(MessageTypeClientHello, data)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(data) < 4 {
 		return nil, ErrInvalidMessage
 	}
 
 	ch := &ClientHello{}
 	offset := 0
-	var err error
 
 	// Read each field
-	ch.EphemeralPublicKey, offset, err = readLengthPrefixedBytes(data, offset)
+	ch.EphemeralPublicKey, offset, err = readBoundedBytes(data, offset, s.Limits.publicKeySize())
 	if err != nil {
 		return nil, err
 	}
 
-	ch.Ciphertext1, offset, err = readLengthPrefixedBytes(data, offset)
+	ch.Ciphertext1, offset, err = readBoundedBytes(data, offset, s.Limits.ciphertextSize())
 	if err != nil {
 		return nil, err
 	}
@@ -124,54 +372,131 @@ func (s *DefaultSerializer) UnmarshalClientHello(data []byte) (*ClientHello, err
 		return nil, err
 	}
 
-	kem1TypeBytes, offset, err := readLengthPrefixedBytes(data, offset)
+	kem1TypeBytes, offset, err := readBoundedBytes(data, offset, s.Limits.nameSize())
 	if err != nil {
 		return nil, err
 	}
 	ch.KEM1Type = string(kem1TypeBytes)
 
-	kem2TypeBytes, offset, err := readLengthPrefixedBytes(data, offset)
+	kem2TypeBytes, offset, err := readBoundedBytes(data, offset, s.Limits.nameSize())
 	if err != nil {
 		return nil, err
 	}
 	ch.KEM2Type = string(kem2TypeBytes)
 
+	ch.CipherSuites, offset, err = readStringList(data, offset, s.Limits.listEntries(), s.Limits.nameSize())
+	if err != nil {
+		return nil, err
+	}
+
+	if offset+8 > len(data) {
+		return nil, ErrBufferTooShort
+	}
+	ch.Timestamp = binary.BigEndian.Uint64(data[offset : offset+8])
+	offset += 8
+
+	ch.PSKIdentity, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.PSKBinder, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.EncryptedIdentity, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	ch.SupportedKEM2Types, offset, err = readStringList(data, offset, s.Limits.listEntries(), s.Limits.nameSize())
+	if err != nil {
+		return nil, err
+	}
+
+	if offset+2 > len(data) {
+		return nil, ErrBufferTooShort
+	}
+	ch.Version = binary.BigEndian.Uint16(data[offset : offset+2])
+	offset += 2
+
+	ch.Extensions, offset, err = readExtensions(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	ch.Extensions, ch.Cookie, err = splitCookie(ch.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if we've consumed the entire buffer
 	if offset != len(data) {
-		return ch, errors.New("extra data after message")
+		return ch, fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
 	}
 
+	enc := s.encoderFor(raw)
+	if err := checkCanonical(raw, func() ([]byte, error) { return enc.MarshalClientHello(ch) }); err != nil {
+		return nil, err
+	}
 	return ch, nil
 }
 
+// Flags of the ServerResponse byte that follows Finished
+const (
+	serverFlagEarlyData byte = 1 << iota
+	serverFlagPSK
+)
+
 // MarshalServerResponse serializes a ServerResponse into a byte slice
 func (s *DefaultSerializer) MarshalServerResponse(sr *ServerResponse) ([]byte, error) {
 	if sr == nil {
 		return nil, errors.New("cannot marshal nil ServerResponse")
 	}
+	if err := checkDuplicateExtensions(sr.Extensions); err != nil {
+		return nil, err
+	}
 
 	// Pre-allocate a reasonable buffer
-	estimatedSize := 4 + len(sr.Ciphertext2) + 4 + len(sr.EncryptedPayload)
-	result := make([]byte, 0, estimatedSize)
+	estimatedSize := 4 + len(sr.Ciphertext2) + 4 + len(sr.EncryptedPayload) + 4 + len(sr.CipherSuite) + 4 + len(sr.Finished) + 1 + 4 + len(sr.Ciphertext3) +
+		extensionsSize(sr.Extensions)
+	result := s.beginFrame(MessageTypeServerResponse, estimatedSize)
 
 	result = writeLengthPrefixedBytes(result, sr.Ciphertext2)
 	result = writeLengthPrefixedBytes(result, sr.EncryptedPayload)
+	result = writeLengthPrefixedBytes(result, []byte(sr.CipherSuite))
+	result = writeLengthPrefixedBytes(result, sr.Finished)
+	var flags byte
+	if sr.EarlyDataAccepted {
+		flags |= serverFlagEarlyData
+	}
+	if sr.PSKAccepted {
+		flags |= serverFlagPSK
+	}
+	result = append(result, flags)
+	result = writeLengthPrefixedBytes(result, sr.Ciphertext3)
+	result = writeExtensions(result, sr.Extensions)
 
-	return result, nil
+	return s.endFrame(result), nil
 }
 
 // UnmarshalServerResponse deserializes a byte slice into a ServerResponse
 func (s *DefaultSerializer) UnmarshalServerResponse(data []byte) (*ServerResponse, error) {
+	raw := data
+	data, err := s.openFrame(MessageTypeServerResponse, data)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(data) < 4 {
 		return nil, ErrInvalidMessage
 	}
 
 	sr := &ServerResponse{}
 	offset := 0
-	var err error
 
 	// Read each field
-	sr.Ciphertext2, offset, err = readLengthPrefixedBytes(data, offset)
+	sr.Ciphertext2, offset, err = readBoundedBytes(data, offset, s.Limits.ciphertextSize())
 	if err != nil {
 		return nil, err
 	}
@@ -181,10 +506,291 @@ func (s *DefaultSerializer) UnmarshalServerResponse(data []byte) (*ServerRespons
 		return nil, err
 	}
 
+	cipherSuiteBytes, offset, err := readBoundedBytes(data, offset, s.Limits.nameSize())
+	if err != nil {
+		return nil, err
+	}
+	sr.CipherSuite = string(cipherSuiteBytes)
+
+	sr.Finished, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset+1 > len(data) {
+		return nil, ErrBufferTooShort
+	}
+	flags := data[offset]
+	if flags&^(serverFlagEarlyData|serverFlagPSK) != 0 {
+		return nil, ErrInvalidMessage
+	}
+	sr.EarlyDataAccepted = flags&serverFlagEarlyData != 0
+	sr.PSKAccepted = flags&serverFlagPSK != 0
+	offset++
+
+	sr.Ciphertext3, offset, err = readBoundedBytes(data, offset, s.Limits.ciphertextSize())
+	if err != nil {
+		return nil, err
+	}
+
+	sr.Extensions, offset, err = readExtensions(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if we've consumed the entire buffer
 	if offset != len(data) {
-		return sr, errors.New("extra data after message")
+		return sr, fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
 	}
 
+	enc := s.encoderFor(raw)
+	if err := checkCanonical(raw, func() ([]byte, error) { return enc.MarshalServerResponse(sr) }); err != nil {
+		return nil, err
+	}
 	return sr, nil
 }
+
+// MarshalClientFinished serializes a ClientFinished into a byte slice
+func (s *DefaultSerializer) MarshalClientFinished(cf *ClientFinished) ([]byte, error) {
+	if cf == nil {
+		return nil, errors.New("cannot marshal nil ClientFinished")
+	}
+
+	result := s.beginFrame(MessageTypeClientFinished, 4+len(cf.Finished))
+	result = writeLengthPrefixedBytes(result, cf.Finished)
+
+	return s.endFrame(result), nil
+}
+
+// UnmarshalClientFinished deserializes a byte slice into a ClientFinished
+func (s *DefaultSerializer) UnmarshalClientFinished(data []byte) (*ClientFinished, error) {
+	data, err := s.openFrame(MessageTypeClientFinished, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, ErrInvalidMessage
+	}
+
+	cf := &ClientFinished{}
+	offset := 0
+
+	cf.Finished, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != len(data) {
+		return cf, fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
+	}
+
+	return cf, nil
+}
+
+// MarshalNewSessionTicket serializes a NewSessionTicket into a byte slice
+func (s *DefaultSerializer) MarshalNewSessionTicket(nst *NewSessionTicket) ([]byte, error) {
+	if nst == nil {
+		return nil, errors.New("cannot marshal nil NewSessionTicket")
+	}
+
+	result := s.beginFrame(MessageTypeNewSessionTicket, 4+4+len(nst.Nonce)+4+len(nst.Ticket))
+	result = binary.BigEndian.AppendUint32(result, nst.Lifetime)
+	result = writeLengthPrefixedBytes(result, nst.Nonce)
+	result = writeLengthPrefixedBytes(result, nst.Ticket)
+
+	return s.endFrame(result), nil
+}
+
+// UnmarshalNewSessionTicket deserializes a byte slice into a NewSessionTicket
+func (s *DefaultSerializer) UnmarshalNewSessionTicket(data []byte) (*NewSessionTicket, error) {
+	data, err := s.openFrame(MessageTypeNewSessionTicket, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, ErrInvalidMessage
+	}
+
+	nst := &NewSessionTicket{
+		Lifetime: binary.BigEndian.Uint32(data[:4]),
+	}
+	offset := 4
+
+	nst.Nonce, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	nst.Ticket, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != len(data) {
+		return nst, fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
+	}
+
+	return nst, nil
+}
+
+// MarshalClientIdentity serializes a ClientIdentity into a byte slice
+func (s *DefaultSerializer) MarshalClientIdentity(id *ClientIdentity) ([]byte, error) {
+	if id == nil {
+		return nil, errors.New("cannot marshal nil ClientIdentity")
+	}
+
+	result := make([]byte, 0, 4+len(id.ID)+4+len(id.KEMType)+4+len(id.PublicKey))
+	result = writeLengthPrefixedBytes(result, id.ID)
+	result = writeLengthPrefixedBytes(result, []byte(id.KEMType))
+	result = writeLengthPrefixedBytes(result, id.PublicKey)
+
+	return result, nil
+}
+
+// UnmarshalClientIdentity deserializes a byte slice into a ClientIdentity
+func (s *DefaultSerializer) UnmarshalClientIdentity(data []byte) (*ClientIdentity, error) {
+	if len(data) < 4 {
+		return nil, ErrInvalidMessage
+	}
+
+	id := &ClientIdentity{}
+	offset := 0
+	var err error
+
+	id.ID, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	kemTypeBytes, offset, err := readBoundedBytes(data, offset, s.Limits.nameSize())
+	if err != nil {
+		return nil, err
+	}
+	id.KEMType = string(kemTypeBytes)
+
+	id.PublicKey, offset, err = readLengthPrefixedBytes(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset != len(data) {
+		return id, fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
+	}
+
+	return id, nil
+}
+
+// MarshalKeyUpdate serializes a KeyUpdate into a byte slice
+func (s *DefaultSerializer) MarshalKeyUpdate(ku *KeyUpdate) ([]byte, error) {
+	if ku == nil {
+		return nil, errors.New("cannot marshal nil KeyUpdate")
+	}
+
+	result := s.beginFrame(MessageTypeKeyUpdate, 1)
+	if ku.UpdateRequested {
+		result = append(result, 1)
+	} else {
+		result = append(result, 0)
+	}
+
+	return s.endFrame(result), nil
+}
+
+// UnmarshalKeyUpdate deserializes a byte slice into a KeyUpdate
+func (s *DefaultSerializer) UnmarshalKeyUpdate(data []byte) (*KeyUpdate, error) {
+	data, err := s.openFrame(MessageTypeKeyUpdate, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != 1 || data[0] > 1 {
+		return nil, ErrInvalidMessage
+	}
+
+	return &KeyUpdate{UpdateRequested: data[0] == 1}, nil
+}
+
+// MarshalHelloRetryRequest serializes a HelloRetryRequest into a byte slice
+func (s *DefaultSerializer) MarshalHelloRetryRequest(hrr *HelloRetryRequest) ([]byte, error) {
+	if hrr == nil {
+		return nil, errors.New("cannot marshal nil HelloRetryRequest")
+	}
+
+	result := s.beginFrame(MessageTypeHelloRetryRequest, 4+len(hrr.KEM2Type)+4+len(hrr.Cookie))
+	result = writeLengthPrefixedBytes(result, []byte(hrr.KEM2Type))
+	// Requests without a cookie end here, as in earlier releases
+	if len(hrr.Cookie) > 0 {
+		result = writeLengthPrefixedBytes(result, hrr.Cookie)
+	}
+
+	return s.endFrame(result), nil
+}
+
+// UnmarshalHelloRetryRequest deserializes a byte slice into a HelloRetryRequest
+func (s *DefaultSerializer) UnmarshalHelloRetryRequest(data []byte) (*HelloRetryRequest, error) {
+	raw := data
+	data, err := s.openFrame(MessageTypeHelloRetryRequest, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, ErrInvalidMessage
+	}
+
+	hrr := &HelloRetryRequest{}
+	kem2TypeBytes, offset, err := readBoundedBytes(data, 0, s.Limits.nameSize())
+	if err != nil {
+		return nil, err
+	}
+	hrr.KEM2Type = string(kem2TypeBytes)
+
+	if offset < len(data) {
+		hrr.Cookie, offset, err = readBoundedBytes(data, offset, MaxCookieSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(hrr.Cookie) == 0 {
+			return nil, fmt.Errorf("%w: empty cookie", ErrInvalidMessage)
+		}
+	}
+
+	if offset != len(data) {
+		return hrr, fmt.Errorf("%w: extra data after message", ErrInvalidMessage)
+	}
+
+	enc := s.encoderFor(raw)
+	if err := checkCanonical(raw, func() ([]byte, error) { return enc.MarshalHelloRetryRequest(hrr) }); err != nil {
+		return nil, err
+	}
+	return hrr, nil
+}
+
+// MarshalAlert serializes an Alert into a byte slice
+func (s *DefaultSerializer) MarshalAlert(a *Alert) ([]byte, error) {
+	if a == nil {
+		return nil, errors.New("cannot marshal nil Alert")
+	}
+
+	result := s.beginFrame(MessageTypeAlert, 1)
+	result = append(result, byte(a.Code))
+
+	return s.endFrame(result), nil
+}
+
+// UnmarshalAlert deserializes a byte slice into an Alert. Unknown codes are
+// kept, since every alert is fatal.
+func (s *DefaultSerializer) UnmarshalAlert(data []byte) (*Alert, error) {
+	data, err := s.openFrame(MessageTypeAlert, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != 1 {
+		return nil, ErrInvalidMessage
+	}
+
+	return &Alert{Code: AlertCode(data[0])}, nil
+}
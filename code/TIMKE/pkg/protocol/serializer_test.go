@@ -0,0 +1,270 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// conformingSerializers are every Serializer, which must all carry the same
+// messages
+func conformingSerializers() map[string]Serializer {
+	return map[string]Serializer{
+		"binary": &DefaultSerializer{},
+		"cbor":   &CBORSerializer{Limits: NewLimits()},
+		"json":   &JSONSerializer{},
+	}
+}
+
+// marshalAny serializes any message decoded by a goldenMessage
+func marshalAny(s Serializer, msg any) ([]byte, error) {
+	switch m := msg.(type) {
+	case *ClientHello:
+		return s.MarshalClientHello(m)
+	case *ServerResponse:
+		return s.MarshalServerResponse(m)
+	case *ClientFinished:
+		return s.MarshalClientFinished(m)
+	case *NewSessionTicket:
+		return s.MarshalNewSessionTicket(m)
+	case *ClientIdentity:
+		return s.MarshalClientIdentity(m)
+	case *KeyUpdate:
+		return s.MarshalKeyUpdate(m)
+	case *HelloRetryRequest:
+		return s.MarshalHelloRetryRequest(m)
+	case *Alert:
+		return s.MarshalAlert(m)
+	default:
+		return nil, fmt.Errorf("unknown message %T", msg)
+	}
+}
+
+// TestSerializerConformance round-trips every message through every
+// serializer, comparing what they decode in the binary encoding
+func TestSerializerConformance(t *testing.T) {
+	reference := &DefaultSerializer{}
+	messages := goldenMessages()
+
+	for name, serializer := range conformingSerializers() {
+		for i, msg := range messages {
+			t.Run(name+"/"+msg.name, func(t *testing.T) {
+				want, err := msg.marshal(reference)
+				if err != nil {
+					t.Fatalf("Failed to marshal reference: %v", err)
+				}
+
+				data, err := msg.marshal(serializer)
+				if err != nil {
+					t.Fatalf("Failed to marshal: %v", err)
+				}
+				decoded, err := msg.unmarshal(serializer, data)
+				if err != nil {
+					t.Fatalf("Failed to unmarshal: %v", err)
+				}
+				got, err := marshalAny(reference, decoded)
+				if err != nil {
+					t.Fatalf("Failed to marshal decoded message: %v", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("Message changed in a round trip:\ngot  %x\nwant %x", got, want)
+				}
+
+				// Zero values round-trip too, whether or not they are encoded
+				emptyWant := mustMarshalEmpty(t, reference, decoded)
+				if empty, err := msg.unmarshal(serializer, mustMarshalEmpty(t, serializer, decoded)); err != nil {
+					t.Errorf("Failed to unmarshal empty message: %v", err)
+				} else if got, _ := marshalAny(reference, empty); !bytes.Equal(got, emptyWant) {
+					t.Errorf("Empty message changed in a round trip:\ngot  %x\nwant %x", got, emptyWant)
+				}
+
+				other := messages[(i+1)%len(messages)]
+				if _, err := other.unmarshal(serializer, data); err == nil {
+					t.Errorf("Expected a %s to be rejected as %s", msg.name, other.name)
+				}
+				for n := range len(data) {
+					if _, err := msg.unmarshal(serializer, data[:n]); err == nil {
+						t.Errorf("Expected a truncation to %d bytes to be rejected", n)
+						break
+					}
+				}
+				if _, err := msg.unmarshal(serializer, append(bytes.Clone(data), 0)); err == nil {
+					t.Error("Expected trailing data to be rejected")
+				}
+			})
+		}
+	}
+}
+
+// mustMarshalEmpty serializes the zero value of msg's type
+func mustMarshalEmpty(t *testing.T, s Serializer, msg any) []byte {
+	t.Helper()
+
+	var empty any
+	switch msg.(type) {
+	case *ClientHello:
+		empty = &ClientHello{}
+	case *ServerResponse:
+		empty = &ServerResponse{}
+	case *ClientFinished:
+		empty = &ClientFinished{}
+	case *NewSessionTicket:
+		empty = &NewSessionTicket{}
+	case *ClientIdentity:
+		empty = &ClientIdentity{}
+	case *KeyUpdate:
+		empty = &KeyUpdate{}
+	case *HelloRetryRequest:
+		empty = &HelloRetryRequest{}
+	case *Alert:
+		empty = &Alert{}
+	}
+
+	data, err := marshalAny(s, empty)
+	if err != nil {
+		t.Fatalf("Failed to marshal empty message: %v", err)
+	}
+	return data
+}
+
+func TestCBORSerializer(t *testing.T) {
+	serializer := &CBORSerializer{Limits: &Limits{MaxPublicKeySize: 8, MaxNameSize: 16, MaxListEntries: 2}}
+
+	data, err := serializer.MarshalHelloRetryRequest(&HelloRetryRequest{KEM2Type: "ML-KEM-1024"})
+	if err != nil {
+		t.Fatalf("Failed to marshal hello retry request: %v", err)
+	}
+	// {0: 6, 1: "ML-KEM-1024"}
+	want := append([]byte{0xa2, 0x00, 0x06, 0x01, 0x6b}, "ML-KEM-1024"...)
+	if !bytes.Equal(data, want) {
+		t.Errorf("Unexpected encoding %x", data)
+	}
+
+	testCases := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"not shortest form":  {[]byte{0xa2, 0x00, 0x01, 0x04, 0x78, 0x01, 'A'}, ErrInvalidMessage},
+		"indefinite length":  {[]byte{0xa2, 0x00, 0x01, 0x04, 0x7f, 0x61, 'A', 0xff}, ErrInvalidMessage},
+		"keys out of order":  {[]byte{0xa3, 0x00, 0x01, 0x05, 0x60, 0x04, 0x60}, ErrInvalidMessage},
+		"duplicate key":      {[]byte{0xa3, 0x00, 0x01, 0x04, 0x60, 0x04, 0x60}, ErrInvalidMessage},
+		"type not first":     {[]byte{0xa2, 0x04, 0x60, 0x00, 0x01}, ErrInvalidMessage},
+		"unknown field":      {[]byte{0xa2, 0x00, 0x01, 0x18, 0x20, 0x00}, ErrInvalidMessage},
+		"invalid UTF-8":      {[]byte{0xa2, 0x00, 0x01, 0x04, 0x61, 0xff}, ErrInvalidMessage},
+		"oversized key":      {append([]byte{0xa2, 0x00, 0x01, 0x01, 0x49}, make([]byte, 9)...), ErrMessageTooLarge},
+		"too many suites":    {[]byte{0xa2, 0x00, 0x01, 0x06, 0x83, 0x60, 0x60, 0x60}, ErrMessageTooLarge},
+		"huge announced map": {[]byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x01}, ErrInvalidMessage},
+		"huge announced key": {[]byte{0xa2, 0x00, 0x01, 0x01, 0x5a, 0xff, 0xff, 0xff, 0xff}, ErrBufferTooShort},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := serializer.UnmarshalClientHello(tc.data); !errors.Is(err, tc.err) {
+				t.Errorf("Expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNewSerializer(t *testing.T) {
+	for _, name := range SerializerNames {
+		serializer, err := NewSerializer(name, nil)
+		if err != nil {
+			t.Fatalf("Failed to create %s serializer: %v", name, err)
+		}
+
+		// Bodies of every format are carried in a frame
+		body, err := serializer.MarshalClientFinished(&ClientFinished{Finished: []byte{0xcf}})
+		if err != nil {
+			t.Fatalf("Failed to marshal client finished: %v", err)
+		}
+		header, frame, err := NewDecoder(bytes.NewReader(NewFrame(MessageTypeClientFinished, body)), nil).ReadFrame()
+		if err != nil {
+			t.Fatalf("Failed to read %s frame: %v", name, err)
+		}
+		if header.Type != MessageTypeClientFinished {
+			t.Errorf("Expected client finished, got type %d", header.Type)
+		}
+		if _, err := serializer.UnmarshalClientFinished(frame[FrameHeaderSize:]); err != nil {
+			t.Errorf("Failed to unmarshal %s body: %v", name, err)
+		}
+	}
+
+	if _, err := NewSerializer("xml", nil); err == nil {
+		t.Error("Expected an unknown serializer to be rejected")
+	}
+}
+
+// TestSerializerCanonical checks that the handshake messages, which the
+// transcript hashes as decoded, have a single encoding in every serializer
+func TestSerializerCanonical(t *testing.T) {
+	cookieFirst, err := (&DefaultSerializer{}).MarshalClientHello(&ClientHello{
+		KEM1Type:   "ML-KEM-768",
+		Version:    ProtocolVersion,
+		Extensions: []Extension{{Type: ExtensionCookie, Data: []byte("cookie")}, {Type: 0x0010, Data: []byte("h2")}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal client hello: %v", err)
+	}
+
+	testCases := map[string]struct {
+		serializer Serializer
+		data       []byte
+	}{
+		"binary cookie not last": {&DefaultSerializer{}, cookieFirst},
+		// {0: 6, 1: "ML-KEM-1024", 2: h''}
+		"cbor empty cookie":     {&CBORSerializer{}, append(append([]byte{0xa3, 0x00, 0x06, 0x01, 0x6b}, "ML-KEM-1024"...), 0x02, 0x40)},
+		"json keys reordered":   {&JSONSerializer{}, []byte(`{"message":{"KEM2Type":"ML-KEM-1024","Cookie":null},"type":"hello_retry_request"}`)},
+		"json escaped string":   {&JSONSerializer{}, []byte(`{"type":"hello_retry_request","message":{"KEM2Type":"ML\u002dKEM-1024","Cookie":null}}`)},
+		"json fields reordered": {&JSONSerializer{}, []byte(`{"type":"hello_retry_request","message":{"Cookie":null,"KEM2Type":"ML-KEM-1024"}}`)},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var err error
+			if name == "binary cookie not last" {
+				_, err = tc.serializer.UnmarshalClientHello(tc.data)
+			} else {
+				_, err = tc.serializer.UnmarshalHelloRetryRequest(tc.data)
+			}
+			if !errors.Is(err, ErrInvalidMessage) {
+				t.Errorf("Expected %v, got %v", ErrInvalidMessage, err)
+			}
+		})
+	}
+
+	// Any change to an encoding either fails to decode or is encoded back
+	// as changed
+	for name, serializer := range conformingSerializers() {
+		for _, msg := range goldenMessages() {
+			data, err := msg.marshal(serializer)
+			if err != nil {
+				t.Fatalf("Failed to marshal %s: %v", msg.name, err)
+			}
+			decoded, err := msg.unmarshal(serializer, data)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal %s: %v", msg.name, err)
+			}
+			switch decoded.(type) {
+			case *ClientHello, *ServerResponse, *HelloRetryRequest:
+			default:
+				continue
+			}
+
+			t.Run(name+"/"+msg.name, func(t *testing.T) {
+				for i := range data {
+					for _, bit := range []byte{0x01, 0x20, 0x80} {
+						mutated := bytes.Clone(data)
+						mutated[i] ^= bit
+						decoded, err := msg.unmarshal(serializer, mutated)
+						if err != nil {
+							continue
+						}
+						if encoded, err := marshalAny(serializer, decoded); err != nil || !bytes.Equal(encoded, mutated) {
+							t.Fatalf("Byte %d ^ %#x decodes, but does not encode back: %x", i, bit, mutated)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package protocol
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"slices"
+	"time"
 
 	"TIMKE/pkg/crypto"
 	"TIMKE/pkg/kem"
@@ -14,166 +19,763 @@ type Server struct {
 	state   SessionState
 	options *SessionOptions
 	rand    io.Reader
+	now     func() time.Time
+
+	clientAddr net.Addr       // bound into retry cookies
+	metrics    *engineMetrics // of the ServerEngine that created it, if any
 
 	ephemeralClientPubKey kem.PublicKey
 	ciphertext1           []byte
-	sharedSecret1         []byte // K_1
-	tempKey               []byte // K_tmp
+	sharedSecret1         *crypto.Secret // K_1
+	tempKey               *crypto.Secret // K_tmp
 	ciphertext2           []byte
-	sharedSecret2         []byte // K_2
-	sessionKey            []byte // K_main
+	sharedSecret2         *crypto.Secret // K_2
+	sessionKey            *crypto.Secret // K_main
 
 	dynamicKEM1 kem.KEM
 	dynamicKEM2 kem.KEM
+	cipherSuite crypto.CipherSuite
+	offer       *negotiation
+	records     *recordLayer
+
+	transcript     *Transcript
+	transcriptHash []byte // through ClientFinished
+	helloRetry     *HelloRetryRequest
+	alert          *Alert // why the handshake failed
+
+	earlyDataAccepted bool
+	earlyDataErr      error // why 0-RTT data was rejected
+
+	clientExtensions   []Extension
+	responseExtensions []Extension
+
+	clientIdentity  *ClientIdentity
+	clientKEM       kem.KEM
+	clientPublicKey kem.PublicKey
+	ciphertext3     []byte
+
+	resumed          bool
+	ticketErr        error          // why the ticket was dropped for a full handshake
+	psk              *crypto.Secret // PSK of the ticket being resumed
+	earlyExporter    *crypto.Secret // stage-1 exporter master
+	exporter         *crypto.Secret // stage-2 exporter master
+	resumptionSecret *crypto.Secret // base of the tickets issued for this session
 }
 
 func NewServer(config *Config, options *SessionOptions) (*Server, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
 	if options == nil || options.ServerPrivateKey == nil {
 		return nil, errors.New("server private key is required")
 	}
 
+	return newServer(config, options), nil
+}
+
+func newServer(config *Config, options *SessionOptions) *Server {
 	return &Server{
 		config:  config,
 		state:   StateInitial,
 		options: options,
-		rand:    kem.DefaultRand,
-	}, nil
+		rand:    config.random(),
+		now:     time.Now,
+	}
 }
 
 func (s *Server) ProcessClientHello(clientHello *ClientHello) ([]byte, error) {
+	return s.ProcessClientHelloContext(context.Background(), clientHello)
+}
+
+// ProcessClientHelloContext is ProcessClientHello under ctx, which is passed
+// to the SessionOptions callbacks and the session store and bounds the
+// decapsulation
+func (s *Server) ProcessClientHelloContext(ctx context.Context, clientHello *ClientHello) ([]byte, error) {
 	if s.state != StateInitial {
 		return nil, errors.New("server not in initial state")
 	}
 
 	if clientHello == nil {
-		s.state = StateFailed
-		return nil, errors.New("nil client hello")
+		return nil, s.fail(errors.New("nil client hello"))
 	}
 
-	var err error
-	if clientHello.KEM1Type != "" && clientHello.KEM2Type != "" {
-		s.dynamicKEM1, err = SelectKEM(clientHello.KEM1Type)
-		if err != nil {
-			s.dynamicKEM1 = DefaultKEM1()
+	// The serialized message is checked against the policy and absorbed into
+	// the transcript
+	helloBytes, err := encodeClientHello(clientHello)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	if err := s.config.Policy.checkMessageSize("ClientHello", len(helloBytes)); err != nil {
+		return nil, s.fail(err)
+	}
+
+	if clientHello.Version != ProtocolVersion {
+		return nil, s.fail(fmt.Errorf("%w: %d", ErrUnsupportedVersion, clientHello.Version))
+	}
+
+	// Unknown extensions are skipped, known ones must decode
+	if err := checkExtensions(clientHello.Extensions); err != nil {
+		return nil, s.fail(err)
+	}
+
+	// A ClientHello answering our HelloRetryRequest continues its
+	// transcript, which a cookie carries if the server kept no state. The
+	// cookie is checked before anything is decapsulated.
+	switch {
+	case len(clientHello.Cookie) > 0:
+		if err := s.openCookie(clientHello.Cookie); err != nil {
+			return nil, s.fail(err)
+		}
+	case s.helloRetry != nil && len(s.helloRetry.Cookie) > 0:
+		return nil, s.fail(fmt.Errorf("%w: missing from the retried client hello", ErrInvalidCookie))
+	case s.helloRetry == nil:
+		s.transcript = NewTranscript()
+	}
+	s.transcript.Write(MessageTypeClientHello, helloBytes)
+
+	s.cipherSuite, err = NegotiateCipherSuite(s.config.cipherSuites(), clientHello.CipherSuites)
+	if err != nil {
+		// Explain why the client's preferred suite is refused
+		if len(clientHello.CipherSuites) > 0 {
+			if perr := s.config.Policy.checkCipherSuite(clientHello.CipherSuites[0]); perr != nil {
+				return nil, s.fail(perr)
+			}
 		}
+		return nil, s.fail(err)
+	}
 
-		s.dynamicKEM2, err = SelectKEM(clientHello.KEM2Type)
+	retry, err := s.negotiateKEMs(clientHello)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	if s.cookieRequired(ctx, clientHello) {
+		if retry == nil {
+			retry = &HelloRetryRequest{KEM2Type: clientHello.KEM2Type}
+		}
+		retry.Cookie, err = s.options.CookieKeys.issue(cookieAddress(s.clientAddr), s.transcript, retry.KEM2Type)
 		if err != nil {
-			s.dynamicKEM2 = DefaultKEM2()
+			return nil, s.fail(err)
 		}
-	} else {
-		s.dynamicKEM1 = DefaultKEM1()
-		s.dynamicKEM2 = DefaultKEM2()
 	}
+	if retry != nil {
+		retryBytes, err := encodeHelloRetryRequest(retry)
+		if err != nil {
+			return nil, s.fail(err)
+		}
+		s.transcript.Write(MessageTypeHelloRetryRequest, retryBytes)
+		s.helloRetry = retry
+		if s.metrics != nil {
+			s.metrics.retries.Add(1)
+		}
+		return nil, ErrHelloRetryRequired
+	}
+	s.offer = offeredNegotiation(clientHello)
+
+	if len(clientHello.PSKIdentity) > 0 {
+		err := s.processTicket(ctx, clientHello)
+		// A rejected ticket is dropped if the client sent key shares for a
+		// full handshake along with it
+		if errors.Is(err, ErrTicketRejected) && canFallBack(clientHello) {
+			s.ticketErr = err
+			err = s.processKeyShares(ctx, clientHello)
+		}
+		if err != nil {
+			return nil, s.fail(err)
+		}
+	} else if len(clientHello.PSKBinder) > 0 {
+		return nil, s.fail(fmt.Errorf("%w: PSK binder without a session ticket", ErrIllegalParameter))
+	} else if err := s.processKeyShares(ctx, clientHello); err != nil {
+		return nil, s.fail(err)
+	}
+	// K_tmp only protects the 0-RTT data and keys the stage-1 exporter
+	defer s.tempKey.Destroy()
+	// After a fallback the client's K_tmp came from the ticket, so there is
+	// no stage-1 key both sides share
+	if s.ticketErr == nil {
+		s.earlyExporter = exporterMaster(s.tempKey, labelEarlyExporter, s.transcript.Sum())
+	}
+
+	if err := s.processIdentity(ctx, clientHello); err != nil {
+		return nil, s.fail(err)
+	}
+
+	if err := s.negotiateExtensions(ctx, clientHello.Extensions); err != nil {
+		return nil, s.fail(err)
+	}
+
+	// 4. Decrypt 0-RTT data
+	if len(clientHello.EncryptedPayload) == 0 {
+		return nil, nil
+	}
+
+	// The 0-RTT data is protected by the rejected ticket
+	if s.ticketErr != nil {
+		s.earlyDataErr = s.ticketErr
+		return nil, nil
+	}
+
+	earlySuite, err := s.earlySuite(clientHello)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+
+	earlyContext, err := earlyTrafficContext(clientHello)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+	earlyCipher, err := newRecordCipher(earlySuite, s.tempKey.Bytes(), labelEarlyTraffic, earlyContext)
+	if err != nil {
+		return nil, s.fail(err)
+	}
+
+	// Rejected 0-RTT data is dropped, the handshake carries on
+	if len(clientHello.EncryptedPayload)-earlyCipher.Overhead() > s.options.maxEarlyDataSize() {
+		s.earlyDataErr = ErrEarlyDataTooLarge
+		return nil, nil
+	}
+
+	zeroRTTData, err := openApplicationData(earlyCipher, clientHello.EncryptedPayload)
+	if err != nil {
+		return nil, s.fail(fmt.Errorf("failed to decrypt 0-RTT data: %w", err))
+	}
+
+	// 5. Check for replays and ask the application
+	err = checkEarlyDataFreshness(ctx, clientHello, s.options.replayCache(), s.options.earlyDataWindow(), s.now())
+	if err == nil && s.options.AcceptEarlyData != nil {
+		info := EarlyDataInfo{
+			Data:        zeroRTTData,
+			CipherSuite: earlySuite.Name(),
+			KEM1Type:    clientHello.KEM1Type,
+			KEM2Type:    clientHello.KEM2Type,
+			Timestamp:   time.UnixMilli(int64(clientHello.Timestamp)),
+			Resumed:     s.resumed,
+		}
+		if !s.options.AcceptEarlyData(ctx, info) {
+			err = ErrEarlyDataRefused
+		}
+	}
+	if err != nil {
+		crypto.Zeroize(zeroRTTData)
+		s.earlyDataErr = err
+		return nil, nil
+	}
+
+	s.earlyDataAccepted = true
+	return zeroRTTData, nil
+}
+
+// negotiateKEMs checks that KEM1 is the KEM of the long-term key and picks
+// KEM2 from the server's preferences. It returns a HelloRetryRequest if the
+// client's key share is not for that KEM2.
+func (s *Server) negotiateKEMs(clientHello *ClientHello) (*HelloRetryRequest, error) {
+	if clientHello.KEM1Type != s.options.ServerPrivateKey.Algorithm() {
+		return nil, fmt.Errorf("%w: KEM1 %q does not match the server key", ErrNoCommonKEM, clientHello.KEM1Type)
+	}
+	if err := s.config.Policy.checkKEM1(clientHello.KEM1Type); err != nil {
+		return nil, err
+	}
+
+	var err error
+	s.dynamicKEM1, err = selectConfiguredKEM(s.config.KEM1, clientHello.KEM1Type)
+	if err != nil {
+		return nil, err
+	}
+
+	offered := clientHello.SupportedKEM2Types
+	if len(offered) == 0 {
+		offered = []string{clientHello.KEM2Type}
+	} else if !slices.Contains(offered, clientHello.KEM2Type) {
+		return nil, fmt.Errorf("%w: key share for KEM2 %q that was not offered", ErrIllegalParameter, clientHello.KEM2Type)
+	}
+
+	s.dynamicKEM2, err = NegotiateKEM(s.config.kem2Types(), offered)
+	if err != nil {
+		// Explain why the client's key share is refused
+		if perr := s.config.Policy.checkKEM2(clientHello.KEM2Type); perr != nil {
+			return nil, perr
+		}
+		return nil, err
+	}
+	selected := s.dynamicKEM2.Setup().Name
+	if s.dynamicKEM2, err = selectConfiguredKEM(s.config.KEM2, selected); err != nil {
+		return nil, err
+	}
+
+	// Resumption without forward secrecy has no key share to replace
+	if selected == clientHello.KEM2Type || len(clientHello.EphemeralPublicKey) == 0 {
+		return nil, nil
+	}
+	if s.helloRetry != nil {
+		return nil, fmt.Errorf("%w: key share for KEM2 %q after requesting %q", ErrIllegalParameter, clientHello.KEM2Type, selected)
+	}
+	return &HelloRetryRequest{KEM2Type: selected}, nil
+}
+
+// SetClientAddress sets the address that retry cookies are bound to, nil by
+// default
+func (s *Server) SetClientAddress(addr net.Addr) {
+	s.clientAddr = addr
+}
+
+// cookieRequired reports whether a ClientHello has to be answered with a
+// cookie first
+func (s *Server) cookieRequired(ctx context.Context, clientHello *ClientHello) bool {
+	if s.options.CookieKeys == nil || len(clientHello.Cookie) > 0 {
+		return false
+	}
+	return s.options.RequireCookie == nil || s.options.RequireCookie(ctx, s.clientAddr)
+}
+
+// openCookie restores the transcript through the HelloRetryRequest that
+// issued cookie
+func (s *Server) openCookie(cookie []byte) error {
+	if s.options.CookieKeys == nil {
+		return fmt.Errorf("%w: cookies are not enabled", ErrInvalidCookie)
+	}
+
+	transcript, kem2Type, err := s.options.CookieKeys.open(cookieAddress(s.clientAddr), cookie)
+	if err != nil {
+		return err
+	}
+
+	// The HelloRetryRequest is encoded again, as it was sent
+	retry := &HelloRetryRequest{KEM2Type: kem2Type, Cookie: cookie}
+	retryBytes, err := encodeHelloRetryRequest(retry)
+	if err != nil {
+		return err
+	}
+	transcript.Write(MessageTypeHelloRetryRequest, retryBytes)
+	s.transcript = transcript
+	s.helloRetry = retry
+	return nil
+}
+
+// fail aborts the handshake and records the alert telling the client why
+func (s *Server) fail(err error) error {
+	if s.metrics != nil && s.state != StateFailed {
+		s.metrics.failed.Add(1)
+	}
+	s.state = StateFailed
+	s.alert = NewAlert(err)
+	return err
+}
+
+// Alert returns the alert to send to the client after the handshake failed,
+// nil if it did not or the client sent an alert itself
+func (s *Server) Alert() *Alert {
+	return s.alert
+}
+
+// ProcessAlert aborts the handshake on an alert from the client and returns
+// it as an *AlertError
+func (s *Server) ProcessAlert(alert *Alert) error {
+	if alert == nil {
+		return s.fail(errors.New("nil alert"))
+	}
+	return s.fail(&AlertError{Code: alert.Code})
+}
+
+// negotiateExtensions asks the application for the extensions answering the
+// ClientHello
+func (s *Server) negotiateExtensions(ctx context.Context, offered []Extension) error {
+	s.clientExtensions = offered
+	if s.options.NegotiateExtensions == nil {
+		return nil
+	}
+
+	extensions, err := s.options.NegotiateExtensions(ctx, offered)
+	if err != nil {
+		return fmt.Errorf("failed to negotiate extensions: %w", err)
+	}
+	if err := checkDuplicateExtensions(extensions); err != nil {
+		return err
+	}
+	if err := checkExtensionsOffered(offered, extensions); err != nil {
+		return err
+	}
+
+	s.responseExtensions = extensions
+	return nil
+}
+
+// ClientExtensions returns the extensions of the processed ClientHello,
+// including those of unregistered types
+func (s *Server) ClientExtensions() []Extension {
+	return s.clientExtensions
+}
+
+// HelloRetryRequest returns the message to send when ProcessClientHello
+// fails with ErrHelloRetryRequired, nil if no retry was requested
+func (s *Server) HelloRetryRequest() *HelloRetryRequest {
+	return s.helloRetry
+}
+
+// earlySuite returns the suite of the stage-1 records, the client's most
+// preferred one
+func (s *Server) earlySuite(clientHello *ClientHello) (crypto.CipherSuite, error) {
+	if err := s.config.Policy.checkCipherSuite(clientHello.CipherSuites[0]); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(s.config.cipherSuites(), clientHello.CipherSuites[0]) {
+		return nil, fmt.Errorf("%w: 0-RTT cipher suite %q not allowed", ErrHandshakeFailure, clientHello.CipherSuites[0])
+	}
+	return SelectCipherSuite(clientHello.CipherSuites[0])
+}
 
+// processKeyShares runs the full handshake: it decapsulates KEM1 under the
+// long-term key and derives K_tmp
+func (s *Server) processKeyShares(ctx context.Context, clientHello *ClientHello) error {
 	// 1. Parse client ephemeral public key(epkc)
+	var err error
 	s.ephemeralClientPubKey, err = s.dynamicKEM2.ParsePublicKey(clientHello.EphemeralPublicKey)
 	if err != nil {
-		s.state = StateFailed
-		return nil, fmt.Errorf("failed to parse ephemeral public key: %w", err)
+		return fmt.Errorf("%w: failed to parse ephemeral public key: %v", ErrIllegalParameter, err)
 	}
 
 	s.ciphertext1 = clientHello.Ciphertext1
 
 	// 2. Use server's long-term private key to decapsulate KEM1 ciphertext, get K1
-	s.sharedSecret1, err = s.dynamicKEM1.Decapsulate(s.options.ServerPrivateKey, s.ciphertext1)
+	sharedSecret1, err := kem.DecapsulateContext(ctx, s.dynamicKEM1, s.options.ServerPrivateKey, s.ciphertext1)
 	if err != nil {
-		s.state = StateFailed
-		return nil, fmt.Errorf("failed to decapsulate KEM1: %w", err)
+		return fmt.Errorf("failed to decapsulate KEM1: %w", err)
 	}
+	s.sharedSecret1 = crypto.NewSecret(sharedSecret1)
 
 	// 3. temp Key = H1(serverPubKey || ciphertext1 || K1)
 	serverPubKey := s.options.ServerPrivateKey.PublicKey()
-	s.tempKey, err = crypto.H1(
+	tempKey, err := crypto.H1(
 		serverPubKey.Bytes(),
 		s.ciphertext1,
-		s.sharedSecret1,
+		s.sharedSecret1.Bytes(),
 	)
 	if err != nil {
-		s.state = StateFailed
-		return nil, fmt.Errorf("failed to derive temp key: %w", err)
+		return fmt.Errorf("failed to derive temp key: %w", err)
 	}
+	s.tempKey = s.offer.bindEarly(crypto.NewSecret(tempKey))
 
-	// 4. Decrypt 0-RTT data
-	if len(clientHello.EncryptedPayload) == 0 {
-		return nil, nil
+	return nil
+}
+
+// processTicket resumes from the ClientHello's ticket: it recovers the PSK,
+// checks the binder and derives the early secret in place of K_tmp. KEM1 is
+// skipped, even if the client sent a ciphertext to fall back on; KEM2 runs if
+// the client sent an ephemeral key.
+func (s *Server) processTicket(ctx context.Context, clientHello *ClientHello) error {
+	state, err := s.openTicket(ctx, clientHello.PSKIdentity)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTicketRejected, err)
+	}
+	if state.Expired(s.now()) {
+		crypto.Zeroize(state.PSK)
+		return fmt.Errorf("%w: ticket expired", ErrTicketRejected)
+	}
+	if state.KEM1Type != s.dynamicKEM1.Setup().Name {
+		crypto.Zeroize(state.PSK)
+		return fmt.Errorf("%w: ticket issued for %s", ErrTicketRejected, state.KEM1Type)
+	}
+	// The PSK was derived under the ticket's suite, so resuming may not move
+	// the session to another one
+	if state.CipherSuite != s.cipherSuite.Name() {
+		crypto.Zeroize(state.PSK)
+		return fmt.Errorf("%w: ticket issued for cipher suite %s", ErrTicketRejected, state.CipherSuite)
+	}
+	s.psk = crypto.NewSecret(state.PSK)
+
+	s.tempKey = s.offer.bindEarly(resumptionEarlySecret(s.psk))
+	if err := verifyBinder(s.tempKey, clientHello); err != nil {
+		return err
+	}
+
+	if len(clientHello.EphemeralPublicKey) > 0 {
+		s.ephemeralClientPubKey, err = s.dynamicKEM2.ParsePublicKey(clientHello.EphemeralPublicKey)
+		if err != nil {
+			return fmt.Errorf("%w: failed to parse ephemeral public key: %v", ErrIllegalParameter, err)
+		}
+	}
+
+	s.resumed = true
+	return nil
+}
+
+// canFallBack reports whether a ClientHello whose ticket is rejected can
+// complete a full handshake instead. That needs both key shares, and no
+// identity, which is encrypted under the ticket's K_tmp.
+func canFallBack(clientHello *ClientHello) bool {
+	return len(clientHello.Ciphertext1) > 0 && len(clientHello.EphemeralPublicKey) > 0 &&
+		len(clientHello.EncryptedIdentity) == 0
+}
+
+// openTicket recovers the resumption state behind a ticket. Stateful tickets
+// are removed from the store so that each can be used once.
+func (s *Server) openTicket(ctx context.Context, ticket []byte) (*ResumptionState, error) {
+	if s.options.SessionStore != nil {
+		state, err := s.options.SessionStore.Take(ctx, hex.EncodeToString(ticket))
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			return nil, errors.New("unknown ticket")
+		}
+		return state, nil
 	}
 
-	zeroRTTData, err := s.config.SymmetricEncryption.Decrypt(s.tempKey, clientHello.EncryptedPayload)
+	if s.options.TicketKeys == nil {
+		return nil, ErrTicketsDisabled
+	}
+	plaintext, err := s.options.TicketKeys.open(ticket)
 	if err != nil {
-		s.state = StateFailed
-		return nil, fmt.Errorf("failed to decrypt 0-RTT data: %w", err)
+		return nil, err
 	}
+	defer crypto.Zeroize(plaintext)
 
-	return zeroRTTData, nil
+	state := &ResumptionState{}
+	if err := state.UnmarshalBinary(plaintext); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Resumed reports whether the handshake was authenticated by a session ticket
+func (s *Server) Resumed() bool {
+	return s.resumed
+}
+
+// NewSessionTicket issues a ticket for resuming this session, sealed as a
+// handshake record that is sent to the client like application data. Tickets
+// are kept in SessionOptions.SessionStore if set, otherwise they are
+// encrypted under SessionOptions.TicketKeys.
+func (s *Server) NewSessionTicket() ([]byte, error) {
+	return s.NewSessionTicketContext(context.Background())
+}
+
+// NewSessionTicketContext is NewSessionTicket under ctx, which is passed to
+// the session store
+func (s *Server) NewSessionTicketContext(ctx context.Context) ([]byte, error) {
+	if s.state != StateEstablished {
+		return nil, errors.New("session not established")
+	}
+	if s.options.SessionStore == nil && s.options.TicketKeys == nil {
+		return nil, ErrTicketsDisabled
+	}
+
+	nonce := make([]byte, ticketNonceSize)
+	if _, err := io.ReadFull(s.rand, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket nonce: %w", err)
+	}
+
+	lifetime := s.options.ticketLifetime()
+	state := &ResumptionState{
+		CipherSuite: s.cipherSuite.Name(),
+		KEM1Type:    s.dynamicKEM1.Setup().Name,
+		KEM2Type:    s.dynamicKEM2.Setup().Name,
+		IssuedAt:    s.now(),
+		Lifetime:    lifetime,
+		PSK:         ticketPSK(s.resumptionSecret, nonce),
+	}
+	defer crypto.Zeroize(state.PSK)
+
+	var ticket []byte
+	if s.options.SessionStore != nil {
+		ticket = make([]byte, statefulTicketSize)
+		if _, err := io.ReadFull(s.rand, ticket); err != nil {
+			return nil, fmt.Errorf("failed to generate ticket: %w", err)
+		}
+		if err := s.options.SessionStore.Put(ctx, hex.EncodeToString(ticket), state); err != nil {
+			return nil, fmt.Errorf("failed to store session: %w", err)
+		}
+	} else {
+		plaintext, err := state.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		ticket, err = s.options.TicketKeys.seal(plaintext)
+		crypto.Zeroize(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal ticket: %w", err)
+		}
+	}
+
+	msg, err := (&DefaultSerializer{}).MarshalNewSessionTicket(&NewSessionTicket{
+		Lifetime: uint32(lifetime / time.Second),
+		Nonce:    nonce,
+		Ticket:   ticket,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.records.sealHandshake(msg)
+}
+
+// EarlyDataAccepted reports whether the 0-RTT data of the ClientHello was
+// accepted
+func (s *Server) EarlyDataAccepted() bool {
+	return s.earlyDataAccepted
+}
+
+// EarlyDataError returns why 0-RTT data was rejected, or nil if it was
+// accepted or none was sent
+func (s *Server) EarlyDataError() error {
+	return s.earlyDataErr
 }
 
 func (s *Server) GenerateServerResponse(payload []byte) (*ServerResponse, error) {
-	if s.ephemeralClientPubKey == nil || s.sharedSecret1 == nil {
+	return s.GenerateServerResponseContext(context.Background(), payload)
+}
+
+// GenerateServerResponseContext is GenerateServerResponse under ctx, which
+// bounds the encapsulations
+func (s *Server) GenerateServerResponseContext(ctx context.Context, payload []byte) (*ServerResponse, error) {
+	if s.transcript == nil || s.state != StateInitial || s.tempKey == nil {
 		return nil, errors.New("client hello not processed")
 	}
 
-	// 1. Encapsulate KEM2, get ciphertext2 and K2
+	// 1. Encapsulate KEM2, get ciphertext2 and K2. Resumption without
+	// forward secrecy has no KEM2.
 	var err error
-	s.ciphertext2, s.sharedSecret2, err = s.dynamicKEM2.Encapsulate(s.ephemeralClientPubKey, s.rand)
-	if err != nil {
-		s.state = StateFailed
-		return nil, fmt.Errorf("failed to encapsulate KEM2: %w", err)
+	if s.ephemeralClientPubKey != nil {
+		ciphertext2, sharedSecret2, err := kem.EncapsulateContext(ctx, s.dynamicKEM2, s.ephemeralClientPubKey, s.rand)
+		if err != nil {
+			return nil, s.fail(fmt.Errorf("failed to encapsulate KEM2: %w", err))
+		}
+		s.ciphertext2 = ciphertext2
+		s.sharedSecret2 = crypto.NewSecret(sharedSecret2)
 	}
 
 	// 2. Derive session key K_main
-	serverPubKey := s.options.ServerPrivateKey.PublicKey()
-	s.sessionKey, err = crypto.H2(
-		serverPubKey.Bytes(),
-		s.ephemeralClientPubKey.Bytes(),
-		s.ciphertext1,
-		s.ciphertext2,
-		s.sharedSecret1,
-		s.sharedSecret2,
-	)
+	var sessionKey []byte
+	if s.resumed {
+		var epk []byte
+		if s.ephemeralClientPubKey != nil {
+			epk = s.ephemeralClientPubKey.Bytes()
+		}
+		sessionKey, err = crypto.H3(s.psk.Bytes(), epk, s.ciphertext2, s.sharedSecret2.Bytes())
+		s.psk.Destroy()
+	} else {
+		serverPubKey := s.options.ServerPrivateKey.PublicKey()
+		sessionKey, err = crypto.H2(
+			serverPubKey.Bytes(),
+			s.ephemeralClientPubKey.Bytes(),
+			s.ciphertext1,
+			s.ciphertext2,
+			s.sharedSecret1.Bytes(),
+			s.sharedSecret2.Bytes(),
+		)
+	}
+	s.sharedSecret1.Destroy()
+	s.sharedSecret2.Destroy()
 	if err != nil {
-		s.state = StateFailed
-		return nil, fmt.Errorf("failed to derive session key: %w", err)
+		return nil, s.fail(fmt.Errorf("failed to derive session key: %w", err))
 	}
+	sessionKey = s.offer.bindMain(sessionKey, s.cipherSuite.Name())
 
-	// 3. Encrypt payload
-	var encryptedPayload []byte
-	if payload != nil {
-		encryptedPayload, err = s.config.SymmetricEncryption.Encrypt(s.sessionKey, payload)
+	// Only the holder of the client's private key can recover K_3
+	if s.clientPublicKey != nil {
+		ciphertext3, authenticated, err := s.authenticateClient(ctx, sessionKey)
+		crypto.Zeroize(sessionKey)
 		if err != nil {
-			s.state = StateFailed
-			return nil, fmt.Errorf("failed to encrypt payload: %w", err)
+			return nil, s.fail(err)
 		}
+		s.ciphertext3 = ciphertext3
+		sessionKey = authenticated
 	}
+	s.sessionKey = crypto.NewSecret(sessionKey)
 
-	// 4. Return server response
 	serverResponse := &ServerResponse{
-		Ciphertext2:      s.ciphertext2,
-		EncryptedPayload: encryptedPayload,
+		Ciphertext2:       s.ciphertext2,
+		CipherSuite:       s.cipherSuite.Name(),
+		EarlyDataAccepted: s.earlyDataAccepted,
+		PSKAccepted:       s.resumed,
+		Ciphertext3:       s.ciphertext3,
+		Extensions:        s.responseExtensions,
 	}
 
-	s.state = StateEstablished
+	// 3. Bind the traffic keys to the transcript
+	if err := s.transcript.AddServerResponse(serverResponse); err != nil {
+		return nil, s.fail(err)
+	}
+	keyShareHash := s.transcript.Sum()
+
+	s.records, err = newRecordLayer(s.cipherSuite, s.sessionKey.Bytes(), labelServerTraffic, labelClientTraffic, keyShareHash, s.options.keyUpdateLimits())
+	if err != nil {
+		return nil, s.fail(err)
+	}
+
+	serverResponse.Finished = finishedMAC(s.sessionKey, labelServerFinished, keyShareHash)
+	s.transcript.AddFinished(serverResponse.Finished)
+
+	// 4. Encrypt payload
+	if payload != nil {
+		serverResponse.EncryptedPayload, err = s.records.write.cipher.Seal(crypto.RecordTypeApplicationData, payload)
+		if err != nil {
+			return nil, s.fail(fmt.Errorf("failed to encrypt payload: %w", err))
+		}
+	}
+
+	s.state = StateAwaitingFinished
 	return serverResponse, nil
 }
 
+// ProcessClientFinished verifies the client's key confirmation and completes
+// the handshake
+func (s *Server) ProcessClientFinished(clientFinished *ClientFinished) error {
+	if s.state != StateAwaitingFinished {
+		return errors.New("server not waiting for client finished")
+	}
+
+	if clientFinished == nil {
+		return s.fail(errors.New("nil client finished"))
+	}
+
+	if err := verifyFinished(s.sessionKey, labelClientFinished, s.transcript.Sum(), clientFinished.Finished); err != nil {
+		return s.fail(err)
+	}
+	s.transcript.AddFinished(clientFinished.Finished)
+	s.transcriptHash = s.transcript.Sum()
+	s.resumptionSecret = resumptionMaster(s.sessionKey, s.transcriptHash)
+	s.exporter = exporterMaster(s.sessionKey, labelExporter, s.transcriptHash)
+
+	s.state = StateEstablished
+	if s.metrics != nil {
+		s.metrics.completed.Add(1)
+		if s.resumed {
+			s.metrics.resumed.Add(1)
+		}
+	}
+	return nil
+}
+
 func (s *Server) Encrypt(plaintext []byte) ([]byte, error) {
 	if s.state != StateEstablished {
 		return nil, errors.New("session not established")
 	}
 
-	return s.config.SymmetricEncryption.Encrypt(s.sessionKey, plaintext)
+	return s.records.seal(plaintext)
 }
 
+// UpdateKeys ratchets the server's sending keys and asks the client to do the
+// same. The returned KeyUpdate record must be sent before any later record.
+func (s *Server) UpdateKeys() ([]byte, error) {
+	if s.state != StateEstablished {
+		return nil, errors.New("session not established")
+	}
+
+	return s.records.keyUpdate(true)
+}
+
+// Decrypt opens the records in ciphertext and returns their application
+// data. Key updates from the client are handled here; records carrying only
+// those yield nil.
 func (s *Server) Decrypt(ciphertext []byte) ([]byte, error) {
 	if s.state != StateEstablished {
 		return nil, errors.New("session not established")
 	}
 
-	return s.config.SymmetricEncryption.Decrypt(s.sessionKey, ciphertext)
+	return s.records.open(ciphertext, nil)
 }
 
 func (s *Server) GetSessionKey() []byte {
@@ -181,16 +783,66 @@ func (s *Server) GetSessionKey() []byte {
 		return nil
 	}
 
-	key := make([]byte, len(s.sessionKey))
-	copy(key, s.sessionKey)
+	key := make([]byte, s.sessionKey.Len())
+	copy(key, s.sessionKey.Bytes())
 	return key
 }
 
+// ExportKeyingMaterial derives length bytes for label and context, keeping
+// application keys separate from the traffic keys. It uses the stage-2 key
+// once the client Finished is verified and the stage-1 key after the
+// ClientHello, and reports which one it used.
+func (s *Server) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, KeyStage, error) {
+	if s.state == StateFailed {
+		return nil, 0, errors.New("handshake failed")
+	}
+	return exportFromBestStage(s.earlyExporter, s.exporter, label, context, length)
+}
+
+// ExportEarlyKeyingMaterial is ExportKeyingMaterial restricted to the stage-1
+// key
+func (s *Server) ExportEarlyKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if s.state == StateFailed {
+		return nil, errors.New("handshake failed")
+	}
+	return exportKeyingMaterial(s.earlyExporter, label, context, length)
+}
+
+// TranscriptHash returns the hash of the handshake messages that the session
+// keys are bound to
+func (s *Server) TranscriptHash() []byte {
+	if s.state != StateEstablished {
+		return nil
+	}
+	return slices.Clone(s.transcriptHash)
+}
+
+// ChannelBinding returns a value unique to this session for binding
+// upper-layer authentication to it
+func (s *Server) ChannelBinding() []byte {
+	if s.state != StateEstablished {
+		return nil
+	}
+	return channelBinding(s.sessionKey, s.transcriptHash)
+}
+
 func (s *Server) State() SessionState {
 	return s.state
 }
 
+// Reset wipes all handshake and session secrets and returns the server to
+// its initial state. The long-term key in SessionOptions is left untouched.
 func (s *Server) Reset() {
+	s.sharedSecret1.Destroy()
+	s.tempKey.Destroy()
+	s.sharedSecret2.Destroy()
+	s.sessionKey.Destroy()
+	s.psk.Destroy()
+	s.resumptionSecret.Destroy()
+	s.earlyExporter.Destroy()
+	s.exporter.Destroy()
+	s.records.destroy()
+
 	s.state = StateInitial
 	s.ephemeralClientPubKey = nil
 	s.ciphertext1 = nil
@@ -201,4 +853,25 @@ func (s *Server) Reset() {
 	s.sessionKey = nil
 	s.dynamicKEM1 = nil
 	s.dynamicKEM2 = nil
+	s.cipherSuite = nil
+	s.offer = nil
+	s.records = nil
+	s.transcript = nil
+	s.transcriptHash = nil
+	s.helloRetry = nil
+	s.alert = nil
+	s.earlyDataAccepted = false
+	s.earlyDataErr = nil
+	s.clientExtensions = nil
+	s.responseExtensions = nil
+	s.clientIdentity = nil
+	s.clientKEM = nil
+	s.clientPublicKey = nil
+	s.ciphertext3 = nil
+	s.resumed = false
+	s.ticketErr = nil
+	s.psk = nil
+	s.resumptionSecret = nil
+	s.earlyExporter = nil
+	s.exporter = nil
 }
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"TIMKE/pkg/crypto"
+)
+
+var ErrNoCommonCipherSuite = errors.New("no common cipher suite")
+
+func SelectCipherSuite(name string) (crypto.CipherSuite, error) {
+	if name == "" {
+		return nil, fmt.Errorf("cipher suite not specified")
+	}
+
+	suite, err := crypto.GetCipherSuite(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown cipher suite: %s", name)
+	}
+
+	return suite, nil
+}
+
+// NegotiateCipherSuite picks the first suite in preferred that the peer offered
+func NegotiateCipherSuite(preferred, offered []string) (crypto.CipherSuite, error) {
+	for _, name := range preferred {
+		if !slices.Contains(offered, name) {
+			continue
+		}
+
+		suite, err := SelectCipherSuite(name)
+		if err == nil {
+			return suite, nil
+		}
+	}
+
+	return nil, ErrNoCommonCipherSuite
+}
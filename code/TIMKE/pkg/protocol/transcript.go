@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"TIMKE/pkg/crypto/sha3"
+)
+
+const transcriptDomain = "TIMKE-transcript"
+
+// transcriptFinished tags Finished MACs in the transcript, matching the
+// TLS finished handshake type
+const transcriptFinished byte = 20
+
+// TranscriptHashSize is the size of a transcript hash (SHA3-512)
+const TranscriptHashSize = 64
+
+// Transcript is a running SHA3-512 hash over the handshake messages in their
+// DefaultSerializer encoding, whichever serializer carried them. It can be
+// cloned or marshaled to checkpoint the hash at any point of the handshake.
+type Transcript struct {
+	state sha3.State
+}
+
+func NewTranscript() *Transcript {
+	t := &Transcript{state: sha3.New512()}
+	_, _ = t.state.Write([]byte(transcriptDomain))
+	return t
+}
+
+// Write absorbs an encoded message of the given type, framed by its length
+func (t *Transcript) Write(msgType byte, msg []byte) {
+	var header [5]byte
+	header[0] = msgType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	_, _ = t.state.Write(header[:])
+	_, _ = t.state.Write(msg)
+}
+
+// AddServerResponse absorbs the key share of a ServerResponse, leaving out
+// EncryptedPayload and Finished, which depend on keys derived from this hash
+func (t *Transcript) AddServerResponse(sr *ServerResponse) error {
+	if sr == nil {
+		return fmt.Errorf("failed to serialize server response for transcript: nil message")
+	}
+
+	keyShare := *sr
+	keyShare.EncryptedPayload = nil
+	keyShare.Finished = nil
+	data, err := (&DefaultSerializer{}).MarshalServerResponse(&keyShare)
+	if err != nil {
+		return fmt.Errorf("failed to serialize server response for transcript: %w", err)
+	}
+
+	t.Write(MessageTypeServerResponse, data)
+	return nil
+}
+
+// AddFinished absorbs a Finished MAC
+func (t *Transcript) AddFinished(verifyData []byte) {
+	t.Write(transcriptFinished, verifyData)
+}
+
+// Sum returns the hash of the messages absorbed so far without changing the
+// running state
+func (t *Transcript) Sum() []byte {
+	return t.state.Sum(nil)
+}
+
+func (t *Transcript) Clone() *Transcript {
+	return &Transcript{state: *t.state.Clone().(*sha3.State)}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (t *Transcript) MarshalBinary() ([]byte, error) {
+	return t.state.MarshalBinary()
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (t *Transcript) UnmarshalBinary(data []byte) error {
+	return t.state.UnmarshalBinary(data)
+}
+
+// encodeClientHello returns the encoding of a ClientHello that the
+// transcript absorbs. Both sides use DefaultSerializer whatever the wire
+// encoding; decoders are canonical, so this covers every byte received.
+func encodeClientHello(ch *ClientHello) ([]byte, error) {
+	data, err := (&DefaultSerializer{}).MarshalClientHello(ch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize client hello for transcript: %w", err)
+	}
+	return data, nil
+}
+
+// encodeHelloRetryRequest returns the encoding of a HelloRetryRequest that
+// the transcript absorbs
+func encodeHelloRetryRequest(hrr *HelloRetryRequest) ([]byte, error) {
+	data, err := (&DefaultSerializer{}).MarshalHelloRetryRequest(hrr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize hello retry request for transcript: %w", err)
+	}
+	return data, nil
+}
+
+// encodeServerResponse returns the encoding of a ServerResponse that is
+// checked against the policy
+func encodeServerResponse(sr *ServerResponse) ([]byte, error) {
+	data, err := (&DefaultSerializer{}).MarshalServerResponse(sr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize server response: %w", err)
+	}
+	return data, nil
+}
+
+// hashPartialClientHello hashes a ClientHello without the fields computed
+// from this hash
+func hashPartialClientHello(partial ClientHello) ([]byte, error) {
+	data, err := (&DefaultSerializer{}).MarshalClientHello(&partial)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize client hello: %w", err)
+	}
+
+	t := NewTranscript()
+	t.Write(MessageTypeClientHello, data)
+	return t.Sum(), nil
+}
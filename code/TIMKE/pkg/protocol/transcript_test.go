@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testClientHello() *ClientHello {
+	return &ClientHello{
+		EphemeralPublicKey: []byte("epk"),
+		Ciphertext1:        []byte("c1"),
+		KEM1Type:           "ML-KEM-768",
+		KEM2Type:           "ML-KEM-768",
+		CipherSuites:       []string{"AES-256-GCM"},
+	}
+}
+
+// writeClientHello absorbs ch as DefaultSerializer sends it
+func writeClientHello(t *testing.T, transcript *Transcript, ch *ClientHello) {
+	t.Helper()
+
+	data, err := (&DefaultSerializer{}).MarshalClientHello(ch)
+	if err != nil {
+		t.Fatalf("Failed to marshal client hello: %v", err)
+	}
+	transcript.Write(MessageTypeClientHello, data)
+}
+
+func TestTranscriptClone(t *testing.T) {
+	transcript := NewTranscript()
+	writeClientHello(t, transcript, testClientHello())
+
+	checkpoint := transcript.Clone()
+	before := transcript.Sum()
+
+	if err := transcript.AddServerResponse(&ServerResponse{Ciphertext2: []byte("c2")}); err != nil {
+		t.Fatalf("Failed to add server response: %v", err)
+	}
+
+	if !bytes.Equal(checkpoint.Sum(), before) {
+		t.Error("Clone changed after writing to the original")
+	}
+	if bytes.Equal(transcript.Sum(), before) {
+		t.Error("Transcript hash did not change after adding a message")
+	}
+	if len(before) != TranscriptHashSize {
+		t.Errorf("Expected %d byte hash, got %d", TranscriptHashSize, len(before))
+	}
+}
+
+func TestTranscriptMarshal(t *testing.T) {
+	transcript := NewTranscript()
+	writeClientHello(t, transcript, testClientHello())
+
+	data, err := transcript.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal transcript: %v", err)
+	}
+
+	restored := &Transcript{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Failed to unmarshal transcript: %v", err)
+	}
+
+	response := &ServerResponse{Ciphertext2: []byte("c2"), CipherSuite: "AES-256-GCM"}
+	if err := transcript.AddServerResponse(response); err != nil {
+		t.Fatalf("Failed to add server response: %v", err)
+	}
+	if err := restored.AddServerResponse(response); err != nil {
+		t.Fatalf("Failed to add server response: %v", err)
+	}
+
+	if !bytes.Equal(transcript.Sum(), restored.Sum()) {
+		t.Error("Restored transcript diverged from the original")
+	}
+}
+
+func TestTranscriptBindsMessages(t *testing.T) {
+	hash := func(ch *ClientHello, sr *ServerResponse) []byte {
+		transcript := NewTranscript()
+		writeClientHello(t, transcript, ch)
+		if err := transcript.AddServerResponse(sr); err != nil {
+			t.Fatalf("Failed to add server response: %v", err)
+		}
+		return transcript.Sum()
+	}
+
+	base := hash(testClientHello(), &ServerResponse{Ciphertext2: []byte("c2")})
+
+	modified := testClientHello()
+	modified.CipherSuites = append(modified.CipherSuites, "ChaCha20-Poly1305")
+	if bytes.Equal(base, hash(modified, &ServerResponse{Ciphertext2: []byte("c2")})) {
+		t.Error("Transcript does not cover the offered cipher suites")
+	}
+
+	// The server payload and Finished depend on keys derived from the transcript
+	withPayload := &ServerResponse{Ciphertext2: []byte("c2"), EncryptedPayload: []byte("payload"), Finished: []byte("mac")}
+	if !bytes.Equal(base, hash(testClientHello(), withPayload)) {
+		t.Error("Transcript must not cover the encrypted server payload or Finished")
+	}
+}
+
+// TestTranscriptSerializers completes a handshake over every serializer,
+// which the sessions themselves are not told about
+func TestTranscriptSerializers(t *testing.T) {
+	config := newTestConfig(t)
+	serverPubKey, serverPrivKey, err := config.KEM1.GenerateKeyPair(config.KEM1.Setup(), nil)
+	if err != nil {
+		t.Fatalf("Failed to generate server key pair: %v", err)
+	}
+
+	for _, name := range SerializerNames {
+		t.Run(name, func(t *testing.T) {
+			serializer, err := NewSerializer(name, config.Limits())
+			if err != nil {
+				t.Fatalf("Failed to create serializer: %v", err)
+			}
+			client, err := NewClient(config, NewSessionOptions().WithServerPublicKey(serverPubKey))
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			server, err := NewServer(config, NewSessionOptions().WithServerPrivateKey(serverPrivKey))
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+
+			clientHello, err := client.GenerateClientHello([]byte("early"))
+			if err != nil {
+				t.Fatalf("Failed to generate client hello: %v", err)
+			}
+			data, err := serializer.MarshalClientHello(clientHello)
+			if err != nil {
+				t.Fatalf("Failed to marshal client hello: %v", err)
+			}
+			received, err := serializer.UnmarshalClientHello(data)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal client hello: %v", err)
+			}
+			if _, err := server.ProcessClientHello(received); err != nil {
+				t.Fatalf("Failed to process client hello: %v", err)
+			}
+
+			serverResponse, err := server.GenerateServerResponse(nil)
+			if err != nil {
+				t.Fatalf("Failed to generate server response: %v", err)
+			}
+			data, err = serializer.MarshalServerResponse(serverResponse)
+			if err != nil {
+				t.Fatalf("Failed to marshal server response: %v", err)
+			}
+			response, err := serializer.UnmarshalServerResponse(data)
+			if err != nil {
+				t.Fatalf("Failed to unmarshal server response: %v", err)
+			}
+			if _, err := client.ProcessServerResponse(response); err != nil {
+				t.Fatalf("Failed to process server response: %v", err)
+			}
+			completeHandshake(t, client, server)
+
+			if !bytes.Equal(client.TranscriptHash(), server.TranscriptHash()) {
+				t.Error("Transcript hashes differ")
+			}
+		})
+	}
+
+	t.Run("Legacy", func(t *testing.T) {
+		// A legacy ClientHello is absorbed as the framed one it decodes to
+		legacy, err := (&DefaultSerializer{Legacy: true}).MarshalClientHello(testClientHello())
+		if err != nil {
+			t.Fatalf("Failed to marshal client hello: %v", err)
+		}
+		received, err := (&DefaultSerializer{AcceptLegacy: true}).UnmarshalClientHello(legacy)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal client hello: %v", err)
+		}
+
+		got, err := encodeClientHello(received)
+		if err != nil {
+			t.Fatalf("Failed to encode client hello: %v", err)
+		}
+		want, err := encodeClientHello(testClientHello())
+		if err != nil {
+			t.Fatalf("Failed to encode client hello: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("Transcript depends on the wire version of the client hello")
+		}
+	})
+}
@@ -1,6 +1,13 @@
 package protocol
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+
 	"TIMKE/pkg/crypto"
 	"TIMKE/pkg/kem"
 )
@@ -12,35 +19,188 @@ const (
 	StateAwaitingServerResponse
 	StateEstablished
 	StateFailed
+	// StateAwaitingFinished means the session keys are derived but the
+	// client Finished has not been sent (client) or verified (server) yet.
+	// It comes last so that the values of the other states do not change.
+	StateAwaitingFinished
 )
 
 type Config struct {
-	KEM1                kem.KEM
-	KEM2                kem.KEM
+	KEM1 kem.KEM
+	KEM2 kem.KEM
+	// SymmetricEncryption is the suite offered when CipherSuites is empty.
+	// It must be a crypto.CipherSuite.
 	SymmetricEncryption crypto.SymmetricEncryption
+
+	// CipherSuites lists the negotiable suites in preference order. The client
+	// encrypts 0-RTT data with the first entry; the server picks the first of
+	// its own entries that the client offered.
+	CipherSuites []string
+
+	// KEM2Types lists the negotiable ephemeral KEMs in preference order. The
+	// client sends a key share for KEM2 and offers all of them; the server
+	// picks the first of its own entries that the client offered and asks
+	// for another key share if that is not the one sent.
+	KEM2Types []string
+
+	// Policy restricts the algorithms and message sizes the handshake
+	// accepts. A nil Policy accepts every registered algorithm.
+	Policy *Policy
+
+	// Rand is the source of ephemeral keys, encapsulation randomness and
+	// ticket nonces, kem.DefaultRand if nil. Inject a crypto/drbg instance to
+	// audit or reproduce handshakes. Record nonces are derived from sequence
+	// numbers and draw no randomness. OW-ChCCA encapsulates with crypto/rand
+	// only, so Validate fails with kem.ErrUnsupportedRand if it is KEM1 or a
+	// KEM2 type and Rand is another source.
+	Rand io.Reader
 }
 
+// DefaultConfig returns ML-KEM-768 for the long-term key, ML-KEM-1024 or
+// ML-KEM-768 for the ephemeral key, and DefaultPolicy
 func DefaultConfig() *Config {
+	// The built-in parameter sets cannot fail to load
 	kem1, err := kem.NewCirclKEM(kem.MLKEM768Type)
 	if err != nil {
-		return nil
+		panic(fmt.Sprintf("protocol: failed to load ML-KEM-768: %v", err))
 	}
 
 	kem2, err := kem.NewCirclKEM(kem.MLKEM1024Type)
 	if err != nil {
-		return nil
+		panic(fmt.Sprintf("protocol: failed to load ML-KEM-1024: %v", err))
 	}
 
 	return &Config{
 		KEM1:                kem1,
 		KEM2:                kem2,
 		SymmetricEncryption: crypto.DefaultSymmetricEncryption(),
+		CipherSuites:        crypto.DefaultCipherSuites(),
+		KEM2Types:           []string{kem2.Setup().Name, kem1.Setup().Name},
+		Policy:              DefaultPolicy(),
+	}
+}
+
+// cipherSuites returns the configured suite preference list, falling back to
+// the name of SymmetricEncryption when it is a negotiable suite
+func (c *Config) cipherSuites() []string {
+	if len(c.CipherSuites) > 0 {
+		return c.CipherSuites
+	}
+
+	if suite, ok := c.SymmetricEncryption.(crypto.CipherSuite); ok {
+		return []string{suite.Name()}
 	}
+
+	return crypto.DefaultCipherSuites()
+}
+
+// kem2Types returns the configured KEM2 preference list. The client's own
+// KEM2 is always part of it, as the first entry unless listed elsewhere.
+func (c *Config) kem2Types() []string {
+	if c.KEM2 == nil {
+		return c.KEM2Types
+	}
+
+	name := c.KEM2.Setup().Name
+	if slices.Contains(c.KEM2Types, name) {
+		return c.KEM2Types
+	}
+	return append([]string{name}, c.KEM2Types...)
+}
+
+func (c *Config) random() io.Reader {
+	if c.Rand != nil {
+		return c.Rand
+	}
+	return kem.DefaultRand
 }
 
 type SessionOptions struct {
 	ServerPublicKey  kem.PublicKey
 	ServerPrivateKey kem.PrivateKey
+
+	// ReplayCache guards the server against replayed 0-RTT data,
+	// DefaultReplayCache() if nil
+	ReplayCache ReplayCache
+	// EarlyDataWindow is the accepted clock skew for 0-RTT ClientHellos,
+	// DefaultEarlyDataWindow if zero
+	EarlyDataWindow time.Duration
+
+	// AcceptEarlyData lets the application refuse 0-RTT data, for example
+	// requests that are not idempotent. All early data passing the replay
+	// checks is accepted if nil.
+	AcceptEarlyData func(ctx context.Context, info EarlyDataInfo) bool
+	// MaxEarlyDataSize bounds the 0-RTT plaintext, DefaultMaxEarlyDataSize if zero
+	MaxEarlyDataSize int
+
+	// SessionStore is the client's ticket cache, keyed by server public key.
+	// On the server it makes tickets stateful and single use; otherwise
+	// tickets are encrypted under TicketKeys.
+	SessionStore SessionStore
+	// TicketKeys encrypts stateless session tickets on the server
+	TicketKeys *TicketKeys
+	// TicketLifetime bounds how long issued tickets are valid,
+	// DefaultTicketLifetime if zero
+	TicketLifetime time.Duration
+	// PSKOnlyResumption skips KEM2 when the client resumes, saving a key
+	// exchange at the cost of forward secrecy for the resumed session. Such
+	// a ClientHello also carries no KEM1 key share, so a rejected ticket
+	// fails the handshake instead of falling back to a full one.
+	PSKOnlyResumption bool
+
+	// ClientPrivateKey enables mutual authentication: the client sends its
+	// identity under the stage-1 key and proves possession of this key
+	ClientPrivateKey kem.PrivateKey
+	// ClientKEM is the KEM of ClientPrivateKey, Config.KEM1 if nil
+	ClientKEM kem.KEM
+	// ClientID is sent along with the client's public key
+	ClientID []byte
+
+	// AuthorizeClient decides whether a client identity may connect. It must
+	// check that the public key is registered for the ID; the handshake then
+	// proves that the client holds the matching private key.
+	AuthorizeClient func(ctx context.Context, identity *ClientIdentity) error
+	// RequireClientAuth rejects clients that do not authenticate
+	RequireClientAuth bool
+
+	// KeyUpdateLimits triggers automatic key updates, zero fields take
+	// their value from DefaultKeyUpdateLimits
+	KeyUpdateLimits KeyUpdateLimits
+
+	// ClientExtensions are sent in the ClientHello, in this order
+	ClientExtensions []Extension
+	// NegotiateExtensions returns the server's answer to the extensions of
+	// a ClientHello, which may only use the offered types. No extensions are
+	// sent if nil.
+	NegotiateExtensions func(ctx context.Context, offered []Extension) ([]Extension, error)
+
+	// CookieKeys makes the server answer a ClientHello with a stateless
+	// cookie in a HelloRetryRequest, and decapsulate nothing until the
+	// client echoes it
+	CookieKeys *CookieKeys
+	// RequireCookie decides which clients must echo a cookie, for example
+	// under load or from addresses not seen before. All of them must if nil.
+	RequireCookie func(ctx context.Context, addr net.Addr) bool
+
+	// KeyPool hands the client KEM2 key pairs generated in advance. They are
+	// generated while connecting if nil or none is ready.
+	KeyPool *KeyPool
+
+	// Serializer is the wire encoding of the sessions of a ServerEngine. It
+	// does not affect the transcript, so the peers' keys agree whichever
+	// serializer each side was given.
+	Serializer Serializer
+}
+
+// EarlyDataInfo describes 0-RTT data offered to AcceptEarlyData
+type EarlyDataInfo struct {
+	Data        []byte
+	CipherSuite string
+	KEM1Type    string
+	KEM2Type    string
+	Timestamp   time.Time
+	// Resumed is set when the data came with a session ticket
+	Resumed bool
 }
 
 func NewSessionOptions() *SessionOptions {
@@ -56,3 +216,148 @@ func (o *SessionOptions) WithServerPrivateKey(sk kem.PrivateKey) *SessionOptions
 	o.ServerPrivateKey = sk
 	return o
 }
+
+func (o *SessionOptions) WithReplayCache(cache ReplayCache) *SessionOptions {
+	o.ReplayCache = cache
+	return o
+}
+
+func (o *SessionOptions) WithEarlyDataWindow(window time.Duration) *SessionOptions {
+	o.EarlyDataWindow = window
+	return o
+}
+
+func (o *SessionOptions) WithAcceptEarlyData(accept func(ctx context.Context, info EarlyDataInfo) bool) *SessionOptions {
+	o.AcceptEarlyData = accept
+	return o
+}
+
+func (o *SessionOptions) WithMaxEarlyDataSize(size int) *SessionOptions {
+	o.MaxEarlyDataSize = size
+	return o
+}
+
+func (o *SessionOptions) WithSessionStore(store SessionStore) *SessionOptions {
+	o.SessionStore = store
+	return o
+}
+
+func (o *SessionOptions) WithTicketKeys(keys *TicketKeys) *SessionOptions {
+	o.TicketKeys = keys
+	return o
+}
+
+func (o *SessionOptions) WithTicketLifetime(lifetime time.Duration) *SessionOptions {
+	o.TicketLifetime = lifetime
+	return o
+}
+
+func (o *SessionOptions) WithPSKOnlyResumption(pskOnly bool) *SessionOptions {
+	o.PSKOnlyResumption = pskOnly
+	return o
+}
+
+func (o *SessionOptions) WithClientPrivateKey(sk kem.PrivateKey) *SessionOptions {
+	o.ClientPrivateKey = sk
+	return o
+}
+
+func (o *SessionOptions) WithClientKEM(k kem.KEM) *SessionOptions {
+	o.ClientKEM = k
+	return o
+}
+
+func (o *SessionOptions) WithClientID(id []byte) *SessionOptions {
+	o.ClientID = id
+	return o
+}
+
+func (o *SessionOptions) WithAuthorizeClient(authorize func(ctx context.Context, identity *ClientIdentity) error) *SessionOptions {
+	o.AuthorizeClient = authorize
+	return o
+}
+
+func (o *SessionOptions) WithRequireClientAuth(require bool) *SessionOptions {
+	o.RequireClientAuth = require
+	return o
+}
+
+func (o *SessionOptions) WithKeyUpdateLimits(limits KeyUpdateLimits) *SessionOptions {
+	o.KeyUpdateLimits = limits
+	return o
+}
+
+func (o *SessionOptions) WithClientExtensions(extensions []Extension) *SessionOptions {
+	o.ClientExtensions = extensions
+	return o
+}
+
+func (o *SessionOptions) WithNegotiateExtensions(negotiate func(ctx context.Context, offered []Extension) ([]Extension, error)) *SessionOptions {
+	o.NegotiateExtensions = negotiate
+	return o
+}
+
+func (o *SessionOptions) WithCookieKeys(keys *CookieKeys) *SessionOptions {
+	o.CookieKeys = keys
+	return o
+}
+
+func (o *SessionOptions) WithRequireCookie(require func(ctx context.Context, addr net.Addr) bool) *SessionOptions {
+	o.RequireCookie = require
+	return o
+}
+
+func (o *SessionOptions) WithKeyPool(pool *KeyPool) *SessionOptions {
+	o.KeyPool = pool
+	return o
+}
+
+func (o *SessionOptions) WithSerializer(serializer Serializer) *SessionOptions {
+	o.Serializer = serializer
+	return o
+}
+
+func (o *SessionOptions) replayCache() ReplayCache {
+	if o.ReplayCache != nil {
+		return o.ReplayCache
+	}
+	return DefaultReplayCache()
+}
+
+func (o *SessionOptions) earlyDataWindow() time.Duration {
+	if o.EarlyDataWindow > 0 {
+		return o.EarlyDataWindow
+	}
+	return DefaultEarlyDataWindow
+}
+
+func (o *SessionOptions) maxEarlyDataSize() int {
+	if o.MaxEarlyDataSize > 0 {
+		return o.MaxEarlyDataSize
+	}
+	return DefaultMaxEarlyDataSize
+}
+
+// ticketLifetime caps stateless tickets at the key rotation period, after
+// which their key may be retired
+func (o *SessionOptions) ticketLifetime() time.Duration {
+	lifetime := DefaultTicketLifetime
+	if o.TicketLifetime > 0 {
+		lifetime = o.TicketLifetime
+	}
+	if o.SessionStore == nil && o.TicketKeys != nil {
+		lifetime = min(lifetime, o.TicketKeys.rotation)
+	}
+	return lifetime
+}
+
+func (o *SessionOptions) keyUpdateLimits() KeyUpdateLimits {
+	limits := o.KeyUpdateLimits
+	if limits.MaxRecords == 0 {
+		limits.MaxRecords = DefaultKeyUpdateLimits.MaxRecords
+	}
+	if limits.MaxBytes == 0 {
+		limits.MaxBytes = DefaultKeyUpdateLimits.MaxBytes
+	}
+	return limits
+}
@@ -0,0 +1,202 @@
+// Package timing implements a dudect-style statistical timing leakage test.
+//
+// Inputs are split into two classes, measured in random order, and the
+// timing distributions of the classes are compared with Welch's t-test. The
+// test is repeated on measurements cropped at several percentiles, since
+// leakage is often hidden in the tail of the distribution. See Reparaz,
+// Balasch and Verbauwhede, "Dude, is my code constant time?" (DATE 2017).
+//
+// DecryptionTest compares two classes of forged tags, so it only measures how
+// Decrypt rejects a ciphertext: the time taken to accept a valid tag is not
+// measured.
+package timing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Input classes
+const (
+	ClassFixed  = 0 // e.g. valid ciphertexts or tags forged in one place
+	ClassRandom = 1 // e.g. random ciphertexts or tags forged in another
+)
+
+// Thresholds on |t| used by dudect
+const (
+	ThresholdPossibleLeak = 4.5
+	ThresholdDefiniteLeak = 10.0
+)
+
+// numberOfCrops is the number of percentile-cropped tests run next to the
+// uncropped one
+const numberOfCrops = 10
+
+// gcBatch is the number of measurements taken between two collections, which
+// bounds the garbage the operation under test piles up
+const gcBatch = 256
+
+// Test describes an operation whose running time must not depend on the
+// class of its input
+type Test struct {
+	Name string
+	// Input returns a fresh input of the given class. It is called before
+	// measuring and is not timed.
+	Input func(class int) ([]byte, error)
+	// Run performs the operation under test
+	Run func(input []byte)
+}
+
+type Options struct {
+	Samples int
+	// Progress, if set, is called with the result of each test as it
+	// completes
+	Progress func(Result)
+}
+
+type Result struct {
+	Name    string
+	Samples [2]int
+	// T is the Welch t statistic over all measurements
+	T float64
+	// MaxT is the largest |t| over the uncropped and cropped tests
+	MaxT float64
+	// MeanNanos is the mean running time of each class
+	MeanNanos [2]float64
+}
+
+// Leakage returns a human readable verdict for MaxT
+func (r Result) Leakage() string {
+	switch {
+	case r.MaxT >= ThresholdDefiniteLeak:
+		return "definite leakage"
+	case r.MaxT >= ThresholdPossibleLeak:
+		return "possible leakage"
+	default:
+		return "no leakage detected"
+	}
+}
+
+// Leaky reports whether MaxT crossed the dudect leakage threshold
+func (r Result) Leaky() bool {
+	return r.MaxT >= ThresholdPossibleLeak
+}
+
+// welchTest accumulates the running mean and variance of both classes
+type welchTest struct {
+	n    [2]float64
+	mean [2]float64
+	m2   [2]float64
+}
+
+func (w *welchTest) push(x float64, class int) {
+	w.n[class]++
+	delta := x - w.mean[class]
+	w.mean[class] += delta / w.n[class]
+	w.m2[class] += delta * (x - w.mean[class])
+}
+
+func (w *welchTest) t() float64 {
+	if w.n[0] < 2 || w.n[1] < 2 {
+		return 0
+	}
+
+	v0 := w.m2[0] / (w.n[0] - 1)
+	v1 := w.m2[1] / (w.n[1] - 1)
+	den := math.Sqrt(v0/w.n[0] + v1/w.n[1])
+	if den == 0 {
+		return 0
+	}
+
+	return (w.mean[0] - w.mean[1]) / den
+}
+
+// cropThresholds returns measurement cut-offs at increasingly high
+// percentiles, following the dudect reference implementation
+func cropThresholds(times []float64) []float64 {
+	sorted := append([]float64(nil), times...)
+	sort.Float64s(sorted)
+
+	thresholds := make([]float64, numberOfCrops)
+	for i := range thresholds {
+		p := 1 - math.Pow(0.5, 10*float64(i+1)/numberOfCrops)
+		idx := int(p * float64(len(sorted)))
+		if idx >= len(sorted) {
+			idx = len(sorted) - 1
+		}
+		thresholds[i] = sorted[idx]
+	}
+
+	return thresholds
+}
+
+// Run measures test on options.Samples inputs and returns the t statistics
+func Run(test Test, options Options) (Result, error) {
+	result := Result{Name: test.Name}
+	if options.Samples < 4 {
+		return result, errors.New("at least 4 samples are required")
+	}
+	if test.Input == nil || test.Run == nil {
+		return result, errors.New("test needs both Input and Run")
+	}
+
+	classes := make([]int, options.Samples)
+	inputs := make([][]byte, options.Samples)
+	for i := range inputs {
+		classes[i] = rand.IntN(2)
+		input, err := test.Input(classes[i])
+		if err != nil {
+			return result, fmt.Errorf("failed to prepare input: %w", err)
+		}
+		inputs[i] = input
+	}
+
+	// Warm-up run
+	test.Run(inputs[0])
+
+	// Keep the collector from landing in a measurement: it is off while
+	// measuring and runs between batches instead
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	times := make([]float64, options.Samples)
+	for i, input := range inputs {
+		if i%gcBatch == 0 {
+			runtime.GC()
+		}
+		start := time.Now()
+		test.Run(input)
+		times[i] = float64(time.Since(start).Nanoseconds())
+	}
+
+	thresholds := cropThresholds(times)
+	var base welchTest
+	cropped := make([]welchTest, len(thresholds))
+	for i, x := range times {
+		base.push(x, classes[i])
+		for j, threshold := range thresholds {
+			if x < threshold {
+				cropped[j].push(x, classes[i])
+			}
+		}
+	}
+
+	result.Samples = [2]int{int(base.n[0]), int(base.n[1])}
+	result.MeanNanos = base.mean
+	result.T = base.t()
+	result.MaxT = math.Abs(result.T)
+	for i := range cropped {
+		result.MaxT = math.Max(result.MaxT, math.Abs(cropped[i].t()))
+	}
+
+	if options.Progress != nil {
+		options.Progress(result)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,140 @@
+package timing
+
+import (
+	"crypto/subtle"
+	"math"
+	"testing"
+
+	"TIMKE/pkg/crypto"
+)
+
+func TestWelchTest(t *testing.T) {
+	var w welchTest
+	for i := 0; i < 1000; i++ {
+		w.push(100, ClassFixed)
+		w.push(100, ClassRandom)
+	}
+	if w.t() != 0 {
+		t.Errorf("Expected t=0 for identical constant classes, got %f", w.t())
+	}
+
+	w = welchTest{}
+	for i := 0; i < 1000; i++ {
+		w.push(float64(100+i%10), ClassFixed)
+		w.push(float64(200+i%10), ClassRandom)
+	}
+	if math.Abs(w.t()) < ThresholdDefiniteLeak {
+		t.Errorf("Expected a large |t| for separated classes, got %f", w.t())
+	}
+
+	w = welchTest{}
+	for i := 0; i < 1000; i++ {
+		w.push(float64(i%7), ClassFixed)
+		w.push(float64((i+3)%7), ClassRandom)
+	}
+	if math.Abs(w.t()) > ThresholdPossibleLeak {
+		t.Errorf("Expected a small |t| for equal distributions, got %f", w.t())
+	}
+}
+
+func TestCropThresholds(t *testing.T) {
+	times := make([]float64, 1000)
+	for i := range times {
+		times[i] = float64(i)
+	}
+
+	thresholds := cropThresholds(times)
+	if len(thresholds) != numberOfCrops {
+		t.Fatalf("Expected %d thresholds, got %d", numberOfCrops, len(thresholds))
+	}
+	for i := 1; i < len(thresholds); i++ {
+		if thresholds[i] < thresholds[i-1] {
+			t.Errorf("Thresholds not increasing: %v", thresholds)
+		}
+	}
+}
+
+func TestRunDetectsLeak(t *testing.T) {
+	secret := make([]byte, 4096)
+	test := Test{
+		Name: "early exit",
+		Input: func(class int) ([]byte, error) {
+			input := make([]byte, len(secret))
+			if class == ClassRandom {
+				input[0] = 1
+			}
+			return input, nil
+		},
+		Run: func(input []byte) {
+			// Variable-time comparison, exits at the first differing byte
+			for i := range input {
+				if input[i] != secret[i] {
+					return
+				}
+			}
+		},
+	}
+
+	result, err := Run(test, Options{Samples: 5000})
+	if err != nil {
+		t.Fatalf("Failed to run timing test: %v", err)
+	}
+	if !result.Leaky() {
+		t.Errorf("Expected leakage in early-exit comparison, got max|t|=%.2f", result.MaxT)
+	}
+}
+
+func TestRunConstantTime(t *testing.T) {
+	test := Test{
+		Name: "constant time compare",
+		Input: func(class int) ([]byte, error) {
+			input := make([]byte, 64)
+			if class == ClassRandom {
+				input[0] = 1
+			}
+			return input, nil
+		},
+		Run: func(input []byte) {
+			subtle.ConstantTimeCompare(input, make([]byte, 64))
+		},
+	}
+
+	result, err := Run(test, Options{Samples: 1000})
+	if err != nil {
+		t.Fatalf("Failed to run timing test: %v", err)
+	}
+	if result.Samples[0]+result.Samples[1] != 1000 {
+		t.Errorf("Expected 1000 samples, got %v", result.Samples)
+	}
+}
+
+func TestDecryptionTest(t *testing.T) {
+	test, err := DecryptionTest("AES-256-GCM")
+	if err != nil {
+		t.Fatalf("Failed to create decryption test: %v", err)
+	}
+
+	if _, err := Run(test, Options{Samples: 200}); err != nil {
+		t.Fatalf("Failed to run decryption test: %v", err)
+	}
+
+	// Both classes are rejections, a valid tag would be told apart anyway
+	suite, err := crypto.GetCipherSuite("AES-256-GCM")
+	if err != nil {
+		t.Fatalf("Failed to get cipher suite: %v", err)
+	}
+	key := make([]byte, suite.KeySize())
+	test, err = decryptionTest(suite, key)
+	if err != nil {
+		t.Fatalf("Failed to create decryption test: %v", err)
+	}
+	for _, class := range []int{ClassFixed, ClassRandom} {
+		input, err := test.Input(class)
+		if err != nil {
+			t.Fatalf("Failed to prepare input: %v", err)
+		}
+		if _, err := suite.Decrypt(key, input); err == nil {
+			t.Errorf("Expected the input of class %d to be rejected", class)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package timing
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+
+	"TIMKE/pkg/crypto"
+	"TIMKE/pkg/kem"
+)
+
+// payloadSize is the plaintext size used for AEAD decryption tests
+const payloadSize = 256
+
+// DecapsulationTest compares Decapsulate on valid ciphertexts against random
+// ciphertexts of the same length. An implicit-rejection KEM must not take a
+// measurably different path for the latter.
+func DecapsulationTest(name string) (Test, error) {
+	k, err := kem.GetKEM(name)
+	if err != nil {
+		return Test{}, err
+	}
+
+	pk, sk, err := k.GenerateKeyPair(k.Setup(), rand.Reader)
+	if err != nil {
+		return Test{}, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	return Test{
+		Name: name + " Decapsulate",
+		Input: func(class int) ([]byte, error) {
+			ciphertext, _, err := k.Encapsulate(pk, rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			if class == ClassRandom {
+				if _, err := rand.Read(ciphertext); err != nil {
+					return nil, err
+				}
+			}
+			return ciphertext, nil
+		},
+		Run: func(input []byte) {
+			_, _ = k.Decapsulate(sk, input)
+		},
+	}, nil
+}
+
+// DecryptionTest compares Decrypt on ciphertexts whose tag differs from the
+// valid one in its first byte against ciphertexts whose tag differs in its
+// last byte. Both are rejected; rejection must not depend on where the tag
+// differs. The valid-tag path is not measured.
+func DecryptionTest(suiteName string) (Test, error) {
+	suite, err := crypto.GetCipherSuite(suiteName)
+	if err != nil {
+		return Test{}, err
+	}
+
+	key := make([]byte, suite.KeySize())
+	if _, err := rand.Read(key); err != nil {
+		return Test{}, err
+	}
+
+	return decryptionTest(suite, key)
+}
+
+func decryptionTest(suite crypto.CipherSuite, key []byte) (Test, error) {
+	aead, err := suite.NewAEAD(key)
+	if err != nil {
+		return Test{}, fmt.Errorf("failed to create AEAD: %w", err)
+	}
+	tagSize := aead.Overhead()
+
+	return Test{
+		Name: suite.Name() + " Decrypt",
+		Input: func(class int) ([]byte, error) {
+			plaintext := make([]byte, payloadSize)
+			if _, err := rand.Read(plaintext); err != nil {
+				return nil, err
+			}
+			ciphertext, err := suite.Encrypt(key, plaintext)
+			if err != nil {
+				return nil, err
+			}
+			tag := ciphertext[len(ciphertext)-tagSize:]
+			if class == ClassFixed {
+				tag[0] ^= 1
+			} else {
+				tag[tagSize-1] ^= 1
+			}
+			return ciphertext, nil
+		},
+		Run: func(input []byte) {
+			_, _ = suite.Decrypt(key, input)
+		},
+	}, nil
+}
+
+type SuiteOptions struct {
+	Options
+	KEMNames    []string
+	CipherNames []string
+}
+
+func DefaultSuiteOptions() SuiteOptions {
+	return SuiteOptions{
+		Options: Options{
+			Samples: 2000,
+		},
+	}
+}
+
+// RunAll runs the decapsulation test for every selected KEM and the
+// decryption test for every selected cipher suite. Empty lists select
+// everything that is registered.
+func RunAll(options SuiteOptions) ([]Result, error) {
+	kemNames := options.KEMNames
+	if len(kemNames) == 0 {
+		kemNames = kem.ListKEMs()
+		sort.Strings(kemNames)
+	}
+
+	cipherNames := options.CipherNames
+	if len(cipherNames) == 0 {
+		cipherNames = crypto.ListCipherSuites()
+		sort.Strings(cipherNames)
+	}
+
+	var tests []Test
+	for _, name := range kemNames {
+		test, err := DecapsulationTest(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up %s: %w", name, err)
+		}
+		tests = append(tests, test)
+	}
+	for _, name := range cipherNames {
+		test, err := DecryptionTest(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up %s: %w", name, err)
+		}
+		tests = append(tests, test)
+	}
+
+	var results []Result
+	for _, test := range tests {
+		result, err := Run(test, options.Options)
+		if err != nil {
+			return results, fmt.Errorf("failed to measure %s: %w", test.Name, err)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func FormatResults(results []Result) string {
+	var sb strings.Builder
+
+	sb.WriteString("\nTiming Leakage Results\n")
+	sb.WriteString("======================\n\n")
+	sb.WriteString(fmt.Sprintf("%-35s %10s %12s %12s %8s %8s  %s\n",
+		"Test", "Samples", "Mean 0 (ns)", "Mean 1 (ns)", "t", "max|t|", "Verdict"))
+	sb.WriteString(strings.Repeat("-", 110) + "\n")
+
+	for _, r := range results {
+		sb.WriteString(fmt.Sprintf("%-35s %10d %12.0f %12.0f %8.2f %8.2f  %s\n",
+			r.Name, r.Samples[0]+r.Samples[1], r.MeanNanos[0], r.MeanNanos[1], r.T, r.MaxT, r.Leakage()))
+	}
+
+	sb.WriteString(fmt.Sprintf("\nThresholds: |t| >= %.1f possible leakage, |t| >= %.1f definite leakage\n",
+		ThresholdPossibleLeak, ThresholdDefiniteLeak))
+
+	return sb.String()
+}